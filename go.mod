@@ -1,10 +1,22 @@
 module github.com/3scale/3scale-authorizer
 
-go 1.13
+go 1.18
 
 require (
 	github.com/3scale/3scale-go-client v0.5.1
 	github.com/3scale/3scale-porta-go-client v0.0.4-0.20200617082049-6c84693ca4c0
-	github.com/oleiade/lane v1.0.1 // indirect
+	github.com/oleiade/lane v1.0.1
 	github.com/orcaman/concurrent-map v0.0.0-20190314100340-2693aad1ed75
+	github.com/sirupsen/logrus v1.6.0
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/sdk v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
+	go.uber.org/zap v1.15.0
+)
+
+require (
+	github.com/konsorten/go-windows-terminal-sequences v1.0.3 // indirect
+	go.uber.org/atomic v1.6.0 // indirect
+	go.uber.org/multierr v1.5.0 // indirect
+	golang.org/x/sys v0.0.0-20210423185535-09eb48e85fd7 // indirect
 )
@@ -0,0 +1,40 @@
+package authorizer
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// refresher is implemented by caches which can be refreshed on demand. See cache.ConfigCache.RefreshNow
+type refresher interface {
+	RefreshNow() (int, bool)
+}
+
+// RefreshHandler returns a handler, for use on an admin endpoint, which refreshes every config in the system cache
+// when sent a POST. Responds with the number of configs refreshed as JSON, with 409 Conflict if a refresh is already
+// in progress or with 501 Not Implemented if the caching implementation cannot be refreshed on demand
+func (c *SystemCache) RefreshHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		cache, ok := c.ConfigurationCache.(refresher)
+		if !ok {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+
+		refreshed, ran := cache.RefreshNow()
+		if !ran {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Refreshed int `json:"refreshed"`
+		}{Refreshed: refreshed})
+	})
+}
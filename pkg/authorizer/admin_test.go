@@ -0,0 +1,72 @@
+package authorizer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/3scale/3scale-authorizer/pkg/system/v1/cache"
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+func TestSystemCache_RefreshHandler(t *testing.T) {
+	systemCache := NewSystemCache(SystemCacheConfig{MaxSize: cache.DefaultCacheLimit}, make(chan struct{}))
+	var refreshed int
+	value := &cache.Value{Item: client.ProxyConfig{ID: 1}}
+	value.SetRefreshCallback(func() (client.ProxyConfig, error) {
+		refreshed++
+		return client.ProxyConfig{ID: 1}, nil
+	})
+	systemCache.Set("any", *value)
+
+	inputs := []struct {
+		name         string
+		method       string
+		cache        *SystemCache
+		expectStatus int
+		expectBody   string
+	}{
+		{
+			name:         "Test refresh is triggered",
+			method:       http.MethodPost,
+			cache:        systemCache,
+			expectStatus: http.StatusOK,
+			expectBody:   `{"refreshed":1}`,
+		},
+		{
+			name:         "Test refresh requires a POST",
+			method:       http.MethodGet,
+			cache:        systemCache,
+			expectStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:         "Test caches without support for refreshing on demand",
+			method:       http.MethodPost,
+			cache:        &SystemCache{ConfigurationCache: mockConfigCache{}},
+			expectStatus: http.StatusNotImplemented,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			input.cache.RefreshHandler().ServeHTTP(rec, httptest.NewRequest(input.method, "/refresh", nil))
+			if rec.Code != input.expectStatus {
+				t.Errorf("expected status %d, got %d", input.expectStatus, rec.Code)
+			}
+			if body := strings.TrimSpace(rec.Body.String()); body != input.expectBody {
+				t.Errorf("expected body %q, got %q", input.expectBody, body)
+			}
+		})
+	}
+
+	if refreshed != 1 {
+		t.Errorf("expected the config to have been refreshed once, got %d", refreshed)
+	}
+}
+
+// mockConfigCache is a caching implementation which cannot be refreshed on demand
+type mockConfigCache struct {
+	cache.ConfigurationCache
+}
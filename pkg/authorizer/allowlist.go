@@ -0,0 +1,40 @@
+package authorizer
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// PathAllowlist matches request paths, such as health checks and metrics scrapes, which should be allowed
+// without being authorized against 3scale. Callers should check the allowlist before fetching the config
+// of the service or calling the Manager
+type PathAllowlist struct {
+	patterns []*regexp.Regexp
+}
+
+// NewPathAllowlist compiles the provided patterns, each a regular expression which must match the whole path
+// The query string should be removed from the path before matching. Returns an error if any pattern is invalid
+func NewPathAllowlist(patterns []string) (*PathAllowlist, error) {
+	allowlist := &PathAllowlist{patterns: make([]*regexp.Regexp, 0, len(patterns))}
+	for _, pattern := range patterns {
+		expr, err := regexp.Compile(`^(?:` + pattern + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowlist pattern %q - %s", pattern, err)
+		}
+		allowlist.patterns = append(allowlist.patterns, expr)
+	}
+	return allowlist, nil
+}
+
+// Allowed returns true if the path matches any pattern of the allowlist. A nil allowlist allows no paths
+func (a *PathAllowlist) Allowed(path string) bool {
+	if a == nil {
+		return false
+	}
+	for _, expr := range a.patterns {
+		if expr.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package authorizer
+
+import "testing"
+
+func TestPathAllowlist(t *testing.T) {
+	allowlist, err := NewPathAllowlist([]string{"/healthz", "/metrics", `/public/[^/]+\.css`})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	inputs := []struct {
+		path   string
+		expect bool
+	}{
+		{path: "/healthz", expect: true},
+		{path: "/metrics", expect: true},
+		{path: "/public/site.css", expect: true},
+		{path: "/healthz/extra", expect: false},
+		{path: "/api/healthz", expect: false},
+		{path: "/public/nested/site.css", expect: false},
+		{path: "/orders", expect: false},
+	}
+	for _, input := range inputs {
+		if got := allowlist.Allowed(input.path); got != input.expect {
+			t.Errorf("expected %s to be allowed to be %t", input.path, input.expect)
+		}
+	}
+
+	if _, err := NewPathAllowlist([]string{"/healthz", "/public/(unclosed"}); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+
+	var none *PathAllowlist
+	if none.Allowed("/healthz") {
+		t.Error("expected a nil allowlist to allow no paths")
+	}
+}
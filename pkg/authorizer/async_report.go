@@ -0,0 +1,307 @@
+package authorizer
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/3scale/3scale-authorizer/pkg/core"
+)
+
+// DefaultReportBufferSize is the number of pending reports buffered by the AsyncReporter
+const DefaultReportBufferSize = 1024
+
+// ErrReporterClosed is returned by AsyncReporter.Report once the reporter has been closed
+var ErrReporterClosed = errors.New("reporter has been closed")
+
+// ErrDrainTimeout is returned by AsyncReporter.Close if buffered reports remain once the deadline has passed
+var ErrDrainTimeout = errors.New("timed out draining pending reports")
+
+// OverflowPolicy determines how a report is handled when the buffer of pending reports is full
+type OverflowPolicy int
+
+const (
+	// BlockUntilSpace blocks the caller until a pending report has been sent
+	BlockUntilSpace OverflowPolicy = iota
+	// DropOldest discards the oldest pending report to make space
+	DropOldest
+	// DropNewest discards the report being added
+	DropNewest
+)
+
+// AsyncReportConfig configures an AsyncReporter
+type AsyncReportConfig struct {
+	// BufferSize is the number of pending reports held before the OverflowPolicy applies
+	// Defaults to DefaultReportBufferSize
+	BufferSize int
+	Overflow   OverflowPolicy
+	// Spill, if a path is set, writes reports to disk rather than buffering them once the number pending
+	// crosses the threshold, when they fail because 3scale backend is unavailable and when they remain
+	// unsent on Close. Spilled reports are replayed on start up and once a report to 3scale succeeds
+	Spill SpillConfig
+}
+
+// reportSender sends a report to 3scale backend. Satisfied by the Manager
+type reportSender interface {
+	Report(backendURL string, request BackendRequest) error
+}
+
+type pendingReport struct {
+	backendURL string
+	request    BackendRequest
+	queuedAt   time.Time
+}
+
+// AsyncReporter reports usage to 3scale backend in the background, keeping memory bounded when
+// 3scale backend is slow by holding at most BufferSize pending reports
+type AsyncReporter struct {
+	sender reportSender
+	config AsyncReportConfig
+	logger *core.LogThrottle
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []pendingReport
+	closed  bool
+	done    chan struct{}
+	dropped uint64
+	spill   *spillFile
+}
+
+// NewAsyncReporter returns an AsyncReporter which sends reports using the provided Manager
+// Close must be called to stop the reporter once it is no longer required
+func NewAsyncReporter(m *Manager, config AsyncReportConfig) *AsyncReporter {
+	return newAsyncReporter(m, m.throttledLogger(), config)
+}
+
+func newAsyncReporter(sender reportSender, logger *core.LogThrottle, config AsyncReportConfig) *AsyncReporter {
+	if config.BufferSize <= 0 {
+		config.BufferSize = DefaultReportBufferSize
+	}
+
+	r := &AsyncReporter{
+		sender:  sender,
+		config:  config,
+		logger:  logger,
+		pending: make([]pendingReport, 0, config.BufferSize),
+		done:    make(chan struct{}),
+	}
+	r.cond = sync.NewCond(&r.mu)
+
+	if config.Spill.Path != "" {
+		if config.Spill.Threshold <= 0 || config.Spill.Threshold > config.BufferSize {
+			r.config.Spill.Threshold = config.BufferSize
+		}
+		r.spill = newSpillFile(config.Spill.Path)
+	}
+
+	go r.run()
+	return r
+}
+
+// Report adds the request to the buffer of pending reports, applying the configured OverflowPolicy
+// if the buffer is full
+func (r *AsyncReporter) Report(backendURL string, request BackendRequest) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report := pendingReport{backendURL: backendURL, request: request, queuedAt: time.Now()}
+	if r.spill != nil && !r.closed && len(r.pending) >= r.config.Spill.Threshold {
+		r.spillReports(report)
+		return nil
+	}
+
+	for !r.closed && len(r.pending) >= r.config.BufferSize {
+		switch r.config.Overflow {
+		case DropOldest:
+			r.drop(r.pending[0].request.Service, "oldest")
+			r.pending = append(r.pending[:0], r.pending[1:]...)
+		case DropNewest:
+			r.drop(request.Service, "newest")
+			return nil
+		default:
+			r.cond.Wait()
+		}
+	}
+
+	if r.closed {
+		return ErrReporterClosed
+	}
+
+	r.pending = append(r.pending, report)
+	r.cond.Broadcast()
+	return nil
+}
+
+// Dropped returns the number of reports which have been dropped due to the buffer being full, because they
+// could not be spilled or because they were spilled for longer than 3scale backend accepts. See SpillConfig
+func (r *AsyncReporter) Dropped() uint64 {
+	return atomic.LoadUint64(&r.dropped)
+}
+
+// Pending returns the number of reports waiting to be sent
+func (r *AsyncReporter) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.pending)
+}
+
+// Close stops accepting reports and sends those pending, waiting up to the provided timeout
+// Returns ErrDrainTimeout if reports remain unsent once the timeout has passed, unless spilling is
+// configured in which case the remaining reports are spilled to disk. The spill file is closed on return, so a
+// report still being sent at the deadline which then fails with 3scale backend unavailable is counted as dropped
+func (r *AsyncReporter) Close(timeout time.Duration) error {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		r.cond.Broadcast()
+	}
+	r.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-r.done:
+	case <-timer.C:
+		if r.spill == nil {
+			return ErrDrainTimeout
+		}
+		r.mu.Lock()
+		r.spillReports(r.pending...)
+		r.pending = r.pending[:0]
+		r.mu.Unlock()
+	}
+
+	if r.spill == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.spill.close()
+}
+
+func (r *AsyncReporter) run() {
+	defer close(r.done)
+	r.replaySpilled()
+	for {
+		r.mu.Lock()
+		for len(r.pending) == 0 && !r.closed {
+			r.cond.Wait()
+		}
+		if len(r.pending) == 0 {
+			r.mu.Unlock()
+			return
+		}
+
+		next := r.pending[0]
+		r.pending = append(r.pending[:0], r.pending[1:]...)
+		// wake any caller blocked on a full buffer
+		r.cond.Broadcast()
+		r.mu.Unlock()
+
+		err := r.sender.Report(next.backendURL, next.request)
+		switch {
+		case err == nil:
+			r.replaySpilled()
+		case r.spill != nil && isBackendUnavailable(err):
+			r.mu.Lock()
+			r.spillReports(next)
+			r.mu.Unlock()
+		default:
+			r.logger.Errorf("async_report/"+next.request.Service,
+				"unable to report usage for service %s - %s", next.request.Service, core.RedactError(err))
+		}
+	}
+}
+
+// replaySpilled sends the reports spilled to disk, spilling them again if 3scale backend is unavailable
+// Reports older than MaxTransactionAge are moved to the file of expired reports rather than sent
+// The replayed file is only removed once each report has been handled, so a crash part way through
+// a replay results in reports being sent again rather than lost
+func (r *AsyncReporter) replaySpilled() {
+	r.mu.Lock()
+	if r.spill == nil || !r.spill.pending || r.spill.closed {
+		r.mu.Unlock()
+		return
+	}
+	path, err := r.spill.rotate()
+	r.mu.Unlock()
+
+	if err != nil {
+		r.logger.Errorf("async_report_replay", "unable to replay spilled reports - %s", err)
+		return
+	}
+	if path == "" {
+		return
+	}
+
+	reports, skipped, err := readSpill(path)
+	if err != nil {
+		r.logger.Errorf("async_report_replay", "unable to replay spilled reports - %s", err)
+		return
+	}
+	if skipped > 0 {
+		r.logger.Warnf("async_report_replay_skipped", "skipped %d corrupt spilled reports", skipped)
+	}
+
+	reports, expired := splitExpired(reports, time.Now())
+	if len(expired) > 0 {
+		atomic.AddUint64(&r.dropped, uint64(len(expired)))
+		if err := appendExpired(r.config.Spill.Path, expired); err != nil {
+			r.logger.Errorf("async_report_expired", "unable to move aside %d expired spilled reports - %s", len(expired), err)
+		} else {
+			r.logger.Warnf("async_report_expired", "moved %d spilled reports older than %s to %s",
+				len(expired), MaxTransactionAge, r.config.Spill.Path+expiredSuffix)
+		}
+	}
+
+	for i, report := range reports {
+		err := r.sender.Report(report.backendURL, report.request)
+		if err == nil {
+			continue
+		}
+		if isBackendUnavailable(err) {
+			r.mu.Lock()
+			err := r.spill.append(reports[i:]...)
+			if err != nil {
+				r.spill.pending = true
+			}
+			r.mu.Unlock()
+			if err != nil {
+				// keeping the replayed file means reports are sent again on the next replay rather than lost
+				r.logger.Errorf("async_report_spill", "unable to spill %d replayed reports, kept %s - %s",
+					len(reports)-i, path, err)
+				return
+			}
+			break
+		}
+		r.logger.Errorf("async_report/"+report.request.Service,
+			"unable to report spilled usage for service %s - %s", report.request.Service, core.RedactError(err))
+	}
+
+	if err := os.Remove(path); err != nil {
+		r.logger.Errorf("async_report_replay", "unable to remove replayed spill file - %s", err)
+	}
+}
+
+// spillReports writes the reports to disk, counting them as dropped if they cannot be written
+// Must be called with the lock held
+func (r *AsyncReporter) spillReports(reports ...pendingReport) {
+	if len(reports) == 0 {
+		return
+	}
+	if err := r.spill.append(reports...); err != nil {
+		atomic.AddUint64(&r.dropped, uint64(len(reports)))
+		r.logger.Errorf("async_report_spill", "unable to spill %d pending reports - %s", len(reports), err)
+	}
+}
+
+// drop records a dropped report. Must be called with the lock held
+func (r *AsyncReporter) drop(service, which string) {
+	atomic.AddUint64(&r.dropped, 1)
+	r.logger.Warnf("async_report_dropped/"+service,
+		"report buffer full, dropped %s pending report for service %s", which, service)
+}
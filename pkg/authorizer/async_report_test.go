@@ -0,0 +1,166 @@
+package authorizer
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/3scale/3scale-authorizer/pkg/core"
+)
+
+// gatedSender records reports, blocking each call until the gate is opened
+type gatedSender struct {
+	gate chan struct{}
+
+	mu       sync.Mutex
+	services []string
+}
+
+func newGatedSender() *gatedSender {
+	return &gatedSender{gate: make(chan struct{})}
+}
+
+func (s *gatedSender) Report(backendURL string, request BackendRequest) error {
+	<-s.gate
+	s.mu.Lock()
+	s.services = append(s.services, request.Service)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *gatedSender) sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.services...)
+}
+
+// waitForPending waits until the reporter holds the expected number of pending reports
+func waitForPending(t *testing.T, r *AsyncReporter, expect int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for r.Pending() != expect {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d pending reports, got %d", expect, r.Pending())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAsyncReporter_OverflowPolicy(t *testing.T) {
+	inputs := []struct {
+		name          string
+		policy        OverflowPolicy
+		expectSent    []string
+		expectDropped uint64
+	}{
+		{
+			name:          "Test drop oldest discards the first pending report",
+			policy:        DropOldest,
+			expectSent:    []string{"0", "2", "3"},
+			expectDropped: 1,
+		},
+		{
+			name:          "Test drop newest discards the report being added",
+			policy:        DropNewest,
+			expectSent:    []string{"0", "1", "2"},
+			expectDropped: 1,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			logger := &recordingLogger{}
+			sender := newGatedSender()
+			r := newAsyncReporter(sender, core.NewLogThrottle(logger, 10, time.Minute),
+				AsyncReportConfig{BufferSize: 2, Overflow: input.policy})
+
+			// the first report is taken by the background sender, which blocks on the gate
+			r.Report("any", BackendRequest{Service: "0"})
+			waitForPending(t, r, 0)
+
+			for _, service := range []string{"1", "2", "3"} {
+				if err := r.Report("any", BackendRequest{Service: service}); err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+			}
+
+			if r.Dropped() != input.expectDropped {
+				t.Errorf("expected %d dropped reports, got %d", input.expectDropped, r.Dropped())
+			}
+			if len(logger.warnings) != 1 {
+				t.Errorf("expected drop to be logged, got %v", logger.warnings)
+			}
+
+			close(sender.gate)
+			if err := r.Close(time.Second * 5); err != nil {
+				t.Fatalf("unexpected error closing %v", err)
+			}
+			if got := sender.sent(); !reflect.DeepEqual(got, input.expectSent) {
+				t.Errorf("expected reports %v to be sent, got %v", input.expectSent, got)
+			}
+		})
+	}
+}
+
+func TestAsyncReporter_BlockUntilSpace(t *testing.T) {
+	sender := newGatedSender()
+	r := newAsyncReporter(sender, core.NewLogThrottle(&core.NoOpLogger{}, 1, time.Minute),
+		AsyncReportConfig{BufferSize: 1, Overflow: BlockUntilSpace})
+
+	r.Report("any", BackendRequest{Service: "0"})
+	waitForPending(t, r, 0)
+	r.Report("any", BackendRequest{Service: "1"})
+
+	blocked := make(chan struct{})
+	go func() {
+		r.Report("any", BackendRequest{Service: "2"})
+		close(blocked)
+	}()
+
+	select {
+	case <-blocked:
+		t.Fatal("expected report to block while the buffer is full")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	close(sender.gate)
+	select {
+	case <-blocked:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected report to be accepted once space was available")
+	}
+
+	if err := r.Close(time.Second * 5); err != nil {
+		t.Fatalf("unexpected error closing %v", err)
+	}
+	if got := sender.sent(); !reflect.DeepEqual(got, []string{"0", "1", "2"}) || r.Dropped() != 0 {
+		t.Errorf("expected every report to be sent, got %v", got)
+	}
+}
+
+func TestAsyncReporter_Close(t *testing.T) {
+	sender := newGatedSender()
+	r := newAsyncReporter(sender, core.NewLogThrottle(&core.NoOpLogger{}, 1, time.Minute), AsyncReportConfig{})
+
+	for _, service := range []string{"0", "1", "2"} {
+		r.Report("any", BackendRequest{Service: service})
+	}
+
+	// the sender never completes so the drain must give up at the deadline
+	if err := r.Close(time.Millisecond * 50); err != ErrDrainTimeout {
+		t.Errorf("expected drain to time out, got %v", err)
+	}
+	if err := r.Report("any", BackendRequest{Service: "3"}); err != ErrReporterClosed {
+		t.Errorf("expected reports to be rejected once closed, got %v", err)
+	}
+
+	// pending reports continue to drain after closing
+	close(sender.gate)
+	if err := r.Close(time.Second * 5); err != nil {
+		t.Fatalf("unexpected error closing %v", err)
+	}
+	if got := sender.sent(); !reflect.DeepEqual(got, []string{"0", "1", "2"}) {
+		t.Errorf("expected pending reports to be drained on close, got %v", got)
+	}
+}
@@ -0,0 +1,132 @@
+package authorizer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultAuditBufferSize is the number of records buffered by the FileAuditSink before records are dropped
+const DefaultAuditBufferSize = 1024
+
+// AuditRecord describes an authorization decision made by the Manager
+type AuditRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	Service   string    `json:"service"`
+	AppID     string    `json:"app_id,omitempty"`
+	UserID    string    `json:"user_id,omitempty"`
+	// Credential is the fingerprint of the user key or app id provided with the request, stable within a process
+	Credential string         `json:"credential,omitempty"`
+	Metrics    map[string]int `json:"metrics,omitempty"`
+	Outcome    Outcome        `json:"outcome"`
+	Reason     DecisionReason `json:"reason,omitempty"`
+	FromCache  bool           `json:"from_cache,omitempty"`
+}
+
+// AuditSink receives a record of each authorization decision made by the Manager
+// Record is called on the request path so implementations must not block
+type AuditSink interface {
+	Record(record AuditRecord)
+	// Close flushes any buffered records and releases the resources held by the sink
+	Close() error
+}
+
+// NoOpAuditSink discards all records
+type NoOpAuditSink struct{}
+
+func (NoOpAuditSink) Record(record AuditRecord) {}
+
+func (NoOpAuditSink) Close() error { return nil }
+
+// FileAuditSink appends records to a file as JSON lines
+// Records are buffered and written in the background. Records are dropped if the buffer is full
+type FileAuditSink struct {
+	file    *os.File
+	records chan AuditRecord
+	done    chan struct{}
+	dropped uint64
+	once    sync.Once
+	err     error
+}
+
+// NewFileAuditSink opens, or creates, the file at the provided path for appending records
+// A non-positive buffer size defaults to DefaultAuditBufferSize
+func NewFileAuditSink(path string, bufferSize int) (*FileAuditSink, error) {
+	if bufferSize <= 0 {
+		bufferSize = DefaultAuditBufferSize
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open audit file - %s", err)
+	}
+
+	sink := &FileAuditSink{
+		file:    file,
+		records: make(chan AuditRecord, bufferSize),
+		done:    make(chan struct{}),
+	}
+	go sink.run()
+	return sink, nil
+}
+
+// Record buffers the record to be written. The record is dropped if the buffer is full
+func (s *FileAuditSink) Record(record AuditRecord) {
+	select {
+	case s.records <- record:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// Dropped returns the number of records which have been dropped due to the buffer being full
+func (s *FileAuditSink) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close writes any buffered records and closes the file
+// Record must not be called once Close has been called
+func (s *FileAuditSink) Close() error {
+	s.once.Do(func() {
+		close(s.records)
+		<-s.done
+		if err := s.file.Close(); err != nil && s.err == nil {
+			s.err = err
+		}
+	})
+	return s.err
+}
+
+func (s *FileAuditSink) run() {
+	defer close(s.done)
+	encoder := json.NewEncoder(s.file)
+	for record := range s.records {
+		if err := encoder.Encode(record); err != nil && s.err == nil {
+			s.err = fmt.Errorf("unable to write audit record - %s", err)
+		}
+	}
+}
+
+// newAuditRecord builds the audit record of a decision. Credentials are fingerprinted
+func newAuditRecord(request BackendRequest, report DecisionReport, timestamp time.Time) AuditRecord {
+	record := AuditRecord{
+		Timestamp: timestamp,
+		Service:   request.Service,
+		Outcome:   report.Outcome,
+		Reason:    report.Reason,
+		FromCache: report.FromCache,
+	}
+
+	if len(request.Transactions) > 0 {
+		transaction := request.Transactions[0]
+		record.AppID = transaction.Params.AppID
+		record.UserID = transaction.Params.UserID
+		record.Metrics = transaction.Metrics
+
+		record.Credential = credentialID(transaction.Params)
+	}
+	return record
+}
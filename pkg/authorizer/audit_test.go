@@ -0,0 +1,153 @@
+package authorizer
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/3scale/3scale-go-client/threescale"
+)
+
+type capturingAuditSink struct {
+	records []AuditRecord
+}
+
+func (c *capturingAuditSink) Record(record AuditRecord) {
+	c.records = append(c.records, record)
+}
+
+func (c *capturingAuditSink) Close() error { return nil }
+
+func TestManager_AuditSink(t *testing.T) {
+	const userKey = "secret-user-key"
+
+	inputs := []struct {
+		name         string
+		response     *threescale.AuthorizeResult
+		expectRecord AuditRecord
+	}{
+		{
+			name:     "Test allowed request is audited",
+			response: &threescale.AuthorizeResult{Authorized: true},
+			expectRecord: AuditRecord{
+				Service:    "svc",
+				Credential: hashCredential(userKey),
+				Metrics:    map[string]int{"hits": 1},
+				Outcome:    OutcomeAllowed,
+			},
+		},
+		{
+			name:     "Test denied request is audited",
+			response: &threescale.AuthorizeResult{Authorized: false, ErrorCode: "limits_exceeded"},
+			expectRecord: AuditRecord{
+				Service:    "svc",
+				Credential: hashCredential(userKey),
+				Metrics:    map[string]int{"hits": 1},
+				Outcome:    OutcomeDenied,
+				Reason:     ReasonLimitsExceeded,
+			},
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			sink := &capturingAuditSink{}
+			m := Manager{
+				clientBuilder: mockBuilder{withBackendClient: mockBackendClient{withAuthResponse: input.response}},
+				auditSink:     sink,
+			}
+
+			request := BackendRequest{
+				Service: "svc",
+				Transactions: []BackendTransaction{
+					{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: userKey}},
+				},
+			}
+			if _, err := m.AuthRep("any", request); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			if len(sink.records) != 1 {
+				t.Fatalf("expected a single audit record, got %d", len(sink.records))
+			}
+
+			record := sink.records[0]
+			if record.Timestamp.IsZero() {
+				t.Error("expected the record to be timestamped")
+			}
+			record.Timestamp = input.expectRecord.Timestamp
+			if !reflect.DeepEqual(record, input.expectRecord) {
+				t.Errorf("unexpected audit record, wanted %v, got %v", input.expectRecord, record)
+			}
+		})
+	}
+}
+
+func TestFileAuditSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir - %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	sink, err := NewFileAuditSink(path, 10)
+	if err != nil {
+		t.Fatalf("unexpected error creating sink - %v", err)
+	}
+
+	sink.Record(AuditRecord{Service: "one", Outcome: OutcomeAllowed})
+	sink.Record(AuditRecord{Service: "two", Outcome: OutcomeDenied, Reason: ReasonCredentials})
+	if err := sink.Close(); err != nil {
+		t.Fatalf("unexpected error closing sink - %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error opening audit file - %v", err)
+	}
+	defer f.Close()
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("expected each line to be a JSON record, got %s", scanner.Text())
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("expected buffered records to be flushed on close, got %d", len(records))
+	}
+	if records[0].Service != "one" || records[1].Service != "two" || records[1].Reason != ReasonCredentials {
+		t.Errorf("unexpected records %v", records)
+	}
+}
+
+func TestFileAuditSink_DropsWhenFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir - %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// build the sink without the writer running so that the buffer fills
+	sink := &FileAuditSink{records: make(chan AuditRecord, 1)}
+	sink.Record(AuditRecord{Service: "one"})
+	sink.Record(AuditRecord{Service: "two"})
+
+	if sink.Dropped() != 1 {
+		t.Errorf("expected a record to be dropped when the buffer is full, got %d", sink.Dropped())
+	}
+
+	if _, err := NewFileAuditSink(filepath.Join(dir, "missing", "audit.log"), 0); err == nil || !strings.Contains(err.Error(), "audit") {
+		t.Errorf("expected an error opening a file in a missing directory, got %v", err)
+	}
+}
@@ -1,8 +1,14 @@
 package authorizer
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/3scale/3scale-authorizer/pkg/backend/v1"
@@ -13,6 +19,47 @@ import (
 	"github.com/3scale/3scale-porta-go-client/client"
 )
 
+const (
+	// MaxTransactionAge is the maximum age of a timestamp on a transaction accepted by 3scale backend
+	MaxTransactionAge = time.Hour * 24
+	// MaxTransactionSkew is the maximum time into the future of a timestamp on a transaction accepted by 3scale backend
+	MaxTransactionSkew = time.Hour
+)
+
+const (
+	// DefaultSystemTimeout is the default timeout of calls to 3scale system, which are made off the request path
+	DefaultSystemTimeout = time.Second * 10
+	// DefaultBackendTimeout is the default timeout of calls to 3scale backend, which are made on the request path
+	DefaultBackendTimeout = time.Second
+)
+
+// ErrBackendUnavailable is returned, wrapped, when 3scale backend could not be reached or did not respond in time
+// Callers can test for it to apply their failure policy to requests made without caching
+var ErrBackendUnavailable = errors.New("3scale backend unavailable")
+
+// ErrMissingAppID is returned, wrapped, when a request provides an app_key without an app_id
+// The request is rejected before calling 3scale unless BackendConfig.AllowAppKeyWithoutAppID is set
+var ErrMissingAppID = errors.New("app_key provided without app_id for service")
+
+// ErrNoCredentials is returned, wrapped, when a request provides none of an app_id, app_key or user_key
+// The request is rejected before calling 3scale unless BackendConfig.AllowEmptyCredentials is set
+var ErrNoCredentials = errors.New("no credentials provided for service")
+
+// Authorizer is the set of methods used to authorize requests against 3scale, implemented by Manager and
+// ReloadableManager. Integrations should depend on it rather than on a copy of a Manager so they can share a
+// Manager and be tested against a stub
+type Authorizer interface {
+	GetSystemConfiguration(systemURL string, request SystemRequest) (client.ProxyConfig, error)
+	AuthRep(backendURL string, request BackendRequest) (*BackendResponse, error)
+	Authorize(backendURL string, request BackendRequest) (*BackendResponse, error)
+	Report(backendURL string, request BackendRequest) error
+}
+
+var (
+	_ Authorizer = Manager{}
+	_ Authorizer = &ReloadableManager{}
+)
+
 // Manager manages connections and interactions between the adapter and 3scale (system and backend)
 // Supports managing interactions between multiple hosts and can optionally leverage available caching implementations
 // Capable of Authorizing a request to 3scale and providing the required functionality to pull from the sources to do so
@@ -24,6 +71,26 @@ type Manager struct {
 	// stopFlush controls the background process that periodically flushes the cache
 	stopFlush       chan struct{}
 	metricsReporter *MetricsReporter
+	// latencies tracks the most recent AuthRep latencies to 3scale backend
+	latencies *latencyWindow
+	// inFlight counts the authorization decisions in progress
+	inFlight *int64
+	// backendClients holds the clients built for each backend URL so the URL is only validated once
+	backendClients *sync.Map
+	// defaultMetrics holds the base metric resolved for each service when its config was cached
+	defaultMetrics *sync.Map
+	auditSink      AuditSink
+	serviceLimiter *serviceLimiter
+	coalescer      *coalescer
+	negative       *negativeCache
+	decisions      *negativeCache
+	// strictRules rejects configs with mapping rules which cannot be compiled
+	strictRules bool
+	ruleLimit   RuleLimitConfig
+	ruleOptions RuleOptions
+	// logThrottle limits the output of log sites on the request path
+	logThrottle *core.LogThrottle
+	tracing     Tracer
 }
 
 // SystemCache wraps the caching implementation and its configuration for 3scale system
@@ -31,6 +98,10 @@ type SystemCache struct {
 	cache.ConfigurationCache
 	SystemCacheConfig
 	stopRefreshingTask chan struct{}
+	// refreshing is set once the refresh worker has been started, however many Managers share the cache
+	refreshing int32
+	// stopped is set once stopRefreshingTask has been closed by a Manager, however many Managers share the cache
+	stopped int32
 }
 
 // SystemCacheConfig holds the configuration for the cache
@@ -39,13 +110,37 @@ type SystemCacheConfig struct {
 	NumRetryFailedRefresh int
 	RefreshInterval       time.Duration
 	TTL                   time.Duration
+	// DEPRECATED: has no effect, cached configs are always refreshed in full
+	// The mapping rules of a product are its current rules in the admin portal, which may not have been promoted to
+	// the environment of the config, so refreshing only the rules could serve rules not yet promoted
+	RefreshMappingRulesOnly bool
+	// CapacityHook, if set, is called when the number of cached items crosses the CapacityThreshold
+	// fraction of MaxSize. SoftMaxSize is used in place of MaxSize when the cache has no limit
+	// A CapacityThreshold of zero or less defaults to cache.DefaultCapacityThreshold
+	CapacityHook      cache.CapacityHook
+	CapacityThreshold float64
+	SoftMaxSize       int
+	// RefreshRateLimit limits the number of calls per second made to 3scale system when refreshing the cache
+	// allowing bursts of up to RefreshBurst calls. Zero implies no limit
+	RefreshRateLimit float64
+	RefreshBurst     int
+	// StaleGracePeriod is the period past TTL a cached config will continue to be served when it could not
+	// be refreshed, riding out transient failures of 3scale system. Configs are fetched again once
+	// the grace period has passed. Zero implies expired configs are served until they are refreshed
+	// The staleness of configs served past TTL is logged and reported via MetricsReporter.ConfigStalenessCB
+	StaleGracePeriod time.Duration
+	// Clock determines the expiry of cached configs and drives their refresh. Defaults to cache.RealClock
+	Clock cache.Clock
 }
 
 // SystemRequest provides the required input to request the latest configuration from 3scale system
 type SystemRequest struct {
 	AccessToken string
-	ServiceID   string
-	Environment string
+	// AccessTokenSource, if set, takes precedence over AccessToken and is read each time a request
+	// is made to 3scale system, including when refreshing the cache
+	AccessTokenSource AccessTokenSource
+	ServiceID         string
+	Environment       string
 }
 
 type BackendConfig struct {
@@ -54,8 +149,60 @@ type BackendConfig struct {
 	// CacheFlushInterval is the period at which the cache should be flushed and
 	// reported to 3scale
 	CacheFlushInterval time.Duration
-	Logger             core.Logger
-	Policy             backend.FailurePolicy
+	// MaxCachedServices limits the number of distinct services cached by each backend when caching is enabled
+	// evicting the applications of the least recently used service once exceeded. Zero implies no limit
+	MaxCachedServices int
+	Logger            core.Logger
+	// Policy determines whether requests are authorized when 3scale backend cannot be reached, including when
+	// calls are rejected by the circuit breaker or shed. Defaults to failing closed with an error wrapping
+	// ErrBackendUnavailable or ErrBackendCallsExhausted. Applies with and without caching
+	Policy backend.FailurePolicy
+	// PolicyOverrides sets the failure policy for individual services, keyed by service id, taking
+	// precedence over Policy
+	PolicyOverrides map[string]backend.FailurePolicy
+	// NoMatch determines how requests which carry no usage, such as when no mapping rule matched, are handled
+	NoMatch NoMatchConfig
+	// DefaultMetricName is the base metric of the service, such as "hits" or "requests", used wherever a
+	// request requires a base metric. Defaults to DefaultMetric. See Manager.DefaultMetricName
+	DefaultMetricName string
+	// AllowAppKeyWithoutAppID passes requests which provide an app_key without an app_id to 3scale as is,
+	// leaving 3scale to reject them, rather than failing them with ErrMissingAppID
+	AllowAppKeyWithoutAppID bool
+	// AllowEmptyCredentials passes requests which provide no credentials to 3scale as is, leaving 3scale
+	// to reject them, rather than failing them with ErrNoCredentials
+	AllowEmptyCredentials bool
+	// Coalesce concurrent identical requests made without caching into a single call to 3scale backend
+	// The usage of the requests which shared the call is reported to 3scale in the background once the call
+	// completes. Only the usage of the request which made the call is checked against the limits of the
+	// application, so limits can be exceeded by the usage of the requests which joined it. Shutdown waits for
+	// the usage to be reported
+	Coalesce bool
+	// NegativeCache caches requests denied because of their credentials. Disabled by default
+	NegativeCache NegativeCacheConfig
+	// DecisionCache caches the decisions made by 3scale, with a maximum age per outcome. Disabled by default
+	DecisionCache DecisionCacheConfig
+	// Concurrency limits the number of concurrent requests to 3scale backend per service
+	Concurrency ConcurrencyConfig
+	// IPFilter, if set, denies requests made from client IPs a service does not accept without calling 3scale
+	// Denials are flagged with ErrorCodeIPDenied, ErrorCodeIPNotAllowed or ErrorCodeIPUnresolved. See NewIPFilter
+	IPFilter *IPFilter
+}
+
+// TimeoutConfig configures the timeouts of calls to 3scale
+// Zero values default to DefaultSystemTimeout and DefaultBackendTimeout respectively
+type TimeoutConfig struct {
+	System  time.Duration
+	Backend time.Duration
+}
+
+func (c TimeoutConfig) withDefaults() TimeoutConfig {
+	if c.System <= 0 {
+		c.System = DefaultSystemTimeout
+	}
+	if c.Backend <= 0 {
+		c.Backend = DefaultBackendTimeout
+	}
+	return c
 }
 
 // BackendAuth contains client authorization credentials for apisonator
@@ -69,6 +216,11 @@ type BackendRequest struct {
 	Auth         BackendAuth
 	Service      string
 	Transactions []BackendTransaction
+	// ConfigVersion is the version of the proxy config the request was built from, if known
+	// Decisions held by the negative and decision caches are only served to requests made with the same version
+	ConfigVersion int
+	// Client is the address the request was received from, used by the IPFilter of BackendConfig
+	Client ClientAddress
 }
 
 // BackendResponse contains the result of an Auth/AuthRep request
@@ -78,12 +230,23 @@ type BackendResponse struct {
 	// RejectedReason should* be set in cases where Authorized is false
 	RejectedReason string
 	RawResponse    interface{}
+	// FailedOpen is set when the request was authorized by the failure policy as 3scale could not be reached
+	FailedOpen bool
+	// FromCache is set when caching is enabled and the decision was made from state cached before the request
+	// or when the decision was served by the negative or decision cache
+	// CacheAge is then the time since the cached state was last learned from 3scale
+	FromCache bool
+	CacheAge  time.Duration
 }
 
 // BackendTransaction contains the metrics and end user auth required to make an Auth/AuthRep request to apisonator
 type BackendTransaction struct {
 	Metrics map[string]int
 	Params  BackendParams
+	// Timestamp is an optional unix timestamp which sets the period the usage is reported in
+	// If unset, the usage is reported at the time the request is processed by 3scale.
+	// 3scale will only take the timestamp into account when calling Report
+	Timestamp int64
 }
 
 // BackendParams contains the ebd user auth for the various supported authentication patterns
@@ -94,6 +257,26 @@ type BackendParams struct {
 	UserKey string
 }
 
+// backendCall is the type of call made to 3scale apisonator to authorize a request
+type backendCall int
+
+const (
+	callAuthRep backendCall = iota
+	callOauthAuthRep
+	callAuthorize
+)
+
+func (c backendCall) String() string {
+	switch c {
+	case callOauthAuthRep:
+		return "OauthAuthRep"
+	case callAuthorize:
+		return "Authorize"
+	default:
+		return "AuthRep"
+	}
+}
+
 type cachedBackend struct {
 	backend   *backend.Backend
 	stopFlush chan struct{}
@@ -101,46 +284,109 @@ type cachedBackend struct {
 
 // NewManager returns an instance of Manager
 // Starts refreshing background process for underlying system cache if provided
+// The Logger provided by the backend config is used by the Manager and defaults to core.NoOpLogger
+// A client without a Transport is given one tuned for connection reuse. See TransportConfig
 func NewManager(
 	client *http.Client,
 	systemCache *SystemCache,
 	backendConfig BackendConfig,
 	reporter *MetricsReporter,
+	opts ...ManagerOption,
 ) *Manager {
 	builder := ClientBuilder{httpClient: client}
 
+	var options managerOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	if client.Transport == nil {
-		client.Transport = http.DefaultTransport
+		client.Transport = newTransport(TransportConfig{})
 	}
 
 	if reporter == nil {
 		reporter = &MetricsReporter{}
 	}
 
-	baseTransport, ok := client.Transport.(*http.Transport)
-	if ok {
-		if reporter.ReportMetrics && reporter.ResponseCB != nil {
-			builder.httpClient.Transport = &MetricsRoundTripper{
-				proxied: baseTransport,
-				hook: reporter.ResponseCB,
-			}
+	if backendConfig.Logger == nil {
+		backendConfig.Logger = &core.NoOpLogger{}
+	}
+
+	if _, wrapped := client.Transport.(*MetricsRoundTripper); !wrapped && reporter.ReportMetrics && (reporter.ResponseCB != nil || reporter.ErrorCB != nil) {
+		builder.httpClient.Transport = &MetricsRoundTripper{
+			proxied:   client.Transport,
+			hook:      reporter.ResponseCB,
+			errorHook: reporter.ErrorCB,
 		}
 	}
 
-	if systemCache != nil {
-		go func() {
-			ticker := time.NewTicker(systemCache.RefreshInterval)
-			for {
-				select {
-				case <-ticker.C:
-					systemCache.Refresh()
-				case <-systemCache.stopRefreshingTask:
-					ticker.Stop()
-					return
-				}
+	if options.breaker != nil {
+		breaker := newBreakerRoundTripper(builder.httpClient.Transport, *options.breaker)
+		logger := backendConfig.Logger
+		breaker.onStateChange = func(host string, from, to BreakerState) {
+			logger.Warnf("circuit breaker for %s changed state from %s to %s", host, from, to)
+			if reporter.BreakerStateCB != nil {
+				reporter.BreakerStateCB(host, to)
 			}
-		}()
+		}
+
+		withBreaker := *builder.httpClient
+		withBreaker.Transport = breaker
+		builder.httpClient = &withBreaker
+	}
+
+	// configs are large and compress well, and a size limit applies to the decompressed config
+	builder.systemHTTPClient = withCompression(builder.httpClient)
+	if options.maxSystemResponseSize > 0 {
+		builder.systemHTTPClient = withMaxResponseSize(builder.systemHTTPClient, options.maxSystemResponseSize)
+	}
+
+	if options.failover != nil {
+		backendClient := *builder.httpClient
+		// the option may be shared between Managers, so each is given its own round tripper
+		backendClient.Transport = options.failover.withTransport(backendClient.Transport)
+		builder.backendHTTPClient = &backendClient
+	}
+
+	if limit := backendConfig.Concurrency.MaxInFlight; limit > 0 {
+		limited := newLimitedRoundTripper(builder.backendClient().Transport, limit, backendConfig.Concurrency.QueueTimeout)
+		limited.onInFlight = reporter.BackendInFlightCB
+		limited.onShed = reporter.ShedCB
 
+		backendClient := *builder.backendClient()
+		backendClient.Transport = limited
+		builder.backendHTTPClient = &backendClient
+	}
+
+	if options.retry != nil {
+		builder.httpClient = withRetries(builder.httpClient, *options.retry)
+		if builder.systemHTTPClient != nil {
+			builder.systemHTTPClient = withRetries(builder.systemHTTPClient, *options.retry)
+		}
+		if builder.backendHTTPClient != nil {
+			builder.backendHTTPClient = withRetries(builder.backendHTTPClient, *options.retry)
+		}
+	}
+
+	// a timeout set on the provided client is respected unless timeouts have been explicitly configured
+	if options.timeouts != nil || client.Timeout == 0 {
+		var timeouts TimeoutConfig
+		if options.timeouts != nil {
+			timeouts = *options.timeouts
+		}
+		timeouts = timeouts.withDefaults()
+
+		systemClient := *builder.systemClient()
+		systemClient.Timeout = timeouts.System
+		builder.systemHTTPClient = &systemClient
+
+		backendClient := *builder.backendClient()
+		backendClient.Timeout = timeouts.Backend
+		builder.backendHTTPClient = &backendClient
+	}
+
+	if systemCache != nil {
+		systemCache.startRefreshing()
 	}
 
 	m := &Manager{
@@ -149,6 +395,36 @@ func NewManager(
 		backendConf:     backendConfig,
 		stopFlush:       make(chan struct{}),
 		metricsReporter: reporter,
+		latencies:       newLatencyWindow(DefaultLatencyWindowSize),
+		inFlight:        new(int64),
+		backendClients:  &sync.Map{},
+		defaultMetrics:  &sync.Map{},
+		auditSink:       options.auditSink,
+		strictRules:     options.strictRules,
+		ruleLimit:       options.ruleLimit,
+		ruleOptions:     options.ruleOptions,
+		tracing:         options.tracer,
+		logThrottle:     core.NewLogThrottle(backendConfig.Logger, core.DefaultThrottleLimit, core.DefaultThrottleInterval),
+	}
+
+	if m.auditSink == nil {
+		m.auditSink = NoOpAuditSink{}
+	}
+
+	if backendConfig.Concurrency.enabled() {
+		m.serviceLimiter = newServiceLimiter(backendConfig.Concurrency)
+	}
+
+	if backendConfig.Coalesce && !backendConfig.EnableCaching {
+		m.coalescer = newCoalescer()
+	}
+
+	if backendConfig.NegativeCache.TTL > 0 {
+		m.negative = newNegativeCache(backendConfig.NegativeCache)
+	}
+
+	if backendConfig.DecisionCache.enabled() {
+		m.decisions = newDecisionCache(backendConfig.DecisionCache)
 	}
 
 	if backendConfig.EnableCaching {
@@ -158,11 +434,53 @@ func NewManager(
 	return m
 }
 
+// startRefreshing starts refreshing the cache every RefreshInterval until stopRefreshingTask is closed
+// The worker is only started by the first call, so Managers sharing the cache do not multiply the refreshes
+func (c *SystemCache) startRefreshing() {
+	if !atomic.CompareAndSwapInt32(&c.refreshing, 0, 1) {
+		return
+	}
+	go func() {
+		ticker := c.clock().NewTicker(c.RefreshInterval)
+		for {
+			select {
+			case <-ticker.C():
+				c.Refresh()
+			case <-c.stopRefreshingTask:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// stop closes stopRefreshingTask, stopping the refresh worker. Only the first call closes it, so Managers
+// sharing the cache can each be shut down. Safe to call on a nil cache
+func (c *SystemCache) stop() {
+	if c == nil || !atomic.CompareAndSwapInt32(&c.stopped, 0, 1) {
+		return
+	}
+	if c.stopRefreshingTask != nil {
+		close(c.stopRefreshingTask)
+	}
+}
+
+// isStopped returns true once the cache has been stopped by a Manager, after which it is no longer refreshed
+func (c *SystemCache) isStopped() bool {
+	return c != nil && atomic.LoadInt32(&c.stopped) == 1
+}
+
+// clock returns the clock of the cache, which is unset for caches not created by NewSystemCache
+func (c *SystemCache) clock() cache.Clock {
+	if c.Clock == nil {
+		return cache.RealClock{}
+	}
+	return c.Clock
+}
+
 // NewSystemCache returns a system cache configured with an in-memory caching implementation
 // and sets some sensible defaults if zero values have been provided for the config
 func NewSystemCache(config SystemCacheConfig, stopRefreshing chan struct{}) *SystemCache {
-	c := cache.NewConfigCache(config.TTL, config.MaxSize)
-
 	if config.RefreshInterval == time.Duration(0) {
 		config.RefreshInterval = cache.DefaultCacheRefreshInterval
 	}
@@ -171,6 +489,20 @@ func NewSystemCache(config SystemCacheConfig, stopRefreshing chan struct{}) *Sys
 		config.TTL = cache.DefaultCacheTTL
 	}
 
+	c := cache.NewConfigCache(config.TTL, config.MaxSize)
+	if config.CapacityHook != nil {
+		c.OnCapacityThreshold(config.CapacityThreshold, config.CapacityHook)
+		c.SetSoftLimit(config.SoftMaxSize)
+	}
+	c.SetRefreshRateLimit(config.RefreshRateLimit, config.RefreshBurst)
+	if config.StaleGracePeriod > 0 {
+		c.SetStaleGracePeriod(config.StaleGracePeriod)
+	}
+	if config.Clock == nil {
+		config.Clock = cache.RealClock{}
+	}
+	c.SetClock(config.Clock)
+
 	return &SystemCache{
 		ConfigurationCache: c,
 		stopRefreshingTask: stopRefreshing,
@@ -180,61 +512,338 @@ func NewSystemCache(config SystemCacheConfig, stopRefreshing chan struct{}) *Sys
 
 // GetSystemConfiguration returns the configuration from 3scale system which can be used to fulfill and Auth request
 func (m Manager) GetSystemConfiguration(systemURL string, request SystemRequest) (client.ProxyConfig, error) {
+	return m.GetSystemConfigurationContext(context.Background(), systemURL, request)
+}
+
+// GetSystemConfigurationContext is GetSystemConfiguration with the span of the fetch started from the context
+func (m Manager) GetSystemConfigurationContext(ctx context.Context, systemURL string, request SystemRequest) (client.ProxyConfig, error) {
+	config, _, err := m.systemConfiguration(ctx, systemURL, request)
+	return config, err
+}
+
+// systemConfiguration returns the config of the service along with the state prepared when it was cached
+// The prepared state is nil for configs which are not cached
+func (m Manager) systemConfiguration(ctx context.Context, systemURL string, request SystemRequest) (client.ProxyConfig, *preparedConfig, error) {
 	var config client.ProxyConfig
+	var prepared *preparedConfig
 	var err error
 
 	if err = validateSystemRequest(request); err != nil {
-		return config, err
+		return config, nil, err
 	}
 
+	_, span := m.tracer().StartSpan(ctx, SpanSystemConfig)
+	span.SetAttribute("service", request.ServiceID)
+	span.SetAttribute("environment", request.Environment)
+	defer func() { span.End(err) }()
+
 	if m.systemCache != nil && m.systemCache.ConfigurationCache != nil {
-		config, err = m.fetchSystemConfigFromCache(systemURL, request)
+		config, prepared, err = m.fetchSystemConfigFromCache(systemURL, request, span)
 
 	} else {
+		span.SetAttribute("cache_hit", "false")
 		config, err = m.fetchSystemConfigRemotely(systemURL, request)
 	}
 
 	if err != nil {
-		return config, fmt.Errorf("cannot get 3scale system config - %s", err.Error())
+		err = fmt.Errorf("cannot get 3scale system config - %w", err)
+		return config, nil, err
 	}
 
-	return config, nil
+	return config, prepared, nil
+}
+
+// LatencyQuantiles returns the p50, p95 and p99 latency of calls to AuthRep against 3scale backend
+// Quantiles are computed over the most recent DefaultLatencyWindowSize calls
+func (m Manager) LatencyQuantiles() map[float64]time.Duration {
+	return m.latencies.quantiles(latencyQuantiles)
+}
+
+// ConfigAge returns the time since the cached config of the service for the environment was last fetched or refreshed
+// from 3scale system. The returned bool is false if the Manager has no system cache or the config is not cached
+func (m Manager) ConfigAge(systemURL, serviceID, environment string) (time.Duration, bool) {
+	if m.systemCache == nil {
+		return 0, false
+	}
+	cachedValue, found := m.systemCache.Get(generateSystemCacheKey(systemURL, serviceID, environment))
+	if !found {
+		return 0, false
+	}
+	return cachedValue.Age(), true
 }
 
 // Shutdown stops running background process
+// Waits for the usage of coalesced requests to be reported before flushing any cached usage to 3scale
+// The system cache, if any, is no longer refreshed, including for other Managers sharing it
 func (m Manager) Shutdown() {
+	m.waitCoalesced()
 	close(m.stopFlush)
-	close(m.systemCache.stopRefreshingTask)
+	m.systemCache.stop()
+}
+
+// waitCoalesced waits for the calls shared by coalesced requests and the reports of their usage to complete
+func (m Manager) waitCoalesced() {
+	if m.coalescer != nil {
+		m.coalescer.wait()
+	}
 }
 
 // AuthRep does a Authorize and Report request into 3scale apisonator
 func (m Manager) AuthRep(backendURL string, request BackendRequest) (*BackendResponse, error) {
-	if !m.backendConf.EnableCaching {
-		return m.passthroughAuthRep(backendURL, request, false)
-	}
+	return m.doAuthRep(context.Background(), backendURL, request, callAuthRep)
+}
 
-	return m.cachedAuthRep(backendURL, request, false)
+// AuthRepContext is AuthRep with the span of the decision started from the context, relating it to the trace of
+// the incoming request. See WithTracer
+func (m Manager) AuthRepContext(ctx context.Context, backendURL string, request BackendRequest) (*BackendResponse, error) {
+	return m.doAuthRep(ctx, backendURL, request, callAuthRep)
 }
 
 // DEPRECATED: do not use in new code
 func (m Manager) OauthAuthRep(backendURL string, request BackendRequest) (*BackendResponse, error) {
-	if !m.backendConf.EnableCaching {
-		return m.passthroughAuthRep(backendURL, request, true)
+	return m.doAuthRep(context.Background(), backendURL, request, callOauthAuthRep)
+}
+
+// Authorize does an Authorize request into 3scale apisonator
+// The request is authorized against the usage provided but no usage is reported, making it suitable for traffic,
+// such as health checks, which should not count towards the limits of the application
+func (m Manager) Authorize(backendURL string, request BackendRequest) (*BackendResponse, error) {
+	return m.doAuthRep(context.Background(), backendURL, request, callAuthorize)
+}
+
+// AuthorizeContext is Authorize with the span of the decision started from the context. See AuthRepContext
+func (m Manager) AuthorizeContext(ctx context.Context, backendURL string, request BackendRequest) (*BackendResponse, error) {
+	return m.doAuthRep(ctx, backendURL, request, callAuthorize)
+}
+
+func (m Manager) doAuthRep(ctx context.Context, backendURL string, request BackendRequest, call backendCall) (*BackendResponse, error) {
+	start := time.Now()
+	m.reportInFlight(1)
+	ctx, span := m.tracer().StartSpan(ctx, SpanAuthorize)
+	span.SetAttribute("service", request.Service)
+	span.SetAttribute("call", call.String())
+
+	var res *BackendResponse
+	var err error
+	if release, ok := m.serviceLimiter.acquire(request.Service); ok {
+		res, err = m.decide(ctx, backendURL, request, call)
+		release()
+	} else {
+		err = fmt.Errorf("%w %s", ErrConcurrencyLimitExceeded, request.Service)
 	}
 
-	return m.cachedAuthRep(backendURL, request, true)
+	m.reportInFlight(-1)
+	report := newDecisionReport(request.Service, res, err, time.Since(start))
+	setDecisionAttributes(span, report)
+	span.End(err)
+	if m.metricsReporter != nil && m.metricsReporter.DecisionCB != nil {
+		m.metricsReporter.DecisionCB(report)
+	}
+	// building the record is skipped when it would be discarded, as it is on the request path
+	if _, discard := m.auditSink.(NoOpAuditSink); m.auditSink != nil && !discard {
+		m.auditSink.Record(newAuditRecord(request, report, start))
+	}
+	if report.Outcome == OutcomeDenied {
+		m.logDenied(request, res, report.Reason)
+	}
+	return res, err
 }
 
-func (m Manager) passthroughAuthRep(backendURL string, request BackendRequest, oidc bool) (*BackendResponse, error) {
-	client, err := m.clientBuilder.BuildBackendClient(backendURL)
+func (m Manager) decide(ctx context.Context, backendURL string, request BackendRequest, call backendCall) (*BackendResponse, error) {
+	// the client IP is checked first as the service must not be called from elsewhere, whatever the credentials
+	if denied := m.backendConf.IPFilter.apply(request); denied != nil {
+		return denied, nil
+	}
+	if !m.backendConf.AllowAppKeyWithoutAppID && request.missingAppID() {
+		return nil, fmt.Errorf("%w %s", ErrMissingAppID, request.Service)
+	}
+	if !m.backendConf.AllowEmptyCredentials && request.noCredentials() {
+		return nil, fmt.Errorf("%w %s", ErrNoCredentials, request.Service)
+	}
+
+	var negativeKey string
+	if m.negative != nil {
+		if key, ok := negativeCacheKey(backendURL, request); ok {
+			if denied, hit := m.negativeLookup(key, request.ConfigVersion); hit {
+				return denied, nil
+			}
+			negativeKey = key
+		}
+	}
+
+	if call != callAuthorize {
+		var denied *BackendResponse
+		request, denied = m.backendConf.NoMatch.apply(request, m.defaultMetric(request.Service))
+		if denied != nil {
+			return denied, nil
+		}
+	}
+
+	var decisionKey string
+	if m.decisions != nil {
+		if key, ok := decisionCacheKey(backendURL, request); ok {
+			if cached, hit := m.decisionLookup(key, request.ConfigVersion, call); hit {
+				return cached, nil
+			}
+			decisionKey = key
+		}
+	}
+
+	var res *BackendResponse
+	var err error
+	switch {
+	case m.backendConf.EnableCaching:
+		res, err = m.cachedAuthRep(ctx, backendURL, request, call)
+	case m.coalescer != nil:
+		res, err = m.coalescedAuthRep(ctx, backendURL, request, call)
+	default:
+		res, err = m.passthroughAuthRep(ctx, backendURL, request, call)
+	}
+
+	if err != nil && isBackendUnavailable(err) && m.AllowOnFailure(request.Service) {
+		m.throttledLogger().Warnf("fail_open/"+request.Service,
+			"authorizing request for service %s as 3scale backend is unavailable - %s", request.Service, err)
+		return &BackendResponse{Authorized: true, FailedOpen: true}, nil
+	}
+	if negativeKey != "" && err == nil && isCredentialDenial(res) {
+		m.negative.set(negativeKey, request.ConfigVersion, res)
+	}
+	if decisionKey != "" && err == nil {
+		if ttl := m.backendConf.DecisionCache.ttl(res, call); ttl > 0 {
+			m.decisions.setFor(decisionKey, request.ConfigVersion, res, ttl)
+		}
+	}
+	return res, err
+}
+
+// AllowOnFailure returns true if the failure policy for the service authorizes requests when 3scale cannot be
+// reached. It is applied by the Manager to calls to 3scale backend and should be applied by callers when the
+// config for the service cannot be fetched from 3scale system
+func (m Manager) AllowOnFailure(service string) bool {
+	policy, ok := m.backendConf.PolicyOverrides[service]
+	if !ok {
+		policy = m.backendConf.Policy
+	}
+	return policy != nil && policy()
+}
+
+// logger returns the configured logger, falling back to a logger which discards all output
+func (m Manager) logger() core.Logger {
+	if m.backendConf.Logger == nil {
+		return &core.NoOpLogger{}
+	}
+	return m.backendConf.Logger
+}
+
+// throttledLogger returns the throttle to be used by log sites on the request path
+func (m Manager) throttledLogger() *core.LogThrottle {
+	if m.logThrottle == nil {
+		return core.NewLogThrottle(m.logger(), core.DefaultThrottleLimit, core.DefaultThrottleInterval)
+	}
+	return m.logThrottle
+}
+
+// logDenied logs the reason 3scale gave for denying the request, identifying the credentials by their hash
+func (m Manager) logDenied(request BackendRequest, res *BackendResponse, reason DecisionReason) {
+	var credential string
+	if len(request.Transactions) > 0 {
+		credential = credentialID(request.Transactions[0].Params)
+	}
+
+	m.throttledLogger().Infof("denied/"+request.Service+"/"+string(reason),
+		"request denied for service %s and credential %s - reason %s, error code %q",
+		request.Service, credential, reason, res.ErrorCode)
+}
+
+// reportInFlight adjusts the count of decisions in progress and reports it if required
+func (m Manager) reportInFlight(delta int64) {
+	if m.inFlight == nil {
+		return
+	}
+
+	inFlight := atomic.AddInt64(m.inFlight, delta)
+	if m.metricsReporter != nil && m.metricsReporter.InFlightCB != nil {
+		m.metricsReporter.InFlightCB(inFlight)
+	}
+}
+
+// Report usage to 3scale apisonator
+// Usage is always reported directly to 3scale, bypassing any caching, so that timestamps set on the
+// transactions are respected. Supports multiple transactions
+func (m Manager) Report(backendURL string, request BackendRequest) error {
+	client, err := m.backendClient(backendURL)
+	if err != nil {
+		return fmt.Errorf("unable to build required client for 3scale backend - %s", err.Error())
+	}
+
+	req, err := request.toAPIReportRequest()
+	if err != nil {
+		return fmt.Errorf("unable to build request to 3scale - %s", err)
+	}
+
+	res, err := client.Report(*req)
+	if err != nil {
+		if !errors.Is(err, ErrBackendCallsExhausted) {
+			var rawResponse interface{}
+			if res != nil {
+				rawResponse = res.RawResponse
+			}
+			m.reportFailure(TargetBackend, request.Service, withBackendStatus(err, rawResponse))
+		}
+		callErr := backendCallError("Report", err)
+		// a result is returned alongside the error when 3scale responds with a server error
+		if res != nil && !errors.Is(callErr, ErrBackendUnavailable) {
+			callErr = fmt.Errorf("%w - %s", ErrBackendUnavailable, callErr)
+		}
+		return callErr
+	}
+
+	if !res.Accepted {
+		return fmt.Errorf("report not accepted by 3scale - %s", res.ErrorCode)
+	}
+	return nil
+}
+
+func (m Manager) passthroughAuthRep(ctx context.Context, backendURL string, request BackendRequest, call backendCall) (*BackendResponse, error) {
+	client, err := m.backendClient(backendURL)
 	if err != nil {
 		return nil, fmt.Errorf("unable to build required client for 3scale backend - %s", err.Error())
 	}
 
-	return m.authRep(client, request, oidc)
+	return m.authRep(ctx, client, request, call)
+}
+
+// backendClient returns the client for the provided backend URL, reusing the client registered when a config
+// with the URL as its endpoint was cached. Clients for any other URL are built for the call and not stored, so
+// the stored clients are bounded by the endpoints of the configs cached
+func (m Manager) backendClient(backendURL string) (threescale.Client, error) {
+	if m.backendClients != nil {
+		if client, ok := m.backendClients.Load(backendURL); ok {
+			return client.(threescale.Client), nil
+		}
+	}
+	return m.clientBuilder.BuildBackendClient(backendURL)
 }
 
-func (m Manager) cachedAuthRep(backendURL string, request BackendRequest, oidc bool) (*BackendResponse, error) {
+// registerBackendClient builds, validating the URL, and stores the client for the endpoint of a config being cached
+func (m Manager) registerBackendClient(backendURL string) error {
+	if m.backendClients != nil {
+		if _, ok := m.backendClients.Load(backendURL); ok {
+			return nil
+		}
+	}
+
+	client, err := m.clientBuilder.BuildBackendClient(backendURL)
+	if err != nil {
+		return err
+	}
+	if m.backendClients != nil {
+		m.backendClients.LoadOrStore(backendURL, client)
+	}
+	return nil
+}
+
+func (m Manager) cachedAuthRep(ctx context.Context, backendURL string, request BackendRequest, call backendCall) (*BackendResponse, error) {
 	var cb cachedBackend
 	var err error
 	cb, knownBackend := m.cachedBackends[backendURL]
@@ -242,60 +851,124 @@ func (m Manager) cachedAuthRep(backendURL string, request BackendRequest, oidc b
 		// try to create a cache if we haven't seen this backend before
 		cb, err = m.newCachedBackend(backendURL)
 		if err != nil {
-			//todo(pgough) - add logging when we accept a logger
-			return m.passthroughAuthRep(backendURL, request, oidc)
+			m.throttledLogger().Errorf("cached_backend/"+backendURL,
+				"unable to create cached backend for %s, falling back to passthrough - %s", backendURL, core.RedactError(err))
+			return m.passthroughAuthRep(ctx, backendURL, request, call)
 		}
 		m.cachedBackends[backendURL] = cb
 	}
 
-	return m.authRep(cb.backend, request, oidc)
+	return m.authRep(ctx, cb.backend, request, call)
 }
 
-func (m Manager) authRep(client threescale.Client, request BackendRequest, oidc bool) (*BackendResponse, error) {
-	req, err := request.ToAPIRequest()
+func (m Manager) authRep(ctx context.Context, client threescale.Client, request BackendRequest, call backendCall) (*BackendResponse, error) {
+	req, err := request.toAPIRequest()
 	if err != nil {
 		return nil, fmt.Errorf("unable to build request to 3scale - %s", err)
 	}
 
 	var res *threescale.AuthorizeResult
 
-	if oidc {
-		res, err = client.OauthAuthRep(*req)
-	} else {
-		res, err = client.AuthRep(*req)
+	_, span := m.tracer().StartSpan(ctx, SpanBackendCall)
+	span.SetAttribute("service", request.Service)
+	span.SetAttribute("call", call.String())
+
+	start := time.Now()
+	switch call {
+	case callOauthAuthRep:
+		res, err = client.OauthAuthRep(req)
+	case callAuthorize:
+		res, err = client.Authorize(req)
+	default:
+		res, err = client.AuthRep(req)
 	}
+	m.latencies.record(time.Since(start))
 	if err != nil {
 		var rawResponse interface{}
 		if res != nil {
 			rawResponse = res.RawResponse
 		}
+		if !errors.Is(err, ErrBackendCallsExhausted) {
+			m.reportFailure(TargetBackend, request.Service, withBackendStatus(err, rawResponse))
+		}
+		err = backendCallError(call.String(), err)
+		span.End(err)
 		return &BackendResponse{
 			Authorized:  false,
 			RawResponse: rawResponse,
-		}, fmt.Errorf("error calling AuthRep - %s", err)
+		}, err
 	}
 
-	return &BackendResponse{
+	response := &BackendResponse{
 		Authorized:     res.Authorized,
 		ErrorCode:      res.ErrorCode,
 		RejectedReason: res.RejectionReason,
 		RawResponse:    res.RawResponse,
-	}, nil
+	}
+	if decision, ok := res.RawResponse.(backend.CachedDecision); ok {
+		response.FromCache = true
+		response.CacheAge = decision.Age
+	}
+	span.SetAttribute("cache_hit", strconv.FormatBool(response.FromCache))
+	span.End(nil)
+	return response, nil
+}
+
+// backendCallError redacts the error returned by a call to 3scale backend, wrapping ErrBackendCallsExhausted
+// if the call was shed or ErrBackendUnavailable if 3scale backend could not be reached
+func backendCallError(call string, err error) error {
+	callErr := fmt.Errorf("error calling %s - %s", call, core.RedactError(err))
+	var netErr net.Error
+	if errors.Is(err, ErrBackendCallsExhausted) {
+		return fmt.Errorf("%w - %s", ErrBackendCallsExhausted, callErr)
+	} else if errors.As(err, &netErr) {
+		return fmt.Errorf("%w - %s", ErrBackendUnavailable, callErr)
+	}
+	return callErr
+}
+
+// isBackendUnavailable returns true if the error reports that 3scale backend could not handle the call
+func isBackendUnavailable(err error) bool {
+	return errors.Is(err, ErrBackendUnavailable) || errors.Is(err, ErrBackendCallsExhausted)
 }
 
 // newCachedBackend creates a new backend and start the flushing process in the background
 func (m Manager) newCachedBackend(url string) (cachedBackend, error) {
 	httpClient := http.DefaultClient
 	if cb, ok := m.clientBuilder.(ClientBuilder); ok {
-		httpClient = cb.httpClient
+		httpClient = withTarget(cb.backendClient(), TargetBackend)
 	}
-	backend, err := backend.NewBackend(url, httpClient, m.backendConf.Logger, m.backendConf.Policy)
+	// the failure policy is applied per service by the Manager so the backend always fails closed
+	cached, err := backend.NewBackend(url, httpClient, m.backendConf.Logger, backend.FailClosedPolicy)
 	if err != nil {
 		return cachedBackend{}, err
 	}
 
-	backend.SetCacheHitCallback(func() {
-		m.metricsReporter.CacheHitCB(Backend)
+	cached.SetMaxServices(m.backendConf.MaxCachedServices)
+
+	reporter := m.metricsReporter
+	if reporter == nil {
+		reporter = &MetricsReporter{}
+	}
+
+	// hits and misses are counted between flushes to report the hit ratio of each flush interval
+	var hits, misses uint64
+	cached.SetCacheHitCallback(func() {
+		atomic.AddUint64(&hits, 1)
+		if reporter.CacheHitCB != nil {
+			reporter.CacheHitCB(Backend)
+		}
+	})
+	cached.SetCacheMissCallback(func() {
+		atomic.AddUint64(&misses, 1)
+		if reporter.CacheMissCB != nil {
+			reporter.CacheMissCB(Backend)
+		}
+	})
+	cached.SetFlushCallback(func(stats backend.FlushStats) {
+		if reporter.BackendCacheCB != nil {
+			reporter.BackendCacheCB(newBackendCacheReport(url, stats, atomic.SwapUint64(&hits, 0), atomic.SwapUint64(&misses, 0)))
+		}
 	})
 
 	ticker := time.NewTicker(m.backendConf.CacheFlushInterval)
@@ -303,62 +976,99 @@ func (m Manager) newCachedBackend(url string) (cachedBackend, error) {
 		for {
 			select {
 			case <-ticker.C:
-				backend.Flush()
+				cached.Flush()
 			case <-m.stopFlush:
 				// allows us to drain the cache before shutting down
-				backend.Flush()
+				cached.Flush()
 				ticker.Stop()
 				return
 			}
 
 		}
 	}()
-	m.backendConf.Logger.Infof("created new cached backend for %s", url)
+	m.logger().Infof("created new cached backend for %s", url)
 	return cachedBackend{
-		backend:   backend,
+		backend:   cached,
 		stopFlush: m.stopFlush,
 	}, nil
 }
 
-func (m Manager) fetchSystemConfigFromCache(systemURL string, request SystemRequest) (client.ProxyConfig, error) {
+func (m Manager) fetchSystemConfigFromCache(systemURL string, request SystemRequest, span Span) (client.ProxyConfig, *preparedConfig, error) {
 	var config client.ProxyConfig
+	var prepared *preparedConfig
 	var err error
 
-	cacheKey := generateSystemCacheKey(systemURL, request.ServiceID)
+	cacheKey := generateSystemCacheKey(systemURL, request.ServiceID, request.Environment)
 	cachedValue, found := m.systemCache.Get(cacheKey)
+	span.SetAttribute("cache_hit", strconv.FormatBool(found))
 	if !found {
+		if m.metricsReporter != nil && m.metricsReporter.CacheMissCB != nil {
+			m.metricsReporter.CacheMissCB(System)
+		}
 		config, err = m.fetchSystemConfigRemotely(systemURL, request)
 		if err != nil {
-			return config, err
+			return config, nil, err
 		}
 
 		itemToCache := &cache.Value{Item: config}
 		itemToCache = m.setValueFromConfig(systemURL, request, itemToCache)
+		if err := itemToCache.Prepare(); err != nil {
+			return config, nil, err
+		}
+		prepared, _ = itemToCache.Prepared().(*preparedConfig)
 		m.systemCache.Set(cacheKey, *itemToCache)
 
 	} else {
 		config = cachedValue.Item
+		prepared, err = m.prepared(cachedValue)
+		if err != nil {
+			return config, nil, err
+		}
+		staleness := cachedValue.Staleness()
+		if staleness > 0 {
+			m.throttledLogger().Warnf("stale_config/"+cacheKey,
+				"serving stale config for service %s from %s - config could not be refreshed and expired %s ago",
+				request.ServiceID, core.RedactCredentials(systemURL), staleness.Round(time.Second))
+		}
+		if m.metricsReporter != nil && m.metricsReporter.ConfigStalenessCB != nil {
+			m.metricsReporter.ConfigStalenessCB(request.ServiceID, staleness)
+		}
+		if m.metricsReporter != nil && m.metricsReporter.ConfigAgeCB != nil {
+			m.metricsReporter.ConfigAgeCB(request.ServiceID, cachedValue.Age())
+		}
 		if m.metricsReporter.CacheHitCB != nil {
 			m.metricsReporter.CacheHitCB(System)
 		}
 	}
 
-	return config, err
+	return config, prepared, err
 }
 
 func (m Manager) fetchSystemConfigRemotely(systemURL string, request SystemRequest) (client.ProxyConfig, error) {
 	var config client.ProxyConfig
 
-	systemClient, err := m.clientBuilder.BuildSystemClient(systemURL, request.AccessToken)
+	token, err := request.accessToken()
 	if err != nil {
-		return config, fmt.Errorf("unable to build system client for %s - %s", systemURL, err.Error())
+		return config, err
+	}
+
+	systemClient, err := m.clientBuilder.BuildSystemClient(systemURL, token)
+	if err != nil {
+		return config, fmt.Errorf("unable to build system client for %s - %s", core.RedactCredentials(systemURL), core.RedactError(err))
 	}
 
 	proxyConfElement, err := systemClient.GetLatestProxyConfig(request.ServiceID, request.Environment)
 	if err != nil {
-		return config, fmt.Errorf("unable to fetch required data from 3scale system - %s", err.Error())
+		m.reportFailure(TargetSystem, request.ServiceID, err)
+		return config, fmt.Errorf("unable to fetch required data from 3scale system - %w", core.RedactError(err))
 	}
 
+	if err := m.limitRules(request.ServiceID, &proxyConfElement.ProxyConfig); err != nil {
+		return config, err
+	}
+	if err := m.validateRules(request.ServiceID, proxyConfElement.ProxyConfig); err != nil {
+		return config, err
+	}
 	return proxyConfElement.ProxyConfig, nil
 }
 
@@ -366,6 +1076,10 @@ func (m Manager) refreshCallback(systemURL string, request SystemRequest, retryA
 	return func() (client.ProxyConfig, error) {
 		config, err := m.fetchSystemConfigRemotely(systemURL, request)
 		if err != nil {
+			if isNotFound(err) {
+				// the service or its config has been deleted so we should stop serving it
+				return config, cache.ErrRemoveFromCache
+			}
 			if retryAttempts > 0 {
 				retryAttempts--
 				return m.refreshCallback(systemURL, request, retryAttempts)()
@@ -377,16 +1091,30 @@ func (m Manager) refreshCallback(systemURL string, request SystemRequest, retryA
 
 func (m Manager) setValueFromConfig(systemURL string, request SystemRequest, value *cache.Value) *cache.Value {
 	value.SetRefreshCallback(m.refreshCallback(systemURL, request, m.systemCache.NumRetryFailedRefresh))
+	value.SetPrepareCallback(m.prepareCallback())
 	return value
 }
 
 // ToAPIRequest transforms the BackendRequest into a request that is acceptable for the 3scale Client interface
 func (request BackendRequest) ToAPIRequest() (*threescale.Request, error) {
+	req, err := request.toAPIRequest()
+	if err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// toAPIRequest is ToAPIRequest without the allocation of the returned request, for use on the request path
+func (request BackendRequest) toAPIRequest() (threescale.Request, error) {
 	if request.Transactions == nil || len(request.Transactions) < 1 {
-		return nil, fmt.Errorf("cannot process emtpy transaction")
+		return threescale.Request{}, fmt.Errorf("cannot process emtpy transaction")
 	}
 
-	return &threescale.Request{
+	if err := request.Transactions[0].validateTimestamp(); err != nil {
+		return threescale.Request{}, err
+	}
+
+	return threescale.Request{
 		Auth: api.ClientAuth{
 			Type:  api.AuthType(request.Auth.Type),
 			Value: request.Auth.Value,
@@ -395,29 +1123,104 @@ func (request BackendRequest) ToAPIRequest() (*threescale.Request, error) {
 		Extensions: api.Extensions{
 			backend.RejectionReasonHeaderExtension: "1",
 		},
-		Service: api.Service(request.Service),
-		Transactions: []api.Transaction{
-			{
-				Metrics: request.Transactions[0].Metrics,
-				Params: api.Params{
-					AppID:   request.Transactions[0].Params.AppID,
-					AppKey:  request.Transactions[0].Params.AppKey,
-					UserID:  request.Transactions[0].Params.UserID,
-					UserKey: request.Transactions[0].Params.UserKey,
-				},
-			},
+		Service:      api.Service(request.Service),
+		Transactions: []api.Transaction{request.Transactions[0].toAPITransaction()},
+	}, nil
+}
+
+// toAPIReportRequest transforms the BackendRequest into a report request, retaining all transactions
+func (request BackendRequest) toAPIReportRequest() (*threescale.Request, error) {
+	if request.Transactions == nil || len(request.Transactions) < 1 {
+		return nil, fmt.Errorf("cannot process emtpy transaction")
+	}
+
+	transactions := make([]api.Transaction, 0, len(request.Transactions))
+	for _, transaction := range request.Transactions {
+		if err := transaction.validateTimestamp(); err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, transaction.toAPITransaction())
+	}
+
+	return &threescale.Request{
+		Auth: api.ClientAuth{
+			Type:  api.AuthType(request.Auth.Type),
+			Value: request.Auth.Value,
 		},
+		Service:      api.Service(request.Service),
+		Transactions: transactions,
 	}, nil
 }
 
+func (transaction BackendTransaction) toAPITransaction() api.Transaction {
+	return api.Transaction{
+		Metrics: transaction.Metrics,
+		Params: api.Params{
+			AppID:   transaction.Params.AppID,
+			AppKey:  transaction.Params.AppKey,
+			UserID:  transaction.Params.UserID,
+			UserKey: transaction.Params.UserKey,
+		},
+		Timestamp: transaction.Timestamp,
+	}
+}
+
+// missingAppID returns true if the credentials of the request include an app_key but no app_id
+func (request BackendRequest) missingAppID() bool {
+	if len(request.Transactions) < 1 {
+		return false
+	}
+	params := request.Transactions[0].Params
+	return params.AppKey != "" && params.AppID == ""
+}
+
+// noCredentials returns true if the request provides none of an app_id, app_key or user_key
+func (request BackendRequest) noCredentials() bool {
+	if len(request.Transactions) < 1 {
+		return false
+	}
+	params := request.Transactions[0].Params
+	return params.AppID == "" && params.AppKey == "" && params.UserKey == ""
+}
+
+// validateTimestamp ensures a timestamp, if set, is within the window accepted by 3scale backend
+func (transaction BackendTransaction) validateTimestamp() error {
+	if transaction.Timestamp == 0 {
+		return nil
+	}
+
+	ts := time.Unix(transaction.Timestamp, 0)
+	current := time.Now()
+	if ts.Before(current.Add(-MaxTransactionAge)) || ts.After(current.Add(MaxTransactionSkew)) {
+		return fmt.Errorf("transaction timestamp %d is outside of the window accepted by 3scale", transaction.Timestamp)
+	}
+	return nil
+}
+
+// accessToken returns the token that should be used for a request to 3scale system
+func (request SystemRequest) accessToken() (string, error) {
+	if request.AccessTokenSource != nil {
+		return request.AccessTokenSource.Token()
+	}
+	return request.AccessToken, nil
+}
+
 // validateSystemRequest to avoid wasting compute time on invalid request
 func validateSystemRequest(request SystemRequest) error {
-	if request.Environment == "" || request.ServiceID == "" || request.AccessToken == "" {
+	if request.Environment == "" || request.ServiceID == "" || (request.AccessToken == "" && request.AccessTokenSource == nil) {
 		return fmt.Errorf("invalid arguements provided")
 	}
 	return nil
 }
 
-func generateSystemCacheKey(systemURL, svcID string) string {
-	return fmt.Sprintf("%s_%s", systemURL, svcID)
+// isNotFound returns true if the error was caused by 3scale system responding with a 404
+func isNotFound(err error) bool {
+	var apiErr client.ApiErr
+	return errors.As(err, &apiErr) && apiErr.Code() == http.StatusNotFound
+}
+
+// generateSystemCacheKey keys configs by environment so that configs of the same service for different
+// environments, such as when canarying a staging config, are cached separately
+func generateSystemCacheKey(systemURL, svcID, environment string) string {
+	return fmt.Sprintf("%s_%s_%s", systemURL, svcID, environment)
 }
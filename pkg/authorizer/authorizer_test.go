@@ -1,11 +1,18 @@
 package authorizer
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/3scale/3scale-authorizer/pkg/core"
+	"github.com/3scale/3scale-authorizer/pkg/fake"
 	"github.com/3scale/3scale-authorizer/pkg/system/v1/cache"
 	"github.com/3scale/3scale-go-client/threescale"
 	"github.com/3scale/3scale-go-client/threescale/api"
@@ -32,7 +39,7 @@ func TestManager_GetSystemConfiguration(t *testing.T) {
 	const svcID = "any"
 	const env = "test"
 
-	var cacheKey = generateSystemCacheKey(systemURL, svcID)
+	var cacheKey = generateSystemCacheKey(systemURL, svcID, env)
 
 	validRequest := SystemRequest{
 		AccessToken: token,
@@ -235,7 +242,7 @@ func TestManager_CacheRefreshCallback(t *testing.T) {
 	const env = "test"
 
 	m := Manager{}
-	cacheKey := generateSystemCacheKey(systemURL, svcID)
+	cacheKey := generateSystemCacheKey(systemURL, svcID, env)
 
 	sc := SystemCache{ConfigurationCache: cache.NewDefaultConfigCache()}
 	value := cache.Value{
@@ -295,6 +302,197 @@ func TestManager_CacheRefreshCallback(t *testing.T) {
 
 }
 
+func TestManager_StaleGracePeriod(t *testing.T) {
+	const systemURL = "test"
+
+	request := SystemRequest{
+		AccessToken: "any",
+		ServiceID:   "1",
+		Environment: "test",
+	}
+	cacheKey := generateSystemCacheKey(systemURL, request.ServiceID, request.Environment)
+
+	inputs := []struct {
+		name      string
+		expiredBy time.Duration
+		expectErr bool
+	}{
+		{
+			name:      "Test stale config is served within the grace period",
+			expiredBy: time.Minute,
+		},
+		{
+			name:      "Test stale config is not served past the grace period",
+			expiredBy: time.Hour,
+			expectErr: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			systemCache := NewSystemCache(SystemCacheConfig{MaxSize: cache.DefaultCacheLimit, StaleGracePeriod: time.Minute * 10}, nil)
+			stale := &cache.Value{Item: client.ProxyConfig{ID: 1}}
+			stale.SetExpiry(time.Now().Add(-input.expiredBy))
+			systemCache.Set(cacheKey, *stale)
+
+			m := Manager{
+				clientBuilder:   mockBuilder{withSystemClient: mockSystemClient{withErr: true}},
+				systemCache:     systemCache,
+				metricsReporter: &MetricsReporter{},
+			}
+
+			config, err := m.GetSystemConfiguration(systemURL, request)
+			if err != nil {
+				if !input.expectErr {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+
+			if input.expectErr {
+				t.Error("expected an error as system is unavailable and the cached config is past the grace period")
+			}
+			if config.ID != 1 {
+				t.Errorf("expected the stale config to be served, got %v", config)
+			}
+		})
+	}
+}
+
+func TestManager_StaleConfigServedDuringOutage(t *testing.T) {
+	const systemURL = "test"
+
+	request := SystemRequest{
+		AccessToken: "any",
+		ServiceID:   "1",
+		Environment: "test",
+	}
+	cacheKey := generateSystemCacheKey(systemURL, request.ServiceID, request.Environment)
+
+	var staleness, ages []time.Duration
+	m := Manager{
+		clientBuilder: mockBuilder{withSystemClient: mockSystemClient{withErr: true}},
+		systemCache:   NewSystemCache(SystemCacheConfig{MaxSize: cache.DefaultCacheLimit, StaleGracePeriod: time.Hour * 24}, nil),
+		metricsReporter: &MetricsReporter{
+			ConfigStalenessCB: func(service string, s time.Duration) {
+				staleness = append(staleness, s)
+			},
+			ConfigAgeCB: func(service string, age time.Duration) {
+				ages = append(ages, age)
+			},
+		},
+		backendConf: BackendConfig{Logger: &core.NoOpLogger{}},
+	}
+
+	portalDown := true
+	stale := &cache.Value{Item: client.ProxyConfig{ID: 1}}
+	stale.SetExpiry(time.Now().Add(-time.Hour))
+	stale.SetRefreshCallback(func() (client.ProxyConfig, error) {
+		if portalDown {
+			return client.ProxyConfig{}, fmt.Errorf("arbitrary error")
+		}
+		return client.ProxyConfig{ID: 2}, nil
+	})
+	m.systemCache.Set(cacheKey, *stale)
+
+	// the config continues to be served through refreshes failing for the duration of the outage
+	for i := 0; i < 3; i++ {
+		m.systemCache.Refresh()
+		config, err := m.GetSystemConfiguration(systemURL, request)
+		if err != nil || config.ID != 1 {
+			t.Fatalf("expected the last known good config to be served, got %v - %v", config, err)
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	for i := 1; i < len(staleness); i++ {
+		if staleness[i] <= staleness[i-1] || staleness[i-1] < time.Hour {
+			t.Errorf("expected staleness past an hour to climb through the outage, got %v", staleness)
+		}
+		if ages[i] <= ages[i-1] {
+			t.Errorf("expected the config age to climb through the outage, got %v", ages)
+		}
+	}
+	outageAge, ok := m.ConfigAge(systemURL, request.ServiceID, request.Environment)
+	if !ok || outageAge < ages[len(ages)-1] {
+		t.Errorf("expected the config age to be available, got %s", outageAge)
+	}
+
+	// once a refresh succeeds the fresh config is served and is no longer stale
+	portalDown = false
+	m.systemCache.Refresh()
+	config, err := m.GetSystemConfiguration(systemURL, request)
+	if err != nil || config.ID != 2 {
+		t.Fatalf("expected the refreshed config to be served, got %v - %v", config, err)
+	}
+	if last := staleness[len(staleness)-1]; last != 0 {
+		t.Errorf("expected staleness to be reset once the config was refreshed, got %s", last)
+	}
+	if age, _ := m.ConfigAge(systemURL, request.ServiceID, request.Environment); age >= outageAge {
+		t.Errorf("expected the config age to be reset once the config was refreshed, got %s", age)
+	}
+	if _, ok := m.ConfigAge(systemURL, "unknown", request.Environment); ok {
+		t.Error("expected no age for a service which is not cached")
+	}
+}
+
+func TestManager_CacheRefreshCallbackRemovesDeletedService(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	m := Manager{clientBuilder: NewClientBuilder(http.DefaultClient)}
+	request := SystemRequest{
+		AccessToken: "any",
+		ServiceID:   "any",
+		Environment: "test",
+	}
+
+	_, err := m.refreshCallback(ts.URL, request, 1)()
+	if err != cache.ErrRemoveFromCache {
+		t.Errorf("expected a 404 from system to signal removal from the cache, got %v", err)
+	}
+}
+
+func TestManager_RefreshMappingRulesOnly(t *testing.T) {
+	system := fake.NewSystem("access-token")
+	defer system.Close()
+
+	promoted := client.ProxyConfig{ID: 1, Version: 1, Environment: "production"}
+	promoted.Content.Proxy.ProxyRules = []client.ProxyRule{
+		{ID: 1, MetricID: 2, MetricSystemName: "hits", Pattern: "/promoted", HTTPMethod: "GET", Delta: 1},
+	}
+	system.SetConfig("1", "production", promoted)
+
+	systemCache := NewSystemCache(SystemCacheConfig{MaxSize: -1, RefreshMappingRulesOnly: true}, make(chan struct{}))
+	m := NewManager(&http.Client{}, systemCache, BackendConfig{}, nil)
+	defer m.Shutdown()
+
+	request := SystemRequest{AccessToken: "access-token", ServiceID: "1", Environment: "production"}
+	if _, err := m.GetSystemConfiguration(system.URL, request); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// rules changed in the admin portal which have not been promoted to production
+	system.SetMappingRules("1", []client.ProxyRule{
+		{ID: 2, MetricID: 2, MetricSystemName: "hits", Pattern: "/unpromoted", HTTPMethod: "GET", Delta: 1},
+	})
+	systemCache.Refresh()
+
+	config, err := m.GetSystemConfiguration(system.URL, request)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(config.Content.Proxy.ProxyRules, promoted.Content.Proxy.ProxyRules) {
+		t.Errorf("expected the rules promoted to production to be kept, got %v", config.Content.Proxy.ProxyRules)
+	}
+	for _, r := range system.Requests() {
+		if strings.HasSuffix(r.Path, "/mapping_rules.json") {
+			t.Errorf("expected the rules of the admin portal not to be fetched, got a request to %s", r.Path)
+		}
+	}
+}
+
 func TestManager_AuthRep(t *testing.T) {
 	inputs := []struct {
 		name             string
@@ -436,6 +634,687 @@ func TestManager_AuthRep(t *testing.T) {
 	}
 }
 
+func TestManager_Authorize(t *testing.T) {
+	var authorizations, authReps []threescale.Request
+	m := Manager{
+		clientBuilder: mockBuilder{
+			withBackendClient: mockBackendClient{
+				withAuthResponse: &threescale.AuthorizeResult{Authorized: true},
+				authorizations:   &authorizations,
+				authReps:         &authReps,
+			},
+		},
+		// authorize only requests must not be denied for carrying no usage
+		backendConf: BackendConfig{NoMatch: NoMatchConfig{Behaviour: NoMatchDeny}},
+	}
+
+	request := BackendRequest{
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{Params: BackendParams{UserKey: "any"}},
+		},
+	}
+
+	resp, err := m.Authorize("any", request)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !resp.Authorized {
+		t.Error("expected request to be authorized")
+	}
+
+	if len(authReps) != 0 {
+		t.Errorf("expected no calls to AuthRep, got %d", len(authReps))
+	}
+	if len(authorizations) != 1 {
+		t.Fatalf("expected a single call to Authorize, got %d", len(authorizations))
+	}
+	if usage := authorizations[0].Transactions[0].Metrics; len(usage) != 0 {
+		t.Errorf("expected no usage to be sent with an authorize only request, got %v", usage)
+	}
+
+	m.clientBuilder = mockBuilder{withBackendClient: mockBackendClient{withAuthRepErr: true}}
+	if _, err := m.Authorize("any", request); err == nil {
+		t.Error("expected an error when the call to 3scale fails")
+	}
+}
+
+func TestManager_Report(t *testing.T) {
+	hourAgo := time.Now().Add(-time.Hour).Unix()
+
+	var reports []threescale.Request
+	m := Manager{
+		clientBuilder: mockBuilder{
+			withBackendClient: mockBackendClient{reports: &reports},
+		},
+	}
+
+	request := BackendRequest{
+		Auth:    BackendAuth{Type: "any", Value: "any"},
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{
+				Metrics:   map[string]int{"hits": 1},
+				Params:    BackendParams{UserKey: "a"},
+				Timestamp: hourAgo,
+			},
+			{
+				Metrics: map[string]int{"hits": 2},
+				Params:  BackendParams{UserKey: "b"},
+			},
+		},
+	}
+
+	if err := m.Report("any", request); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(reports) != 1 || len(reports[0].Transactions) != 2 {
+		t.Fatalf("expected a single report with both transactions, got %v", reports)
+	}
+	if reports[0].Transactions[0].Timestamp != hourAgo {
+		t.Error("expected timestamp to be forwarded to 3scale")
+	}
+	if reports[0].Transactions[1].Timestamp != 0 {
+		t.Error("expected unset timestamp to be left for 3scale to decide")
+	}
+
+	request.Transactions[1].Timestamp = time.Now().Add(-MaxTransactionAge * 2).Unix()
+	if err := m.Report("any", request); err == nil {
+		t.Error("expected error for timestamp outside of the accepted window")
+	}
+	if len(reports) != 1 {
+		t.Error("expected request with invalid timestamp not to have been reported")
+	}
+
+	m.clientBuilder = mockBuilder{withBackendClient: mockBackendClient{withReportErr: true}}
+	request.Transactions = request.Transactions[:1]
+	if err := m.Report("any", request); err == nil {
+		t.Error("expected error when the client fails to report")
+	}
+}
+
+func TestManager_LogsCachedBackendFailure(t *testing.T) {
+	logger := &recordingLogger{}
+	m := Manager{
+		clientBuilder: mockBuilder{
+			withBackendClient: mockBackendClient{withAuthResponse: &threescale.AuthorizeResult{Authorized: true}},
+		},
+		backendConf:    BackendConfig{EnableCaching: true, Logger: logger},
+		cachedBackends: make(map[string]cachedBackend),
+	}
+
+	request := BackendRequest{
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: "any"}},
+		},
+	}
+
+	// an invalid backend url cannot be cached so the request should be made directly
+	resp, err := m.AuthRep("invalid", request)
+	if err != nil || !resp.Authorized {
+		t.Fatalf("expected request to fall back to passthrough mode, got %v", err)
+	}
+
+	if len(logger.errors) != 1 || !strings.Contains(logger.errors[0], "unable to create cached backend for invalid") {
+		t.Errorf("expected failure to create cached backend to be logged, got %v", logger.errors)
+	}
+}
+
+func TestManager_ThrottlesRequestPathLogs(t *testing.T) {
+	logger := &recordingLogger{}
+	m := Manager{
+		clientBuilder: mockBuilder{
+			withBackendClient: mockBackendClient{withAuthResponse: &threescale.AuthorizeResult{Authorized: true}},
+		},
+		backendConf:    BackendConfig{EnableCaching: true, Logger: logger},
+		cachedBackends: make(map[string]cachedBackend),
+		logThrottle:    core.NewLogThrottle(logger, 1, time.Hour),
+	}
+
+	request := BackendRequest{
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: "any"}},
+		},
+	}
+	for i := 0; i < 10; i++ {
+		m.AuthRep("invalid", request)
+	}
+
+	if len(logger.errors) != 1 {
+		t.Errorf("expected repeated failures for the same backend to be throttled, got %d lines", len(logger.errors))
+	}
+}
+
+func TestNewManager_DefaultLogger(t *testing.T) {
+	m := NewManager(http.DefaultClient, nil, BackendConfig{}, nil)
+	if m.backendConf.Logger == nil {
+		t.Error("expected a default logger to be set")
+	}
+}
+
+func TestManager_MissingAppID(t *testing.T) {
+	inputs := []struct {
+		name         string
+		allow        bool
+		params       BackendParams
+		expectErr    error
+		expectCalled bool
+	}{
+		{
+			name:      "Test app_key without app_id is rejected before calling 3scale",
+			params:    BackendParams{AppKey: "key"},
+			expectErr: ErrMissingAppID,
+		},
+		{
+			name:         "Test app_key without app_id is passed to 3scale when allowed",
+			allow:        true,
+			params:       BackendParams{AppKey: "key"},
+			expectCalled: true,
+		},
+		{
+			name:         "Test app_key with app_id is passed to 3scale",
+			params:       BackendParams{AppID: "app", AppKey: "key"},
+			expectCalled: true,
+		},
+		{
+			name:         "Test user_key is passed to 3scale",
+			params:       BackendParams{UserKey: "key"},
+			expectCalled: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var authReps []threescale.Request
+			m := Manager{
+				clientBuilder: mockBuilder{
+					withBackendClient: mockBackendClient{
+						withAuthResponse: &threescale.AuthorizeResult{Authorized: true},
+						authReps:         &authReps,
+					},
+				},
+				backendConf: BackendConfig{AllowAppKeyWithoutAppID: input.allow},
+			}
+
+			_, err := m.AuthRep("any", BackendRequest{
+				Service: "svc",
+				Transactions: []BackendTransaction{
+					{Metrics: map[string]int{"hits": 1}, Params: input.params},
+				},
+			})
+			if !errors.Is(err, input.expectErr) {
+				t.Errorf("expected error %v, got %v", input.expectErr, err)
+			}
+			if called := len(authReps) == 1; called != input.expectCalled {
+				t.Errorf("expected 3scale to have been called %t", input.expectCalled)
+			}
+		})
+	}
+}
+
+func TestManager_NoCredentials(t *testing.T) {
+	inputs := []struct {
+		name         string
+		allow        bool
+		params       BackendParams
+		expectErr    error
+		expectCalled bool
+	}{
+		{
+			name:      "Test empty credentials are rejected before calling 3scale",
+			expectErr: ErrNoCredentials,
+		},
+		{
+			name:      "Test user_id alone is rejected before calling 3scale",
+			params:    BackendParams{UserID: "user"},
+			expectErr: ErrNoCredentials,
+		},
+		{
+			name:         "Test empty credentials are passed to 3scale when allowed",
+			allow:        true,
+			expectCalled: true,
+		},
+		{
+			name:         "Test app_id is passed to 3scale",
+			params:       BackendParams{AppID: "app"},
+			expectCalled: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var authReps []threescale.Request
+			m := Manager{
+				clientBuilder: mockBuilder{
+					withBackendClient: mockBackendClient{
+						withAuthResponse: &threescale.AuthorizeResult{Authorized: true},
+						authReps:         &authReps,
+					},
+				},
+				backendConf: BackendConfig{AllowEmptyCredentials: input.allow},
+			}
+
+			_, err := m.AuthRep("any", BackendRequest{
+				Service: "svc",
+				Transactions: []BackendTransaction{
+					{Metrics: map[string]int{"hits": 1}, Params: input.params},
+				},
+			})
+			if !errors.Is(err, input.expectErr) {
+				t.Errorf("expected error %v, got %v", input.expectErr, err)
+			}
+			if called := len(authReps) == 1; called != input.expectCalled {
+				t.Errorf("expected 3scale to have been called %t", input.expectCalled)
+			}
+		})
+	}
+}
+
+func TestManager_CachedBackend(t *testing.T) {
+	const maxHits = 25
+
+	// the fake backend tracks usage reported by this and other instances of the authorizer
+	var mu sync.Mutex
+	var authorizations, reported, external int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.URL.Path {
+		case "/transactions/authorize.xml":
+			authorizations++
+			start := time.Now().UTC().Truncate(time.Hour)
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><status><authorized>true</authorized><plan>Basic</plan>
+<usage_reports><usage_report metric="hits" period="hour"><period_start>%s</period_start><period_end>%s</period_end>
+<max_value>%d</max_value><current_value>%d</current_value></usage_report></usage_reports></status>`,
+				start.Format("2006-01-02 15:04:05 -0700"), start.Add(time.Hour).Format("2006-01-02 15:04:05 -0700"),
+				maxHits, reported+external)
+		case "/transactions.xml":
+			r.ParseForm()
+			for key, values := range r.Form {
+				if strings.HasSuffix(key, "[usage][hits]") {
+					var hits int
+					fmt.Sscan(values[0], &hits)
+					reported += hits
+				}
+			}
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	var cacheReports []BackendCacheReport
+	reporter := &MetricsReporter{BackendCacheCB: func(report BackendCacheReport) {
+		cacheReports = append(cacheReports, report)
+	}}
+	m := NewManager(&http.Client{}, nil, BackendConfig{EnableCaching: true, CacheFlushInterval: time.Hour}, reporter)
+	defer close(m.stopFlush)
+
+	request := BackendRequest{
+		Service: "svc",
+		Transactions: []BackendTransaction{
+			{Metrics: map[string]int{"hits": 1}, Params: BackendParams{AppID: "app"}},
+		},
+	}
+
+	for i := 0; i < 20; i++ {
+		resp, err := m.AuthRep(ts.URL, request)
+		if err != nil || !resp.Authorized {
+			t.Fatalf("expected request %d to be authorized, got %v", i, err)
+		}
+	}
+
+	mu.Lock()
+	if authorizations != 1 || reported != 0 {
+		t.Errorf("expected a single call to backend and usage to accumulate locally, got %d calls and %d reported",
+			authorizations, reported)
+	}
+	// another instance reports usage in the meantime, taking the application over its limit
+	external = 10
+	mu.Unlock()
+
+	m.cachedBackends[ts.URL].backend.Flush()
+
+	mu.Lock()
+	if reported != 20 {
+		t.Errorf("expected usage to be reported on flush, got %d", reported)
+	}
+	mu.Unlock()
+
+	resp, err := m.AuthRep(ts.URL, request)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if resp.Authorized || resp.ErrorCode != "limits_exceeded" {
+		t.Error("expected the refreshed state to deny the request once limits have been exceeded")
+	}
+
+	if len(cacheReports) != 1 {
+		t.Fatalf("expected the cache state to be reported after the flush, got %d reports", len(cacheReports))
+	}
+	if report := cacheReports[0]; report.Backend != ts.URL || report.Entries != 1 || report.HitRatio != 0.95 {
+		t.Errorf("unexpected cache report %+v", report)
+	}
+}
+
+func TestManager_AuthRepWithFakes(t *testing.T) {
+	portal := fake.NewSystem("access-token")
+	defer portal.Close()
+	config := client.ProxyConfig{ID: 1, Version: 1, Environment: "production"}
+	config.Content.BackendAuthenticationValue = "token"
+	portal.SetConfig("1", "production", config)
+
+	backend := fake.NewBackend()
+	defer backend.Close()
+	backend.AddService("1", "token", map[string][]string{"hits": {"orders"}})
+	backend.AddApplication("1", fake.Application{
+		UserKey: "key",
+		Limits:  []fake.Limit{{Metric: "hits", Period: "minute", Max: 3}},
+	})
+
+	m := NewManager(&http.Client{}, nil, BackendConfig{EnableCaching: true, CacheFlushInterval: time.Millisecond * 10}, nil)
+	defer close(m.stopFlush)
+
+	proxyConfig, err := m.GetSystemConfiguration(portal.URL, SystemRequest{AccessToken: "access-token", ServiceID: "1", Environment: "production"})
+	if err != nil {
+		t.Fatalf("unexpected error fetching config %v", err)
+	}
+	request := BackendRequest{
+		Auth:    BackendAuth{Type: "service_token", Value: proxyConfig.Content.BackendAuthenticationValue},
+		Service: "1",
+		Transactions: []BackendTransaction{
+			{Metrics: map[string]int{"orders": 1}, Params: BackendParams{UserKey: "key"}},
+		},
+	}
+
+	var authorized int
+	for i := 0; i < 5; i++ {
+		res, err := m.AuthRep(backend.URL, request)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if res.Authorized {
+			authorized++
+		}
+	}
+	if authorized != 3 {
+		t.Errorf("expected requests to be authorized up to the limit from the cache, got %d", authorized)
+	}
+
+	// usage is reported to 3scale, including the parent metric, once the cache is flushed
+	deadline := time.Now().Add(time.Second * 5)
+	for backend.Usage("1", "key", "orders") != 3 || backend.Usage("1", "key", "hits") != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the cached usage to be flushed, got %d orders and %d hits",
+				backend.Usage("1", "key", "orders"), backend.Usage("1", "key", "hits"))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestManager_CachedDecisionSource(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/transactions.xml" {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><status><authorized>true</authorized><plan>Basic</plan></status>`))
+	}))
+	defer ts.Close()
+
+	var decisions []DecisionReport
+	reporter := &MetricsReporter{DecisionCB: func(report DecisionReport) {
+		decisions = append(decisions, report)
+	}}
+	m := NewManager(&http.Client{}, nil, BackendConfig{EnableCaching: true, CacheFlushInterval: time.Hour}, reporter)
+	defer close(m.stopFlush)
+
+	request := BackendRequest{
+		Service: "svc",
+		Transactions: []BackendTransaction{
+			{Metrics: map[string]int{"hits": 1}, Params: BackendParams{AppID: "app"}},
+		},
+	}
+
+	first, err := m.AuthRep(ts.URL, request)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if first.FromCache || first.CacheAge != 0 {
+		t.Error("expected the first decision to be made from state fetched from 3scale")
+	}
+
+	time.Sleep(time.Millisecond * 10)
+	second, err := m.AuthRep(ts.URL, request)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !second.FromCache || second.CacheAge < time.Millisecond*10 {
+		t.Errorf("expected the second decision to be served from cache, got %+v", second)
+	}
+
+	// flushing learns the state from 3scale again
+	m.cachedBackends[ts.URL].backend.Flush()
+	third, _ := m.AuthRep(ts.URL, request)
+	if !third.FromCache || third.CacheAge >= second.CacheAge {
+		t.Errorf("expected the cache age to be reset by the flush, got %v", third.CacheAge)
+	}
+
+	if len(decisions) != 3 || decisions[0].FromCache || !decisions[1].FromCache {
+		t.Errorf("expected the source of decisions to be reported, got %+v", decisions)
+	}
+	if resp, _ := m.Authorize(ts.URL, request); !resp.FromCache {
+		t.Error("expected authorizations to be served from cache")
+	}
+}
+
+func TestNewManager_Timeouts(t *testing.T) {
+	m := NewManager(&http.Client{}, nil, BackendConfig{}, nil)
+	builder := m.clientBuilder.(ClientBuilder)
+	if builder.systemClient().Timeout != DefaultSystemTimeout || builder.backendClient().Timeout != DefaultBackendTimeout {
+		t.Error("expected default timeouts to be applied")
+	}
+
+	m = NewManager(&http.Client{Timeout: time.Minute}, nil, BackendConfig{}, nil)
+	builder = m.clientBuilder.(ClientBuilder)
+	if builder.systemClient().Timeout != time.Minute || builder.backendClient().Timeout != time.Minute {
+		t.Error("expected the timeout of the provided client to be respected")
+	}
+
+	// a slow server is within the system timeout but exceeds the backend timeout
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond * 200)
+		if strings.HasPrefix(r.URL.Path, "/transactions") {
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><status><authorized>true</authorized></status>`))
+			return
+		}
+		w.Write([]byte(`{"proxy_config":{"id":1,"version":1,"environment":"production","content":{"id":1}}}`))
+	}))
+	defer ts.Close()
+
+	request := BackendRequest{
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: "any"}},
+		},
+	}
+	systemRequest := SystemRequest{AccessToken: "any", ServiceID: "1", Environment: "production"}
+
+	m = NewManager(&http.Client{}, nil, BackendConfig{}, nil,
+		WithTimeouts(TimeoutConfig{System: time.Second * 5, Backend: time.Millisecond * 50}))
+	if _, err := m.GetSystemConfiguration(ts.URL, systemRequest); err != nil {
+		t.Errorf("expected system call to be within its timeout, got %v", err)
+	}
+	_, err := m.Authorize(ts.URL, request)
+	if !errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("expected backend timeout to be reported as unavailable, got %v", err)
+	}
+	if err := m.Report(ts.URL, request); !errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("expected report timeout to be reported as unavailable, got %v", err)
+	}
+
+	m = NewManager(&http.Client{Timeout: time.Minute}, nil, BackendConfig{}, nil,
+		WithTimeouts(TimeoutConfig{System: time.Millisecond * 50, Backend: time.Second * 5}))
+	if _, err := m.GetSystemConfiguration(ts.URL, systemRequest); err == nil {
+		t.Error("expected system call to exceed its timeout")
+	}
+	if resp, err := m.Authorize(ts.URL, request); err != nil || !resp.Authorized {
+		t.Errorf("expected backend call to be within its timeout, got %v", err)
+	}
+}
+
+func TestManager_BackendClientBuiltOnce(t *testing.T) {
+	var builds int
+	m := Manager{
+		clientBuilder: mockBuilder{
+			withBackendClient: mockBackendClient{withAuthResponse: &threescale.AuthorizeResult{Authorized: true}},
+			backendBuilds:     &builds,
+		},
+		backendClients: &sync.Map{},
+	}
+
+	request := BackendRequest{
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: "any"}},
+		},
+	}
+
+	config := client.ProxyConfig{}
+	config.Content.Proxy.Backend.Endpoint = "https://backend"
+	if _, err := m.prepareConfig(config); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := m.AuthRep("https://backend", request); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if builds != 1 {
+		t.Errorf("expected client for the endpoint of a cached config to be built once, got %d", builds)
+	}
+
+	// clients for other backends are not stored, so the stored clients do not grow with the URLs requested
+	for i := 0; i < 2; i++ {
+		if _, err := m.AuthRep("https://other-backend", request); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if builds != 3 {
+		t.Errorf("expected a new client for each call to another backend, got %d builds", builds)
+	}
+	if _, stored := m.backendClients.Load("https://other-backend"); stored {
+		t.Error("expected the client for another backend not to be stored")
+	}
+}
+
+func TestManager_InvalidBackendEndpoint(t *testing.T) {
+	config := client.ProxyConfig{ID: 1, Version: 1, Environment: "production"}
+	config.Content.ID = 1
+	config.Content.Proxy.Backend.Endpoint = "ftp://backend"
+	system := fake.NewSystem("access-token")
+	defer system.Close()
+	system.SetConfig("1", "production", config)
+
+	m := NewManager(&http.Client{}, NewSystemCache(SystemCacheConfig{MaxSize: -1}, make(chan struct{})), BackendConfig{}, nil)
+	defer m.Shutdown()
+
+	request := SystemRequest{AccessToken: "access-token", ServiceID: "1", Environment: "production"}
+	for i := 0; i < 2; i++ {
+		if _, err := m.GetSystemConfiguration(system.URL, request); err == nil {
+			t.Fatal("expected a config with an invalid backend endpoint to be rejected")
+		}
+	}
+	if _, found := m.systemCache.Get(generateSystemCacheKey(system.URL, "1", "production")); found {
+		t.Error("expected a config with an invalid backend endpoint not to be cached")
+	}
+	if calls := len(system.Requests()); calls != 2 {
+		t.Errorf("expected the rejected config to be fetched again, got %d fetches", calls)
+	}
+}
+
+func BenchmarkManager_BackendClient(b *testing.B) {
+	const backendURL = "https://su1.3scale.net:443"
+	builder := NewClientBuilder(http.DefaultClient)
+
+	b.Run("Rebuild", func(b *testing.B) {
+		m := Manager{clientBuilder: builder}
+		for i := 0; i < b.N; i++ {
+			m.backendClient(backendURL)
+		}
+	})
+
+	b.Run("Stored", func(b *testing.B) {
+		m := Manager{clientBuilder: builder, backendClients: &sync.Map{}}
+		m.registerBackendClient(backendURL)
+		for i := 0; i < b.N; i++ {
+			m.backendClient(backendURL)
+		}
+	})
+}
+
+func BenchmarkManager_AuthRep(b *testing.B) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><status><authorized>true</authorized><plan>Basic</plan></status>`))
+	}))
+	defer ts.Close()
+
+	request := BackendRequest{
+		Auth:    BackendAuth{Type: "service_token", Value: "any"},
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{Metrics: map[string]int{"hits": 1, "orders": 2}, Params: BackendParams{UserKey: "any"}},
+		},
+	}
+
+	b.Run("Passthrough", func(b *testing.B) {
+		m := NewManager(&http.Client{}, nil, BackendConfig{}, nil)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := m.AuthRep(ts.URL, request); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Cached", func(b *testing.B) {
+		m := NewManager(&http.Client{}, nil, BackendConfig{EnableCaching: true, CacheFlushInterval: time.Hour}, nil)
+		defer close(m.stopFlush)
+		// populate the cache so the benchmark measures only the local decision
+		if _, err := m.AuthRep(ts.URL, request); err != nil {
+			b.Fatal(err)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := m.AuthRep(ts.URL, request); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestManager_Shutdown(t *testing.T) {
+	// a manager without a system cache
+	NewManager(&http.Client{}, nil, BackendConfig{}, nil).Shutdown()
+
+	// managers sharing a system cache
+	systemCache := NewSystemCache(SystemCacheConfig{}, make(chan struct{}))
+	first := NewManager(&http.Client{}, systemCache, BackendConfig{}, nil)
+	second := NewManager(&http.Client{}, systemCache, BackendConfig{}, nil)
+	first.Shutdown()
+	second.Shutdown()
+
+	if !systemCache.isStopped() {
+		t.Error("expected the shared system cache to be stopped")
+	}
+}
+
 func TestBackendRequest_ToAPIRequest(t *testing.T) {
 	badRequestWithNilTransaction := BackendRequest{
 		Auth: BackendAuth{
@@ -513,12 +1392,48 @@ func TestBackendRequest_ToAPIRequest(t *testing.T) {
 	if !reflect.DeepEqual(expect, apiReq) {
 		t.Errorf("expected pointer values to be deeply equal")
 	}
+
+	validRequest.Transactions[0].Timestamp = time.Now().Unix()
+	apiReq, err = validRequest.ToAPIRequest()
+	if err != nil {
+		t.Errorf("unexpected error when transforming request with timestamp")
+	}
+	if apiReq.Transactions[0].Timestamp != validRequest.Transactions[0].Timestamp {
+		t.Errorf("expected timestamp to be forwarded")
+	}
+
+	validRequest.Transactions[0].Timestamp = time.Now().Add(MaxTransactionSkew * 2).Unix()
+	if _, err = validRequest.ToAPIRequest(); err == nil {
+		t.Errorf("expected an error due to timestamp in the future")
+	}
+}
+
+type recordingLogger struct {
+	infos, warnings, errors, debugs []string
+}
+
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.infos = append(l.infos, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Warnf(format string, args ...interface{}) {
+	l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.errors = append(l.errors, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.debugs = append(l.debugs, fmt.Sprintf(format, args...))
 }
 
 type mockBuilder struct {
 	withBuildSystemClientErr bool
 	withSystemClient         mockSystemClient
 	withBackendClient        mockBackendClient
+	// backendBuilds counts the calls to BuildBackendClient if non-nil
+	backendBuilds *int
 }
 
 func (m mockBuilder) BuildSystemClient(systemURL, accessToken string) (SystemClient, error) {
@@ -529,6 +1444,9 @@ func (m mockBuilder) BuildSystemClient(systemURL, accessToken string) (SystemCli
 }
 
 func (m mockBuilder) BuildBackendClient(backendURL string) (threescale.Client, error) {
+	if m.backendBuilds != nil {
+		*m.backendBuilds++
+	}
 	return m.withBackendClient, nil
 }
 
@@ -552,10 +1470,23 @@ func (m mockSystemClient) GetLatestProxyConfig(serviceID, environment string) (c
 type mockBackendClient struct {
 	withAuthRepErr   bool
 	withAuthResponse *threescale.AuthorizeResult
+	withReportErr    bool
+	// reports records the requests passed to Report if non-nil
+	reports *[]threescale.Request
+	// authReps records the requests passed to AuthRep if non-nil
+	authReps *[]threescale.Request
+	// authorizations records the requests passed to Authorize if non-nil
+	authorizations *[]threescale.Request
 }
 
 func (mbc mockBackendClient) Authorize(request threescale.Request) (*threescale.AuthorizeResult, error) {
-	panic("implement me")
+	if mbc.authorizations != nil {
+		*mbc.authorizations = append(*mbc.authorizations, request)
+	}
+	if mbc.withAuthRepErr {
+		return nil, fmt.Errorf("arbitrary error")
+	}
+	return mbc.withAuthResponse, nil
 }
 
 func (mbc mockBackendClient) OauthAuthorize(request threescale.Request) (*threescale.AuthorizeResult, error) {
@@ -563,6 +1494,9 @@ func (mbc mockBackendClient) OauthAuthorize(request threescale.Request) (*threes
 }
 
 func (mbc mockBackendClient) AuthRep(request threescale.Request) (*threescale.AuthorizeResult, error) {
+	if mbc.authReps != nil {
+		*mbc.authReps = append(*mbc.authReps, request)
+	}
 	if mbc.withAuthRepErr {
 		return nil, fmt.Errorf("arbitrary error")
 	}
@@ -573,8 +1507,14 @@ func (mbc mockBackendClient) OauthAuthRep(request threescale.Request) (*threesca
 	return mbc.AuthRep(request)
 }
 
-func (mockBackendClient) Report(request threescale.Request) (*threescale.ReportResult, error) {
-	panic("implement me")
+func (mbc mockBackendClient) Report(request threescale.Request) (*threescale.ReportResult, error) {
+	if mbc.withReportErr {
+		return nil, fmt.Errorf("arbitrary error")
+	}
+	if mbc.reports != nil {
+		*mbc.reports = append(*mbc.reports, request)
+	}
+	return &threescale.ReportResult{Accepted: true}, nil
 }
 
 func (mockBackendClient) GetPeer() string {
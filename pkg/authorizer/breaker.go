@@ -0,0 +1,253 @@
+package authorizer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBreakerFailureRate is the default fraction of failed calls within a window which opens a breaker
+	DefaultBreakerFailureRate = 0.5
+	// DefaultBreakerMinRequests is the default number of calls within a window required before a breaker can open
+	DefaultBreakerMinRequests = 20
+	// DefaultBreakerWindow is the default period over which calls are counted
+	DefaultBreakerWindow = time.Second * 10
+	// DefaultBreakerOpenDuration is the default period calls fail fast for before a probe is allowed
+	DefaultBreakerOpenDuration = time.Second * 30
+)
+
+// ErrCircuitOpen is returned, wrapped, for calls which are rejected without being sent because the breaker
+// for the target host is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// BreakerState is the state of the circuit breaker for a single host
+type BreakerState int
+
+const (
+	// BreakerClosed allows all calls
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects all calls until the open duration has passed
+	BreakerOpen
+	// BreakerHalfOpen allows a single probe call, the result of which closes or reopens the breaker
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// BreakerConfig configures a circuit breaker per target host
+// Zero values are replaced with the defaults above
+type BreakerConfig struct {
+	// FailureRate is the fraction of failed calls within a Window at which the breaker opens
+	// A call fails if no response is received or the response has a 5xx status
+	FailureRate float64
+	// MinRequests is the number of calls within a Window required before the breaker can open
+	MinRequests int
+	Window      time.Duration
+	// OpenDuration is the period calls fail fast for before a single probe call is allowed through
+	OpenDuration time.Duration
+}
+
+// BreakerStateHook is called each time the breaker for a host changes state
+type BreakerStateHook func(host string, state BreakerState)
+
+// breakerRoundTripper fails calls fast while the breaker for the target host is open
+type breakerRoundTripper struct {
+	proxied http.RoundTripper
+	config  BreakerConfig
+	// onStateChange, if set, is called outside of the lock after each state transition
+	onStateChange func(host string, from, to BreakerState)
+	now           func() time.Time
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+type breaker struct {
+	state       BreakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probing     bool
+}
+
+// circuitOpenError reports itself as a temporary network error so the failure policy of a cached backend applies
+type circuitOpenError struct {
+	host string
+}
+
+func (e circuitOpenError) Error() string     { return fmt.Sprintf("%s for %s", ErrCircuitOpen, e.host) }
+func (e circuitOpenError) Is(err error) bool { return err == ErrCircuitOpen }
+func (e circuitOpenError) Temporary() bool   { return true }
+func (e circuitOpenError) Timeout() bool     { return false }
+
+func newBreakerRoundTripper(proxied http.RoundTripper, config BreakerConfig) *breakerRoundTripper {
+	if config.FailureRate <= 0 || config.FailureRate > 1 {
+		config.FailureRate = DefaultBreakerFailureRate
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = DefaultBreakerMinRequests
+	}
+	if config.Window <= 0 {
+		config.Window = DefaultBreakerWindow
+	}
+	if config.OpenDuration <= 0 {
+		config.OpenDuration = DefaultBreakerOpenDuration
+	}
+
+	return &breakerRoundTripper{
+		proxied:  proxied,
+		config:   config,
+		now:      time.Now,
+		breakers: make(map[string]*breaker),
+	}
+}
+
+func (b *breakerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if !b.allow(host) {
+		return nil, circuitOpenError{host: host}
+	}
+
+	proxied := b.proxied
+	if proxied == nil {
+		proxied = http.DefaultTransport
+	}
+
+	resp, err := proxied.RoundTrip(req)
+	// a call abandoned by the caller says nothing about the health of the host
+	if err != nil && errors.Is(err, context.Canceled) {
+		b.release(host)
+		return resp, err
+	}
+	b.record(host, err != nil || resp.StatusCode >= http.StatusInternalServerError)
+	return resp, err
+}
+
+// state returns the current state of the breaker for the provided host
+func (b *breakerRoundTripper) state(host string) BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if br, ok := b.breakers[host]; ok {
+		return br.state
+	}
+	return BreakerClosed
+}
+
+// allow reports whether a call to the host should be sent, moving an open breaker to half-open once
+// the open duration has passed
+func (b *breakerRoundTripper) allow(host string) bool {
+	b.mu.Lock()
+	br := b.breaker(host)
+	now := b.now()
+
+	var allowed, probe bool
+	switch br.state {
+	case BreakerClosed:
+		if now.Sub(br.windowStart) >= b.config.Window {
+			br.reset(now)
+		}
+		allowed = true
+	case BreakerOpen:
+		if now.Sub(br.openedAt) >= b.config.OpenDuration {
+			br.state = BreakerHalfOpen
+			br.probing = true
+			allowed, probe = true, true
+		}
+	case BreakerHalfOpen:
+		if !br.probing {
+			br.probing = true
+			allowed = true
+		}
+	}
+	b.mu.Unlock()
+
+	if probe {
+		b.notify(host, BreakerOpen, BreakerHalfOpen)
+	}
+	return allowed
+}
+
+// record the result of a call which was allowed through
+func (b *breakerRoundTripper) record(host string, failed bool) {
+	b.mu.Lock()
+	br := b.breaker(host)
+	now := b.now()
+	from := br.state
+
+	switch br.state {
+	case BreakerClosed:
+		br.requests++
+		if failed {
+			br.failures++
+		}
+		if br.requests >= b.config.MinRequests &&
+			float64(br.failures)/float64(br.requests) >= b.config.FailureRate {
+			br.open(now)
+		}
+	case BreakerHalfOpen:
+		br.probing = false
+		if failed {
+			br.open(now)
+		} else {
+			br.state = BreakerClosed
+			br.reset(now)
+		}
+	}
+	to := br.state
+	b.mu.Unlock()
+
+	if from != to {
+		b.notify(host, from, to)
+	}
+}
+
+// release allows another probe when a half-open probe was abandoned without a result
+func (b *breakerRoundTripper) release(host string) {
+	b.mu.Lock()
+	if br := b.breaker(host); br.state == BreakerHalfOpen {
+		br.probing = false
+	}
+	b.mu.Unlock()
+}
+
+// breaker returns the breaker for the host, creating it if required. Must be called with the lock held
+func (b *breakerRoundTripper) breaker(host string) *breaker {
+	br, ok := b.breakers[host]
+	if !ok {
+		br = &breaker{windowStart: b.now()}
+		b.breakers[host] = br
+	}
+	return br
+}
+
+func (b *breakerRoundTripper) notify(host string, from, to BreakerState) {
+	if b.onStateChange != nil {
+		b.onStateChange(host, from, to)
+	}
+}
+
+func (br *breaker) open(now time.Time) {
+	br.state = BreakerOpen
+	br.openedAt = now
+}
+
+func (br *breaker) reset(now time.Time) {
+	br.windowStart = now
+	br.requests = 0
+	br.failures = 0
+}
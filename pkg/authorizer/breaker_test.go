@@ -0,0 +1,226 @@
+package authorizer
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBreakerRoundTripper(t *testing.T) {
+	// the fake upstream responds with each scripted status code in turn
+	var mu sync.Mutex
+	var script []int
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		code := http.StatusOK
+		if len(script) > 0 {
+			code, script = script[0], script[1:]
+		}
+		w.WriteHeader(code)
+	}))
+	defer ts.Close()
+	host := strings.TrimPrefix(ts.URL, "http://")
+
+	clock := time.Unix(0, 0)
+	var transitions []string
+	breaker := newBreakerRoundTripper(http.DefaultTransport, BreakerConfig{
+		FailureRate:  0.5,
+		MinRequests:  4,
+		Window:       time.Minute,
+		OpenDuration: time.Second * 30,
+	})
+	breaker.now = func() time.Time { return clock }
+	breaker.onStateChange = func(h string, from, to BreakerState) {
+		if h != host {
+			t.Errorf("unexpected host %s", h)
+		}
+		transitions = append(transitions, from.String()+"->"+to.String())
+	}
+	client := &http.Client{Transport: breaker}
+
+	call := func() error {
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	expectState := func(state BreakerState) {
+		t.Helper()
+		if got := breaker.state(host); got != state {
+			t.Fatalf("expected breaker to be %s, got %s", state, got)
+		}
+	}
+
+	// a failure rate below the threshold leaves the breaker closed
+	script = []int{http.StatusOK, http.StatusInternalServerError, http.StatusOK, http.StatusOK}
+	for i := 0; i < 4; i++ {
+		if err := call(); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	expectState(BreakerClosed)
+
+	// client errors are not failures of the host
+	clock = clock.Add(time.Minute)
+	script = []int{http.StatusForbidden, http.StatusForbidden, http.StatusForbidden, http.StatusForbidden}
+	for i := 0; i < 4; i++ {
+		call()
+	}
+	expectState(BreakerClosed)
+
+	clock = clock.Add(time.Minute)
+	script = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK, http.StatusInternalServerError}
+	for i := 0; i < 4; i++ {
+		call()
+	}
+	expectState(BreakerOpen)
+
+	before := calls
+	err := call()
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected call to fail fast while open, got %v", err)
+	}
+	if calls != before {
+		t.Error("expected no call to reach the upstream while open")
+	}
+
+	// a failed probe reopens the breaker
+	clock = clock.Add(time.Second * 30)
+	script = []int{http.StatusInternalServerError}
+	call()
+	expectState(BreakerOpen)
+	if err := call(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected breaker to have reopened, got %v", err)
+	}
+
+	// a successful probe closes the breaker
+	clock = clock.Add(time.Second * 30)
+	if err := call(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expectState(BreakerClosed)
+	if err := call(); err != nil {
+		t.Fatalf("expected calls to be allowed once closed, got %v", err)
+	}
+
+	expect := []string{
+		"closed->open",
+		"open->half_open",
+		"half_open->open",
+		"open->half_open",
+		"half_open->closed",
+	}
+	if strings.Join(transitions, ",") != strings.Join(expect, ",") {
+		t.Errorf("unexpected transitions %v", transitions)
+	}
+}
+
+func TestBreakerRoundTripper_SingleProbe(t *testing.T) {
+	breaker := newBreakerRoundTripper(nil, BreakerConfig{MinRequests: 1, OpenDuration: time.Second})
+	clock := time.Unix(0, 0)
+	breaker.now = func() time.Time { return clock }
+
+	breaker.record("host", true)
+	if breaker.allow("host") {
+		t.Fatal("expected open breaker to reject calls")
+	}
+
+	clock = clock.Add(time.Second)
+	if !breaker.allow("host") {
+		t.Fatal("expected a probe to be allowed once the open duration has passed")
+	}
+	if breaker.allow("host") {
+		t.Error("expected only a single probe to be allowed while half-open")
+	}
+
+	// an abandoned probe allows another
+	breaker.release("host")
+	if !breaker.allow("host") {
+		t.Error("expected a probe to be allowed after the previous probe was abandoned")
+	}
+
+	if breaker.allow("other") != true {
+		t.Error("expected breakers to be tracked per host")
+	}
+}
+
+func TestCircuitOpenError(t *testing.T) {
+	// the error is wrapped by the http client and must still be treated as a temporary network error
+	err := error(&url.Error{Op: "Post", URL: "http://host", Err: circuitOpenError{host: "host"}})
+
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Temporary() || netErr.Timeout() {
+		t.Error("expected a temporary network error")
+	}
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Error("expected error to wrap ErrCircuitOpen")
+	}
+	if !isConnectionError(err) {
+		t.Error("expected rejected calls to fail over to another endpoint")
+	}
+}
+
+func TestWithCircuitBreaker(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	logger := &recordingLogger{}
+	var states []BreakerState
+	var failures []ErrorClass
+	reporter := &MetricsReporter{
+		BreakerStateCB: func(host string, state BreakerState) {
+			states = append(states, state)
+		},
+		FailureCB: func(report FailureReport) {
+			failures = append(failures, report.ErrorClass)
+		},
+	}
+
+	client := &http.Client{}
+	m := NewManager(client, nil, BackendConfig{Logger: logger}, reporter, WithCircuitBreaker(BreakerConfig{MinRequests: 2}))
+	if _, ok := client.Transport.(*breakerRoundTripper); ok {
+		t.Error("expected the provided client to be left unmodified")
+	}
+
+	// the breaker applies to both system and backend
+	builder := m.clientBuilder.(ClientBuilder)
+	for _, c := range []*http.Client{builder.httpClient, builder.backendClient()} {
+		if _, ok := c.Transport.(*breakerRoundTripper); !ok {
+			t.Fatal("expected calls to 3scale to pass through the circuit breaker")
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		m.AuthRep(ts.URL, BackendRequest{
+			Service: "any",
+			Transactions: []BackendTransaction{
+				{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: "any"}},
+			},
+		})
+	}
+
+	if len(states) != 1 || states[0] != BreakerOpen {
+		t.Errorf("expected breaker opening to be reported, got %v", states)
+	}
+	if len(logger.warnings) != 1 || !strings.Contains(logger.warnings[0], "from closed to open") {
+		t.Errorf("expected breaker opening to be logged, got %v", logger.warnings)
+	}
+	// calls rejected by the open breaker are not reported as failing to connect
+	if expect := []ErrorClass{ErrorClassServer, ErrorClassServer, ErrorClassRejected}; !reflect.DeepEqual(failures, expect) {
+		t.Errorf("expected failures %v, got %v", expect, failures)
+	}
+}
@@ -25,6 +25,10 @@ type SystemClient interface {
 // ClientBuilder builds the 3scale clients, injecting the underlying HTTP client
 type ClientBuilder struct {
 	httpClient *http.Client
+	// systemHTTPClient, if set, is used in place of httpClient for 3scale system
+	systemHTTPClient *http.Client
+	// backendHTTPClient, if set, is used in place of httpClient for 3scale backend
+	backendHTTPClient *http.Client
 }
 
 // NewClientBuilder returns a pointer to ClientBuilder
@@ -47,20 +51,35 @@ func (cb ClientBuilder) BuildSystemClient(systemURL, accessToken string) (System
 		return client, err
 	}
 
-	return system.NewThreeScale(ap, accessToken, cb.httpClient), nil
+	return system.NewThreeScale(ap, accessToken, withTarget(cb.systemClient(), TargetSystem)), nil
 }
 
 // BuildBackendClient builds a 3scale apisonator http client
 // The provided 'backendURL' must be prepended with a valid scheme
 func (cb ClientBuilder) BuildBackendClient(backendURL string) (threescale.Client, error) {
-	return apisonator.NewClient(backendURL, cb.httpClient)
+	return apisonator.NewClient(backendURL, withTarget(cb.backendClient(), TargetBackend))
+}
+
+// systemClient returns the HTTP client used for 3scale system
+func (cb ClientBuilder) systemClient() *http.Client {
+	if cb.systemHTTPClient != nil {
+		return cb.systemHTTPClient
+	}
+	return cb.httpClient
+}
+
+// backendClient returns the HTTP client used for 3scale backend
+func (cb ClientBuilder) backendClient() *http.Client {
+	if cb.backendHTTPClient != nil {
+		return cb.backendHTTPClient
+	}
+	return cb.httpClient
 }
 
 func (cb ClientBuilder) parseURL(url *url.URL) (string, string, int) {
-	var scheme string
+	scheme := url.Scheme
 	host, port, _ := net.SplitHostPort(url.Host)
 	if port == "" {
-		scheme = url.Scheme
 		if scheme == "http" {
 			port = "80"
 		} else if scheme == "https" {
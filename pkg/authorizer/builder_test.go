@@ -2,6 +2,7 @@ package authorizer
 
 import (
 	"net/http"
+	"net/url"
 	"testing"
 )
 
@@ -29,6 +30,11 @@ func TestClientBuilder_BuildSystemClient(t *testing.T) {
 		t.Errorf("unexpected failure buidling http client")
 	}
 
+	_, err = builder.BuildSystemClient("https://expect.pass:8443", token)
+	if err != nil {
+		t.Errorf("unexpected failure buidling http client with explicit port")
+	}
+
 }
 
 func TestClientBuilder_BuildBackendClient(t *testing.T) {
@@ -45,3 +51,39 @@ func TestClientBuilder_BuildBackendClient(t *testing.T) {
 	}
 
 }
+
+func TestClientBuilder_ParseURL(t *testing.T) {
+	inputs := []struct {
+		name   string
+		url    string
+		scheme string
+		host   string
+		port   int
+	}{
+		{name: "Test http default port", url: "http://expect.pass", scheme: "http", host: "expect.pass", port: 80},
+		{name: "Test https default port", url: "https://expect.pass", scheme: "https", host: "expect.pass", port: 443},
+		{name: "Test http explicit port", url: "http://expect.pass:8080", scheme: "http", host: "expect.pass", port: 8080},
+		{name: "Test https explicit port", url: "https://expect.pass:8443", scheme: "https", host: "expect.pass", port: 8443},
+	}
+
+	builder := NewClientBuilder(http.DefaultClient)
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			u, err := url.Parse(input.url)
+			if err != nil {
+				t.Fatalf("unexpected error parsing url - %s", err)
+			}
+
+			scheme, host, port := builder.parseURL(u)
+			if scheme != input.scheme {
+				t.Errorf("unexpected scheme, wanted %s but got %s", input.scheme, scheme)
+			}
+			if host != input.host {
+				t.Errorf("unexpected host, wanted %s but got %s", input.host, host)
+			}
+			if port != input.port {
+				t.Errorf("unexpected port, wanted %d but got %d", input.port, port)
+			}
+		})
+	}
+}
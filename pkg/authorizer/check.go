@@ -0,0 +1,233 @@
+package authorizer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/3scale/3scale-authorizer/pkg/core"
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+// Default names of the credentials of a request, used when the config of the service does not override them
+const (
+	DefaultUserKeyName = "user_key"
+	DefaultAppIDName   = "app_id"
+	DefaultAppKeyName  = "app_key"
+)
+
+// CheckRequest describes a request made to an API, to be authorized against the config of its service
+type CheckRequest struct {
+	Method string
+	// Path of the request, including the query string
+	Path   string
+	Header http.Header
+}
+
+// EnvironmentOverride selects an alternate environment, such as staging, for requests tagged with a header
+// allowing a config to be canaried through the same Manager. Configs of each environment are cached separately
+type EnvironmentOverride struct {
+	// Header whose presence tags a request, regardless of its value
+	Header string
+	// Environment of the config used for tagged requests
+	Environment string
+}
+
+// Apply returns the request for the config of a check with the headers, switching to the alternate environment
+// if the check is tagged. The request is returned unchanged if the override is not configured
+func (o EnvironmentOverride) Apply(request SystemRequest, header http.Header) SystemRequest {
+	if o.Header == "" || o.Environment == "" {
+		return request
+	}
+	if _, tagged := header[http.CanonicalHeaderKey(o.Header)]; tagged {
+		request.Environment = o.Environment
+	}
+	return request
+}
+
+// NewBackendRequest builds the request to 3scale backend which authorizes the check against the config
+// Credentials are read from the location set by the config and usage is accumulated from each mapping
+// rule matching the request, as done by APIcast
+// The mapping rules are compiled on each call, Manager.Check matches requests against the rules compiled
+// once when the config is cached
+func NewBackendRequest(config client.ProxyConfig, check CheckRequest) (BackendRequest, error) {
+	return newBackendRequest(config, CompileMappingRules(config.Content.Proxy.ProxyRules, RuleOptions{}), check, nil)
+}
+
+// newBackendRequest builds the request to 3scale backend, logging the evaluation of the rules with logf if set
+func newBackendRequest(config client.ProxyConfig, rules *MappingRules, check CheckRequest, logf func(format string, args ...interface{})) (BackendRequest, error) {
+	u, err := url.ParseRequestURI(check.Path)
+	if err != nil {
+		return BackendRequest{}, fmt.Errorf("invalid request path %q - %s", check.Path, err)
+	}
+
+	params, err := checkCredentials(config.Content.Proxy, u.Query(), check.Header)
+	if err != nil {
+		return BackendRequest{}, err
+	}
+
+	var evaluated func(rule client.ProxyRule, matched bool)
+	if logf != nil {
+		// only the path is logged, the query string may carry credentials
+		logf("service %d: matching %s %s against %d mapping rules", config.Content.ID, check.Method, u.Path, len(rules.rules))
+		evaluated = func(rule client.ProxyRule, matched bool) {
+			logf("service %d: mapping rule %d %s %s metric %s delta %d matched %t",
+				config.Content.ID, rule.ID, rule.HTTPMethod, rule.Pattern, rule.MetricSystemName, rule.Delta, matched)
+		}
+	}
+	metrics := rules.match(check.Method, u, evaluated)
+	if logf != nil {
+		logf("service %d: usage of %s %s is %v", config.Content.ID, check.Method, u.Path, metrics)
+	}
+
+	return BackendRequest{
+		Auth: BackendAuth{
+			Type:  config.Content.BackendAuthenticationType,
+			Value: config.Content.BackendAuthenticationValue,
+		},
+		Service:       strconv.FormatInt(config.Content.ID, 10),
+		ConfigVersion: config.Version,
+		Transactions:  []BackendTransaction{{Metrics: metrics, Params: params}},
+	}, nil
+}
+
+// Check authorizes the check with AuthRep against the config of its service, fetched as done by
+// GetSystemConfiguration. Usage is matched against the mapping rules compiled once when the config was cached
+func (m Manager) Check(systemURL string, request SystemRequest, check CheckRequest) (*BackendResponse, error) {
+	return m.CheckContext(context.Background(), systemURL, request, check)
+}
+
+// CheckContext is Check with the spans of the fetch of the config and of the decision started from the context
+func (m Manager) CheckContext(ctx context.Context, systemURL string, request SystemRequest, check CheckRequest) (*BackendResponse, error) {
+	config, prepared, err := m.preparedConfiguration(ctx, systemURL, request)
+	if err != nil {
+		return nil, err
+	}
+	backendRequest, err := newBackendRequest(config, prepared.rules, check, m.ruleLogger(check))
+	if err != nil {
+		return nil, err
+	}
+	return m.AuthRepContext(ctx, config.Content.Proxy.Backend.Endpoint, backendRequest)
+}
+
+// Explain returns the request to 3scale backend which Check would make for the check, along with each mapping
+// rule which matched the check in order, without calling 3scale backend
+func (m Manager) Explain(systemURL string, request SystemRequest, check CheckRequest) (BackendRequest, []client.ProxyRule, error) {
+	config, prepared, err := m.preparedConfiguration(context.Background(), systemURL, request)
+	if err != nil {
+		return BackendRequest{}, nil, err
+	}
+
+	u, err := url.ParseRequestURI(check.Path)
+	if err != nil {
+		return BackendRequest{}, nil, fmt.Errorf("invalid request path %q - %s", check.Path, err)
+	}
+	_, matched := prepared.rules.Explain(check.Method, u)
+
+	backendRequest, err := newBackendRequest(config, prepared.rules, check, m.ruleLogger(check))
+	return backendRequest, matched, err
+}
+
+// preparedConfiguration returns the config of the service along with its prepared state, preparing the config
+// now if it is not cached
+func (m Manager) preparedConfiguration(ctx context.Context, systemURL string, request SystemRequest) (client.ProxyConfig, *preparedConfig, error) {
+	config, prepared, err := m.systemConfiguration(ctx, systemURL, request)
+	if err != nil || prepared != nil {
+		return config, prepared, err
+	}
+	prepared, err = m.prepareConfig(config)
+	return config, prepared, err
+}
+
+// ruleLogger returns the function the evaluation of the mapping rules for the check is logged with, nil if it
+// should not be logged. See RuleDebugConfig
+func (m Manager) ruleLogger(check CheckRequest) func(format string, args ...interface{}) {
+	logger := m.logger()
+	if m.ruleOptions.Debug.triggered(check.Header) {
+		return logger.Infof
+	}
+	if core.DebugEnabled(logger) {
+		return logger.Debugf
+	}
+	return nil
+}
+
+// checkCredentials reads the credentials of a request from the query, headers or basic authorization
+// as configured for the service
+func checkCredentials(proxy client.ContentProxy, query url.Values, header http.Header) (BackendParams, error) {
+	userKeyName := nameOrDefault(proxy.AuthUserKey, DefaultUserKeyName)
+	appIDName := nameOrDefault(proxy.AuthAppID, DefaultAppIDName)
+	appKeyName := nameOrDefault(proxy.AuthAppKey, DefaultAppKeyName)
+
+	switch proxy.CredentialsLocation {
+	case "", "query":
+		return BackendParams{
+			UserKey: query.Get(userKeyName),
+			AppID:   query.Get(appIDName),
+			AppKey:  query.Get(appKeyName),
+		}, nil
+	case "headers":
+		return BackendParams{
+			UserKey: header.Get(userKeyName),
+			AppID:   header.Get(appIDName),
+			AppKey:  header.Get(appKeyName),
+		}, nil
+	case "authorization":
+		req := http.Request{Header: header}
+		user, password, ok := req.BasicAuth()
+		if !ok {
+			return BackendParams{}, nil
+		}
+		if password == "" {
+			return BackendParams{UserKey: user}, nil
+		}
+		return BackendParams{AppID: user, AppKey: password}, nil
+	default:
+		return BackendParams{}, fmt.Errorf("unsupported credentials location %q", proxy.CredentialsLocation)
+	}
+}
+
+func nameOrDefault(name, defaultName string) string {
+	if name == "" {
+		return defaultName
+	}
+	return name
+}
+
+// ParseCheckRequests reads a batch of checks, one per line in the form "METHOD PATH [Name: value; ...]"
+// where the trailing headers are separated by ';'. Blank lines and lines starting with '#' are skipped
+func ParseCheckRequests(r io.Reader) ([]CheckRequest, error) {
+	var checks []CheckRequest
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(text, " ", 3)
+		if len(fields) < 2 || fields[1] == "" {
+			return nil, fmt.Errorf("line %d - expected a method and path", line)
+		}
+		check := CheckRequest{Method: strings.ToUpper(fields[0]), Path: fields[1], Header: make(http.Header)}
+		if len(fields) == 3 {
+			for _, header := range strings.Split(fields[2], ";") {
+				i := strings.IndexByte(header, ':')
+				if i < 1 {
+					return nil, fmt.Errorf("line %d - invalid header %q", line, strings.TrimSpace(header))
+				}
+				check.Header.Add(strings.TrimSpace(header[:i]), strings.TrimSpace(header[i+1:]))
+			}
+		}
+		checks = append(checks, check)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read check requests - %s", err)
+	}
+	return checks, nil
+}
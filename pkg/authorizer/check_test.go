@@ -0,0 +1,349 @@
+package authorizer
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/3scale/3scale-authorizer/pkg/core"
+	"github.com/3scale/3scale-authorizer/pkg/fake"
+	"github.com/3scale/3scale-authorizer/pkg/system/v1/cache"
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+func TestNewBackendRequest(t *testing.T) {
+	config := func(location string) client.ProxyConfig {
+		config := client.ProxyConfig{Version: 4}
+		config.Content.ID = 12
+		config.Content.BackendAuthenticationType = "service_token"
+		config.Content.BackendAuthenticationValue = "token"
+		config.Content.Proxy.CredentialsLocation = location
+		config.Content.Proxy.ProxyRules = []client.ProxyRule{
+			{HTTPMethod: "GET", Pattern: "/widgets/{id}", MetricSystemName: "widget", Delta: 1, Last: true},
+			{HTTPMethod: "GET", Pattern: "/", MetricSystemName: "hits", Delta: 1},
+			{HTTPMethod: "POST", Pattern: "/widgets$", MetricSystemName: "create", Delta: 2},
+		}
+		return config
+	}
+
+	inputs := []struct {
+		name          string
+		config        client.ProxyConfig
+		check         CheckRequest
+		expectParams  BackendParams
+		expectMetrics map[string]int
+		expectErr     bool
+	}{
+		{
+			name:          "Test credentials are read from the query",
+			config:        config(""),
+			check:         CheckRequest{Method: "GET", Path: "/widgets?user_key=abc"},
+			expectParams:  BackendParams{UserKey: "abc"},
+			expectMetrics: map[string]int{"hits": 1},
+		},
+		{
+			name:   "Test credentials are read from the headers",
+			config: config("headers"),
+			check: CheckRequest{Method: "POST", Path: "/widgets", Header: http.Header{
+				"App_id": {"app"}, "App_key": {"key"},
+			}},
+			expectParams:  BackendParams{AppID: "app", AppKey: "key"},
+			expectMetrics: map[string]int{"create": 2},
+		},
+		{
+			name:   "Test credentials are read from basic authorization",
+			config: config("authorization"),
+			check: CheckRequest{Method: "get", Path: "/widgets/1", Header: http.Header{
+				"Authorization": {"Basic YWJjOg=="},
+			}},
+			expectParams:  BackendParams{UserKey: "abc"},
+			expectMetrics: map[string]int{"widget": 1},
+		},
+		{
+			name:      "Test unsupported credentials location fails",
+			config:    config("cookie"),
+			check:     CheckRequest{Method: "GET", Path: "/"},
+			expectErr: true,
+		},
+		{
+			name:      "Test invalid path fails",
+			config:    config(""),
+			check:     CheckRequest{Method: "GET", Path: "widgets"},
+			expectErr: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			request, err := NewBackendRequest(input.config, input.check)
+			if input.expectErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if request.Service != "12" || request.ConfigVersion != 4 || request.Auth.Value != "token" {
+				t.Errorf("unexpected request %+v", request)
+			}
+			transaction := request.Transactions[0]
+			if transaction.Params != input.expectParams {
+				t.Errorf("expected params %+v, got %+v", input.expectParams, transaction.Params)
+			}
+			if !reflect.DeepEqual(transaction.Metrics, input.expectMetrics) {
+				t.Errorf("expected metrics %v, got %v", input.expectMetrics, transaction.Metrics)
+			}
+		})
+	}
+}
+
+func TestParseCheckRequests(t *testing.T) {
+	checks, err := ParseCheckRequests(strings.NewReader(`
+# smoke tests
+GET /widgets?user_key=abc
+post /widgets Host: api.example.com; Authorization: Basic YWJjOg==
+`))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	expect := []CheckRequest{
+		{Method: "GET", Path: "/widgets?user_key=abc", Header: http.Header{}},
+		{Method: "POST", Path: "/widgets", Header: http.Header{
+			"Host": {"api.example.com"}, "Authorization": {"Basic YWJjOg=="},
+		}},
+	}
+	if !reflect.DeepEqual(checks, expect) {
+		t.Errorf("expected %v, got %v", expect, checks)
+	}
+
+	for _, invalid := range []string{"GET", "GET / Host"} {
+		if _, err := ParseCheckRequests(strings.NewReader(invalid)); err == nil {
+			t.Errorf("expected an error parsing %q", invalid)
+		}
+	}
+}
+
+func TestEnvironmentOverride(t *testing.T) {
+	system := fake.NewSystem("token")
+	defer system.Close()
+	system.SetConfig("1", "production", client.ProxyConfig{ID: 1, Version: 1, Environment: "production"})
+	system.SetConfig("1", "staging", client.ProxyConfig{ID: 1, Version: 2, Environment: "staging"})
+
+	systemCache := NewSystemCache(SystemCacheConfig{MaxSize: -1}, make(chan struct{}))
+	m := NewManager(&http.Client{}, systemCache, BackendConfig{}, nil)
+	defer m.Shutdown()
+
+	override := EnvironmentOverride{Header: "X-Canary", Environment: "staging"}
+	request := SystemRequest{AccessToken: "token", ServiceID: "1", Environment: "production"}
+
+	inputs := []struct {
+		name          string
+		header        http.Header
+		expectEnv     string
+		expectVersion int
+	}{
+		{
+			name:          "Test untagged request uses production",
+			header:        http.Header{},
+			expectEnv:     "production",
+			expectVersion: 1,
+		},
+		{
+			name:          "Test tagged request uses staging",
+			header:        http.Header{"X-Canary": {""}},
+			expectEnv:     "staging",
+			expectVersion: 2,
+		},
+	}
+
+	// the second round is served from the separate cache entries of each environment
+	for round := 0; round < 2; round++ {
+		for _, input := range inputs {
+			selected := override.Apply(request, input.header)
+			if selected.Environment != input.expectEnv {
+				t.Fatalf("%s: expected environment %s, got %s", input.name, input.expectEnv, selected.Environment)
+			}
+			config, err := m.GetSystemConfiguration(system.URL, selected)
+			if err != nil || config.Version != input.expectVersion {
+				t.Errorf("%s: expected config version %d, got %d - %v", input.name, input.expectVersion, config.Version, err)
+			}
+		}
+	}
+
+	if calls := len(system.Requests()); calls != 2 {
+		t.Errorf("expected a single fetch of each environment, got %d", calls)
+	}
+	for _, env := range []string{"production", "staging"} {
+		if _, cached := m.ConfigAge(system.URL, "1", env); !cached {
+			t.Errorf("expected the %s config to be cached", env)
+		}
+	}
+
+	if unset := (EnvironmentOverride{}).Apply(request, http.Header{"X-Canary": {""}}); unset != request {
+		t.Error("expected an unconfigured override to leave the request unchanged")
+	}
+}
+
+func TestManager_Check(t *testing.T) {
+	backend := fake.NewBackend()
+	defer backend.Close()
+	backend.AddService("1", "token", nil)
+	backend.AddApplication("1", fake.Application{UserKey: "abc"})
+
+	config := func(rules ...client.ProxyRule) client.ProxyConfig {
+		config := client.ProxyConfig{ID: 1, Version: 1, Environment: "production"}
+		config.Content.ID = 1
+		config.Content.BackendAuthenticationType = "service_token"
+		config.Content.BackendAuthenticationValue = "token"
+		config.Content.Proxy.Backend.Endpoint = backend.URL
+		config.Content.Proxy.ProxyRules = rules
+		return config
+	}
+	system := fake.NewSystem("access-token")
+	defer system.Close()
+	system.SetConfig("1", "production", config(client.ProxyRule{HTTPMethod: "GET", Pattern: "/", MetricSystemName: "hits", Delta: 1}))
+
+	systemCache := NewSystemCache(SystemCacheConfig{MaxSize: -1}, make(chan struct{}))
+	m := NewManager(&http.Client{}, systemCache, BackendConfig{}, nil)
+	defer m.Shutdown()
+
+	request := SystemRequest{AccessToken: "access-token", ServiceID: "1", Environment: "production"}
+	check := CheckRequest{Method: "GET", Path: "/widgets?user_key=abc"}
+	if res, err := m.Check(system.URL, request, check); err != nil || !res.Authorized {
+		t.Fatalf("expected the check to be authorized, got %+v - %v", res, err)
+	}
+	if usage := backend.Usage("1", "abc", "hits"); usage != 1 {
+		t.Errorf("expected the usage of the matching rule to be reported, got %d", usage)
+	}
+
+	// the config is cached with rules reporting another metric, which are used in place of those of the config as
+	// they were compiled when caching
+	cached := cache.Value{Item: config(client.ProxyRule{HTTPMethod: "GET", Pattern: "/", MetricSystemName: "hits", Delta: 1})}
+	cached.SetPrepareCallback(func(client.ProxyConfig) (interface{}, error) {
+		return m.prepareConfig(config(client.ProxyRule{HTTPMethod: "GET", Pattern: "/widgets", MetricSystemName: "widgets", Delta: 1}))
+	})
+	if err := cached.Prepare(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	systemCache.Set(generateSystemCacheKey(system.URL, "1", "production"), cached)
+
+	if res, err := m.Check(system.URL, request, check); err != nil || !res.Authorized {
+		t.Fatalf("expected the check to be authorized, got %+v - %v", res, err)
+	}
+	if usage := backend.Usage("1", "abc", "widgets"); usage != 1 {
+		t.Errorf("expected the usage to be matched against the compiled rules, got %d", usage)
+	}
+	if calls := len(system.Requests()); calls != 1 {
+		t.Errorf("expected a single fetch of the config, got %d", calls)
+	}
+
+	backendRequest, matched, err := m.Explain(system.URL, request, check)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(matched) != 1 || matched[0].MetricSystemName != "widgets" {
+		t.Errorf("expected the matching rule to be explained, got %+v", matched)
+	}
+	if metrics := backendRequest.Transactions[0].Metrics; !reflect.DeepEqual(metrics, map[string]int{"widgets": 1}) {
+		t.Errorf("expected the explained request to carry the usage, got %v", metrics)
+	}
+	if usage := backend.Usage("1", "abc", "widgets"); usage != 1 {
+		t.Errorf("expected Explain not to call 3scale backend, got usage %d", usage)
+	}
+}
+
+// infoLogger records the output of a logger which has debug disabled
+type infoLogger struct {
+	*recordingLogger
+}
+
+func (infoLogger) DebugEnabled() bool { return false }
+
+func TestManager_CheckRuleLogging(t *testing.T) {
+	backend := fake.NewBackend()
+	defer backend.Close()
+	backend.AddService("1", "token", nil)
+	backend.AddApplication("1", fake.Application{UserKey: "abc"})
+
+	config := client.ProxyConfig{ID: 1, Version: 1, Environment: "production"}
+	config.Content.ID = 1
+	config.Content.BackendAuthenticationType = "service_token"
+	config.Content.BackendAuthenticationValue = "token"
+	config.Content.Proxy.Backend.Endpoint = backend.URL
+	config.Content.Proxy.ProxyRules = []client.ProxyRule{
+		{ID: 1, HTTPMethod: "GET", Pattern: "/", MetricSystemName: "hits", Delta: 1},
+		{ID: 2, HTTPMethod: "POST", Pattern: "/widgets", MetricSystemName: "create", Delta: 1},
+		{ID: 3, HTTPMethod: "GET", Pattern: "/widgets", MetricSystemName: "list", Delta: 2},
+	}
+	system := fake.NewSystem("access-token")
+	defer system.Close()
+	system.SetConfig("1", "production", config)
+
+	expect := []string{
+		"service 1: matching GET /widgets against 3 mapping rules",
+		"service 1: mapping rule 1 GET / metric hits delta 1 matched true",
+		"service 1: mapping rule 2 POST /widgets metric create delta 1 matched false",
+		"service 1: mapping rule 3 GET /widgets metric list delta 2 matched true",
+		"service 1: usage of GET /widgets is map[hits:1 list:2]",
+	}
+	debug := RuleDebugConfig{Header: "X-Debug-Rules", Secret: "secret"}
+
+	inputs := []struct {
+		name        string
+		debugLevel  bool
+		header      http.Header
+		expectDebug []string
+		expectInfo  []string
+	}{
+		{
+			name:        "Test evaluation is logged at debug level",
+			debugLevel:  true,
+			expectDebug: expect,
+		},
+		{
+			name: "Test evaluation is not logged with debug disabled",
+		},
+		{
+			name:       "Test debug header with the secret logs the evaluation",
+			header:     http.Header{"X-Debug-Rules": {"secret"}},
+			expectInfo: expect,
+		},
+		{
+			name:   "Test debug header with another secret is ignored",
+			header: http.Header{"X-Debug-Rules": {"guess"}},
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			recorder := &recordingLogger{}
+			var logger core.Logger = infoLogger{recorder}
+			if input.debugLevel {
+				logger = recorder
+			}
+			m := NewManager(&http.Client{}, nil, BackendConfig{Logger: logger}, nil, WithRuleOptions(RuleOptions{Debug: debug}))
+
+			request := SystemRequest{AccessToken: "access-token", ServiceID: "1", Environment: "production"}
+			check := CheckRequest{Method: "GET", Path: "/widgets?user_key=abc", Header: input.header}
+			if res, err := m.Check(system.URL, request, check); err != nil || !res.Authorized {
+				t.Fatalf("expected the check to be authorized, got %+v - %v", res, err)
+			}
+
+			if !reflect.DeepEqual(recorder.debugs, input.expectDebug) {
+				t.Errorf("unexpected debug output\n got: %q\nwant: %q", recorder.debugs, input.expectDebug)
+			}
+			if !reflect.DeepEqual(recorder.infos, input.expectInfo) {
+				t.Errorf("unexpected info output\n got: %q\nwant: %q", recorder.infos, input.expectInfo)
+			}
+			for _, line := range append(recorder.debugs, recorder.infos...) {
+				if strings.Contains(line, "abc") {
+					t.Errorf("expected credentials not to be logged, got %q", line)
+				}
+			}
+		})
+	}
+}
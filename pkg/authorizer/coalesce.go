@@ -0,0 +1,196 @@
+package authorizer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// coalescer tracks the calls to 3scale backend in flight so identical concurrent calls can share a result
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+	// background tracks the calls in flight along with the reports of their joined usage
+	background sync.WaitGroup
+}
+
+// coalescedCall is a call to 3scale backend in flight, awaited by the callers which joined it
+type coalescedCall struct {
+	done   chan struct{}
+	res    *BackendResponse
+	err    error
+	joined int
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{calls: make(map[string]*coalescedCall)}
+}
+
+// do calls fn unless an identical call is in flight, in which case the result of that call is awaited
+// fn is called in the background with a context detached from the cancellation of the caller which made the call,
+// so each caller waits only until its own context is done. Once fn returns, after is called in the background with
+// its result and the number of callers which joined the call and were returned its result
+func (c *coalescer) do(ctx context.Context, key string, fn func(context.Context) (*BackendResponse, error),
+	after func(*BackendResponse, int, error)) (*BackendResponse, error) {
+	c.mu.Lock()
+	call, joining := c.calls[key]
+	if joining {
+		call.joined++
+	} else {
+		call = &coalescedCall{done: make(chan struct{})}
+		c.calls[key] = call
+		c.background.Add(1)
+		go c.call(key, call, detach(ctx), fn, after)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		c.mu.Lock()
+		select {
+		case <-call.done:
+			// the call completed while giving up, and has counted the caller as returned its result
+		default:
+			if joining {
+				call.joined--
+			}
+			c.mu.Unlock()
+			return nil, ctx.Err()
+		}
+		c.mu.Unlock()
+	}
+
+	if joining {
+		return copyResponse(call.res), call.err
+	}
+	return call.res, call.err
+}
+
+// call makes the call and releases the callers waiting on it, even if fn panics
+func (c *coalescer) call(key string, call *coalescedCall, ctx context.Context, fn func(context.Context) (*BackendResponse, error),
+	after func(*BackendResponse, int, error)) {
+	defer c.background.Done()
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				call.res, call.err = nil, fmt.Errorf("coalesced call to 3scale backend panicked - %v", r)
+			}
+
+			// the result is published with the call removed while holding the lock, so joined is final
+			c.mu.Lock()
+			delete(c.calls, key)
+			close(call.done)
+			c.mu.Unlock()
+		}()
+		call.res, call.err = fn(ctx)
+	}()
+
+	after(call.res, call.joined, call.err)
+}
+
+// wait blocks until the calls in flight and the reports of their joined usage have completed
+func (c *coalescer) wait() {
+	c.background.Wait()
+}
+
+// joined returns the number of callers waiting on the call in flight for the key
+func (c *coalescer) joined(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if call, ok := c.calls[key]; ok {
+		return call.joined
+	}
+	return 0
+}
+
+// detachedContext carries the values of its parent but not its deadline or cancellation
+type detachedContext struct {
+	context.Context
+}
+
+func detach(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// coalescedAuthRep shares a single call to 3scale backend between identical concurrent requests
+// The usage of the requests which joined an authorized AuthRep is reported to 3scale in a single call in the
+// background, so 3scale sees the true number of requests without the caller waiting on the report. Limits are
+// only checked by 3scale for the usage of a single request, so joined requests can exceed them. Shutdown waits
+// for the reports to complete
+func (m Manager) coalescedAuthRep(ctx context.Context, backendURL string, request BackendRequest, call backendCall) (*BackendResponse, error) {
+	key, ok := coalesceKey(backendURL, request, call)
+	if !ok {
+		return m.passthroughAuthRep(ctx, backendURL, request, call)
+	}
+
+	return m.coalescer.do(ctx, key, func(ctx context.Context) (*BackendResponse, error) {
+		return m.passthroughAuthRep(ctx, backendURL, request, call)
+	}, func(res *BackendResponse, joined int, err error) {
+		if joined > 0 && call != callAuthorize && err == nil && res.Authorized && len(request.Transactions[0].Metrics) > 0 {
+			m.reportCoalesced(backendURL, request, joined)
+		}
+	})
+}
+
+// reportCoalesced reports the usage of the requests which joined a shared AuthRep
+func (m Manager) reportCoalesced(backendURL string, request BackendRequest, joined int) {
+	if err := m.Report(backendURL, scaleUsage(request, joined)); err != nil {
+		m.throttledLogger().Errorf("coalesced_report/"+request.Service,
+			"unable to report usage of %d coalesced requests for service %s - %s", joined, request.Service, err)
+	}
+}
+
+// coalesceKey identifies requests which can share a single call to 3scale backend
+// Requests with a timestamp are not coalesced since their usage must be reported in the period they set
+func coalesceKey(backendURL string, request BackendRequest, call backendCall) (string, bool) {
+	if len(request.Transactions) != 1 || request.Transactions[0].Timestamp != 0 {
+		return "", false
+	}
+	transaction := request.Transactions[0]
+
+	metrics := make([]string, 0, len(transaction.Metrics))
+	for metric := range transaction.Metrics {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+
+	// the key is held for as long as the call is in flight so credentials are fingerprinted
+	credentials := fingerprint(request.Auth.Value, transaction.Params.AppID, transaction.Params.AppKey,
+		transaction.Params.UserID, transaction.Params.UserKey)
+	parts := []string{backendURL, call.String(), request.Service, request.Auth.Type, credentials}
+	for _, metric := range metrics {
+		parts = append(parts, metric, strconv.Itoa(transaction.Metrics[metric]))
+	}
+	return strings.Join(parts, "\x00"), true
+}
+
+// scaleUsage returns a copy of the request with its usage multiplied by the provided factor
+func scaleUsage(request BackendRequest, factor int) BackendRequest {
+	transaction := request.Transactions[0]
+	metrics := make(map[string]int, len(transaction.Metrics))
+	for metric, value := range transaction.Metrics {
+		metrics[metric] = value * factor
+	}
+	transaction.Metrics = metrics
+	request.Transactions = []BackendTransaction{transaction}
+	return request
+}
+
+func copyResponse(res *BackendResponse) *BackendResponse {
+	if res == nil {
+		return nil
+	}
+	copied := *res
+	return &copied
+}
@@ -0,0 +1,278 @@
+package authorizer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestManager_CoalescedAuthRep(t *testing.T) {
+	const concurrent = 10
+
+	release := make(chan struct{})
+	reportGate := make(chan struct{})
+	var authReps, reported int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/authrep.xml"):
+			atomic.AddInt32(&authReps, 1)
+			<-release
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><status><authorized>true</authorized><plan>Basic</plan></status>`))
+		case strings.HasSuffix(r.URL.Path, "/transactions.xml"):
+			<-reportGate
+			hits, _ := strconv.Atoi(r.Form.Get("transactions[0][usage][hits]"))
+			atomic.AddInt32(&reported, int32(hits))
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			t.Errorf("unexpected call to %s", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+
+	m := NewManager(&http.Client{}, NewSystemCache(SystemCacheConfig{}, make(chan struct{})), BackendConfig{Coalesce: true}, nil)
+	request := BackendRequest{
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: "any"}},
+		},
+	}
+	key, _ := coalesceKey(ts.URL, request, callAuthRep)
+
+	var wg sync.WaitGroup
+	var authorized int32
+	call := func() {
+		defer wg.Done()
+		resp, err := m.AuthRep(ts.URL, request)
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+			return
+		}
+		if resp.Authorized {
+			atomic.AddInt32(&authorized, 1)
+		}
+	}
+
+	wg.Add(1)
+	go call()
+	// wait for the first call to reach 3scale before the remainder join it
+	for atomic.LoadInt32(&authReps) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i < concurrent; i++ {
+		wg.Add(1)
+		go call()
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for m.coalescer.joined(key) != concurrent-1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d calls to join, got %d", concurrent-1, m.coalescer.joined(key))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	// the report of the joined usage does not hold up the requests
+	wg.Wait()
+
+	if authReps != 1 {
+		t.Errorf("expected a single call to 3scale, got %d", authReps)
+	}
+	if authorized != concurrent {
+		t.Errorf("expected every request to share the result, got %d authorized", authorized)
+	}
+
+	shutdown := make(chan struct{})
+	go func() {
+		m.Shutdown()
+		close(shutdown)
+	}()
+	select {
+	case <-shutdown:
+		t.Fatal("expected shutdown to wait for the report of the joined usage")
+	case <-time.After(time.Millisecond * 50):
+	}
+	close(reportGate)
+	<-shutdown
+
+	// one hit is reported by the authrep, the remainder by the report
+	if reported != concurrent-1 {
+		t.Errorf("expected %d hits to be reported for the coalesced requests, got %d", concurrent-1, reported)
+	}
+}
+
+func TestCoalescer_Do(t *testing.T) {
+	const key = "key"
+	type result struct {
+		res *BackendResponse
+		err error
+	}
+
+	t.Run("Test callers stop waiting when their context is done", func(t *testing.T) {
+		c := newCoalescer()
+		release := make(chan struct{})
+		joinedUsage := make(chan int, 1)
+		fn := func(ctx context.Context) (*BackendResponse, error) {
+			<-release
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return &BackendResponse{Authorized: true}, nil
+		}
+		after := func(_ *BackendResponse, joined int, _ error) {
+			joinedUsage <- joined
+		}
+
+		leaderCtx, cancelLeader := context.WithCancel(context.Background())
+		leader := make(chan result, 1)
+		go func() {
+			res, err := c.do(leaderCtx, key, fn, after)
+			leader <- result{res, err}
+		}()
+		inFlight := func() bool {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			_, ok := c.calls[key]
+			return ok
+		}
+		for !inFlight() {
+			time.Sleep(time.Millisecond)
+		}
+
+		joiners := make(chan result, 2)
+		joinerCtx, cancelJoiner := context.WithCancel(context.Background())
+		go func() {
+			res, err := c.do(joinerCtx, key, fn, after)
+			joiners <- result{res, err}
+		}()
+		go func() {
+			res, err := c.do(context.Background(), key, fn, after)
+			joiners <- result{res, err}
+		}()
+		for c.joined(key) != 2 {
+			time.Sleep(time.Millisecond)
+		}
+
+		cancelLeader()
+		if r := <-leader; r.err != context.Canceled {
+			t.Errorf("expected the leader to stop waiting once cancelled, got %v", r.err)
+		}
+		cancelJoiner()
+		if r := <-joiners; r.err != context.Canceled {
+			t.Errorf("expected the joiner to stop waiting once cancelled, got %v", r.err)
+		}
+
+		close(release)
+		if r := <-joiners; r.err != nil || !r.res.Authorized {
+			t.Errorf("expected the remaining joiner to share the result of the call, got %v %v", r.res, r.err)
+		}
+		if joined := <-joinedUsage; joined != 1 {
+			t.Errorf("expected only the joiner returned the result to be counted, got %d", joined)
+		}
+		c.wait()
+	})
+
+	t.Run("Test callers are released when the call panics", func(t *testing.T) {
+		c := newCoalescer()
+		release := make(chan struct{})
+		fn := func(ctx context.Context) (*BackendResponse, error) {
+			<-release
+			panic("unexpected")
+		}
+		after := func(*BackendResponse, int, error) {}
+
+		results := make(chan result, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				res, err := c.do(context.Background(), key, fn, after)
+				results <- result{res, err}
+			}()
+		}
+		for c.joined(key) != 1 {
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+
+		for i := 0; i < 2; i++ {
+			select {
+			case r := <-results:
+				if r.err == nil {
+					t.Error("expected an error from a call which panicked")
+				}
+			case <-time.After(time.Second * 5):
+				t.Fatal("expected callers to be released when the call panics")
+			}
+		}
+		c.wait()
+		if _, ok := c.calls[key]; ok {
+			t.Error("expected the call to be removed once it panicked")
+		}
+	})
+}
+
+func TestCoalesceKey(t *testing.T) {
+	newRequest := func(metrics map[string]int, params BackendParams, timestamp int64) BackendRequest {
+		return BackendRequest{
+			Service:      "any",
+			Transactions: []BackendTransaction{{Metrics: metrics, Params: params, Timestamp: timestamp}},
+		}
+	}
+	base, _ := coalesceKey("url", newRequest(map[string]int{"hits": 1, "other": 2}, BackendParams{UserKey: "a"}, 0), callAuthRep)
+
+	inputs := []struct {
+		name        string
+		request     BackendRequest
+		call        backendCall
+		expectOk    bool
+		expectEqual bool
+	}{
+		{
+			name:        "Test identical requests share a key",
+			request:     newRequest(map[string]int{"other": 2, "hits": 1}, BackendParams{UserKey: "a"}, 0),
+			call:        callAuthRep,
+			expectOk:    true,
+			expectEqual: true,
+		},
+		{
+			name:     "Test different credentials do not share a key",
+			request:  newRequest(map[string]int{"hits": 1, "other": 2}, BackendParams{UserKey: "b"}, 0),
+			call:     callAuthRep,
+			expectOk: true,
+		},
+		{
+			name:     "Test different usage does not share a key",
+			request:  newRequest(map[string]int{"hits": 2, "other": 2}, BackendParams{UserKey: "a"}, 0),
+			call:     callAuthRep,
+			expectOk: true,
+		},
+		{
+			name:     "Test different calls do not share a key",
+			request:  newRequest(map[string]int{"hits": 1, "other": 2}, BackendParams{UserKey: "a"}, 0),
+			call:     callAuthorize,
+			expectOk: true,
+		},
+		{
+			name:    "Test requests with a timestamp are not coalesced",
+			request: newRequest(map[string]int{"hits": 1}, BackendParams{UserKey: "a"}, time.Now().Unix()),
+			call:    callAuthRep,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			key, ok := coalesceKey("url", input.request, input.call)
+			if ok != input.expectOk {
+				t.Fatalf("expected ok to be %t", input.expectOk)
+			}
+			if ok && (key == base) != input.expectEqual {
+				t.Errorf("expected keys to be equal %t", input.expectEqual)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package authorizer
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrConcurrencyLimitExceeded is returned when a service has reached its limit of concurrent requests to 3scale
+var ErrConcurrencyLimitExceeded = errors.New("concurrency limit exceeded for service")
+
+// ErrBackendCallsExhausted is returned, wrapped, when a call to 3scale backend is shed because the
+// limit of in flight calls has been reached
+var ErrBackendCallsExhausted = errors.New("limit of in flight calls to 3scale backend reached")
+
+// ConcurrencyConfig limits the number of concurrent requests to 3scale backend per service
+// so that a service with a slow backend cannot consume all available capacity, and optionally
+// bounds the number of calls in flight to 3scale backend across all services
+type ConcurrencyConfig struct {
+	// PerService is the maximum number of concurrent requests per service. Zero implies no limit
+	PerService int
+	// Overrides sets the limit for individual services, keyed by service id, taking precedence over PerService
+	// A negative override implies no limit for the service
+	Overrides map[string]int
+	// MaxInFlight is the maximum number of calls in flight to 3scale backend, including reports
+	// flushed by a cached backend. Zero implies no limit
+	MaxInFlight int
+	// QueueTimeout is the period a call waits for one in flight to complete once MaxInFlight has been
+	// reached before it is shed. Zero sheds the call immediately
+	QueueTimeout time.Duration
+}
+
+func (c ConcurrencyConfig) enabled() bool {
+	return c.PerService > 0 || len(c.Overrides) > 0
+}
+
+func (c ConcurrencyConfig) limitFor(service string) int {
+	if limit, ok := c.Overrides[service]; ok {
+		return limit
+	}
+	return c.PerService
+}
+
+// serviceLimiter holds a semaphore per service
+type serviceLimiter struct {
+	config     ConcurrencyConfig
+	mu         sync.Mutex
+	semaphores map[string]chan struct{}
+}
+
+func newServiceLimiter(config ConcurrencyConfig) *serviceLimiter {
+	return &serviceLimiter{
+		config:     config,
+		semaphores: make(map[string]chan struct{}),
+	}
+}
+
+// acquire a slot for the service without blocking
+// Returns false if the service is already at its limit. The returned func must be called to release the slot
+func (sl *serviceLimiter) acquire(service string) (func(), bool) {
+	if sl == nil {
+		return func() {}, true
+	}
+
+	sem := sl.semaphore(service)
+	if sem == nil {
+		return func() {}, true
+	}
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, true
+	default:
+		return nil, false
+	}
+}
+
+// semaphore returns the semaphore for the service or nil if the service has no limit
+func (sl *serviceLimiter) semaphore(service string) chan struct{} {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	sem, ok := sl.semaphores[service]
+	if !ok {
+		if limit := sl.config.limitFor(service); limit > 0 {
+			sem = make(chan struct{}, limit)
+		}
+		sl.semaphores[service] = sem
+	}
+	return sem
+}
+
+// limitedRoundTripper bounds the number of calls in flight through it
+type limitedRoundTripper struct {
+	proxied      http.RoundTripper
+	slots        chan struct{}
+	queueTimeout time.Duration
+	inFlight     int64
+	// onInFlight and onShed, if set, report the calls in flight and calls shed
+	onInFlight InFlightHook
+	onShed     ShedHook
+}
+
+// shedError reports itself as a temporary network error so the failure policy of a cached backend applies
+type shedError struct{}
+
+func (shedError) Error() string     { return ErrBackendCallsExhausted.Error() }
+func (shedError) Is(err error) bool { return err == ErrBackendCallsExhausted }
+func (shedError) Temporary() bool   { return true }
+func (shedError) Timeout() bool     { return false }
+
+func newLimitedRoundTripper(proxied http.RoundTripper, limit int, queueTimeout time.Duration) *limitedRoundTripper {
+	return &limitedRoundTripper{
+		proxied:      proxied,
+		slots:        make(chan struct{}, limit),
+		queueTimeout: queueTimeout,
+	}
+}
+
+func (l *limitedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !l.acquire(req) {
+		if l.onShed != nil {
+			l.onShed()
+		}
+		return nil, shedError{}
+	}
+	defer l.release()
+
+	proxied := l.proxied
+	if proxied == nil {
+		proxied = http.DefaultTransport
+	}
+	return proxied.RoundTrip(req)
+}
+
+// acquire a slot, waiting up to the queue timeout if none are free
+func (l *limitedRoundTripper) acquire(req *http.Request) bool {
+	select {
+	case l.slots <- struct{}{}:
+		l.report(1)
+		return true
+	default:
+	}
+
+	if l.queueTimeout <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		l.report(1)
+		return true
+	case <-timer.C:
+		return false
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+func (l *limitedRoundTripper) release() {
+	<-l.slots
+	l.report(-1)
+}
+
+func (l *limitedRoundTripper) report(delta int64) {
+	inFlight := atomic.AddInt64(&l.inFlight, delta)
+	if l.onInFlight != nil {
+		l.onInFlight(inFlight)
+	}
+}
@@ -0,0 +1,193 @@
+package authorizer
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/3scale/3scale-go-client/threescale"
+	"github.com/3scale/3scale-go-client/threescale/api"
+)
+
+// blockingBackendClient blocks calls to AuthRep for the provided service until unblocked
+type blockingBackendClient struct {
+	mockBackendClient
+	service string
+	entered chan struct{}
+	unblock chan struct{}
+}
+
+func (b blockingBackendClient) AuthRep(request threescale.Request) (*threescale.AuthorizeResult, error) {
+	if request.Service == api.Service(b.service) {
+		select {
+		case <-b.unblock:
+		default:
+			b.entered <- struct{}{}
+			<-b.unblock
+		}
+	}
+	return b.mockBackendClient.AuthRep(request)
+}
+
+type blockingBuilder struct {
+	mockBuilder
+	client blockingBackendClient
+}
+
+func (b blockingBuilder) BuildBackendClient(backendURL string) (threescale.Client, error) {
+	return b.client, nil
+}
+
+func TestManager_ServiceConcurrencyLimit(t *testing.T) {
+	client := blockingBackendClient{
+		mockBackendClient: mockBackendClient{withAuthResponse: &threescale.AuthorizeResult{Authorized: true}},
+		service:           "slow",
+		entered:           make(chan struct{}),
+		unblock:           make(chan struct{}),
+	}
+
+	m := Manager{
+		clientBuilder: blockingBuilder{client: client},
+		serviceLimiter: newServiceLimiter(ConcurrencyConfig{
+			PerService: 1,
+			Overrides:  map[string]int{"unlimited": -1},
+		}),
+	}
+
+	requestFor := func(service string) BackendRequest {
+		return BackendRequest{
+			Service: service,
+			Transactions: []BackendTransaction{
+				{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: "any"}},
+			},
+		}
+	}
+
+	blocked := make(chan error)
+	go func() {
+		_, err := m.AuthRep("any", requestFor("slow"))
+		blocked <- err
+	}()
+	<-client.entered
+
+	start := time.Now()
+	_, err := m.AuthRep("any", requestFor("slow"))
+	if !errors.Is(err, ErrConcurrencyLimitExceeded) {
+		t.Errorf("expected the slow service to be over its limit, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("expected a request over the limit to fail fast")
+	}
+
+	for _, service := range []string{"healthy", "unlimited"} {
+		resp, err := m.AuthRep("any", requestFor(service))
+		if err != nil || !resp.Authorized {
+			t.Errorf("expected %s service to remain responsive, got %v", service, err)
+		}
+	}
+
+	close(client.unblock)
+	if err := <-blocked; err != nil {
+		t.Errorf("unexpected error from blocked request %v", err)
+	}
+
+	// the slot must be released once the slow request completes
+	if _, err := m.AuthRep("any", requestFor("slow")); err != nil {
+		t.Errorf("expected slow service to accept requests once below its limit, got %v", err)
+	}
+}
+
+func TestManager_BackendInFlightLimit(t *testing.T) {
+	const limit = 3
+	const requests = 12
+
+	var inFlight, maxInFlight int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt64(&inFlight, 1)
+		for {
+			max := atomic.LoadInt64(&maxInFlight)
+			if current <= max || atomic.CompareAndSwapInt64(&maxInFlight, max, current) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond * 20)
+		atomic.AddInt64(&inFlight, -1)
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><status><authorized>true</authorized></status>`))
+	}))
+	defer ts.Close()
+
+	request := BackendRequest{
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: "any"}},
+		},
+	}
+
+	inputs := []struct {
+		name         string
+		queueTimeout time.Duration
+		expectShed   bool
+	}{
+		{
+			name:         "Test calls queue for a free slot",
+			queueTimeout: time.Second * 10,
+		},
+		{
+			name:       "Test calls are shed immediately without a queue timeout",
+			expectShed: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			atomic.StoreInt64(&maxInFlight, 0)
+			var shed int64
+			var reportedMax int64
+			reporter := &MetricsReporter{
+				BackendInFlightCB: func(n int64) {
+					if n > atomic.LoadInt64(&reportedMax) {
+						atomic.StoreInt64(&reportedMax, n)
+					}
+				},
+				ShedCB: func() { atomic.AddInt64(&shed, 1) },
+			}
+
+			m := NewManager(&http.Client{}, nil, BackendConfig{
+				Concurrency: ConcurrencyConfig{MaxInFlight: limit, QueueTimeout: input.queueTimeout},
+			}, reporter)
+
+			var wg sync.WaitGroup
+			var failed int64
+			for i := 0; i < requests; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, err := m.AuthRep(ts.URL, request); err != nil {
+						if !errors.Is(err, ErrBackendCallsExhausted) {
+							t.Errorf("unexpected error %v", err)
+						}
+						atomic.AddInt64(&failed, 1)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if max := atomic.LoadInt64(&maxInFlight); max > limit {
+				t.Errorf("expected at most %d calls in flight, got %d", limit, max)
+			}
+			if reportedMax > limit {
+				t.Errorf("expected reported in flight calls to be at most %d, got %d", limit, reportedMax)
+			}
+			if failed != shed {
+				t.Errorf("expected each failed call to be reported as shed, got %d failed and %d shed", failed, shed)
+			}
+			if input.expectShed != (shed > 0) {
+				t.Errorf("unexpected number of shed calls %d", shed)
+			}
+		})
+	}
+}
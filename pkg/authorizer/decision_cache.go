@@ -0,0 +1,82 @@
+package authorizer
+
+import (
+	"time"
+
+	"github.com/3scale/3scale-authorizer/pkg/system/v1/cache"
+)
+
+// DefaultDecisionCacheSize is the number of decisions held by the decision cache when DecisionCacheConfig.MaxSize is unset
+const DefaultDecisionCacheSize = 1024
+
+// DecisionCacheConfig configures the caching of decisions made by 3scale, with a maximum age per outcome
+// Identical requests, with the same credentials and usage, are decided from the cache without calling 3scale
+// until the cached decision is older than the maximum age of its outcome
+type DecisionCacheConfig struct {
+	// AllowTTL is the maximum age of a cached allow. Zero never caches allows
+	// Allows are only cached for and served to calls to Authorize, as the usage of requests made with AuthRep
+	// must be reported to 3scale
+	AllowTTL time.Duration
+	// DenyTTL is the maximum age of a cached denial. Zero, the default, never caches denials so that a request
+	// denied for exceeding its limits is allowed as soon as the limits of the application are raised
+	DenyTTL time.Duration
+	// MaxSize is the number of decisions held, evicting the least recently used. Defaults to DefaultDecisionCacheSize
+	MaxSize int
+	// Clock determines the expiry of cached decisions. Defaults to cache.RealClock
+	Clock cache.Clock
+}
+
+func (c DecisionCacheConfig) enabled() bool {
+	return c.AllowTTL > 0 || c.DenyTTL > 0
+}
+
+// ttl returns the maximum age the response can be cached for, zero if it must not be cached
+func (c DecisionCacheConfig) ttl(res *BackendResponse, call backendCall) time.Duration {
+	switch {
+	case res == nil || res.FailedOpen || res.FromCache:
+		// only decisions made by 3scale are cached
+		return 0
+	case res.Authorized && call == callAuthorize:
+		return c.AllowTTL
+	case res.Authorized:
+		return 0
+	default:
+		return c.DenyTTL
+	}
+}
+
+// newDecisionCache returns a cache of decisions with a TTL set per entry
+// The store of the negative cache is used, holding decisions of either outcome
+func newDecisionCache(config DecisionCacheConfig) *negativeCache {
+	if config.MaxSize <= 0 {
+		config.MaxSize = DefaultDecisionCacheSize
+	}
+	return newNegativeCache(NegativeCacheConfig{MaxSize: config.MaxSize, Clock: config.Clock})
+}
+
+// decisionCacheKey returns the key a decision of the request is cached under, the same for calls to Authorize and
+// AuthRep so that a denial of either is served to both
+// Returns false for requests which cannot be cached, such as those with multiple transactions
+func decisionCacheKey(backendURL string, request BackendRequest) (string, bool) {
+	return coalesceKey(backendURL, request, callAuthorize)
+}
+
+// decisionLookup returns the cached decision of the request, if any, which can be served to the call
+func (m Manager) decisionLookup(key string, version int, call backendCall) (*BackendResponse, bool) {
+	res, ok := m.decisions.get(key, version)
+	if ok && res.Authorized && call != callAuthorize {
+		ok = false
+	}
+	if m.metricsReporter != nil {
+		if ok && m.metricsReporter.CacheHitCB != nil {
+			m.metricsReporter.CacheHitCB(Decision)
+		}
+		if !ok && m.metricsReporter.CacheMissCB != nil {
+			m.metricsReporter.CacheMissCB(Decision)
+		}
+	}
+	if !ok {
+		return nil, false
+	}
+	return res, true
+}
@@ -0,0 +1,140 @@
+package authorizer
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/3scale/3scale-authorizer/pkg/fake"
+	"github.com/3scale/3scale-authorizer/pkg/system/v1/cache"
+)
+
+func TestManager_DecisionCache(t *testing.T) {
+	inputs := []struct {
+		name     string
+		config   DecisionCacheConfig
+		userKey  string
+		authRep  bool
+		expectOK bool
+		// expectCalls is the number of calls to 3scale made by requests sent every ten seconds for a minute
+		expectCalls int
+	}{
+		{
+			name:        "Test allows are cached for the allow TTL",
+			config:      DecisionCacheConfig{AllowTTL: time.Second * 30},
+			userKey:     "valid",
+			expectOK:    true,
+			expectCalls: 2,
+		},
+		{
+			name:        "Test denials are not cached by default",
+			config:      DecisionCacheConfig{AllowTTL: time.Second * 30},
+			userKey:     "limited",
+			expectCalls: 7,
+		},
+		{
+			name:        "Test denials are cached for the deny TTL",
+			config:      DecisionCacheConfig{AllowTTL: time.Minute, DenyTTL: time.Second * 20},
+			userKey:     "limited",
+			expectCalls: 3,
+		},
+		{
+			name:        "Test allows are not cached for AuthRep",
+			config:      DecisionCacheConfig{AllowTTL: time.Minute},
+			userKey:     "valid",
+			authRep:     true,
+			expectOK:    true,
+			expectCalls: 7,
+		},
+		{
+			name:        "Test denials are cached for AuthRep",
+			config:      DecisionCacheConfig{DenyTTL: time.Minute},
+			userKey:     "limited",
+			authRep:     true,
+			expectCalls: 1,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			backend := fake.NewBackend()
+			defer backend.Close()
+			backend.AddService("any", "token", nil)
+			backend.AddApplication("any", fake.Application{UserKey: "valid"})
+			backend.AddApplication("any", fake.Application{
+				UserKey: "limited",
+				Limits:  []fake.Limit{{Metric: "hits", Period: "minute", Max: 0}},
+			})
+
+			var hits int
+			reporter := &MetricsReporter{CacheHitCB: func(cache Cache) {
+				if cache == Decision {
+					hits++
+				}
+			}}
+			clock := cache.NewManualClock(time.Now())
+			input.config.Clock = clock
+			m := NewManager(&http.Client{}, nil, BackendConfig{DecisionCache: input.config}, reporter)
+			request := BackendRequest{
+				Auth:    BackendAuth{Type: "service_token", Value: "token"},
+				Service: "any",
+				Transactions: []BackendTransaction{
+					{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: input.userKey}},
+				},
+			}
+
+			for i := 0; i <= 6; i++ {
+				call, path := m.Authorize, fake.AuthorizePath
+				if input.authRep {
+					call, path = m.AuthRep, fake.AuthRepPath
+				}
+				calls := len(backend.Requests(path))
+
+				res, err := call(backend.URL, request)
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				if res.Authorized != input.expectOK {
+					t.Fatalf("expected authorized to be %t, got %+v", input.expectOK, res)
+				}
+				if cached := len(backend.Requests(path)) == calls; res.FromCache != cached {
+					t.Errorf("expected the decision to be flagged as cached to be %t", cached)
+				}
+				clock.Advance(time.Second * 10)
+			}
+
+			calls := len(backend.Requests(fake.AuthorizePath)) + len(backend.Requests(fake.AuthRepPath))
+			if calls != input.expectCalls {
+				t.Errorf("expected %d calls to 3scale, got %d", input.expectCalls, calls)
+			}
+			if hits != 7-input.expectCalls {
+				t.Errorf("expected %d decisions from the cache, got %d", 7-input.expectCalls, hits)
+			}
+		})
+	}
+}
+
+func TestManager_DecisionCacheKeyedByUsage(t *testing.T) {
+	backend := fake.NewBackend()
+	defer backend.Close()
+	backend.AddService("any", "token", nil)
+	backend.AddApplication("any", fake.Application{UserKey: "valid"})
+
+	m := NewManager(&http.Client{}, nil, BackendConfig{DecisionCache: DecisionCacheConfig{AllowTTL: time.Minute}}, nil)
+	for _, usage := range []int{1, 2, 1} {
+		request := BackendRequest{
+			Auth:    BackendAuth{Type: "service_token", Value: "token"},
+			Service: "any",
+			Transactions: []BackendTransaction{
+				{Metrics: map[string]int{"hits": usage}, Params: BackendParams{UserKey: "valid"}},
+			},
+		}
+		if _, err := m.Authorize(backend.URL, request); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	if calls := len(backend.Requests(fake.AuthorizePath)); calls != 2 {
+		t.Errorf("expected a call to 3scale per distinct usage, got %d", calls)
+	}
+}
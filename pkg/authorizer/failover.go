@@ -0,0 +1,173 @@
+package authorizer
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DefaultEndpointCooldown is the default period an endpoint is skipped for after a connection error
+const DefaultEndpointCooldown = time.Second * 30
+
+// EndpointStrategy determines how an endpoint is selected for each request
+type EndpointStrategy int
+
+const (
+	// RoundRobin selects each endpoint in turn
+	RoundRobin EndpointStrategy = iota
+	// Random selects an endpoint at random
+	Random
+)
+
+// FailoverConfig configures the set of endpoints requests are distributed across
+type FailoverConfig struct {
+	// Endpoints must contain at least one URL, with a scheme and host, eg. https://backend.example.com:443
+	Endpoints []string
+	Strategy  EndpointStrategy
+	// Cooldown is the period an endpoint is skipped for after a connection error. Defaults to DefaultEndpointCooldown
+	Cooldown time.Duration
+}
+
+// FailoverRoundTripper sends each request to one of a set of endpoints
+// If the connection to the selected endpoint fails, the endpoint is marked as unhealthy and the request is retried
+// against the next healthy endpoint. Unhealthy endpoints are skipped until their cooldown has passed, unless
+// all endpoints are unhealthy
+type FailoverRoundTripper struct {
+	proxied   http.RoundTripper
+	endpoints []*endpoint
+	strategy  EndpointStrategy
+	cooldown  time.Duration
+
+	mu   sync.Mutex
+	next int
+}
+
+type endpoint struct {
+	url       *url.URL
+	downUntil time.Time
+}
+
+func newFailoverRoundTripper(config FailoverConfig) (*FailoverRoundTripper, error) {
+	if len(config.Endpoints) == 0 {
+		return nil, errors.New("at least one endpoint must be provided")
+	}
+
+	endpoints := make([]*endpoint, 0, len(config.Endpoints))
+	for _, e := range config.Endpoints {
+		u, err := url.ParseRequestURI(e)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid endpoint %s", e)
+		}
+		endpoints = append(endpoints, &endpoint{url: u})
+	}
+
+	if config.Cooldown <= 0 {
+		config.Cooldown = DefaultEndpointCooldown
+	}
+
+	return &FailoverRoundTripper{
+		endpoints: endpoints,
+		strategy:  config.Strategy,
+		cooldown:  config.Cooldown,
+	}, nil
+}
+
+// withTransport returns a FailoverRoundTripper over the same endpoints which sends requests using proxied
+// The health of each endpoint is tracked separately from that of f
+func (f *FailoverRoundTripper) withTransport(proxied http.RoundTripper) *FailoverRoundTripper {
+	endpoints := make([]*endpoint, 0, len(f.endpoints))
+	for _, e := range f.endpoints {
+		endpoints = append(endpoints, &endpoint{url: e.url})
+	}
+
+	return &FailoverRoundTripper{
+		proxied:   proxied,
+		endpoints: endpoints,
+		strategy:  f.strategy,
+		cooldown:  f.cooldown,
+	}
+}
+
+func (f *FailoverRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	proxied := f.proxied
+	if proxied == nil {
+		proxied = http.DefaultTransport
+	}
+
+	var err error
+	for _, e := range f.order() {
+		attempt := req.Clone(req.Context())
+		attempt.URL.Scheme = e.url.Scheme
+		attempt.URL.Host = e.url.Host
+		attempt.Host = e.url.Host
+
+		if req.Body != nil && req.GetBody != nil {
+			if attempt.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		var resp *http.Response
+		resp, err = proxied.RoundTrip(attempt)
+		if err == nil || !isConnectionError(err) {
+			return resp, err
+		}
+		f.markDown(e)
+
+		// the body has been consumed and cannot be replayed against another endpoint
+		if req.Body != nil && req.GetBody == nil {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// order returns the endpoints in the order they should be attempted, healthy endpoints first
+func (f *FailoverRoundTripper) order() []*endpoint {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var start int
+	switch f.strategy {
+	case Random:
+		start = rand.Intn(len(f.endpoints))
+	default:
+		start = f.next
+		f.next = (f.next + 1) % len(f.endpoints)
+	}
+
+	now := time.Now()
+	healthy := make([]*endpoint, 0, len(f.endpoints))
+	var unhealthy []*endpoint
+	for i := range f.endpoints {
+		e := f.endpoints[(start+i)%len(f.endpoints)]
+		if now.Before(e.downUntil) {
+			unhealthy = append(unhealthy, e)
+			continue
+		}
+		healthy = append(healthy, e)
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (f *FailoverRoundTripper) markDown(e *endpoint) {
+	f.mu.Lock()
+	e.downUntil = time.Now().Add(f.cooldown)
+	f.mu.Unlock()
+}
+
+// isConnectionError reports whether the error occurred establishing a connection, including through a proxy, or
+// the request was rejected by an open circuit breaker, in which case the request has not been sent and can safely
+// be sent elsewhere
+func isConnectionError(err error) bool {
+	if errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrProxyConnect) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
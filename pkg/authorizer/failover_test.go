@@ -0,0 +1,159 @@
+package authorizer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFailoverRoundTripper(t *testing.T) {
+	hits := map[string]int{}
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[name]++
+			w.Write([]byte(name))
+		}))
+	}
+
+	one, two := newServer("one"), newServer("two")
+	defer one.Close()
+	defer two.Close()
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	t.Run("Test round robin distributes requests across endpoints", func(t *testing.T) {
+		hits = map[string]int{}
+		failover, err := newFailoverRoundTripper(FailoverConfig{Endpoints: []string{one.URL, two.URL}})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		client := &http.Client{Transport: failover}
+		for i := 0; i < 10; i++ {
+			resp, err := client.Get("http://ignored.example.com/transactions/authrep.xml")
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			resp.Body.Close()
+		}
+
+		if hits["one"] != 5 || hits["two"] != 5 {
+			t.Errorf("expected requests to be distributed evenly, got %v", hits)
+		}
+	})
+
+	t.Run("Test failover to a healthy endpoint on connection error", func(t *testing.T) {
+		hits = map[string]int{}
+		failover, err := newFailoverRoundTripper(FailoverConfig{Endpoints: []string{down.URL, one.URL}})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		client := &http.Client{Transport: failover}
+		for i := 0; i < 4; i++ {
+			resp, err := client.Post("http://ignored.example.com/transactions.xml", "text/plain", strings.NewReader("body"))
+			if err != nil {
+				t.Fatalf("expected request to fail over, got %v", err)
+			}
+			resp.Body.Close()
+		}
+
+		if hits["one"] != 4 {
+			t.Errorf("expected all requests to be served by the healthy endpoint, got %v", hits)
+		}
+		if !failover.endpoints[0].downUntil.After(failover.endpoints[1].downUntil) {
+			t.Error("expected the unreachable endpoint to be marked as down")
+		}
+	})
+
+	t.Run("Test error when all endpoints are unreachable", func(t *testing.T) {
+		failover, err := newFailoverRoundTripper(FailoverConfig{Endpoints: []string{down.URL}, Strategy: Random})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		client := &http.Client{Transport: failover}
+		if _, err := client.Get("http://ignored.example.com"); err == nil {
+			t.Error("expected an error when no endpoint is reachable")
+		}
+	})
+}
+
+func TestWithBackendEndpoints(t *testing.T) {
+	if _, err := WithBackendEndpoints(FailoverConfig{}); err == nil {
+		t.Error("expected an error when no endpoints are provided")
+	}
+	if _, err := WithBackendEndpoints(FailoverConfig{Endpoints: []string{"no-scheme"}}); err == nil {
+		t.Error("expected an error for an invalid endpoint")
+	}
+
+	opt, err := WithBackendEndpoints(FailoverConfig{Endpoints: []string{"https://backend.example.com"}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	client := &http.Client{}
+	m := NewManager(client, nil, BackendConfig{}, nil, opt)
+	builder := m.clientBuilder.(ClientBuilder)
+	if _, ok := builder.backendClient().Transport.(*FailoverRoundTripper); !ok {
+		t.Error("expected backend client to fail over between endpoints")
+	}
+	if _, ok := builder.httpClient.Transport.(*FailoverRoundTripper); ok {
+		t.Error("expected system client to be unaffected by backend endpoints")
+	}
+}
+
+func TestWithBackendEndpoints_SharedOption(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	opt, err := WithBackendEndpoints(FailoverConfig{Endpoints: []string{backend.URL}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	first := NewManager(&http.Client{}, nil, BackendConfig{}, nil, opt)
+	firstClient := first.clientBuilder.(ClientBuilder).backendClient()
+	firstFailover := firstClient.Transport.(*FailoverRoundTripper)
+	firstProxied := firstFailover.proxied
+
+	// requests in flight on the first Manager while the second is built from the same option
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			resp, err := firstClient.Get("http://unused/transactions/authrep.xml")
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+				return
+			}
+			resp.Body.Close()
+		}
+	}()
+
+	second := NewManager(&http.Client{}, nil, BackendConfig{}, nil, opt, WithCircuitBreaker(BreakerConfig{}))
+	secondClient := second.clientBuilder.(ClientBuilder).backendClient()
+	resp, err := secondClient.Get("http://unused/transactions/authrep.xml")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+	wg.Wait()
+
+	secondFailover := secondClient.Transport.(*FailoverRoundTripper)
+	if firstFailover == secondFailover {
+		t.Error("expected each Manager to have its own failover round tripper")
+	}
+	if firstFailover.proxied != firstProxied {
+		t.Error("expected the first Manager to keep its own transport once the second is built")
+	}
+	if _, ok := secondFailover.proxied.(*breakerRoundTripper); !ok {
+		t.Errorf("expected the second Manager to fail over over its own breaker, got %T", secondFailover.proxied)
+	}
+}
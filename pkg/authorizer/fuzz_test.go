@@ -0,0 +1,129 @@
+//go:build go1.18
+// +build go1.18
+
+package authorizer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+func FuzzCompileRulePattern(f *testing.F) {
+	for _, seed := range []string{
+		"/", "/widgets/{id}", "/widgets/{id}/parts$", "/search?q={term}&type=book", "/v(1|2)/users",
+		"/orders/{id", "/{}", "/{{id}}", "/items[$", "orders", "/%zz?q=%zz", "/search?;", "/a$b$", "$", "",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, pattern string) {
+		expr, err := compileRulePattern(pattern)
+		if err != nil {
+			return
+		}
+		// a valid pattern must match the path it was written as when it has no placeholders
+		path := strings.TrimSuffix(strings.SplitN(pattern, "?", 2)[0], "$")
+		if !strings.ContainsAny(path, "{}") && !expr.MatchString(path) {
+			t.Errorf("expected %q to match its own path %q", pattern, path)
+		}
+		compileRuleQuery(pattern)
+	})
+}
+
+func FuzzMatchRules(f *testing.F) {
+	files, err := filepath.Glob(filepath.Join("testdata", "apicast", "*.json"))
+	if err != nil {
+		f.Fatalf("unexpected error %v", err)
+	}
+	var rules []client.ProxyRule
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			f.Fatalf("unexpected error %v", err)
+		}
+		var fixture ruleFixture
+		if err := json.Unmarshal(data, &fixture); err != nil {
+			f.Fatalf("invalid fixture %s - %v", file, err)
+		}
+		rules = append(rules, fixture.Rules...)
+		for _, c := range fixture.Cases {
+			f.Add(c.Method, c.Path)
+		}
+	}
+	for _, path := range []string{
+		"/widgets/%2F", "/widgets/%00", "/search?q=a&q=b", "/search?type=book&type=film", "/search?q", "/search?%zz",
+		"//widgets", "/widgets/../private", "/" + strings.Repeat("a/", 1000),
+	} {
+		f.Add("GET", path)
+	}
+
+	compiled := CompileMappingRules(rules, RuleOptions{})
+	f.Fuzz(func(t *testing.T, method, path string) {
+		u, err := url.ParseRequestURI(path)
+		if err != nil {
+			return
+		}
+		for metric, delta := range compiled.Match(method, u) {
+			if delta < 0 {
+				t.Errorf("expected usage of %s to be positive, got %d", metric, delta)
+			}
+		}
+	})
+}
+
+func FuzzCheckCredentials(f *testing.F) {
+	for _, seed := range []struct{ query, authorization, header string }{
+		{query: "user_key=abc"},
+		{query: "app_id=a&app_key=b"},
+		{query: "user_key=a&user_key=b"},
+		{query: "user_key=%zz&app_id=%41"},
+		{query: "user_key"},
+		{authorization: "Basic YWJjOg=="},
+		{authorization: "Basic YWJjOmRlZg=="},
+		{authorization: "Basic YWJjOmRl"},
+		{authorization: "Basic YWJj"},
+		{authorization: "Basic ==="},
+		{authorization: "Bearer abc"},
+		{authorization: "basic"},
+		{header: "abc"},
+	} {
+		f.Add(seed.query, seed.authorization, seed.header)
+	}
+
+	f.Fuzz(func(t *testing.T, rawQuery, authorization, headerValue string) {
+		query, _ := url.ParseQuery(rawQuery)
+		header := http.Header{"Authorization": {authorization}, "User_key": {headerValue}}
+
+		for _, location := range []string{"query", "headers", "authorization"} {
+			params, err := checkCredentials(client.ContentProxy{CredentialsLocation: location}, query, header)
+			if err != nil {
+				t.Errorf("unexpected error for location %s - %v", location, err)
+			}
+			if location == "headers" && params.UserKey != headerValue {
+				t.Errorf("expected the user key to be read from the header, got %q", params.UserKey)
+			}
+		}
+
+		// credentials set as basic authorization must be read back as set
+		user, _ := url.QueryUnescape(rawQuery)
+		if user == "" || strings.Contains(user, ":") {
+			return
+		}
+		req := http.Request{Header: make(http.Header)}
+		req.SetBasicAuth(user, headerValue)
+		params, _ := checkCredentials(client.ContentProxy{CredentialsLocation: "authorization"}, nil, req.Header)
+		if headerValue == "" && params.UserKey != user {
+			t.Errorf("expected user key %q, got %+v", user, params)
+		}
+		if headerValue != "" && (params.AppID != user || params.AppKey != headerValue) {
+			t.Errorf("expected app %q with key %q, got %+v", user, headerValue, params)
+		}
+	})
+}
@@ -0,0 +1,174 @@
+package authorizer
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// ErrorCodeIPDenied is set as the error code on responses denied as the client IP is on the deny list of the service
+	ErrorCodeIPDenied = "ip_denied"
+	// ErrorCodeIPNotAllowed is set as the error code on responses denied as the client IP is not on the allow list
+	// of the service
+	ErrorCodeIPNotAllowed = "ip_not_allowed"
+	// ErrorCodeIPUnresolved is set as the error code on responses denied as the client IP could not be resolved
+	ErrorCodeIPUnresolved = "ip_unresolved"
+)
+
+// ClientAddress describes where a request was received from, used to resolve the IP of the client
+type ClientAddress struct {
+	// ForwardedFor is the value of the X-Forwarded-For header of the request. Multiple headers should be joined with ","
+	ForwardedFor string
+	// SourceAddress is the address of the peer the request was received from, such as 10.0.0.1 or 10.0.0.1:5678
+	SourceAddress string
+}
+
+// IPRules are the CIDR ranges, or single IP addresses, requests to a service may or may not be made from
+// A deny list hit takes precedence over an allow list entry. When the allow list is not empty, requests from an
+// IP not on the allow list are denied. Both lists empty means no filtering
+type IPRules struct {
+	Allow []string
+	Deny  []string
+}
+
+// IPFilterConfig configures the filtering of requests by client IP
+type IPFilterConfig struct {
+	// Services are the rules of each service, keyed by service id. Requests to other services are not filtered
+	Services map[string]IPRules
+	// TrustedProxies is the number of proxies in front of the authorizer trusted to append to X-Forwarded-For
+	// The client IP is the address that many entries from the right of X-Forwarded-For, the address appended by the
+	// outermost trusted proxy. Zero ignores X-Forwarded-For and uses the source address. The source address is also
+	// used when X-Forwarded-For is absent
+	TrustedProxies int
+	// AllowUnresolved authorizes, with 3scale, requests to services with rules when the client IP cannot be
+	// resolved, rather than denying them
+	AllowUnresolved bool
+}
+
+// IPFilter denies requests made from IP addresses a service does not accept, before calling 3scale
+type IPFilter struct {
+	services        map[string]ipRules
+	trustedProxies  int
+	allowUnresolved bool
+}
+
+type ipRules struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewIPFilter compiles the rules of each service. Returns an error if any entry is not a valid CIDR range or IP
+func NewIPFilter(config IPFilterConfig) (*IPFilter, error) {
+	if config.TrustedProxies < 0 {
+		return nil, fmt.Errorf("invalid number of trusted proxies %d", config.TrustedProxies)
+	}
+
+	filter := &IPFilter{
+		services:        make(map[string]ipRules, len(config.Services)),
+		trustedProxies:  config.TrustedProxies,
+		allowUnresolved: config.AllowUnresolved,
+	}
+	for service, rules := range config.Services {
+		allow, err := parseIPNets(rules.Allow)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow list for service %s - %s", service, err)
+		}
+		deny, err := parseIPNets(rules.Deny)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deny list for service %s - %s", service, err)
+		}
+		if len(allow) > 0 || len(deny) > 0 {
+			filter.services[service] = ipRules{allow: allow, deny: deny}
+		}
+	}
+	return filter, nil
+}
+
+func parseIPNets(entries []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			nets = append(nets, cidr)
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not a CIDR range or IP address", entry)
+		}
+		if v4 := ip.To4(); v4 != nil {
+			ip = v4
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+	}
+	return nets, nil
+}
+
+// ClientIP returns the IP of the client which made the request, nil if it cannot be resolved
+// Only the entry of X-Forwarded-For appended by the outermost trusted proxy is considered, so a malformed entry is
+// not skipped in favour of an entry the client could have set
+func (f *IPFilter) ClientIP(address ClientAddress) net.IP {
+	if f.trustedProxies > 0 && strings.TrimSpace(address.ForwardedFor) != "" {
+		entries := strings.Split(address.ForwardedFor, ",")
+		// with fewer entries than trusted proxies, every entry was appended by a trusted proxy
+		i := len(entries) - f.trustedProxies
+		if i < 0 {
+			i = 0
+		}
+		return parseClientIP(entries[i])
+	}
+	return parseClientIP(address.SourceAddress)
+}
+
+// parseClientIP parses an address with an optional port, such as 10.0.0.1, 10.0.0.1:80, 2001:db8::1 or [2001:db8::1]:80
+func parseClientIP(address string) net.IP {
+	address = strings.TrimSpace(address)
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	// the zone of a link local address does not take part in matching
+	if i := strings.IndexByte(address, '%'); i >= 0 {
+		address = address[:i]
+	}
+	return net.ParseIP(address)
+}
+
+// apply the rules of the service to the request
+// Returns a response if the request should be denied without calling 3scale
+func (f *IPFilter) apply(request BackendRequest) *BackendResponse {
+	if f == nil {
+		return nil
+	}
+	rules, ok := f.services[request.Service]
+	if !ok {
+		return nil
+	}
+
+	ip := f.ClientIP(request.Client)
+	switch {
+	case ip == nil && f.allowUnresolved:
+		return nil
+	case ip == nil:
+		return ipDenial(ErrorCodeIPUnresolved)
+	case containsIP(rules.deny, ip):
+		return ipDenial(ErrorCodeIPDenied)
+	case len(rules.allow) > 0 && !containsIP(rules.allow, ip):
+		return ipDenial(ErrorCodeIPNotAllowed)
+	}
+	return nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func ipDenial(code string) *BackendResponse {
+	return &BackendResponse{Authorized: false, ErrorCode: code, RejectedReason: code}
+}
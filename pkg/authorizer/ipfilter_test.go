@@ -0,0 +1,231 @@
+package authorizer
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/3scale/3scale-authorizer/pkg/fake"
+)
+
+func TestIPFilter_ClientIP(t *testing.T) {
+	inputs := []struct {
+		name           string
+		trustedProxies int
+		address        ClientAddress
+		expect         string
+	}{
+		{
+			name:    "Test source address is used without trusted proxies",
+			address: ClientAddress{ForwardedFor: "203.0.113.7", SourceAddress: "10.0.0.1:5678"},
+			expect:  "10.0.0.1",
+		},
+		{
+			name:           "Test entry appended by the trusted proxy",
+			trustedProxies: 1,
+			address:        ClientAddress{ForwardedFor: "198.51.100.1, 203.0.113.7", SourceAddress: "10.0.0.1"},
+			expect:         "203.0.113.7",
+		},
+		{
+			name:           "Test entry appended by the outermost of multiple trusted proxies",
+			trustedProxies: 2,
+			address:        ClientAddress{ForwardedFor: "198.51.100.1,203.0.113.7,10.0.0.2", SourceAddress: "10.0.0.1"},
+			expect:         "203.0.113.7",
+		},
+		{
+			name:           "Test fewer entries than trusted proxies",
+			trustedProxies: 3,
+			address:        ClientAddress{ForwardedFor: "203.0.113.7, 10.0.0.2"},
+			expect:         "203.0.113.7",
+		},
+		{
+			name:           "Test source address without X-Forwarded-For",
+			trustedProxies: 1,
+			address:        ClientAddress{SourceAddress: "[2001:db8::1]:443"},
+			expect:         "2001:db8::1",
+		},
+		{
+			name:           "Test IPv6 entry with port",
+			trustedProxies: 1,
+			address:        ClientAddress{ForwardedFor: "[2001:db8::7]:8080"},
+			expect:         "2001:db8::7",
+		},
+		{
+			name:           "Test untrusted malformed entries are ignored",
+			trustedProxies: 1,
+			address:        ClientAddress{ForwardedFor: "unknown, not-an-ip, 203.0.113.7"},
+			expect:         "203.0.113.7",
+		},
+		{
+			name:           "Test malformed trusted entry is unresolved",
+			trustedProxies: 1,
+			address:        ClientAddress{ForwardedFor: "203.0.113.7, unknown", SourceAddress: "10.0.0.1"},
+		},
+		{
+			name: "Test no address is unresolved",
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			filter, err := NewIPFilter(IPFilterConfig{TrustedProxies: input.trustedProxies})
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			got := filter.ClientIP(input.address)
+			if input.expect == "" && got != nil {
+				t.Errorf("expected the client IP to be unresolved, got %s", got)
+			}
+			if input.expect != "" && !got.Equal(net.ParseIP(input.expect)) {
+				t.Errorf("expected client IP %s, got %s", input.expect, got)
+			}
+		})
+	}
+}
+
+func TestManager_IPFilter(t *testing.T) {
+	inputs := []struct {
+		name            string
+		rules           IPRules
+		allowUnresolved bool
+		sourceAddress   string
+		expectReason    DecisionReason
+	}{
+		{
+			name:          "Test no lists do not filter",
+			sourceAddress: "203.0.113.7",
+		},
+		{
+			name:          "Test allow list hit",
+			rules:         IPRules{Allow: []string{"203.0.113.0/24"}},
+			sourceAddress: "203.0.113.7",
+		},
+		{
+			name:          "Test allow list miss",
+			rules:         IPRules{Allow: []string{"203.0.113.0/24"}},
+			sourceAddress: "198.51.100.1",
+			expectReason:  ReasonIPNotAllowed,
+		},
+		{
+			name:          "Test deny list hit",
+			rules:         IPRules{Deny: []string{"198.51.100.1"}},
+			sourceAddress: "198.51.100.1",
+			expectReason:  ReasonIPDenied,
+		},
+		{
+			name:          "Test deny list miss",
+			rules:         IPRules{Deny: []string{"198.51.100.1"}},
+			sourceAddress: "198.51.100.2",
+		},
+		{
+			name:          "Test deny list takes precedence over allow list",
+			rules:         IPRules{Allow: []string{"203.0.113.0/24"}, Deny: []string{"203.0.113.128/25"}},
+			sourceAddress: "203.0.113.200",
+			expectReason:  ReasonIPDenied,
+		},
+		{
+			name:          "Test IPv6 allow list",
+			rules:         IPRules{Allow: []string{"2001:db8::/32"}},
+			sourceAddress: "[2001:db8::1]:443",
+		},
+		{
+			name:          "Test IPv4 mapped IPv6 address matches IPv4 range",
+			rules:         IPRules{Deny: []string{"203.0.113.0/24"}},
+			sourceAddress: "::ffff:203.0.113.7",
+			expectReason:  ReasonIPDenied,
+		},
+		{
+			name:          "Test IPv6 address does not match IPv4 allow list",
+			rules:         IPRules{Allow: []string{"0.0.0.0/0"}},
+			sourceAddress: "2001:db8::1",
+			expectReason:  ReasonIPNotAllowed,
+		},
+		{
+			name:         "Test unresolved client IP is denied by default",
+			rules:        IPRules{Allow: []string{"203.0.113.0/24"}},
+			expectReason: ReasonIPUnresolved,
+		},
+		{
+			name:            "Test unresolved client IP allowed",
+			rules:           IPRules{Allow: []string{"203.0.113.0/24"}},
+			allowUnresolved: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			backend := fake.NewBackend()
+			defer backend.Close()
+			backend.AddService("partner", "token", nil)
+			backend.AddApplication("partner", fake.Application{UserKey: "valid"})
+
+			filter, err := NewIPFilter(IPFilterConfig{
+				Services:        map[string]IPRules{"partner": input.rules},
+				AllowUnresolved: input.allowUnresolved,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			var report DecisionReport
+			reporter := &MetricsReporter{DecisionCB: func(r DecisionReport) { report = r }}
+			m := NewManager(&http.Client{}, nil, BackendConfig{IPFilter: filter}, reporter)
+
+			res, err := m.AuthRep(backend.URL, BackendRequest{
+				Auth:         BackendAuth{Type: "service_token", Value: "token"},
+				Service:      "partner",
+				Transactions: []BackendTransaction{{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: "valid"}}},
+				Client:       ClientAddress{SourceAddress: input.sourceAddress},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			if res.Authorized != (input.expectReason == ReasonNone) {
+				t.Errorf("expected authorized to be %t, got %+v", input.expectReason == ReasonNone, res)
+			}
+			if report.Reason != input.expectReason {
+				t.Errorf("expected reason %q, got %q", input.expectReason, report.Reason)
+			}
+			calls := len(backend.Requests(fake.AuthRepPath))
+			if expect := map[bool]int{true: 1, false: 0}[input.expectReason == ReasonNone]; calls != expect {
+				t.Errorf("expected %d calls to 3scale, got %d", expect, calls)
+			}
+		})
+	}
+}
+
+func TestManager_IPFilterOtherServices(t *testing.T) {
+	backend := fake.NewBackend()
+	defer backend.Close()
+	backend.AddService("other", "token", nil)
+	backend.AddApplication("other", fake.Application{UserKey: "valid"})
+
+	filter, err := NewIPFilter(IPFilterConfig{Services: map[string]IPRules{"partner": {Allow: []string{"203.0.113.0/24"}}}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	m := NewManager(&http.Client{}, nil, BackendConfig{IPFilter: filter}, nil)
+
+	res, err := m.AuthRep(backend.URL, BackendRequest{
+		Auth:         BackendAuth{Type: "service_token", Value: "token"},
+		Service:      "other",
+		Transactions: []BackendTransaction{{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: "valid"}}},
+	})
+	if err != nil || !res.Authorized {
+		t.Errorf("expected requests to services without rules not to be filtered, got %+v - %v", res, err)
+	}
+}
+
+func TestNewIPFilter_Invalid(t *testing.T) {
+	for _, config := range []IPFilterConfig{
+		{Services: map[string]IPRules{"1": {Allow: []string{"203.0.113.0/33"}}}},
+		{Services: map[string]IPRules{"1": {Deny: []string{"partner.example.com"}}}},
+		{TrustedProxies: -1},
+	} {
+		if _, err := NewIPFilter(config); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
@@ -1,8 +1,16 @@
 package authorizer
 
 import (
+	"context"
+	"errors"
+	"net"
 	"net/http"
+	"sort"
+	"sync"
 	"time"
+
+	"github.com/3scale/3scale-authorizer/pkg/backend/v1"
+	"github.com/3scale/3scale-porta-go-client/client"
 )
 
 type Cache int
@@ -10,15 +18,58 @@ type Cache int
 const (
 	System Cache = iota
 	Backend
+	// Negative is the cache of requests denied because of their credentials. See NegativeCacheConfig
+	Negative
+	// Decision is the cache of decisions made by 3scale. See DecisionCacheConfig
+	Decision
+)
+
+func (c Cache) String() string {
+	switch c {
+	case Backend:
+		return "backend"
+	case Negative:
+		return "negative"
+	case Decision:
+		return "decision"
+	default:
+		return "system"
+	}
+}
+
+// ErrorClass categorises a failed request to 3scale
+type ErrorClass string
+
+const (
+	// ErrorClassNone is set when the request succeeded
+	ErrorClassNone       ErrorClass = ""
+	ErrorClassTimeout    ErrorClass = "timeout"
+	ErrorClassConnection ErrorClass = "connection"
+	ErrorClassClient     ErrorClass = "4xx"
+	ErrorClassServer     ErrorClass = "5xx"
+	// ErrorClassRejected is set for calls rejected without being sent, by an open circuit breaker or as the
+	// limit of calls in flight was reached
+	ErrorClassRejected ErrorClass = "rejected"
+	// ErrorClassOther is set for failures which fit none of the classes above, such as an unreadable response
+	ErrorClassOther ErrorClass = "other"
 )
 
 // TelemetryReport reports HTTP info from the request/response cycle to 3scale
+// Reports of calls which received a response are passed to MetricsReporter.ResponseCB. Reports of calls which
+// failed without a response, such as on a timeout or connection error, are passed to MetricsReporter.ErrorCB
+// with a zero Code. ResponseCB is not called for such calls, as was the case before ErrorClass was reported
 type TelemetryReport struct {
-	Host      string
-	Method    string
-	Endpoint  string
+	// Target is the 3scale API the request was made to. It is empty for requests not made to 3scale by the Manager
+	Target   Target
+	Host     string
+	Method   string
+	Endpoint string
+	// Code is the response status code and is zero if no response was received
 	Code      int
 	TimeTaken time.Duration
+	// ErrorClass categorises the failure, if any, allowing timeouts, connection errors and error
+	// responses to be told apart
+	ErrorClass ErrorClass
 }
 
 // ResponseHook is a callback function which allows running a function after each HTTP response from 3scale
@@ -27,33 +78,363 @@ type ResponseHook func(report TelemetryReport)
 // CacheHitHook is called when a hit is successful on system or backend cache
 type CacheHitHook func(cache Cache)
 
+// CacheMissHook is called when an item is not found in system or backend cache
+type CacheMissHook func(cache Cache)
+
+// BackendCacheReport describes the state of the cache of a cached backend after each flush to 3scale backend
+type BackendCacheReport struct {
+	Backend string
+	// Entries is the number of applications held in the cache
+	Entries int
+	// HitRatio is the fraction of lookups since the previous flush which hit the cache
+	// and is zero if there have been no lookups
+	HitRatio      float64
+	FlushDuration time.Duration
+	// FlushLag is the time since the previous flush and is the maximum age of the usage reported by the flush
+	FlushLag time.Duration
+}
+
+// BackendCacheHook is called after each flush of a cached backend
+type BackendCacheHook func(report BackendCacheReport)
+
+// Outcome is the result of an authorization decision
+type Outcome string
+
+const (
+	OutcomeAllowed Outcome = "allowed"
+	OutcomeDenied  Outcome = "denied"
+	OutcomeError   Outcome = "error"
+)
+
+// DecisionReason explains a denied decision, or a decision allowed by the failure policy
+// The set of reasons is deliberately small so that it can be used as a metric label
+type DecisionReason string
+
+const (
+	// ReasonNone is set for errors and for requests allowed by 3scale
+	ReasonNone           DecisionReason = ""
+	ReasonLimitsExceeded DecisionReason = "limits_exceeded"
+	// ReasonCredentials is set when the user key or application key is invalid
+	ReasonCredentials         DecisionReason = "credentials"
+	ReasonApplicationNotFound DecisionReason = "application_not_found"
+	ReasonServiceTokenInvalid DecisionReason = "service_token_invalid"
+	ReasonNoMatch             DecisionReason = "no_match"
+	// ReasonIPDenied, ReasonIPNotAllowed and ReasonIPUnresolved are set for requests denied by the IPFilter
+	ReasonIPDenied     DecisionReason = "ip_denied"
+	ReasonIPNotAllowed DecisionReason = "ip_not_allowed"
+	ReasonIPUnresolved DecisionReason = "ip_unresolved"
+	// ReasonFailOpen is set for requests authorized by the failure policy as 3scale could not be reached
+	ReasonFailOpen DecisionReason = "fail_open"
+	// ReasonUnknown is set for any error code not listed above, including a missing error code
+	ReasonUnknown DecisionReason = "unknown"
+)
+
+// DecisionReport reports the outcome of an authorization decision made by the Manager
+type DecisionReport struct {
+	Service string
+	Outcome Outcome
+	Reason  DecisionReason
+	// TimeTaken is the end to end duration of the decision, including any calls to 3scale
+	TimeTaken time.Duration
+	// FromCache is set when the decision was made from cached state. See BackendResponse.FromCache
+	FromCache bool
+}
+
+// DecisionHook is called after each authorization decision made by the Manager
+type DecisionHook func(report DecisionReport)
+
+// InFlightHook is called with the number of decisions in progress each time a decision starts or ends
+type InFlightHook func(inFlight int64)
+
+// ConfigStalenessHook is called with the time since the config served for a service expired each time a config
+// is served from the system cache. Staleness is zero while the config is within its TTL
+type ConfigStalenessHook func(service string, staleness time.Duration)
+
+// ConfigAgeHook is called with the time since the config served for a service was last fetched or refreshed
+// each time a config is served from the system cache
+type ConfigAgeHook func(service string, age time.Duration)
+
+// Target is the 3scale API a failed call was made to
+type Target string
+
+const (
+	TargetSystem  Target = "system"
+	TargetBackend Target = "backend"
+)
+
+// FailureReport reports a call made by the Manager to 3scale system for the config of a service, or to 3scale
+// backend to authorize or report a request, which failed
+type FailureReport struct {
+	Target     Target
+	Service    string
+	ErrorClass ErrorClass
+}
+
+// FailureHook is called each time a call to 3scale system or 3scale backend fails
+type FailureHook func(report FailureReport)
+
+// ShedHook is called each time a call to 3scale backend is shed. See ConcurrencyConfig.MaxInFlight
+type ShedHook func()
+
 // MetricsReporter holds config for reporting metrics
 type MetricsReporter struct {
 	ReportMetrics bool
 	ResponseCB    ResponseHook
-	CacheHitCB    CacheHitHook
+	// ErrorCB is called, in place of ResponseCB, for each HTTP call to 3scale which failed without a response
+	ErrorCB     ResponseHook
+	CacheHitCB  CacheHitHook
+	CacheMissCB CacheMissHook
+	DecisionCB  DecisionHook
+	InFlightCB  InFlightHook
+	// BreakerStateCB is called each time a circuit breaker changes state. See WithCircuitBreaker
+	BreakerStateCB BreakerStateHook
+	// BackendInFlightCB and ShedCB report the calls in flight to 3scale backend and those shed
+	// once ConcurrencyConfig.MaxInFlight has been reached
+	BackendInFlightCB InFlightHook
+	ShedCB            ShedHook
+	BackendCacheCB    BackendCacheHook
+	// ConfigStalenessCB reports the staleness of configs served past TTL. See SystemCacheConfig.StaleGracePeriod
+	ConfigStalenessCB ConfigStalenessHook
+	// ConfigAgeCB reports the age of cached configs, which grows while refreshes of the config fail
+	ConfigAgeCB ConfigAgeHook
+	// FailureCB reports failed calls to 3scale system and 3scale backend, classified by ErrorClass
+	// Calls shed once ConcurrencyConfig.MaxInFlight has been reached are reported by ShedCB instead
+	FailureCB FailureHook
+}
+
+// newDecisionReport classifies the result of an authorization decision
+func newDecisionReport(service string, res *BackendResponse, err error, timeTaken time.Duration) DecisionReport {
+	report := DecisionReport{Service: service, TimeTaken: timeTaken}
+	if res != nil {
+		report.FromCache = res.FromCache
+	}
+
+	switch {
+	case err != nil || res == nil:
+		report.Outcome = OutcomeError
+	case res.Authorized:
+		report.Outcome = OutcomeAllowed
+		if res.FailedOpen {
+			report.Reason = ReasonFailOpen
+		}
+	default:
+		report.Outcome = OutcomeDenied
+		report.Reason = decisionReason(res.ErrorCode)
+	}
+	return report
+}
+
+func newBackendCacheReport(backendURL string, stats backend.FlushStats, hits, misses uint64) BackendCacheReport {
+	report := BackendCacheReport{
+		Backend:       backendURL,
+		Entries:       stats.Entries,
+		FlushDuration: stats.Duration,
+		FlushLag:      stats.Lag,
+	}
+	if lookups := hits + misses; lookups > 0 {
+		report.HitRatio = float64(hits) / float64(lookups)
+	}
+	return report
+}
+
+// decisionReason maps an error code returned by 3scale to a DecisionReason
+func decisionReason(errorCode string) DecisionReason {
+	switch errorCode {
+	case "limits_exceeded":
+		return ReasonLimitsExceeded
+	case "application_key_invalid", "user_key_invalid":
+		return ReasonCredentials
+	case "application_not_found":
+		return ReasonApplicationNotFound
+	case "service_token_invalid", "provider_key_invalid", "provider_key_invalid_or_service_missing":
+		return ReasonServiceTokenInvalid
+	case ErrorCodeNoMatch:
+		return ReasonNoMatch
+	case ErrorCodeIPDenied:
+		return ReasonIPDenied
+	case ErrorCodeIPNotAllowed:
+		return ReasonIPNotAllowed
+	case ErrorCodeIPUnresolved:
+		return ReasonIPUnresolved
+	default:
+		return ReasonUnknown
+	}
+}
+
+// DefaultLatencyWindowSize is the number of most recent samples used to compute latency quantiles
+const DefaultLatencyWindowSize = 1024
+
+// latencyQuantiles are the quantiles reported by Manager.LatencyQuantiles
+var latencyQuantiles = []float64{0.5, 0.95, 0.99}
+
+// latencyWindow keeps the most recent durations in a fixed size ring buffer
+// Recording is constant time, the cost of sorting is only paid when quantiles are requested
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+func newLatencyWindow(size int) *latencyWindow {
+	if size <= 0 {
+		size = DefaultLatencyWindowSize
+	}
+	return &latencyWindow{samples: make([]time.Duration, size)}
+}
+
+// record a sample, evicting the oldest when the window is full. Safe to call on a nil window
+func (lw *latencyWindow) record(d time.Duration) {
+	if lw == nil {
+		return
+	}
+
+	lw.mu.Lock()
+	lw.samples[lw.next] = d
+	lw.next++
+	if lw.next == len(lw.samples) {
+		lw.next = 0
+		lw.full = true
+	}
+	lw.mu.Unlock()
+}
+
+// quantiles returns the nearest-rank value for each of the provided quantiles
+// Returns an empty map when no samples have been recorded
+func (lw *latencyWindow) quantiles(qs []float64) map[float64]time.Duration {
+	result := make(map[float64]time.Duration, len(qs))
+	if lw == nil {
+		return result
+	}
+
+	lw.mu.Lock()
+	n := lw.next
+	if lw.full {
+		n = len(lw.samples)
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, lw.samples[:n])
+	lw.mu.Unlock()
+
+	if n == 0 {
+		return result
+	}
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for _, q := range qs {
+		idx := int(q*float64(n)+0.5) - 1
+		if idx < 0 {
+			idx = 0
+		}
+		if idx >= n {
+			idx = n - 1
+		}
+		result[q] = sorted[idx]
+	}
+	return result
 }
 
 type MetricsRoundTripper struct {
 	proxied http.RoundTripper
 	hook    ResponseHook
+	// errorHook, if set, is called for requests which failed without a response, for which hook is not called
+	errorHook ResponseHook
 }
 
 func (mt *MetricsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	start := time.Now()
 	resp, err := mt.proxied.RoundTrip(req)
-	if err != nil {
-		return resp, err
-	}
 
 	timeTaken := time.Now().Sub(start)
+	target, _ := req.Context().Value(targetKey{}).(Target)
 	report := TelemetryReport{
+		Target:    target,
 		Host:      req.Host,
 		Method:    req.Method,
 		Endpoint:  req.URL.Path,
-		Code:      resp.StatusCode,
 		TimeTaken: timeTaken,
 	}
-	mt.hook(report)
+	if err == nil {
+		report.Code = resp.StatusCode
+	}
+	report.ErrorClass = classifyError(err, report.Code)
+
+	switch {
+	case err != nil && mt.errorHook != nil:
+		mt.errorHook(report)
+	case err == nil && mt.hook != nil:
+		mt.hook(report)
+	}
 	return resp, err
 }
+
+// classifyError categorises the result of a request to 3scale
+func classifyError(err error, code int) ErrorClass {
+	if err != nil {
+		var netErr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+			return ErrorClassTimeout
+		}
+		return ErrorClassConnection
+	}
+
+	switch {
+	case code >= 500:
+		return ErrorClassServer
+	case code >= 400:
+		return ErrorClassClient
+	default:
+		return ErrorClassNone
+	}
+}
+
+// backendStatusError carries the status of the response to a call to 3scale backend which failed with a server
+// error, which the 3scale backend client only reports in the message of the error
+type backendStatusError struct {
+	code int
+	err  error
+}
+
+func (e backendStatusError) Error() string { return e.err.Error() }
+func (e backendStatusError) Unwrap() error { return e.err }
+
+// withBackendStatus wraps the error of a call to 3scale backend with the status of the raw response, if any
+func withBackendStatus(err error, rawResponse interface{}) error {
+	if resp, ok := rawResponse.(*http.Response); ok && resp != nil {
+		return backendStatusError{code: resp.StatusCode, err: err}
+	}
+	return err
+}
+
+// classifyFailure categorises the error returned by a call to 3scale system or 3scale backend as done by
+// classifyError for the requests made by the call
+func classifyFailure(err error) ErrorClass {
+	var netErr net.Error
+	var statusErr backendStatusError
+	var apiErr client.ApiErr
+	code := 0
+	switch {
+	// rejected calls are checked first as the error of an open breaker is returned by the transport
+	case errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrBackendCallsExhausted):
+		return ErrorClassRejected
+	case errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr):
+		return classifyError(err, 0)
+	case errors.As(err, &statusErr):
+		code = statusErr.code
+	case errors.As(err, &apiErr):
+		code = apiErr.Code()
+	}
+
+	if class := classifyError(nil, code); class != ErrorClassNone {
+		return class
+	}
+	return ErrorClassOther
+}
+
+// reportFailure classifies the error returned by a call to the target and reports it to the FailureCB, if set
+func (m Manager) reportFailure(target Target, service string, err error) {
+	if m.metricsReporter == nil || m.metricsReporter.FailureCB == nil {
+		return
+	}
+	m.metricsReporter.FailureCB(FailureReport{Target: target, Service: service, ErrorClass: classifyFailure(err)})
+}
@@ -0,0 +1,526 @@
+package authorizer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/3scale/3scale-authorizer/pkg/fake"
+	"github.com/3scale/3scale-go-client/threescale"
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+func TestLatencyWindow_Quantiles(t *testing.T) {
+	lw := newLatencyWindow(100)
+	if q := lw.quantiles(latencyQuantiles); len(q) != 0 {
+		t.Errorf("expected no quantiles before any samples are recorded, got %v", q)
+	}
+
+	// 1ms to 100ms in random order so the result does not depend on insertion order
+	for _, i := range []int{50, 1, 99, 25, 75, 100, 5, 95} {
+		lw.record(time.Duration(i) * time.Millisecond)
+	}
+	for i := 1; i <= 100; i++ {
+		switch i {
+		case 50, 1, 99, 25, 75, 100, 5, 95:
+			continue
+		}
+		lw.record(time.Duration(i) * time.Millisecond)
+	}
+
+	inputs := []struct {
+		quantile float64
+		min, max time.Duration
+	}{
+		{quantile: 0.5, min: 49 * time.Millisecond, max: 51 * time.Millisecond},
+		{quantile: 0.95, min: 94 * time.Millisecond, max: 96 * time.Millisecond},
+		{quantile: 0.99, min: 98 * time.Millisecond, max: 100 * time.Millisecond},
+	}
+
+	quantiles := lw.quantiles(latencyQuantiles)
+	for _, input := range inputs {
+		got, ok := quantiles[input.quantile]
+		if !ok {
+			t.Errorf("expected quantile %v to be reported", input.quantile)
+			continue
+		}
+		if got < input.min || got > input.max {
+			t.Errorf("expected quantile %v in range [%v, %v], got %v", input.quantile, input.min, input.max, got)
+		}
+	}
+
+	// a full window evicts the oldest samples
+	for i := 0; i < 100; i++ {
+		lw.record(time.Second)
+	}
+	if got := lw.quantiles([]float64{0.5})[0.5]; got != time.Second {
+		t.Errorf("expected old samples to be evicted from the window, got p50 %v", got)
+	}
+}
+
+func TestLatencyWindow_ConcurrentRecord(t *testing.T) {
+	lw := newLatencyWindow(10)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lw.record(time.Millisecond)
+			lw.quantiles(latencyQuantiles)
+		}()
+	}
+	wg.Wait()
+
+	if got := lw.quantiles([]float64{0.99})[0.99]; got != time.Millisecond {
+		t.Errorf("unexpected p99 %v", got)
+	}
+
+	var nilWindow *latencyWindow
+	nilWindow.record(time.Millisecond)
+	if q := nilWindow.quantiles(latencyQuantiles); len(q) != 0 {
+		t.Errorf("expected no quantiles from a nil window")
+	}
+}
+
+func TestManager_LatencyQuantiles(t *testing.T) {
+	m := Manager{
+		clientBuilder: mockBuilder{
+			withBackendClient: mockBackendClient{withAuthResponse: &threescale.AuthorizeResult{Authorized: true}},
+		},
+		latencies: newLatencyWindow(DefaultLatencyWindowSize),
+	}
+
+	if q := m.LatencyQuantiles(); len(q) != 0 {
+		t.Errorf("expected no quantiles before any calls to backend, got %v", q)
+	}
+
+	request := BackendRequest{
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: "any"}},
+		},
+	}
+	if _, err := m.AuthRep("any", request); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	q := m.LatencyQuantiles()
+	for _, quantile := range latencyQuantiles {
+		if _, ok := q[quantile]; !ok {
+			t.Errorf("expected quantile %v to be reported after a call to backend", quantile)
+		}
+	}
+}
+
+func TestManager_DecisionHook(t *testing.T) {
+	request := BackendRequest{
+		Service: "svc",
+		Transactions: []BackendTransaction{
+			{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: "any"}},
+		},
+	}
+
+	inputs := []struct {
+		name          string
+		backend       mockBackendClient
+		noMatch       NoMatchConfig
+		request       BackendRequest
+		expectOutcome Outcome
+		expectReason  DecisionReason
+	}{
+		{
+			name:          "Test allowed request",
+			backend:       mockBackendClient{withAuthResponse: &threescale.AuthorizeResult{Authorized: true}},
+			expectOutcome: OutcomeAllowed,
+			expectReason:  ReasonNone,
+		},
+		{
+			name: "Test request denied due to limits",
+			backend: mockBackendClient{withAuthResponse: &threescale.AuthorizeResult{
+				Authorized: false, ErrorCode: "limits_exceeded",
+			}},
+			expectOutcome: OutcomeDenied,
+			expectReason:  ReasonLimitsExceeded,
+		},
+		{
+			name: "Test request denied due to credentials",
+			backend: mockBackendClient{withAuthResponse: &threescale.AuthorizeResult{
+				Authorized: false, ErrorCode: "user_key_invalid",
+			}},
+			expectOutcome: OutcomeDenied,
+			expectReason:  ReasonCredentials,
+		},
+		{
+			name: "Test unrecognised error code is bucketed as unknown",
+			backend: mockBackendClient{withAuthResponse: &threescale.AuthorizeResult{
+				Authorized: false, ErrorCode: "something_new",
+			}},
+			expectOutcome: OutcomeDenied,
+			expectReason:  ReasonUnknown,
+		},
+		{
+			name:    "Test request denied due to no matching rules",
+			noMatch: NoMatchConfig{Behaviour: NoMatchDeny},
+			request: BackendRequest{
+				Service:      "svc",
+				Transactions: []BackendTransaction{{Params: BackendParams{UserKey: "any"}}},
+			},
+			expectOutcome: OutcomeDenied,
+			expectReason:  ReasonNoMatch,
+		},
+		{
+			name:          "Test error calling backend",
+			backend:       mockBackendClient{withAuthRepErr: true},
+			expectOutcome: OutcomeError,
+			expectReason:  ReasonNone,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var reports []DecisionReport
+			var inFlight []int64
+
+			m := Manager{
+				clientBuilder: mockBuilder{withBackendClient: input.backend},
+				backendConf:   BackendConfig{NoMatch: input.noMatch},
+				metricsReporter: &MetricsReporter{
+					DecisionCB: func(report DecisionReport) { reports = append(reports, report) },
+					InFlightCB: func(n int64) { inFlight = append(inFlight, n) },
+				},
+				inFlight: new(int64),
+			}
+
+			req := request
+			if len(input.request.Transactions) > 0 {
+				req = input.request
+			}
+			m.AuthRep("any", req)
+
+			if len(reports) != 1 {
+				t.Fatalf("expected a single decision to be reported, got %d", len(reports))
+			}
+			if reports[0].Service != "svc" {
+				t.Errorf("unexpected service %s", reports[0].Service)
+			}
+			if reports[0].Outcome != input.expectOutcome {
+				t.Errorf("expected outcome %s, got %s", input.expectOutcome, reports[0].Outcome)
+			}
+			if reports[0].Reason != input.expectReason {
+				t.Errorf("expected reason %q, got %q", input.expectReason, reports[0].Reason)
+			}
+			if len(inFlight) != 2 || inFlight[0] != 1 || inFlight[1] != 0 {
+				t.Errorf("expected in flight count to go from 1 to 0, got %v", inFlight)
+			}
+		})
+	}
+}
+
+func TestMetricsRoundTripper(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(time.Millisecond * 100)
+		case "/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+
+	inputs := []struct {
+		name        string
+		url         string
+		target      Target
+		expectCode  int
+		expectClass ErrorClass
+	}{
+		{
+			name:        "Test successful response",
+			url:         ts.URL + "/ok",
+			expectCode:  http.StatusOK,
+			expectClass: ErrorClassNone,
+		},
+		{
+			name:        "Test request to 3scale system",
+			url:         ts.URL + "/ok",
+			target:      TargetSystem,
+			expectCode:  http.StatusOK,
+			expectClass: ErrorClassNone,
+		},
+		{
+			name:        "Test request to 3scale backend",
+			url:         ts.URL + "/unavailable",
+			target:      TargetBackend,
+			expectCode:  http.StatusServiceUnavailable,
+			expectClass: ErrorClassServer,
+		},
+		{
+			name:        "Test client error response",
+			url:         ts.URL + "/missing",
+			expectCode:  http.StatusNotFound,
+			expectClass: ErrorClassClient,
+		},
+		{
+			name:        "Test server error response",
+			url:         ts.URL + "/unavailable",
+			expectCode:  http.StatusServiceUnavailable,
+			expectClass: ErrorClassServer,
+		},
+		{
+			name:        "Test timeout",
+			url:         ts.URL + "/slow",
+			expectClass: ErrorClassTimeout,
+		},
+		{
+			name:        "Test connection error",
+			url:         closed.URL,
+			expectClass: ErrorClassConnection,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var responses, errs []TelemetryReport
+			reporter := &MetricsReporter{
+				ReportMetrics: true,
+				ResponseCB:    func(report TelemetryReport) { responses = append(responses, report) },
+				ErrorCB:       func(report TelemetryReport) { errs = append(errs, report) },
+			}
+
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.ResponseHeaderTimeout = time.Millisecond * 20
+
+			m := NewManager(&http.Client{Transport: transport}, nil, BackendConfig{}, reporter)
+			httpClient := m.clientBuilder.(ClientBuilder).httpClient
+			if input.target != "" {
+				httpClient = withTarget(httpClient, input.target)
+			}
+			resp, err := httpClient.Get(input.url)
+			if err == nil {
+				resp.Body.Close()
+			}
+
+			// calls which failed without a response are only reported to the error hook
+			reports, other := responses, errs
+			if input.expectCode == 0 {
+				reports, other = errs, responses
+			}
+			if len(other) != 0 {
+				t.Errorf("expected no report to the other hook, got %v", other)
+			}
+			if len(reports) != 1 {
+				t.Fatalf("expected a single report, got %d", len(reports))
+			}
+			if reports[0].Code != input.expectCode {
+				t.Errorf("expected code %d, got %d", input.expectCode, reports[0].Code)
+			}
+			if reports[0].ErrorClass != input.expectClass {
+				t.Errorf("expected error class %q, got %q", input.expectClass, reports[0].ErrorClass)
+			}
+			if reports[0].Target != input.target {
+				t.Errorf("expected target %q, got %q", input.target, reports[0].Target)
+			}
+			if input.expectClass == ErrorClassTimeout && reports[0].TimeTaken < time.Millisecond*20 {
+				t.Errorf("expected time taken to cover the timeout, got %v", reports[0].TimeTaken)
+			}
+		})
+	}
+}
+
+func TestMetricsRoundTripper_WithoutErrorHook(t *testing.T) {
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+
+	var reports []TelemetryReport
+	reporter := &MetricsReporter{
+		ReportMetrics: true,
+		ResponseCB:    func(report TelemetryReport) { reports = append(reports, report) },
+	}
+	m := NewManager(&http.Client{}, nil, BackendConfig{}, reporter)
+	if _, err := m.clientBuilder.(ClientBuilder).httpClient.Get(closed.URL); err == nil {
+		t.Fatal("expected a connection error")
+	}
+	if len(reports) != 0 {
+		t.Errorf("expected a call without a response not to be reported to the response hook, got %v", reports)
+	}
+}
+
+func TestManager_FailureHook(t *testing.T) {
+	inputs := []struct {
+		name        string
+		target      Target
+		status      int
+		slow        bool
+		closed      bool
+		expectClass ErrorClass
+	}{
+		{name: "Test system server error", target: TargetSystem, status: http.StatusServiceUnavailable, expectClass: ErrorClassServer},
+		{name: "Test system client error", target: TargetSystem, status: http.StatusForbidden, expectClass: ErrorClassClient},
+		{name: "Test system timeout", target: TargetSystem, slow: true, expectClass: ErrorClassTimeout},
+		{name: "Test system connection error", target: TargetSystem, closed: true, expectClass: ErrorClassConnection},
+		{name: "Test backend server error", target: TargetBackend, status: http.StatusInternalServerError, expectClass: ErrorClassServer},
+		{name: "Test backend timeout", target: TargetBackend, slow: true, expectClass: ErrorClassTimeout},
+		{name: "Test backend connection error", target: TargetBackend, closed: true, expectClass: ErrorClassConnection},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			system := fake.NewSystem("access-token")
+			defer system.Close()
+			config := client.ProxyConfig{ID: 1, Version: 1, Environment: "production"}
+			system.SetConfig("1", "production", config)
+
+			backend := fake.NewBackend()
+			defer backend.Close()
+			backend.AddService("1", "token", nil)
+			backend.AddApplication("1", fake.Application{UserKey: "key"})
+
+			var failing interface {
+				Fail(serviceID string, status int)
+				SetLatency(latency time.Duration)
+				Close()
+			} = system
+			if input.target == TargetBackend {
+				failing = backend
+			}
+			switch {
+			case input.status != 0:
+				failing.Fail("1", input.status)
+			case input.slow:
+				failing.SetLatency(time.Millisecond * 200)
+			case input.closed:
+				failing.Close()
+			}
+
+			var reports []FailureReport
+			reporter := &MetricsReporter{FailureCB: func(report FailureReport) { reports = append(reports, report) }}
+			m := NewManager(&http.Client{}, nil, BackendConfig{}, reporter,
+				WithTimeouts(TimeoutConfig{System: time.Millisecond * 50, Backend: time.Millisecond * 50}))
+
+			_, err := m.GetSystemConfiguration(system.URL, SystemRequest{AccessToken: "access-token", ServiceID: "1", Environment: "production"})
+			if input.target == TargetBackend {
+				if err != nil {
+					t.Fatalf("unexpected error fetching config %v", err)
+				}
+				_, err = m.AuthRep(backend.URL, BackendRequest{
+					Auth:         BackendAuth{Type: "service_token", Value: "token"},
+					Service:      "1",
+					Transactions: []BackendTransaction{{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: "key"}}},
+				})
+			}
+			if err == nil {
+				t.Fatal("expected the call to fail")
+			}
+
+			if len(reports) != 1 {
+				t.Fatalf("expected a single failure to be reported, got %+v", reports)
+			}
+			expect := FailureReport{Target: input.target, Service: "1", ErrorClass: input.expectClass}
+			if reports[0] != expect {
+				t.Errorf("expected failure %+v, got %+v", expect, reports[0])
+			}
+		})
+	}
+}
+
+func TestClassifyFailure(t *testing.T) {
+	inputs := []struct {
+		name   string
+		err    error
+		expect ErrorClass
+	}{
+		{name: "Test deadline exceeded", err: fmt.Errorf("wrapped - %w", context.DeadlineExceeded), expect: ErrorClassTimeout},
+		{name: "Test connection error", err: &url.Error{Op: "Get", URL: "backend", Err: &net.OpError{Op: "dial", Err: errors.New("refused")}}, expect: ErrorClassConnection},
+		{name: "Test circuit open", err: &url.Error{Op: "Get", URL: "backend", Err: circuitOpenError{host: "backend"}}, expect: ErrorClassRejected},
+		{name: "Test calls exhausted", err: fmt.Errorf("%w for backend", ErrBackendCallsExhausted), expect: ErrorClassRejected},
+		{name: "Test backend server error", err: backendStatusError{code: 502, err: errors.New("unable to process request - status: 502 Bad Gateway")}, expect: ErrorClassServer},
+		{name: "Test status only in the message", err: errors.New("unable to process request - status: 502 Bad Gateway"), expect: ErrorClassOther},
+		{name: "Test unreadable response", err: errors.New("XML syntax error on line 1: unexpected EOF"), expect: ErrorClassOther},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			if got := classifyFailure(input.err); got != input.expect {
+				t.Errorf("expected %q, got %q", input.expect, got)
+			}
+		})
+	}
+}
+
+func TestManager_RejectionReasons(t *testing.T) {
+	const userKey = "raw-user-key"
+
+	inputs := []struct {
+		errorCode    string
+		expectReason DecisionReason
+	}{
+		{errorCode: "limits_exceeded", expectReason: ReasonLimitsExceeded},
+		{errorCode: "application_not_found", expectReason: ReasonApplicationNotFound},
+		{errorCode: "user_key_invalid", expectReason: ReasonCredentials},
+		{errorCode: "application_key_invalid", expectReason: ReasonCredentials},
+		{errorCode: "service_token_invalid", expectReason: ReasonServiceTokenInvalid},
+		{errorCode: "provider_key_invalid", expectReason: ReasonServiceTokenInvalid},
+		{errorCode: "not_a_known_code", expectReason: ReasonUnknown},
+		{errorCode: "", expectReason: ReasonUnknown},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.errorCode, func(t *testing.T) {
+			var reports []DecisionReport
+			logger := &recordingLogger{}
+			m := Manager{
+				clientBuilder: mockBuilder{
+					withBackendClient: mockBackendClient{withAuthResponse: &threescale.AuthorizeResult{
+						Authorized: false, ErrorCode: input.errorCode,
+					}},
+				},
+				backendConf: BackendConfig{Logger: logger},
+				metricsReporter: &MetricsReporter{
+					DecisionCB: func(report DecisionReport) { reports = append(reports, report) },
+				},
+			}
+
+			request := BackendRequest{
+				Service: "svc",
+				Transactions: []BackendTransaction{
+					{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: userKey}},
+				},
+			}
+			resp, err := m.AuthRep("any", request)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if resp.ErrorCode != input.errorCode {
+				t.Errorf("expected the error code to be retained, got %q", resp.ErrorCode)
+			}
+
+			if len(reports) != 1 || reports[0].Reason != input.expectReason {
+				t.Errorf("expected reason %q, got %v", input.expectReason, reports)
+			}
+
+			if len(logger.infos) != 1 {
+				t.Fatalf("expected the denial to be logged, got %v", logger.infos)
+			}
+			line := logger.infos[0]
+			if !strings.Contains(line, "svc") || !strings.Contains(line, string(input.expectReason)) {
+				t.Errorf("expected service and reason to be logged, got %s", line)
+			}
+			if !strings.Contains(line, hashCredential(userKey)) || strings.Contains(line, userKey) {
+				t.Errorf("expected only the hashed credential to be logged, got %s", line)
+			}
+		})
+	}
+}
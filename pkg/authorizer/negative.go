@@ -0,0 +1,144 @@
+package authorizer
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/3scale/3scale-authorizer/pkg/system/v1/cache"
+)
+
+// DefaultNegativeCacheSize is the number of denials held by the negative cache when NegativeCacheConfig.MaxSize is unset
+const DefaultNegativeCacheSize = 1024
+
+// NegativeCacheConfig configures the caching of requests denied by 3scale because of their credentials
+// Identical requests are denied from the cache, without calling 3scale, until the denial expires
+// Denials for any other reason, such as limits being exceeded, are never cached
+type NegativeCacheConfig struct {
+	// TTL of a cached denial. Zero disables the negative cache
+	TTL time.Duration
+	// MaxSize is the number of denials held, evicting the least recently used. Defaults to DefaultNegativeCacheSize
+	MaxSize int
+	// Clock determines the expiry of cached denials. Defaults to cache.RealClock
+	Clock cache.Clock
+}
+
+// negativeCache holds denials keyed by service and a hash of the credentials of the request
+type negativeCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	maxSize int
+	clock   cache.Clock
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type negativeEntry struct {
+	key      string
+	res      BackendResponse
+	version  int
+	storedAt time.Time
+	ttl      time.Duration
+}
+
+func newNegativeCache(config NegativeCacheConfig) *negativeCache {
+	if config.MaxSize <= 0 {
+		config.MaxSize = DefaultNegativeCacheSize
+	}
+	if config.Clock == nil {
+		config.Clock = cache.RealClock{}
+	}
+	return &negativeCache{
+		ttl:     config.TTL,
+		maxSize: config.MaxSize,
+		clock:   config.Clock,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns a copy of the denial cached for the key, flagged as served from the cache
+// Denials which have expired or were cached for another version of the proxy config are treated as missing
+func (c *negativeCache) get(key string, version int) (*BackendResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*negativeEntry)
+	age := c.clock.Now().Sub(entry.storedAt)
+	if age > entry.ttl || entry.version != version {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(e)
+	res := entry.res
+	res.FromCache = true
+	res.CacheAge = age
+	return &res, true
+}
+
+// set caches the denial for the key, evicting the least recently used denial if the cache is full
+func (c *negativeCache) set(key string, version int, res *BackendResponse) {
+	c.setFor(key, version, res, c.ttl)
+}
+
+// setFor caches the response for the key until the TTL has passed. See set
+func (c *negativeCache) setFor(key string, version int, res *BackendResponse, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &negativeEntry{key: key, res: *res, version: version, storedAt: c.clock.Now(), ttl: ttl}
+	// the raw response references the request made to 3scale, including its credentials
+	entry.res.RawResponse = nil
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+	if c.order.Len() > c.maxSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*negativeEntry).key)
+	}
+}
+
+// negativeCacheKey returns the key a denial of the request is cached under
+// Returns false for requests which cannot be cached, such as those with multiple transactions
+func negativeCacheKey(backendURL string, request BackendRequest) (string, bool) {
+	if len(request.Transactions) != 1 {
+		return "", false
+	}
+
+	params := request.Transactions[0].Params
+	return backendURL + "|" + request.Service + "|" + fingerprint(params.AppID, params.AppKey, params.UserKey), true
+}
+
+// isCredentialDenial returns true if 3scale denied the request because of its credentials
+func isCredentialDenial(res *BackendResponse) bool {
+	if res == nil || res.Authorized {
+		return false
+	}
+	reason := decisionReason(res.ErrorCode)
+	return reason == ReasonCredentials || reason == ReasonApplicationNotFound
+}
+
+// negativeLookup returns the cached denial of the request, if any, and reports the lookup
+func (m Manager) negativeLookup(key string, version int) (*BackendResponse, bool) {
+	res, ok := m.negative.get(key, version)
+	if m.metricsReporter != nil {
+		if ok && m.metricsReporter.CacheHitCB != nil {
+			m.metricsReporter.CacheHitCB(Negative)
+		}
+		if !ok && m.metricsReporter.CacheMissCB != nil {
+			m.metricsReporter.CacheMissCB(Negative)
+		}
+	}
+	return res, ok
+}
@@ -0,0 +1,122 @@
+package authorizer
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/3scale/3scale-authorizer/pkg/fake"
+	"github.com/3scale/3scale-authorizer/pkg/system/v1/cache"
+)
+
+func TestManager_NegativeCache(t *testing.T) {
+	inputs := []struct {
+		name        string
+		params      BackendParams
+		expectCalls int
+	}{
+		{
+			name:        "Test unknown application is denied from the cache",
+			params:      BackendParams{AppID: "unknown"},
+			expectCalls: 1,
+		},
+		{
+			name:        "Test invalid user key is denied from the cache",
+			params:      BackendParams{UserKey: "unknown"},
+			expectCalls: 1,
+		},
+		{
+			name:        "Test limits exceeded is not cached",
+			params:      BackendParams{UserKey: "limited"},
+			expectCalls: 5,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			backend := fake.NewBackend()
+			defer backend.Close()
+			backend.AddService("any", "token", nil)
+			backend.AddApplication("any", fake.Application{
+				UserKey: "limited",
+				Limits:  []fake.Limit{{Metric: "hits", Period: "minute", Max: 0}},
+			})
+
+			var hits, misses int
+			reporter := &MetricsReporter{
+				CacheHitCB: func(cache Cache) {
+					if cache == Negative {
+						hits++
+					}
+				},
+				CacheMissCB: func(cache Cache) {
+					if cache == Negative {
+						misses++
+					}
+				},
+			}
+			m := NewManager(&http.Client{}, nil, BackendConfig{NegativeCache: NegativeCacheConfig{TTL: time.Minute}}, reporter)
+			request := BackendRequest{
+				Auth:    BackendAuth{Type: "service_token", Value: "token"},
+				Service: "any",
+				Transactions: []BackendTransaction{
+					{Metrics: map[string]int{"hits": 1}, Params: input.params},
+				},
+			}
+
+			for i := 0; i < 5; i++ {
+				res, err := m.AuthRep(backend.URL, request)
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				if res.Authorized || res.ErrorCode == "" {
+					t.Fatalf("expected the request to be denied with an error code, got %+v", res)
+				}
+				if cached := i > 0 && input.expectCalls == 1; res.FromCache != cached {
+					t.Errorf("expected the denial to be flagged as cached to be %t", cached)
+				}
+			}
+
+			if calls := len(backend.Requests(fake.AuthRepPath)); calls != input.expectCalls {
+				t.Errorf("expected %d calls to 3scale, got %d", input.expectCalls, calls)
+			}
+			if hits+misses != 5 || misses != input.expectCalls {
+				t.Errorf("unexpected cache lookups, got %d hits and %d misses", hits, misses)
+			}
+		})
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	denied := &BackendResponse{ErrorCode: "application_not_found"}
+
+	clock := cache.NewManualClock(time.Now())
+	c := newNegativeCache(NegativeCacheConfig{TTL: time.Minute, MaxSize: 2, Clock: clock})
+	c.set("a", 1, denied)
+	if _, ok := c.get("a", 2); ok {
+		t.Error("expected the denial to be bypassed for a different config version")
+	}
+	if _, ok := c.get("a", 1); ok {
+		t.Error("expected the denial to have been removed once bypassed")
+	}
+
+	c.set("a", 1, denied)
+	c.set("b", 1, denied)
+	// using a leaves b as the least recently used
+	c.get("a", 1)
+	c.set("c", 1, denied)
+	for key, expect := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := c.get(key, 1); ok != expect {
+			t.Errorf("expected %s to be cached to be %t", key, expect)
+		}
+	}
+
+	clock.Advance(time.Second * 30)
+	if res, ok := c.get("a", 1); !ok || res.CacheAge != time.Second*30 {
+		t.Errorf("expected the age of the denial to be reported, got %v", res)
+	}
+	clock.Advance(time.Minute)
+	if _, ok := c.get("a", 1); ok {
+		t.Error("expected the denial to have expired")
+	}
+}
@@ -0,0 +1,100 @@
+package authorizer
+
+// ManagerOption configures optional behaviour of the Manager. See NewManager
+type ManagerOption func(*managerOptions)
+
+type managerOptions struct {
+	maxSystemResponseSize int64
+	auditSink             AuditSink
+	failover              *FailoverRoundTripper
+	breaker               *BreakerConfig
+	retry                 *RetryConfig
+	timeouts              *TimeoutConfig
+	strictRules           bool
+	ruleLimit             RuleLimitConfig
+	ruleOptions           RuleOptions
+	tracer                Tracer
+}
+
+// WithMaxSystemResponseSize limits the size, in bytes, of a response body read from 3scale system
+// Responses exceeding the limit result in an error. A non-positive value implies no limit
+func WithMaxSystemResponseSize(bytes int64) ManagerOption {
+	return func(o *managerOptions) {
+		o.maxSystemResponseSize = bytes
+	}
+}
+
+// WithAuditSink records each authorization decision made by the Manager to the provided sink
+// The sink is owned by the caller and must be closed by the caller once the Manager has been shut down
+func WithAuditSink(sink AuditSink) ManagerOption {
+	return func(o *managerOptions) {
+		o.auditSink = sink
+	}
+}
+
+// WithBackendEndpoints sends requests to 3scale backend to the provided set of endpoints rather than the
+// backend URL provided with each request, failing over between them on connection errors. See FailoverConfig
+// The option may be used to build several Managers, each of which tracks the health of the endpoints separately
+// An error is returned if the config is invalid
+func WithBackendEndpoints(config FailoverConfig) (ManagerOption, error) {
+	failover, err := newFailoverRoundTripper(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(o *managerOptions) {
+		o.failover = failover
+	}, nil
+}
+
+// WithCircuitBreaker fails calls to a 3scale system or backend host fast once the rate of failed calls to that
+// host crosses the configured threshold. Calls rejected by an open breaker return an error wrapping ErrCircuitOpen,
+// to which the failure policy of the backend config is applied. See BreakerConfig
+func WithCircuitBreaker(config BreakerConfig) ManagerOption {
+	return func(o *managerOptions) {
+		o.breaker = &config
+	}
+}
+
+// WithRetries retries calls to 3scale system and backend which fail with a network error or 5xx response,
+// backing off exponentially between attempts. Calls which report usage, AuthRep and Report, are only
+// retried when a connection could not be established, so usage is never reported twice. See RetryConfig
+func WithRetries(config RetryConfig) ManagerOption {
+	return func(o *managerOptions) {
+		o.retry = &config
+	}
+}
+
+// WithTimeouts bounds the duration of each call to 3scale system and backend, including any retries
+// Takes precedence over a timeout set on the http.Client provided to NewManager. See TimeoutConfig
+func WithTimeouts(config TimeoutConfig) ManagerOption {
+	return func(o *managerOptions) {
+		o.timeouts = &config
+	}
+}
+
+// WithStrictRuleValidation fails fetches of a config from 3scale system if any of its mapping rules cannot be
+// compiled, returning an error wrapping ErrInvalidRules. A cached config is retained when its refresh fails
+// Invalid rules are always logged. See ValidateConfig
+func WithStrictRuleValidation() ManagerOption {
+	return func(o *managerOptions) {
+		o.strictRules = true
+	}
+}
+
+// WithRuleLimit limits the number of mapping rules of each service, logging a warning for configs which exceed
+// the limit. Such configs are truncated or, if set to reject, fetches fail with an error wrapping ErrTooManyRules
+// A cached config is retained when its refresh fails
+func WithRuleLimit(config RuleLimitConfig) ManagerOption {
+	return func(o *managerOptions) {
+		o.ruleLimit = config
+	}
+}
+
+// WithRuleOptions configures how requests are matched against the mapping rules of their service by Check
+// See RuleOptions
+func WithRuleOptions(options RuleOptions) ManagerOption {
+	return func(o *managerOptions) {
+		o.ruleOptions = options
+	}
+}
@@ -0,0 +1,97 @@
+package authorizer
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithMaxSystemResponseSize(t *testing.T) {
+	const limit = 64
+	const validConfig = `{"proxy_config":{"id":1,"version":1,"environment":"test"}}`
+	oversizedConfig := `{"proxy_config":{"id":1,"environment":"` + strings.Repeat("a", limit) + `"}}`
+
+	inputs := []struct {
+		name      string
+		body      string
+		chunked   bool
+		expectErr bool
+	}{
+		{
+			name: "Test response within the limit succeeds",
+			body: validConfig,
+		},
+		{
+			name:      "Test response with content length above the limit fails",
+			body:      oversizedConfig,
+			expectErr: true,
+		},
+		{
+			name:      "Test chunked response above the limit fails",
+			body:      oversizedConfig,
+			chunked:   true,
+			expectErr: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if input.chunked {
+					// flushing before writing the body forces a response without a content length
+					w.(http.Flusher).Flush()
+				}
+				w.Write([]byte(input.body))
+			}))
+			defer ts.Close()
+
+			m := NewManager(&http.Client{}, nil, BackendConfig{}, nil, WithMaxSystemResponseSize(limit))
+			request := SystemRequest{
+				AccessToken: "any",
+				ServiceID:   "1",
+				Environment: "test",
+			}
+
+			_, err := m.GetSystemConfiguration(ts.URL, request)
+			if err != nil {
+				if !input.expectErr {
+					t.Errorf("unexpected error %v", err)
+				}
+				if !strings.Contains(err.Error(), ErrResponseTooLarge.Error()) {
+					t.Errorf("expected error to report the size limit, got %v", err)
+				}
+				return
+			}
+
+			if input.expectErr {
+				t.Error("expected an error when the response exceeds the limit")
+			}
+		})
+	}
+}
+
+func TestLimitedReadCloser(t *testing.T) {
+	body := strings.Repeat("a", 10)
+
+	r := &limitedReadCloser{ReadCloser: nopCloser{strings.NewReader(body)}, remaining: 10}
+	buf := make([]byte, 32)
+	n, err := r.Read(buf)
+	if n != 10 || err != nil {
+		t.Errorf("expected body matching the limit to be read in full, got %d bytes and error %v", n, err)
+	}
+
+	r = &limitedReadCloser{ReadCloser: nopCloser{strings.NewReader(body)}, remaining: 9}
+	n, err = r.Read(buf)
+	if n != 9 || !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("expected %d bytes and ErrResponseTooLarge, got %d bytes and error %v", 9, n, err)
+	}
+}
+
+type nopCloser struct {
+	*strings.Reader
+}
+
+func (nopCloser) Close() error { return nil }
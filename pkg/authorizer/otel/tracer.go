@@ -0,0 +1,50 @@
+// Package otel exports the spans of an authorizer.Manager with OpenTelemetry
+package otel
+
+import (
+	"context"
+
+	"github.com/3scale/3scale-authorizer/pkg/authorizer"
+	"github.com/3scale/3scale-authorizer/pkg/core"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentationName is the name of the OpenTelemetry tracer the spans are started with
+const InstrumentationName = "github.com/3scale/3scale-authorizer"
+
+// NewTracer returns an authorizer.Tracer which starts the spans of the Manager with a tracer of the provider
+// Spans are started as children of the span of the context passed to the *Context methods of the Manager
+// See authorizer.WithTracer
+func NewTracer(provider trace.TracerProvider) authorizer.Tracer {
+	return tracer{provider.Tracer(InstrumentationName)}
+}
+
+type tracer struct {
+	tracer trace.Tracer
+}
+
+func (t tracer) StartSpan(ctx context.Context, name string) (context.Context, authorizer.Span) {
+	ctx, s := t.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindInternal))
+	return ctx, span{s}
+}
+
+type span struct {
+	span trace.Span
+}
+
+func (s span) SetAttribute(key, value string) {
+	s.span.SetAttributes(attribute.String(key, value))
+}
+
+// End the span, setting its status to error if the operation failed. The error is redacted as it may carry
+// the credentials of the request
+func (s span) End(err error) {
+	if err != nil {
+		err = core.RedactError(err)
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
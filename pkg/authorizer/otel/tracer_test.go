@@ -0,0 +1,91 @@
+package otel
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/3scale/3scale-authorizer/pkg/authorizer"
+	"github.com/3scale/3scale-authorizer/pkg/fake"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracer(t *testing.T) {
+	backend := fake.NewBackend()
+	defer backend.Close()
+	backend.AddService("1", "token", nil)
+	backend.AddApplication("1", fake.Application{UserKey: "key"})
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(context.Background())
+
+	m := authorizer.NewManager(&http.Client{}, nil, authorizer.BackendConfig{}, nil, authorizer.WithTracer(NewTracer(provider)))
+
+	ctx, incoming := provider.Tracer("test").Start(context.Background(), "incoming")
+	request := authorizer.BackendRequest{
+		Auth:    authorizer.BackendAuth{Type: "service_token", Value: "token"},
+		Service: "1",
+		Transactions: []authorizer.BackendTransaction{
+			{Metrics: map[string]int{"hits": 1}, Params: authorizer.BackendParams{UserKey: "key"}},
+		},
+	}
+	if res, err := m.AuthRepContext(ctx, backend.URL, request); err != nil || !res.Authorized {
+		t.Fatalf("expected the request to be authorized, got %+v - %v", res, err)
+	}
+	incoming.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans to be exported, got %d", len(spans))
+	}
+	backendCall, decision := spans[0], spans[1]
+	if decision.Name != authorizer.SpanAuthorize || decision.Parent.SpanID() != incoming.SpanContext().SpanID() {
+		t.Errorf("expected the decision to be a child of the incoming span, got %s with parent %s", decision.Name, decision.Parent.SpanID())
+	}
+	if backendCall.Name != authorizer.SpanBackendCall || backendCall.Parent.SpanID() != decision.SpanContext.SpanID() {
+		t.Errorf("expected the call to 3scale backend to be a child of the decision, got %s with parent %s", backendCall.Name, backendCall.Parent.SpanID())
+	}
+	if decision.SpanContext.TraceID() != incoming.SpanContext().TraceID() {
+		t.Error("expected the spans to belong to the trace of the incoming span")
+	}
+
+	expect := map[attribute.Key]string{"service": "1", "call": "AuthRep", "decision": string(authorizer.OutcomeAllowed), "cache_hit": "false"}
+	got := make(map[attribute.Key]string)
+	for _, kv := range decision.Attributes {
+		got[kv.Key] = kv.Value.AsString()
+	}
+	for key, value := range expect {
+		if got[key] != value {
+			t.Errorf("expected attribute %s to be %q, got %q", key, value, got[key])
+		}
+	}
+}
+
+func TestTracer_Error(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(context.Background())
+
+	m := authorizer.NewManager(&http.Client{}, nil, authorizer.BackendConfig{}, nil, authorizer.WithTracer(NewTracer(provider)))
+	request := authorizer.BackendRequest{
+		Service:      "1",
+		Transactions: []authorizer.BackendTransaction{{Params: authorizer.BackendParams{UserKey: "secret-user-key"}}},
+	}
+	if _, err := m.AuthorizeContext(context.Background(), "http://127.0.0.1:1", request); err == nil {
+		t.Fatal("expected an error as 3scale backend is unreachable")
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans to be exported, got %d", len(spans))
+	}
+	for _, span := range spans {
+		if span.Status.Code != codes.Error || len(span.Events) != 1 {
+			t.Errorf("expected span %s to record the error, got status %+v", span.Name, span.Status)
+		}
+	}
+}
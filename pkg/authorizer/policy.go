@@ -0,0 +1,120 @@
+package authorizer
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+// NoMatchBehaviour determines how a request which carries no usage is handled
+type NoMatchBehaviour int
+
+const (
+	// NoMatchAuthorizeOnly passes the request to 3scale as is which authorizes the request without reporting usage
+	NoMatchAuthorizeOnly NoMatchBehaviour = iota
+	// NoMatchDefaultMetric reports the configured default metric for the request
+	NoMatchDefaultMetric
+	// NoMatchDeny denies the request without calling 3scale
+	NoMatchDeny
+)
+
+const (
+	// DefaultMetric is the base metric assumed when no DefaultMetricName has been configured or discovered
+	DefaultMetric = "hits"
+
+	// ErrorCodeNoMatch is set as the error code on responses denied by NoMatchDeny
+	ErrorCodeNoMatch = "no_match"
+)
+
+// NoMatchConfig configures the handling of requests which carry no usage
+// The zero value authorizes the request with 3scale without reporting usage
+type NoMatchConfig struct {
+	Behaviour NoMatchBehaviour
+	// Metric and Delta are used by NoMatchDefaultMetric
+	// Metric defaults to the base metric of the service, see Manager.DefaultMetricName. Delta defaults to 1
+	Metric string
+	Delta  int
+}
+
+// apply the configured behaviour to a request which carries no usage
+// Returns the request that should be sent to 3scale, or a response if the request should be denied
+func (c NoMatchConfig) apply(request BackendRequest, defaultMetric string) (BackendRequest, *BackendResponse) {
+	if len(request.Transactions) < 1 || len(request.Transactions[0].Metrics) > 0 {
+		return request, nil
+	}
+
+	switch c.Behaviour {
+	case NoMatchDeny:
+		return request, &BackendResponse{
+			Authorized:     false,
+			ErrorCode:      ErrorCodeNoMatch,
+			RejectedReason: ErrorCodeNoMatch,
+		}
+	case NoMatchDefaultMetric:
+		metric, delta := c.Metric, c.Delta
+		if metric == "" {
+			metric = defaultMetric
+		}
+		if metric == "" {
+			metric = DefaultMetric
+		}
+		if delta == 0 {
+			delta = 1
+		}
+
+		// copy the transactions so we don't modify the callers request
+		transactions := append([]BackendTransaction(nil), request.Transactions...)
+		transactions[0].Metrics = map[string]int{metric: delta}
+		request.Transactions = transactions
+	}
+
+	return request, nil
+}
+
+// ErrUnknownMetric is returned when the base metric is not among the metrics known to the service
+var ErrUnknownMetric = errors.New("metric is not defined for service")
+
+// DefaultMetricName returns the base metric of the service described by the proxy config
+// An explicitly configured BackendConfig.DefaultMetricName takes precedence and is validated against the
+// metrics referenced by the services mapping rules. Otherwise the metric is discovered from the rule
+// mapping the root path, which 3scale creates for the base metric, falling back to DefaultMetric
+func (m Manager) DefaultMetricName(config client.ProxyConfig) (string, error) {
+	rules := config.Content.Proxy.ProxyRules
+
+	if name := m.backendConf.DefaultMetricName; name != "" {
+		// without any rules there is nothing to validate against
+		if len(rules) == 0 {
+			return name, nil
+		}
+		for _, rule := range rules {
+			if rule.MetricSystemName == name {
+				return name, nil
+			}
+		}
+		return "", fmt.Errorf("%w %d - %s", ErrUnknownMetric, config.Content.ID, name)
+	}
+
+	for _, rule := range rules {
+		if rule.Pattern == "/" && rule.MetricSystemName != "" {
+			return rule.MetricSystemName, nil
+		}
+	}
+	return DefaultMetric, nil
+}
+
+// needsDefaultMetric returns true if requests which carry no usage are reported against the base metric
+func (c NoMatchConfig) needsDefaultMetric() bool {
+	return c.Behaviour == NoMatchDefaultMetric && c.Metric == ""
+}
+
+// defaultMetric returns the base metric resolved for the service when its config was cached, falling back to
+// BackendConfig.DefaultMetricName for services whose config has not been cached by the Manager
+func (m Manager) defaultMetric(service string) string {
+	if m.defaultMetrics != nil {
+		if name, ok := m.defaultMetrics.Load(service); ok {
+			return name.(string)
+		}
+	}
+	return m.backendConf.DefaultMetricName
+}
@@ -0,0 +1,341 @@
+package authorizer
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/3scale/3scale-authorizer/pkg/backend/v1"
+	"github.com/3scale/3scale-authorizer/pkg/fake"
+	"github.com/3scale/3scale-go-client/threescale"
+	"github.com/3scale/3scale-go-client/threescale/api"
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+func TestManager_AuthRepNoMatch(t *testing.T) {
+	newRequest := func(metrics map[string]int) BackendRequest {
+		return BackendRequest{
+			Auth:    BackendAuth{Type: "any", Value: "any"},
+			Service: "any",
+			Transactions: []BackendTransaction{
+				{Metrics: metrics, Params: BackendParams{UserKey: "any"}},
+			},
+		}
+	}
+
+	inputs := []struct {
+		name             string
+		config           NoMatchConfig
+		defaultMetric    string
+		request          BackendRequest
+		expectCalled     bool
+		expectMetrics    api.Metrics
+		expectAuthorized bool
+	}{
+		{
+			name:             "Test default behaviour passes request with no usage to 3scale",
+			request:          newRequest(nil),
+			expectCalled:     true,
+			expectAuthorized: true,
+		},
+		{
+			name:             "Test default metric is applied when no usage",
+			config:           NoMatchConfig{Behaviour: NoMatchDefaultMetric},
+			request:          newRequest(map[string]int{}),
+			expectCalled:     true,
+			expectMetrics:    api.Metrics{"hits": 1},
+			expectAuthorized: true,
+		},
+		{
+			name:             "Test configured default metric is applied when no usage",
+			config:           NoMatchConfig{Behaviour: NoMatchDefaultMetric, Metric: "requests", Delta: 2},
+			request:          newRequest(nil),
+			expectCalled:     true,
+			expectMetrics:    api.Metrics{"requests": 2},
+			expectAuthorized: true,
+		},
+		{
+			name:             "Test configured default metric name is applied when no usage",
+			config:           NoMatchConfig{Behaviour: NoMatchDefaultMetric},
+			defaultMetric:    "requests",
+			request:          newRequest(nil),
+			expectCalled:     true,
+			expectMetrics:    api.Metrics{"requests": 1},
+			expectAuthorized: true,
+		},
+		{
+			name:             "Test default metric is not applied when usage is present",
+			config:           NoMatchConfig{Behaviour: NoMatchDefaultMetric},
+			request:          newRequest(map[string]int{"other": 3}),
+			expectCalled:     true,
+			expectMetrics:    api.Metrics{"other": 3},
+			expectAuthorized: true,
+		},
+		{
+			name:             "Test deny without calling 3scale when no usage",
+			config:           NoMatchConfig{Behaviour: NoMatchDeny},
+			request:          newRequest(nil),
+			expectCalled:     false,
+			expectAuthorized: false,
+		},
+		{
+			name:             "Test deny does not apply when usage is present",
+			config:           NoMatchConfig{Behaviour: NoMatchDeny},
+			request:          newRequest(map[string]int{"hits": 1}),
+			expectCalled:     true,
+			expectMetrics:    api.Metrics{"hits": 1},
+			expectAuthorized: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var authReps []threescale.Request
+			m := Manager{
+				clientBuilder: mockBuilder{
+					withBackendClient: mockBackendClient{
+						withAuthResponse: &threescale.AuthorizeResult{Authorized: true},
+						authReps:         &authReps,
+					},
+				},
+				backendConf: BackendConfig{NoMatch: input.config, DefaultMetricName: input.defaultMetric},
+			}
+
+			resp, err := m.AuthRep("any", input.request)
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+				return
+			}
+
+			if resp.Authorized != input.expectAuthorized {
+				t.Errorf("unexpected auth result")
+			}
+
+			if !input.expectCalled {
+				if len(authReps) != 0 {
+					t.Error("expected 3scale not to have been called")
+				}
+				if resp.ErrorCode != ErrorCodeNoMatch {
+					t.Errorf("unexpected error code %s", resp.ErrorCode)
+				}
+				return
+			}
+
+			if len(authReps) != 1 {
+				t.Fatalf("expected 3scale to have been called once")
+			}
+			metrics := authReps[0].Transactions[0].Metrics
+			if len(metrics) != len(input.expectMetrics) {
+				t.Errorf("unexpected metrics %v", metrics)
+			}
+			for metric, value := range input.expectMetrics {
+				if metrics[metric] != value {
+					t.Errorf("unexpected metrics %v", metrics)
+				}
+			}
+		})
+	}
+}
+
+func TestManager_DefaultMetricName(t *testing.T) {
+	newConfig := func(rules ...client.ProxyRule) client.ProxyConfig {
+		config := client.ProxyConfig{}
+		config.Content.ID = 1
+		config.Content.Proxy.ProxyRules = rules
+		return config
+	}
+	root := client.ProxyRule{Pattern: "/", MetricSystemName: "requests"}
+	other := client.ProxyRule{Pattern: "/other", MetricSystemName: "other"}
+
+	inputs := []struct {
+		name         string
+		configured   string
+		config       client.ProxyConfig
+		expectMetric string
+		expectErr    error
+	}{
+		{
+			name:         "Test defaults to hits when nothing can be discovered",
+			config:       newConfig(other),
+			expectMetric: DefaultMetric,
+		},
+		{
+			name:         "Test discovered from the rule mapping the root path",
+			config:       newConfig(other, root),
+			expectMetric: "requests",
+		},
+		{
+			name:         "Test explicitly configured name takes precedence over discovery",
+			configured:   "other",
+			config:       newConfig(other, root),
+			expectMetric: "other",
+		},
+		{
+			name:       "Test explicitly configured name must exist for the service",
+			configured: "hits",
+			config:     newConfig(other, root),
+			expectErr:  ErrUnknownMetric,
+		},
+		{
+			name:         "Test explicitly configured name is accepted when no metrics are known",
+			configured:   "hits",
+			config:       newConfig(),
+			expectMetric: "hits",
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			m := Manager{backendConf: BackendConfig{DefaultMetricName: input.configured}}
+			metric, err := m.DefaultMetricName(input.config)
+			if !errors.Is(err, input.expectErr) {
+				t.Fatalf("expected error %v, got %v", input.expectErr, err)
+			}
+			if metric != input.expectMetric {
+				t.Errorf("expected metric %s, got %s", input.expectMetric, metric)
+			}
+		})
+	}
+}
+
+func TestManager_FailurePolicyPerService(t *testing.T) {
+	// reserve a port with nothing listening on it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen - %v", err)
+	}
+	unreachable := "http://" + listener.Addr().String()
+	listener.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	config := BackendConfig{
+		Policy:          backend.FailClosedPolicy,
+		PolicyOverrides: map[string]backend.FailurePolicy{"free": backend.FailOpenPolicy},
+	}
+	cached := config
+	cached.EnableCaching = true
+	cached.CacheFlushInterval = time.Hour
+
+	inputs := []struct {
+		name       string
+		config     BackendConfig
+		opts       []ManagerOption
+		backendURL string
+	}{
+		{
+			name:       "Test backend unreachable",
+			config:     config,
+			backendURL: unreachable,
+		},
+		{
+			name:       "Test backend unreachable with caching",
+			config:     cached,
+			backendURL: unreachable,
+		},
+		{
+			name:       "Test circuit breaker open",
+			config:     config,
+			opts:       []ManagerOption{WithCircuitBreaker(BreakerConfig{MinRequests: 1})},
+			backendURL: failing.URL,
+		},
+	}
+
+	newRequest := func(service string) BackendRequest {
+		return BackendRequest{
+			Service: service,
+			Transactions: []BackendTransaction{
+				{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: "any"}},
+			},
+		}
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			reports := map[string]DecisionReport{}
+			reporter := &MetricsReporter{DecisionCB: func(report DecisionReport) {
+				reports[report.Service] = report
+			}}
+			m := NewManager(&http.Client{}, nil, input.config, reporter, input.opts...)
+			defer close(m.stopFlush)
+
+			// the first call to the failing backend opens the breaker
+			m.AuthRep(input.backendURL, newRequest("any"))
+
+			resp, err := m.AuthRep(input.backendURL, newRequest("free"))
+			if err != nil || !resp.Authorized || !resp.FailedOpen {
+				t.Errorf("expected free service to fail open, got %v", err)
+			}
+			if report := reports["free"]; report.Outcome != OutcomeAllowed || report.Reason != ReasonFailOpen {
+				t.Errorf("expected decision to be labelled as failing open, got %+v", report)
+			}
+
+			resp, err = m.AuthRep(input.backendURL, newRequest("partner"))
+			if !errors.Is(err, ErrBackendUnavailable) || (resp != nil && resp.Authorized) {
+				t.Errorf("expected partner service to fail closed, got %v", err)
+			}
+			if report := reports["partner"]; report.Outcome != OutcomeError {
+				t.Errorf("expected decision to be reported as an error, got %+v", report)
+			}
+		})
+	}
+
+	m := Manager{backendConf: config}
+	if !m.AllowOnFailure("free") || m.AllowOnFailure("partner") {
+		t.Error("expected the policy for the service to be exposed for system config failures")
+	}
+}
+
+func TestManager_DefaultMetricResolvedWhenCached(t *testing.T) {
+	backend := fake.NewBackend()
+	defer backend.Close()
+	backend.AddService("1", "token", nil)
+	backend.AddApplication("1", fake.Application{UserKey: "abc"})
+
+	config := client.ProxyConfig{ID: 1, Version: 1, Environment: "production"}
+	config.Content.ID = 1
+	config.Content.Proxy.Backend.Endpoint = backend.URL
+	config.Content.Proxy.ProxyRules = []client.ProxyRule{{HTTPMethod: "GET", Pattern: "/", MetricSystemName: "requests", Delta: 1}}
+	system := fake.NewSystem("access-token")
+	defer system.Close()
+	system.SetConfig("1", "production", config)
+
+	noMatch := NoMatchConfig{Behaviour: NoMatchDefaultMetric}
+	request := SystemRequest{AccessToken: "access-token", ServiceID: "1", Environment: "production"}
+	noUsage := BackendRequest{
+		Auth:         BackendAuth{Type: "service_token", Value: "token"},
+		Service:      "1",
+		Transactions: []BackendTransaction{{Params: BackendParams{UserKey: "abc"}}},
+	}
+
+	t.Run("Test discovered metric is reported for requests without usage", func(t *testing.T) {
+		m := NewManager(&http.Client{}, NewSystemCache(SystemCacheConfig{MaxSize: -1}, make(chan struct{})), BackendConfig{NoMatch: noMatch}, nil)
+		defer m.Shutdown()
+
+		if _, err := m.GetSystemConfiguration(system.URL, request); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if res, err := m.AuthRep(backend.URL, noUsage); err != nil || !res.Authorized {
+			t.Fatalf("expected the request to be authorized, got %+v - %v", res, err)
+		}
+		if usage := backend.Usage("1", "abc", "requests"); usage != 1 {
+			t.Errorf("expected the discovered metric to be reported, got %d", usage)
+		}
+	})
+
+	t.Run("Test unknown configured metric rejects the config", func(t *testing.T) {
+		m := NewManager(&http.Client{}, NewSystemCache(SystemCacheConfig{MaxSize: -1}, make(chan struct{})),
+			BackendConfig{NoMatch: noMatch, DefaultMetricName: "hits"}, nil)
+		defer m.Shutdown()
+
+		if _, err := m.GetSystemConfiguration(system.URL, request); !errors.Is(err, ErrUnknownMetric) {
+			t.Errorf("expected error %v, got %v", ErrUnknownMetric, err)
+		}
+	})
+}
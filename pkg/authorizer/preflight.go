@@ -0,0 +1,82 @@
+package authorizer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PreflightResult is the outcome of checking the config of a service ahead of a rollout. See Manager.Preflight
+type PreflightResult struct {
+	ServiceID     string `json:"service_id"`
+	Environment   string `json:"environment"`
+	ConfigVersion int    `json:"config_version,omitempty"`
+	// Problems describes each check which failed
+	Problems []string `json:"problems,omitempty"`
+}
+
+// OK returns true if every check passed
+func (r PreflightResult) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// String returns a human readable summary of the result
+func (r PreflightResult) String() string {
+	if r.OK() {
+		return fmt.Sprintf("service %s (%s): OK, config version %d", r.ServiceID, r.Environment, r.ConfigVersion)
+	}
+	return fmt.Sprintf("service %s (%s): FAILED\n  - %s", r.ServiceID, r.Environment, strings.Join(r.Problems, "\n  - "))
+}
+
+// Preflight fetches the config of the service from 3scale system, bypassing any cache, and lints its mapping rules
+// If dryRun is provided, its credentials are authorized against the backend of the config without reporting usage
+func (m Manager) Preflight(systemURL string, request SystemRequest, dryRun *BackendParams) PreflightResult {
+	result := PreflightResult{ServiceID: request.ServiceID, Environment: request.Environment}
+	if err := validateSystemRequest(request); err != nil {
+		result.Problems = append(result.Problems, err.Error())
+		return result
+	}
+
+	config, err := m.fetchSystemConfigRemotely(systemURL, request)
+	if err != nil {
+		result.Problems = append(result.Problems, err.Error())
+		return result
+	}
+	result.ConfigVersion = config.Version
+
+	for _, ruleErr := range ValidateConfig(config) {
+		result.Problems = append(result.Problems, ruleErr.Error())
+	}
+	for _, rule := range config.Content.Proxy.ProxyRules {
+		if rule.MetricSystemName == "" {
+			result.Problems = append(result.Problems, fmt.Sprintf("mapping rule %d has no metric", rule.ID))
+		}
+	}
+
+	if dryRun != nil {
+		if problem := m.dryRunAuthorize(request.ServiceID, config.Content.BackendAuthenticationType,
+			config.Content.BackendAuthenticationValue, config.Content.Proxy.Backend.Endpoint, *dryRun); problem != "" {
+			result.Problems = append(result.Problems, problem)
+		}
+	}
+	return result
+}
+
+// dryRunAuthorize authorizes the credentials against 3scale backend, returning a description of any failure
+func (m Manager) dryRunAuthorize(service, authType, authValue, backendURL string, params BackendParams) string {
+	if backendURL == "" {
+		return "config has no backend endpoint"
+	}
+
+	res, err := m.Authorize(backendURL, BackendRequest{
+		Auth:         BackendAuth{Type: authType, Value: authValue},
+		Service:      service,
+		Transactions: []BackendTransaction{{Params: params}},
+	})
+	if err != nil {
+		return fmt.Sprintf("dry-run authorize failed - %s", err)
+	}
+	if !res.Authorized {
+		return fmt.Sprintf("dry-run authorize denied - error code %q", res.ErrorCode)
+	}
+	return ""
+}
@@ -0,0 +1,110 @@
+package authorizer
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/3scale/3scale-authorizer/pkg/fake"
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+func TestManager_Preflight(t *testing.T) {
+	backend := fake.NewBackend()
+	defer backend.Close()
+	backend.AddService("1", "token", nil)
+	backend.AddApplication("1", fake.Application{UserKey: "valid"})
+
+	config := func(rules ...client.ProxyRule) client.ProxyConfig {
+		config := client.ProxyConfig{ID: 1, Version: 3, Environment: "production"}
+		config.Content.BackendAuthenticationType = "service_token"
+		config.Content.BackendAuthenticationValue = "token"
+		config.Content.Proxy.Backend.Endpoint = backend.URL
+		config.Content.Proxy.ProxyRules = rules
+		return config
+	}
+
+	inputs := []struct {
+		name          string
+		config        client.ProxyConfig
+		noConfig      bool
+		accessToken   string
+		dryRun        *BackendParams
+		expectVersion int
+		expectProblem []string
+	}{
+		{
+			name:          "Test valid config passes",
+			config:        config(client.ProxyRule{ID: 1, Pattern: "/", MetricSystemName: "hits"}),
+			accessToken:   "access",
+			dryRun:        &BackendParams{UserKey: "valid"},
+			expectVersion: 3,
+		},
+		{
+			name:        "Test missing config fails",
+			noConfig:    true,
+			accessToken: "access",
+			expectProblem: []string{
+				"unable to fetch required data from 3scale system",
+			},
+		},
+		{
+			name:        "Test invalid access token fails",
+			config:      config(),
+			accessToken: "invalid",
+			expectProblem: []string{
+				"unable to fetch required data from 3scale system",
+			},
+		},
+		{
+			name: "Test invalid rules are reported",
+			config: config(
+				client.ProxyRule{ID: 1, Pattern: "no-slash", MetricSystemName: "hits"},
+				client.ProxyRule{ID: 2, Pattern: "/"},
+			),
+			accessToken:   "access",
+			expectVersion: 3,
+			expectProblem: []string{"no-slash", "mapping rule 2 has no metric"},
+		},
+		{
+			name:          "Test denied dry-run is reported",
+			config:        config(),
+			accessToken:   "access",
+			dryRun:        &BackendParams{UserKey: "unknown"},
+			expectVersion: 3,
+			expectProblem: []string{"dry-run authorize denied"},
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			system := fake.NewSystem("access")
+			defer system.Close()
+			if !input.noConfig {
+				system.SetConfig("1", "production", input.config)
+			}
+
+			m := NewManager(&http.Client{}, nil, BackendConfig{}, nil)
+			result := m.Preflight(system.URL, SystemRequest{
+				AccessToken: input.accessToken,
+				ServiceID:   "1",
+				Environment: "production",
+			}, input.dryRun)
+
+			if result.ConfigVersion != input.expectVersion {
+				t.Errorf("expected config version %d, got %d", input.expectVersion, result.ConfigVersion)
+			}
+			if result.OK() != (len(input.expectProblem) == 0) {
+				t.Fatalf("unexpected result %s", result)
+			}
+			if len(result.Problems) != len(input.expectProblem) {
+				t.Fatalf("expected %d problems, got %v", len(input.expectProblem), result.Problems)
+			}
+			for i, expect := range input.expectProblem {
+				if !strings.Contains(result.Problems[i], expect) {
+					t.Errorf("expected problem %q to contain %q", result.Problems[i], expect)
+				}
+			}
+		})
+	}
+}
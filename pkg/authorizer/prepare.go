@@ -0,0 +1,55 @@
+package authorizer
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/3scale/3scale-authorizer/pkg/system/v1/cache"
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+// preparedConfig is the state derived from a config when it is cached, so that it is not rebuilt for each request
+type preparedConfig struct {
+	rules *MappingRules
+}
+
+// prepareConfig derives the state used to serve requests from the config
+// The client for the backend endpoint of the config is built and registered, so an invalid endpoint rejects the
+// config rather than failing each request. Likewise the base metric of the service is resolved, and validated,
+// when requests which carry no usage are reported against it. See Manager.DefaultMetricName
+func (m Manager) prepareConfig(config client.ProxyConfig) (*preparedConfig, error) {
+	if endpoint := config.Content.Proxy.Backend.Endpoint; endpoint != "" {
+		if err := m.registerBackendClient(endpoint); err != nil {
+			return nil, fmt.Errorf("invalid backend endpoint for service %d - %s", config.Content.ID, err)
+		}
+	}
+	if m.backendConf.NoMatch.needsDefaultMetric() {
+		name, err := m.DefaultMetricName(config)
+		if err != nil {
+			return nil, err
+		}
+		if m.defaultMetrics != nil {
+			m.defaultMetrics.Store(strconv.FormatInt(config.Content.ID, 10), name)
+		}
+	}
+	return &preparedConfig{rules: CompileMappingRules(config.Content.Proxy.ProxyRules, m.ruleOptions)}, nil
+}
+
+// prepareCallback returns the callback preparing each config stored in the system cache, including when refreshed
+func (m Manager) prepareCallback() cache.PrepareCb {
+	return func(config client.ProxyConfig) (interface{}, error) {
+		prepared, err := m.prepareConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		return prepared, nil
+	}
+}
+
+// prepared returns the state prepared for the cached value, preparing it now if the value was not prepared
+func (m Manager) prepared(value cache.Value) (*preparedConfig, error) {
+	if prepared, ok := value.Prepared().(*preparedConfig); ok {
+		return prepared, nil
+	}
+	return m.prepareConfig(value.Item)
+}
@@ -0,0 +1,304 @@
+package authorizer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/3scale/3scale-authorizer/pkg/backend/v1"
+	"github.com/3scale/3scale-authorizer/pkg/fake"
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+func TestEgressProxyConfig_ProxyFunc(t *testing.T) {
+	const proxy = "http://proxy:3128"
+
+	inputs := []struct {
+		name        string
+		config      EgressProxyConfig
+		target      Target
+		url         string
+		expectProxy string
+	}{
+		{
+			name:        "Test default proxy",
+			config:      EgressProxyConfig{Default: EgressProxy{URL: proxy}},
+			target:      TargetSystem,
+			url:         "https://tenant-admin.3scale.net",
+			expectProxy: proxy,
+		},
+		{
+			name:   "Test direct",
+			config: EgressProxyConfig{Default: EgressProxy{URL: proxy, Direct: true}},
+			url:    "https://tenant-admin.3scale.net",
+		},
+		{
+			name:        "Test backend reached directly while system is proxied",
+			config:      EgressProxyConfig{Default: EgressProxy{URL: proxy}, Backend: &EgressProxy{Direct: true}},
+			target:      TargetSystem,
+			url:         "https://tenant-admin.3scale.net",
+			expectProxy: proxy,
+		},
+		{
+			name:   "Test backend override",
+			config: EgressProxyConfig{Default: EgressProxy{URL: proxy}, Backend: &EgressProxy{Direct: true}},
+			target: TargetBackend,
+			url:    "http://backend.internal:3000",
+		},
+		{
+			name:        "Test backend proxy override",
+			config:      EgressProxyConfig{Default: EgressProxy{URL: proxy}, Backend: &EgressProxy{URL: "http://other:8080"}},
+			target:      TargetBackend,
+			url:         "http://backend.internal:3000",
+			expectProxy: "http://other:8080",
+		},
+		{
+			name:   "Test no proxy domain matches subdomains",
+			config: EgressProxyConfig{Default: EgressProxy{URL: proxy, NoProxy: "internal, .example.com"}},
+			url:    "http://backend.internal:3000",
+		},
+		{
+			name:        "Test no proxy domain does not match suffix",
+			config:      EgressProxyConfig{Default: EgressProxy{URL: proxy, NoProxy: "internal"}},
+			url:         "http://backendinternal:3000",
+			expectProxy: proxy,
+		},
+		{
+			name:        "Test no proxy port",
+			config:      EgressProxyConfig{Default: EgressProxy{URL: proxy, NoProxy: "backend.internal:3000"}},
+			url:         "https://backend.internal",
+			expectProxy: proxy,
+		},
+		{
+			name:   "Test no proxy default port",
+			config: EgressProxyConfig{Default: EgressProxy{URL: proxy, NoProxy: "backend.internal:443"}},
+			url:    "https://backend.internal",
+		},
+		{
+			name:   "Test no proxy CIDR",
+			config: EgressProxyConfig{Default: EgressProxy{URL: proxy, NoProxy: "10.0.0.0/8"}},
+			url:    "http://10.1.2.3:3000",
+		},
+		{
+			name:        "Test no proxy IP",
+			config:      EgressProxyConfig{Default: EgressProxy{URL: proxy, NoProxy: "10.1.2.3"}},
+			url:         "http://10.1.2.4:3000",
+			expectProxy: proxy,
+		},
+		{
+			name:   "Test no proxy wildcard",
+			config: EgressProxyConfig{Default: EgressProxy{URL: proxy, NoProxy: "*"}},
+			url:    "https://su1.3scale.net",
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			proxyFunc, err := input.config.proxyFunc()
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			req, _ := http.NewRequest(http.MethodGet, input.url, nil)
+			if input.target != "" {
+				req = req.WithContext(context.WithValue(req.Context(), targetKey{}, input.target))
+			}
+			got, err := proxyFunc(req)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			if input.expectProxy == "" && got != nil {
+				t.Errorf("expected %s to be reached directly, got proxy %s", input.url, got)
+			}
+			if input.expectProxy != "" && (got == nil || got.String() != input.expectProxy) {
+				t.Errorf("expected %s to be reached through %s, got %v", input.url, input.expectProxy, got)
+			}
+		})
+	}
+}
+
+func TestEgressProxyConfig_Invalid(t *testing.T) {
+	for _, config := range []EgressProxyConfig{
+		{Default: EgressProxy{URL: "ftp://proxy:21"}},
+		{Default: EgressProxy{URL: "http://"}},
+		{System: &EgressProxy{URL: "://proxy"}},
+	} {
+		if _, err := NewHTTPClient(HTTPClientConfig{Proxy: config}); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
+
+func TestNewHTTPClient_Proxy(t *testing.T) {
+	proxy := newForwardProxy(false)
+	defer proxy.Close()
+
+	system := fake.NewSystem("access-token")
+	defer system.Close()
+	config := client.ProxyConfig{ID: 1, Version: 1, Environment: "production"}
+	system.SetConfig("1", "production", config)
+
+	backend := fake.NewBackend()
+	defer backend.Close()
+	backend.AddService("1", "token", nil)
+	backend.AddApplication("1", fake.Application{UserKey: "key"})
+
+	httpClient, err := NewHTTPClient(HTTPClientConfig{Proxy: EgressProxyConfig{
+		Default: EgressProxy{URL: proxy.URL},
+		Backend: &EgressProxy{Direct: true},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	m := NewManager(httpClient, nil, BackendConfig{}, nil)
+
+	if _, err := m.GetSystemConfiguration(system.URL, SystemRequest{AccessToken: "access-token", ServiceID: "1", Environment: "production"}); err != nil {
+		t.Fatalf("unexpected error fetching config %v", err)
+	}
+	res, err := m.AuthRep(backend.URL, BackendRequest{
+		Auth:         BackendAuth{Type: "service_token", Value: "token"},
+		Service:      "1",
+		Transactions: []BackendTransaction{{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: "key"}}},
+	})
+	if err != nil || !res.Authorized {
+		t.Fatalf("expected the request to be authorized, got %+v - %v", res, err)
+	}
+
+	hosts := proxy.hosts()
+	systemURL, _ := url.Parse(system.URL)
+	if len(hosts) != 1 || hosts[0] != systemURL.Host {
+		t.Errorf("expected only the call to system to be proxied, got %v", hosts)
+	}
+}
+
+func TestNewHTTPClient_ProxyTunnel(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	proxy := newForwardProxy(false)
+	defer proxy.Close()
+
+	httpClient, err := NewHTTPClient(HTTPClientConfig{
+		TLS:   target.Client().Transport.(*http.Transport).TLSClientConfig,
+		Proxy: EgressProxyConfig{Default: EgressProxy{URL: proxy.URL}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	resp, err := httpClient.Get(target.URL)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	targetURL, _ := url.Parse(target.URL)
+	if hosts := proxy.hosts(); len(hosts) != 1 || hosts[0] != targetURL.Host {
+		t.Errorf("expected the call to be tunnelled through the proxy, got %v", hosts)
+	}
+}
+
+func TestNewHTTPClient_ProxyConnectFailure(t *testing.T) {
+	refusing := newForwardProxy(true)
+	defer refusing.Close()
+	unreachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	unreachable.Close()
+
+	for _, proxyURL := range []string{refusing.URL, unreachable.URL} {
+		httpClient, err := NewHTTPClient(HTTPClientConfig{Proxy: EgressProxyConfig{Default: EgressProxy{URL: proxyURL}}})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		_, err = httpClient.Get("https://backend.example.com")
+		var netErr net.Error
+		if !errors.Is(err, ErrProxyConnect) || !errors.As(err, &netErr) || !netErr.Temporary() {
+			t.Errorf("expected a temporary network error wrapping ErrProxyConnect, got %v", err)
+		}
+		if !isConnectionError(err) {
+			t.Errorf("expected %v to be treated as a connection error", err)
+		}
+
+		// the failure policy applies as 3scale backend cannot be reached
+		m := NewManager(httpClient, nil, BackendConfig{Policy: backend.FailOpenPolicy}, nil)
+		res, err := m.AuthRep("https://backend.example.com", BackendRequest{
+			Service:      "1",
+			Transactions: []BackendTransaction{{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: "key"}}},
+		})
+		if err != nil || !res.Authorized || !res.FailedOpen {
+			t.Errorf("expected the request to be failed open, got %+v - %v", res, err)
+		}
+	}
+}
+
+// forwardProxy is a forward proxy which records the host of each request, tunnelling CONNECT requests unless refusing
+type forwardProxy struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []string
+}
+
+func newForwardProxy(refuse bool) *forwardProxy {
+	p := &forwardProxy{}
+	transport := &http.Transport{}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		p.requests = append(p.requests, r.Host)
+		p.mu.Unlock()
+
+		if refuse {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if r.Method != http.MethodConnect {
+			out := r.Clone(r.Context())
+			out.RequestURI = ""
+			resp, err := transport.RoundTrip(out)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			for k, v := range resp.Header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+			return
+		}
+
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		go func() {
+			io.Copy(conn, upstream)
+			conn.Close()
+		}()
+	}))
+	return p
+}
+
+func (p *forwardProxy) hosts() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.requests...)
+}
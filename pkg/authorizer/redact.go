@@ -0,0 +1,56 @@
+package authorizer
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// fingerprintSize is the number of bytes of the HMAC kept in a fingerprint
+const fingerprintSize = 16
+
+// fingerprintKey keys the fingerprints of credentials and is generated per process, so that fingerprints found
+// outside of the process cannot be matched against known credentials
+var fingerprintKey = newFingerprintKey()
+
+func newFingerprintKey() []byte {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("unable to generate credential fingerprint key - %s", err))
+	}
+	return key
+}
+
+// fingerprint returns a truncated HMAC-SHA256 of the values, which identifies credentials in cache keys, logs and
+// metrics without exposing them. Fingerprints are only stable within a process
+// Each value is length prefixed so that distinct sets of values cannot produce the same input
+func fingerprint(values ...string) string {
+	mac := hmac.New(sha256.New, fingerprintKey)
+	var length [8]byte
+	for _, value := range values {
+		binary.BigEndian.PutUint64(length[:], uint64(len(value)))
+		mac.Write(length[:])
+		mac.Write([]byte(value))
+	}
+	return hex.EncodeToString(mac.Sum(nil)[:fingerprintSize])
+}
+
+// hashCredential returns a shortened fingerprint of the credential which can be used to correlate requests
+// without exposing the credential itself
+func hashCredential(credential string) string {
+	if credential == "" {
+		return ""
+	}
+	return fingerprint(credential)[:12]
+}
+
+// credentialID returns a hashed identifier for the credentials of the request
+func credentialID(params BackendParams) string {
+	if params.UserKey != "" {
+		return hashCredential(params.UserKey)
+	}
+	return hashCredential(params.AppID)
+}
@@ -0,0 +1,180 @@
+package authorizer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/3scale/3scale-authorizer/pkg/fake"
+)
+
+func TestHashCredential(t *testing.T) {
+	if hashCredential("") != "" {
+		t.Error("expected no hash for an empty credential")
+	}
+
+	first, second := hashCredential("key-one"), hashCredential("key-two")
+	if first == second {
+		t.Error("expected different credentials to produce different hashes")
+	}
+	if first != hashCredential("key-one") {
+		t.Error("expected the hash of a credential to be stable")
+	}
+	if len(first) != 12 {
+		t.Errorf("expected a truncated hash, got %s", first)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	first, second := fingerprint("key-one"), fingerprint("key-two")
+	if first == second {
+		t.Error("expected different credentials to produce different fingerprints")
+	}
+	if first != fingerprint("key-one") {
+		t.Error("expected the fingerprint of a credential to be stable within the process")
+	}
+	if len(first) != fingerprintSize*2 {
+		t.Errorf("expected a truncated fingerprint, got %s", first)
+	}
+
+	// the fingerprint is keyed, so it does not match a plain hash a known credential could be checked against
+	sum := sha256.Sum256([]byte("key-one"))
+	if strings.HasPrefix(hex.EncodeToString(sum[:]), first) {
+		t.Error("expected the fingerprint to be keyed")
+	}
+
+	if fingerprint("ab", "c") == fingerprint("a", "bc") || fingerprint("a\x00", "b") == fingerprint("a", "\x00b") {
+		t.Error("expected the boundaries between values to be preserved")
+	}
+}
+
+func TestManager_CachesHoldOnlyFingerprints(t *testing.T) {
+	const userKey = "raw-user-key"
+	const serviceToken = "raw-service-token"
+
+	backend := fake.NewBackend()
+	defer backend.Close()
+	backend.AddService("any", serviceToken, nil)
+	backend.AddApplication("any", fake.Application{UserKey: userKey})
+
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir - %v", err)
+	}
+	defer os.RemoveAll(dir)
+	auditFile := filepath.Join(dir, "audit.log")
+	sink, err := NewFileAuditSink(auditFile, 0)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	logger := &recordingLogger{}
+	m := NewManager(&http.Client{}, nil, BackendConfig{
+		Logger:        logger,
+		Coalesce:      true,
+		NegativeCache: NegativeCacheConfig{TTL: time.Minute},
+		DecisionCache: DecisionCacheConfig{AllowTTL: time.Minute, DenyTTL: time.Minute},
+	}, nil, WithAuditSink(sink))
+
+	for _, key := range []string{userKey, "unknown-" + userKey} {
+		request := BackendRequest{
+			Auth:         BackendAuth{Type: "service_token", Value: serviceToken},
+			Service:      "any",
+			Transactions: []BackendTransaction{{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: key}}},
+		}
+		for _, call := range []func(string, BackendRequest) (*BackendResponse, error){m.Authorize, m.AuthRep} {
+			if _, err := call(backend.URL, request); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var snapshot []string
+	for _, c := range []*negativeCache{m.negative, m.decisions} {
+		if len(c.entries) == 0 {
+			t.Fatal("expected decisions to have been cached")
+		}
+		for key, e := range c.entries {
+			snapshot = append(snapshot, key, fmt.Sprintf("%+v", e.Value.(*negativeEntry).res))
+		}
+	}
+	audit, err := ioutil.ReadFile(auditFile)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	snapshot = append(snapshot, string(audit))
+	for _, logs := range [][]string{logger.infos, logger.warnings, logger.errors, logger.debugs} {
+		snapshot = append(snapshot, logs...)
+	}
+
+	for _, entry := range snapshot {
+		if strings.Contains(entry, userKey) || strings.Contains(entry, serviceToken) {
+			t.Errorf("expected only fingerprints of credentials, got %s", entry)
+		}
+	}
+	if !strings.Contains(string(audit), hashCredential(userKey)) {
+		t.Errorf("expected the audit log to identify the credential by its fingerprint, got %s", audit)
+	}
+}
+
+func TestManager_RedactsCredentials(t *testing.T) {
+	const secret = "do-not-leak-this-secret"
+
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+
+	logger := &recordingLogger{}
+	m := NewManager(&http.Client{}, nil, BackendConfig{Logger: logger}, nil)
+
+	_, err := m.GetSystemConfiguration(closed.URL, SystemRequest{
+		AccessToken: secret,
+		ServiceID:   "1",
+		Environment: "production",
+	})
+	if err == nil {
+		t.Fatal("expected an error calling an unreachable system")
+	}
+	if strings.Contains(err.Error(), secret) {
+		t.Errorf("expected access token to be redacted from error, got %s", err)
+	}
+
+	request := BackendRequest{
+		Service: "1",
+		Auth:    BackendAuth{Type: "service_token", Value: secret},
+		Transactions: []BackendTransaction{
+			{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: secret}},
+		},
+	}
+	for _, call := range []func() error{
+		func() error { _, err := m.AuthRep(closed.URL, request); return err },
+		func() error { _, err := m.Authorize(closed.URL, request); return err },
+		func() error { return m.Report(closed.URL, request) },
+	} {
+		err := call()
+		if err == nil {
+			t.Fatal("expected an error calling an unreachable backend")
+		}
+		if strings.Contains(err.Error(), secret) {
+			t.Errorf("expected credentials to be redacted from error, got %s", err)
+		}
+	}
+
+	for _, lines := range [][]string{logger.infos, logger.warnings, logger.errors, logger.debugs} {
+		for _, line := range lines {
+			if strings.Contains(line, secret) {
+				t.Errorf("expected credentials to be redacted from logs, got %s", line)
+			}
+		}
+	}
+}
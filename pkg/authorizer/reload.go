@@ -0,0 +1,224 @@
+package authorizer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+// ErrManagerShutdown is returned by a ReloadableManager once it has been shut down
+var ErrManagerShutdown = errors.New("manager has been shut down")
+
+// ErrSystemCacheStopped is returned when building a ReloadableManager from a system cache which has been stopped
+// by shutting down or replacing a Manager, as the cache is no longer refreshed
+var ErrSystemCacheStopped = errors.New("system cache has been stopped")
+
+// ManagerConfig holds the arguments a Manager is built with. See NewManager
+type ManagerConfig struct {
+	Client      *http.Client
+	SystemCache *SystemCache
+	Backend     BackendConfig
+	Reporter    *MetricsReporter
+	Options     []ManagerOption
+}
+
+// ReloadableManager serves requests from a Manager which can be replaced without a restart. See Reconfigure
+type ReloadableManager struct {
+	// reconfigure serializes calls to Reconfigure
+	reconfigure sync.Mutex
+	// current holds the *generation serving new requests
+	current atomic.Value
+	// shutdown is set once Shutdown has been called, after which no generation serves requests
+	shutdown int32
+}
+
+// generation is a Manager along with the requests in flight on it
+type generation struct {
+	manager *Manager
+	// inFlight is held for reading by each request and for writing once the generation is retired
+	inFlight sync.RWMutex
+	retired  bool
+}
+
+// NewReloadableManager builds a Manager from the config, returning an error if the config has no client
+func NewReloadableManager(config ManagerConfig) (*ReloadableManager, error) {
+	gen, err := newGeneration(config)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ReloadableManager{}
+	r.current.Store(gen)
+	return r, nil
+}
+
+func newGeneration(config ManagerConfig) (*generation, error) {
+	if config.Client == nil {
+		return nil, errors.New("manager config requires an http client")
+	}
+	if config.SystemCache.isStopped() {
+		return nil, ErrSystemCacheStopped
+	}
+	return &generation{
+		manager: NewManager(config.Client, config.SystemCache, config.Backend, config.Reporter, config.Options...),
+	}, nil
+}
+
+// Reconfigure atomically replaces the Manager with one built from the config. Requests in flight complete
+// on the previous Manager, which is then shut down, flushing any cached usage to 3scale. The system cache
+// of the previous Manager is stopped unless it is reused by the config. Returns an error, leaving the
+// current Manager in place, if the config has no client, ErrSystemCacheStopped if the system cache of the config
+// has been stopped, or ErrManagerShutdown once shut down
+func (r *ReloadableManager) Reconfigure(config ManagerConfig) error {
+	r.reconfigure.Lock()
+	if atomic.LoadInt32(&r.shutdown) == 1 {
+		r.reconfigure.Unlock()
+		return ErrManagerShutdown
+	}
+	next, err := newGeneration(config)
+	if err != nil {
+		r.reconfigure.Unlock()
+		return err
+	}
+	previous := r.current.Load().(*generation)
+	r.current.Store(next)
+	// the previous cache is stopped before returning, so a later config cannot reuse it once it stops refreshing
+	if previous.manager.systemCache != next.manager.systemCache {
+		previous.manager.systemCache.stop()
+	}
+	r.reconfigure.Unlock()
+
+	go previous.retire()
+	return nil
+}
+
+// Shutdown shuts down the current Manager once its requests in flight have completed
+// Requests made once shut down fail with ErrManagerShutdown
+func (r *ReloadableManager) Shutdown() {
+	r.reconfigure.Lock()
+	defer r.reconfigure.Unlock()
+	atomic.StoreInt32(&r.shutdown, 1)
+	gen := r.current.Load().(*generation)
+	gen.retire()
+	gen.manager.systemCache.stop()
+}
+
+// retire waits for the requests in flight to complete before shutting down the Manager, leaving its system
+// cache to be stopped by the caller
+func (g *generation) retire() {
+	g.inFlight.Lock()
+	defer g.inFlight.Unlock()
+	if g.retired {
+		return
+	}
+	g.retired = true
+
+	g.manager.waitCoalesced()
+	close(g.manager.stopFlush)
+}
+
+// acquire returns the current generation, held until released, retrying if it was retired meanwhile
+// Returns ErrManagerShutdown if the generation was retired by Shutdown, as it will not be replaced
+func (r *ReloadableManager) acquire() (*generation, error) {
+	for {
+		gen := r.current.Load().(*generation)
+		gen.inFlight.RLock()
+		if !gen.retired {
+			return gen, nil
+		}
+		gen.inFlight.RUnlock()
+		if atomic.LoadInt32(&r.shutdown) == 1 {
+			return nil, ErrManagerShutdown
+		}
+	}
+}
+
+// Manager returns the Manager serving new requests. Requests made directly on it are not waited for
+// when reconfiguring, prefer the methods of the ReloadableManager
+func (r *ReloadableManager) Manager() *Manager {
+	return r.current.Load().(*generation).manager
+}
+
+// GetSystemConfiguration calls GetSystemConfiguration on the current Manager
+func (r *ReloadableManager) GetSystemConfiguration(systemURL string, request SystemRequest) (client.ProxyConfig, error) {
+	return r.GetSystemConfigurationContext(context.Background(), systemURL, request)
+}
+
+// GetSystemConfigurationContext calls GetSystemConfigurationContext on the current Manager
+func (r *ReloadableManager) GetSystemConfigurationContext(ctx context.Context, systemURL string, request SystemRequest) (client.ProxyConfig, error) {
+	gen, err := r.acquire()
+	if err != nil {
+		return client.ProxyConfig{}, err
+	}
+	defer gen.inFlight.RUnlock()
+	return gen.manager.GetSystemConfigurationContext(ctx, systemURL, request)
+}
+
+// AuthRep calls AuthRep on the current Manager
+func (r *ReloadableManager) AuthRep(backendURL string, request BackendRequest) (*BackendResponse, error) {
+	return r.AuthRepContext(context.Background(), backendURL, request)
+}
+
+// AuthRepContext calls AuthRepContext on the current Manager
+func (r *ReloadableManager) AuthRepContext(ctx context.Context, backendURL string, request BackendRequest) (*BackendResponse, error) {
+	gen, err := r.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer gen.inFlight.RUnlock()
+	return gen.manager.AuthRepContext(ctx, backendURL, request)
+}
+
+// Authorize calls Authorize on the current Manager
+func (r *ReloadableManager) Authorize(backendURL string, request BackendRequest) (*BackendResponse, error) {
+	return r.AuthorizeContext(context.Background(), backendURL, request)
+}
+
+// AuthorizeContext calls AuthorizeContext on the current Manager
+func (r *ReloadableManager) AuthorizeContext(ctx context.Context, backendURL string, request BackendRequest) (*BackendResponse, error) {
+	gen, err := r.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer gen.inFlight.RUnlock()
+	return gen.manager.AuthorizeContext(ctx, backendURL, request)
+}
+
+// Report calls Report on the current Manager
+func (r *ReloadableManager) Report(backendURL string, request BackendRequest) error {
+	gen, err := r.acquire()
+	if err != nil {
+		return err
+	}
+	defer gen.inFlight.RUnlock()
+	return gen.manager.Report(backendURL, request)
+}
+
+// Check calls Check on the current Manager
+func (r *ReloadableManager) Check(systemURL string, request SystemRequest, check CheckRequest) (*BackendResponse, error) {
+	return r.CheckContext(context.Background(), systemURL, request, check)
+}
+
+// CheckContext calls CheckContext on the current Manager
+func (r *ReloadableManager) CheckContext(ctx context.Context, systemURL string, request SystemRequest, check CheckRequest) (*BackendResponse, error) {
+	gen, err := r.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer gen.inFlight.RUnlock()
+	return gen.manager.CheckContext(ctx, systemURL, request, check)
+}
+
+// Explain calls Explain on the current Manager
+func (r *ReloadableManager) Explain(systemURL string, request SystemRequest, check CheckRequest) (BackendRequest, []client.ProxyRule, error) {
+	gen, err := r.acquire()
+	if err != nil {
+		return BackendRequest{}, nil, err
+	}
+	defer gen.inFlight.RUnlock()
+	return gen.manager.Explain(systemURL, request, check)
+}
@@ -0,0 +1,181 @@
+package authorizer
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/3scale/3scale-authorizer/pkg/fake"
+	"github.com/3scale/3scale-authorizer/pkg/system/v1/cache"
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+func TestReloadableManager_Reconfigure(t *testing.T) {
+	backend := fake.NewBackend()
+	defer backend.Close()
+	backend.AddService("svc", "token", nil)
+	backend.AddApplication("svc", fake.Application{UserKey: "valid"})
+
+	request := BackendRequest{
+		Auth:         BackendAuth{Type: "service_token", Value: "token"},
+		Service:      "svc",
+		Transactions: []BackendTransaction{{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: "valid"}}},
+	}
+
+	started, release := make(chan struct{}), make(chan struct{})
+	blocking := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		close(started)
+		<-release
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+
+	var previous, next int32
+	counting := func(count *int32) *MetricsReporter {
+		return &MetricsReporter{DecisionCB: func(DecisionReport) { atomic.AddInt32(count, 1) }}
+	}
+
+	r, err := NewReloadableManager(ManagerConfig{Client: blocking, Reporter: counting(&previous)})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer r.Shutdown()
+
+	done := make(chan error)
+	go func() {
+		res, err := r.AuthRep(backend.URL, request)
+		if err == nil && !res.Authorized {
+			t.Errorf("expected the in flight request to be authorized, got %+v", res)
+		}
+		done <- err
+	}()
+	<-started
+
+	if err := r.Reconfigure(ManagerConfig{}); err == nil {
+		t.Error("expected an error for a config without a client")
+	}
+	if err := r.Reconfigure(ManagerConfig{Client: &http.Client{}, Reporter: counting(&next)}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if res, err := r.AuthRep(backend.URL, request); err != nil || !res.Authorized {
+		t.Fatalf("expected new requests to be served by the new config, got %v - %v", res, err)
+	}
+	if atomic.LoadInt32(&next) != 1 || atomic.LoadInt32(&previous) != 0 {
+		t.Errorf("expected only the new config to have decided, got %d and %d", next, previous)
+	}
+
+	close(release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected the in flight request to complete on the previous config, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for the in flight request")
+	}
+	if atomic.LoadInt32(&previous) != 1 {
+		t.Error("expected the in flight request to have been decided by the previous config")
+	}
+	if usage := backend.Usage("svc", "valid", "hits"); usage != 2 {
+		t.Errorf("expected both requests to be reported, got %d", usage)
+	}
+}
+
+func TestReloadableManager_ReconfigureRefreshesOnce(t *testing.T) {
+	system := fake.NewSystem("access-token")
+	defer system.Close()
+	system.SetConfig("1", "production", client.ProxyConfig{ID: 1, Version: 1, Environment: "production"})
+
+	clock := cache.NewManualClock(time.Now())
+	systemCache := NewSystemCache(SystemCacheConfig{MaxSize: -1, RefreshInterval: time.Minute, Clock: clock}, make(chan struct{}))
+
+	r, err := NewReloadableManager(ManagerConfig{Client: &http.Client{}, SystemCache: systemCache})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer r.Shutdown()
+
+	request := SystemRequest{AccessToken: "access-token", ServiceID: "1", Environment: "production"}
+	if _, err := r.GetSystemConfiguration(system.URL, request); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := r.Reconfigure(ManagerConfig{Client: &http.Client{}, SystemCache: systemCache}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	// give each refresh worker the chance to start its ticker
+	time.Sleep(time.Millisecond * 100)
+	fetched := len(system.Requests())
+	clock.Advance(time.Minute)
+	deadline := time.Now().Add(time.Second * 5)
+	for len(system.Requests()) == fetched && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	// give any other refresh worker the chance to refresh the cache
+	time.Sleep(time.Millisecond * 100)
+
+	if refreshes := len(system.Requests()) - fetched; refreshes != 1 {
+		t.Errorf("expected the shared cache to be refreshed once per interval, got %d refreshes", refreshes)
+	}
+}
+
+func TestReloadableManager_ReconfigureStoppedCache(t *testing.T) {
+	first := NewSystemCache(SystemCacheConfig{}, make(chan struct{}))
+	second := NewSystemCache(SystemCacheConfig{}, make(chan struct{}))
+
+	r, err := NewReloadableManager(ManagerConfig{Client: &http.Client{}, SystemCache: first})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := r.Reconfigure(ManagerConfig{Client: &http.Client{}, SystemCache: second}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !first.isStopped() {
+		t.Error("expected the system cache of the previous manager to be stopped")
+	}
+
+	if err := r.Reconfigure(ManagerConfig{Client: &http.Client{}, SystemCache: first}); !errors.Is(err, ErrSystemCacheStopped) {
+		t.Errorf("expected reconfiguring with a stopped cache to fail with ErrSystemCacheStopped, got %v", err)
+	}
+	if r.Manager().systemCache != second {
+		t.Error("expected the current manager to be kept when the config is rejected")
+	}
+	if _, err := NewReloadableManager(ManagerConfig{Client: &http.Client{}, SystemCache: first}); !errors.Is(err, ErrSystemCacheStopped) {
+		t.Errorf("expected building from a stopped cache to fail with ErrSystemCacheStopped, got %v", err)
+	}
+
+	r.Shutdown()
+	if !second.isStopped() {
+		t.Error("expected the system cache to be stopped on shutdown")
+	}
+}
+
+func TestReloadableManager_AfterShutdown(t *testing.T) {
+	r, err := NewReloadableManager(ManagerConfig{Client: &http.Client{}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	r.Shutdown()
+
+	done := make(chan error)
+	go func() {
+		_, err := r.AuthRep("http://backend.invalid", BackendRequest{Service: "svc"})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrManagerShutdown) {
+			t.Errorf("expected ErrManagerShutdown, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for the request made after shutdown")
+	}
+
+	if err := r.Reconfigure(ManagerConfig{Client: &http.Client{}}); !errors.Is(err, ErrManagerShutdown) {
+		t.Errorf("expected reconfiguring after shutdown to fail with ErrManagerShutdown, got %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package authorizer
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRetryMaxAttempts is the default number of attempts made for a call, including the first
+	DefaultRetryMaxAttempts = 3
+	// DefaultRetryBaseBackoff is the default wait before the first retry, doubling for each subsequent retry
+	DefaultRetryBaseBackoff = time.Millisecond * 50
+	// DefaultRetryMaxBackoff is the default upper bound of the wait between retries
+	DefaultRetryMaxBackoff = time.Second
+)
+
+// RetryConfig configures the retrying of transient failures of calls to 3scale
+// Zero values are replaced with the defaults above
+type RetryConfig struct {
+	// MaxAttempts is the number of attempts made for a call, including the first
+	MaxAttempts int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// Jitter is the fraction, between 0 and 1, by which each backoff is randomly reduced
+	Jitter float64
+}
+
+// retryRoundTripper retries calls which failed with a network error or 5xx response
+//
+// Only calls without side effects, such as fetching config from 3scale system and Authorize calls to
+// 3scale backend, are retried on any transient failure. Calls which report usage, AuthRep and Report, are
+// retried only when the connection could not be established, since the request has then not been sent.
+// A timeout or 5xx response may have been received after the usage was reported so retrying would risk
+// reporting it twice. 4xx responses are never retried
+//
+// No retry is attempted if the backoff would exceed the deadline of the request context
+type retryRoundTripper struct {
+	proxied http.RoundTripper
+	config  RetryConfig
+}
+
+// reportingPaths are the 3scale backend endpoints which report usage
+var reportingPaths = []string{"/transactions/authrep.xml", "/transactions/oauth_authrep.xml", "/transactions.xml"}
+
+func newRetryRoundTripper(proxied http.RoundTripper, config RetryConfig) *retryRoundTripper {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = DefaultRetryMaxAttempts
+	}
+	if config.BaseBackoff <= 0 {
+		config.BaseBackoff = DefaultRetryBaseBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = DefaultRetryMaxBackoff
+	}
+	if config.Jitter < 0 || config.Jitter > 1 {
+		config.Jitter = 0
+	}
+
+	return &retryRoundTripper{proxied: proxied, config: config}
+}
+
+// withRetries returns a copy of the client which retries transient failures
+func withRetries(client *http.Client, config RetryConfig) *http.Client {
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	retrying := *client
+	retrying.Transport = newRetryRoundTripper(transport, config)
+	return &retrying
+}
+
+func (r *retryRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	proxied := r.proxied
+	if proxied == nil {
+		proxied = http.DefaultTransport
+	}
+
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		resp, err := proxied.RoundTrip(req)
+		if attempt >= r.config.MaxAttempts || !r.retryable(req, resp, err) {
+			return resp, err
+		}
+
+		wait := r.backoff(attempt)
+		if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) < wait {
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// retryable reports whether the failed call can safely be attempted again
+func (r *retryRoundTripper) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil || errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return false
+	}
+
+	if isConnectionError(err) {
+		return true
+	}
+	if !isIdempotent(req) {
+		return false
+	}
+	return err != nil || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// backoff returns the wait before the provided attempt is retried
+func (r *retryRoundTripper) backoff(attempt int) time.Duration {
+	wait := r.config.MaxBackoff
+	if shift := uint(attempt - 1); shift < 32 {
+		if exp := r.config.BaseBackoff << shift; exp > 0 && exp < wait {
+			wait = exp
+		}
+	}
+
+	if r.config.Jitter > 0 {
+		wait -= time.Duration(rand.Float64() * r.config.Jitter * float64(wait))
+	}
+	return wait
+}
+
+// isIdempotent reports whether the request can be sent more than once without side effects
+func isIdempotent(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	for _, path := range reportingPaths {
+		if strings.HasSuffix(req.URL.Path, path) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,217 @@
+package authorizer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryRoundTripper(t *testing.T) {
+	fast := RetryConfig{MaxAttempts: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	inputs := []struct {
+		name   string
+		method string
+		path   string
+		// failures is the number of calls which fail before the server succeeds
+		failures     int32
+		failureCode  int
+		expectCode   int
+		expectCalls  int32
+		expectNoCall bool
+	}{
+		{
+			name:        "Test system config fetch succeeds on second attempt",
+			method:      http.MethodGet,
+			path:        "/admin/api/services/1/proxy/configs/production/latest.json",
+			failures:    1,
+			failureCode: http.StatusBadGateway,
+			expectCode:  http.StatusOK,
+			expectCalls: 2,
+		},
+		{
+			name:        "Test authorize succeeds on second attempt",
+			method:      http.MethodGet,
+			path:        "/transactions/authorize.xml",
+			failures:    1,
+			failureCode: http.StatusServiceUnavailable,
+			expectCode:  http.StatusOK,
+			expectCalls: 2,
+		},
+		{
+			name:        "Test persistent failure gives up after max attempts",
+			method:      http.MethodGet,
+			path:        "/transactions/authorize.xml",
+			failures:    10,
+			failureCode: http.StatusInternalServerError,
+			expectCode:  http.StatusInternalServerError,
+			expectCalls: 3,
+		},
+		{
+			name:        "Test client errors are never retried",
+			method:      http.MethodGet,
+			path:        "/transactions/authorize.xml",
+			failures:    10,
+			failureCode: http.StatusForbidden,
+			expectCode:  http.StatusForbidden,
+			expectCalls: 1,
+		},
+		{
+			name:        "Test authrep is not retried on a server error",
+			method:      http.MethodGet,
+			path:        "/transactions/authrep.xml",
+			failures:    1,
+			failureCode: http.StatusInternalServerError,
+			expectCode:  http.StatusInternalServerError,
+			expectCalls: 1,
+		},
+		{
+			name:        "Test report is not retried on a server error",
+			method:      http.MethodPost,
+			path:        "/transactions.xml",
+			failures:    1,
+			failureCode: http.StatusInternalServerError,
+			expectCode:  http.StatusInternalServerError,
+			expectCalls: 1,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var calls int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&calls, 1) <= input.failures {
+					w.WriteHeader(input.failureCode)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer ts.Close()
+
+			client := withRetries(&http.Client{}, fast)
+			req, _ := http.NewRequest(input.method, ts.URL+input.path, strings.NewReader("body"))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != input.expectCode {
+				t.Errorf("expected status %d, got %d", input.expectCode, resp.StatusCode)
+			}
+			if calls != input.expectCalls {
+				t.Errorf("expected %d calls, got %d", input.expectCalls, calls)
+			}
+		})
+	}
+}
+
+func TestRetryRoundTripper_ConnectionErrors(t *testing.T) {
+	// reserve a port with nothing listening on it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen - %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	var attempts int32
+	counting := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&attempts, 1)
+		return http.DefaultTransport.RoundTrip(req)
+	})
+
+	// authrep is retried when the request could not have been sent
+	client := &http.Client{Transport: newRetryRoundTripper(counting, RetryConfig{MaxAttempts: 2, BaseBackoff: time.Millisecond})}
+	if _, err := client.Get("http://" + addr + "/transactions/authrep.xml"); err == nil {
+		t.Fatal("expected connection to fail")
+	}
+	if attempts != 2 {
+		t.Errorf("expected connection errors to be retried, got %d attempts", attempts)
+	}
+}
+
+func TestRetryRoundTripper_RespectsDeadline(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	client := withRetries(&http.Client{}, RetryConfig{MaxAttempts: 5, BaseBackoff: time.Minute, MaxBackoff: time.Minute})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/transactions/authorize.xml", nil)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	if time.Since(start) > time.Second {
+		t.Error("expected retries to give up rather than exceed the deadline")
+	}
+	if calls != 1 || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected the last response to be returned after a single call, got %d calls", calls)
+	}
+}
+
+func TestRetryRoundTripper_Backoff(t *testing.T) {
+	r := newRetryRoundTripper(nil, RetryConfig{BaseBackoff: time.Millisecond * 10, MaxBackoff: time.Millisecond * 50})
+	expect := []time.Duration{10, 20, 40, 50, 50}
+	for i, e := range expect {
+		if got := r.backoff(i + 1); got != e*time.Millisecond {
+			t.Errorf("attempt %d: expected backoff %v, got %v", i+1, e*time.Millisecond, got)
+		}
+	}
+
+	r.config.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := r.backoff(1); got < time.Millisecond*5 || got > time.Millisecond*10 {
+			t.Fatalf("expected jittered backoff within bounds, got %v", got)
+		}
+	}
+}
+
+func TestWithRetries(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><status><authorized>true</authorized><plan>Basic</plan></status>`))
+	}))
+	defer ts.Close()
+
+	m := NewManager(&http.Client{}, nil, BackendConfig{}, nil,
+		WithRetries(RetryConfig{BaseBackoff: time.Millisecond}))
+
+	resp, err := m.Authorize(ts.URL, BackendRequest{
+		Service: "any",
+		Transactions: []BackendTransaction{
+			{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: "any"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !resp.Authorized || calls != 2 {
+		t.Errorf("expected authorization to succeed on the second attempt, got %d calls", calls)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,395 @@
+package authorizer
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+// placeholderPattern matches the value of a {placeholder} in a mapping rule pattern, as done by APIcast
+const placeholderPattern = `([\w_.-]+)`
+
+// ErrInvalidRules is returned, wrapped, when strict rule validation is enabled and a config has mapping
+// rules whose patterns cannot be compiled. See WithStrictRuleValidation
+var ErrInvalidRules = errors.New("invalid mapping rules in proxy config for service")
+
+// ErrTooManyRules is returned, wrapped, when a config has more mapping rules than allowed and the rule limit
+// is set to reject such configs. See WithRuleLimit
+var ErrTooManyRules = errors.New("too many mapping rules in proxy config for service")
+
+// RuleLimitConfig limits the number of mapping rules of a service, bounding the cost of matching its requests
+type RuleLimitConfig struct {
+	// MaxRules allowed per service. Zero implies no limit
+	MaxRules int
+	// Reject configs exceeding the limit rather than truncating them to the first MaxRules rules by position
+	Reject bool
+}
+
+// RuleError describes a mapping rule whose pattern cannot be compiled
+type RuleError struct {
+	RuleID  int64
+	Pattern string
+	Err     error
+}
+
+func (e RuleError) Error() string {
+	return fmt.Sprintf("mapping rule %d has invalid pattern %q - %s", e.RuleID, e.Pattern, e.Err)
+}
+
+func (e RuleError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateConfig compiles the pattern of each mapping rule in the config, returning an error for each
+// rule which fails to compile. Returns nil if every rule is valid
+func ValidateConfig(config client.ProxyConfig) []RuleError {
+	var errs []RuleError
+	for _, rule := range config.Content.Proxy.ProxyRules {
+		if _, err := compileRulePattern(rule.Pattern); err != nil {
+			errs = append(errs, RuleError{RuleID: rule.ID, Pattern: rule.Pattern, Err: err})
+		} else if _, err := compileRuleQuery(rule.Pattern); err != nil {
+			errs = append(errs, RuleError{RuleID: rule.ID, Pattern: rule.Pattern, Err: err})
+		}
+	}
+	return errs
+}
+
+// compileRulePattern compiles a mapping rule pattern into the expression matched against a request path
+// The query string of the pattern is ignored, placeholders match a single path segment and a trailing
+// '$' anchors the pattern to the end of the path. Any other character, including '.', matches literally
+func compileRulePattern(pattern string) (*regexp.Regexp, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("pattern must start with /")
+	}
+
+	path := pattern
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	anchored := strings.HasSuffix(path, "$")
+	path = strings.TrimSuffix(path, "$")
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	for {
+		open := strings.IndexByte(path, '{')
+		if open < 0 {
+			expr.WriteString(regexp.QuoteMeta(path))
+			break
+		}
+		end := strings.IndexByte(path[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated placeholder at offset %d", open)
+		}
+		expr.WriteString(regexp.QuoteMeta(path[:open]))
+		expr.WriteString(placeholderPattern)
+		path = path[open+end+1:]
+	}
+	if anchored {
+		expr.WriteString("$")
+	}
+
+	return regexp.Compile(expr.String())
+}
+
+// anyMethod is the method of a mapping rule which matches requests made with any method
+const anyMethod = "ANY"
+
+// compileRuleQuery returns the query string arguments required by a mapping rule pattern, keyed by name
+// Arguments whose value is a placeholder are mapped to "" and match any value
+func compileRuleQuery(pattern string) (map[string]string, error) {
+	i := strings.IndexByte(pattern, '?')
+	if i < 0 {
+		return nil, nil
+	}
+	values, err := url.ParseQuery(pattern[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid query string - %s", err)
+	}
+
+	query := make(map[string]string, len(values))
+	for name := range values {
+		value := values.Get(name)
+		if strings.HasPrefix(value, "{") && strings.HasSuffix(value, "}") {
+			value = ""
+		}
+		query[name] = value
+	}
+	return query, nil
+}
+
+// RuleOptions configures how requests are matched against mapping rules. See WithRuleOptions
+type RuleOptions struct {
+	// Normalization applied to the path of a request before it is matched
+	Normalization PathNormalization
+	// CapDeltas counts each metric once per request, with the largest delta of the rules matching the request,
+	// rather than summing the delta of each matching rule as done by APIcast. Overlapping rules then do not
+	// multiply the usage of a metric
+	CapDeltas bool
+	// Debug configures a per-request trigger for logging the evaluation of the rules
+	Debug RuleDebugConfig
+	// MatchRequestURI matches the pattern of each rule against the request URI, the path along with the query
+	// string, rather than the path only as done by 3scale. A pattern anchored with '$' then only matches requests
+	// without a query string. The query string arguments required by a pattern are matched in either case
+	MatchRequestURI bool
+}
+
+// subject returns the part of the URL the pattern of each mapping rule is matched against
+func (o RuleOptions) subject(u *url.URL) string {
+	path := o.Normalization.path(u)
+	if !o.MatchRequestURI {
+		return path
+	}
+	if !o.Normalization.enabled() {
+		// the normalized path is escaped, as is the request URI
+		path = u.EscapedPath()
+	}
+	if u.ForceQuery || u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	return path
+}
+
+// RuleDebugConfig configures a header which, set to the shared secret, logs the evaluation of the mapping rules
+// for that request at info level regardless of the level of the logger. Otherwise the evaluation is only logged
+// when the logger has debug enabled. The trigger is disabled unless both are set
+type RuleDebugConfig struct {
+	Header string
+	Secret string
+}
+
+// triggered returns true if the headers of a request carry the debug header set to the secret
+func (d RuleDebugConfig) triggered(header http.Header) bool {
+	if d.Header == "" || d.Secret == "" {
+		return false
+	}
+	value := header.Get(d.Header)
+	return value != "" && subtle.ConstantTimeCompare([]byte(value), []byte(d.Secret)) == 1
+}
+
+// PathNormalization configures the normalization of the path of a request before it is matched against mapping
+// rules, so that equivalent paths match the same rules. The zero value matches the decoded path as is
+// A normalized path is matched in its escaped form, so that an encoded '/' is never taken as a path separator
+type PathNormalization struct {
+	// CollapseSlashes replaces each run of '/' with a single '/', so that /v1//foo matches as /v1/foo
+	CollapseSlashes bool
+	// StripTrailingSlash removes the trailing '/' of any path other than the root, so that /v1/foo/ matches as /v1/foo
+	StripTrailingSlash bool
+	// DecodeUnreserved decodes percent-encoded letters, digits, '-', '.', '_' and '~', which do not change the
+	// meaning of the path. Any other encoded character, such as %2F, is left encoded
+	DecodeUnreserved bool
+}
+
+func (n PathNormalization) enabled() bool {
+	return n.CollapseSlashes || n.StripTrailingSlash || n.DecodeUnreserved
+}
+
+// path returns the path of the URL to be matched against mapping rules
+func (n PathNormalization) path(u *url.URL) string {
+	if !n.enabled() {
+		return u.Path
+	}
+
+	path := u.EscapedPath()
+	if n.DecodeUnreserved && strings.IndexByte(path, '%') >= 0 {
+		path = decodeUnreserved(path)
+	}
+	if n.CollapseSlashes && strings.Contains(path, "//") {
+		var collapsed strings.Builder
+		collapsed.Grow(len(path))
+		for i := 0; i < len(path); i++ {
+			if path[i] == '/' && i > 0 && path[i-1] == '/' {
+				continue
+			}
+			collapsed.WriteByte(path[i])
+		}
+		path = collapsed.String()
+	}
+	if n.StripTrailingSlash && len(path) > 1 {
+		path = strings.TrimRight(path, "/")
+		if path == "" {
+			path = "/"
+		}
+	}
+	return path
+}
+
+// decodeUnreserved decodes the percent-encoded unreserved characters of an escaped path
+func decodeUnreserved(path string) string {
+	var decoded strings.Builder
+	decoded.Grow(len(path))
+	for i := 0; i < len(path); i++ {
+		if path[i] == '%' && i+2 < len(path) {
+			if b, err := strconv.ParseUint(path[i+1:i+3], 16, 8); err == nil && isUnreserved(byte(b)) {
+				decoded.WriteByte(byte(b))
+				i += 2
+				continue
+			}
+		}
+		decoded.WriteByte(path[i])
+	}
+	return decoded.String()
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// MappingRules are the mapping rules of a config compiled for matching requests. See CompileMappingRules
+type MappingRules struct {
+	rules   []compiledRule
+	options RuleOptions
+}
+
+type compiledRule struct {
+	client.ProxyRule
+	expr  *regexp.Regexp
+	query map[string]string
+}
+
+// CompileMappingRules compiles the pattern of each mapping rule once, so that requests are matched without
+// compiling the rules again. Rules which fail to compile are skipped. See ValidateConfig
+func CompileMappingRules(rules []client.ProxyRule, options RuleOptions) *MappingRules {
+	compiled := &MappingRules{rules: make([]compiledRule, 0, len(rules)), options: options}
+	for _, rule := range rules {
+		expr, err := compileRulePattern(rule.Pattern)
+		if err != nil {
+			continue
+		}
+		query, err := compileRuleQuery(rule.Pattern)
+		if err != nil {
+			continue
+		}
+		compiled.rules = append(compiled.rules, compiledRule{ProxyRule: rule, expr: expr, query: query})
+	}
+	return compiled
+}
+
+// Match returns the usage of a request, accumulated from each mapping rule matching its method, path
+// and query string, stopping at the first matching rule flagged as last. Deltas are summed unless capped
+// See RuleOptions
+func (r *MappingRules) Match(method string, u *url.URL) map[string]int {
+	return r.match(method, u, nil)
+}
+
+// Explain returns the usage of a request, as done by Match, along with each mapping rule which matched in order
+func (r *MappingRules) Explain(method string, u *url.URL) (map[string]int, []client.ProxyRule) {
+	var matched []client.ProxyRule
+	metrics := r.match(method, u, func(rule client.ProxyRule, ok bool) {
+		if ok {
+			matched = append(matched, rule)
+		}
+	})
+	return metrics, matched
+}
+
+// match the request against the rules, calling evaluated, if set, with each rule evaluated and whether it matched
+func (r *MappingRules) match(method string, u *url.URL, evaluated func(rule client.ProxyRule, matched bool)) map[string]int {
+	metrics := make(map[string]int)
+	path := r.options.subject(u)
+	var query url.Values
+	for i := range r.rules {
+		rule := &r.rules[i]
+		matched := rule.matches(method, path, u, &query)
+		if evaluated != nil {
+			evaluated(rule.ProxyRule, matched)
+		}
+		if !matched {
+			continue
+		}
+
+		if current, ok := metrics[rule.MetricSystemName]; !r.options.CapDeltas {
+			metrics[rule.MetricSystemName] += int(rule.Delta)
+		} else if !ok || int(rule.Delta) > current {
+			metrics[rule.MetricSystemName] = int(rule.Delta)
+		}
+		if rule.Last {
+			break
+		}
+	}
+	return metrics
+}
+
+// matches returns true if the rule matches the method, the path and the query of the URL, parsed on first use
+// The path is the subject of the options the rules were compiled with. See RuleOptions
+func (rule *compiledRule) matches(method, path string, u *url.URL, query *url.Values) bool {
+	if !strings.EqualFold(rule.HTTPMethod, method) && !strings.EqualFold(rule.HTTPMethod, anyMethod) {
+		return false
+	}
+	if !rule.expr.MatchString(path) {
+		return false
+	}
+	if len(rule.query) > 0 {
+		if *query == nil {
+			*query = u.Query()
+		}
+		return matchQuery(rule.query, *query)
+	}
+	return true
+}
+
+// matchQuery returns true if the query provides each required argument, with the required value if any
+func matchQuery(required map[string]string, query url.Values) bool {
+	for name, value := range required {
+		if _, ok := query[name]; !ok {
+			return false
+		}
+		if value != "" && query.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// limitRules enforces the rule limit on the config, logging a warning when it is exceeded
+// The config is truncated in place to the first rules by position unless the limit rejects it, in which case
+// an error wrapping ErrTooManyRules is returned
+func (m Manager) limitRules(serviceID string, config *client.ProxyConfig) error {
+	limit := m.ruleLimit.MaxRules
+	rules := config.Content.Proxy.ProxyRules
+	if limit <= 0 || len(rules) <= limit {
+		return nil
+	}
+
+	if m.ruleLimit.Reject {
+		m.throttledLogger().Warnf("too_many_rules/"+serviceID,
+			"rejecting config for service %s with %d mapping rules exceeding the limit of %d", serviceID, len(rules), limit)
+		return fmt.Errorf("%w %s - %d rules exceeds the limit of %d", ErrTooManyRules, serviceID, len(rules), limit)
+	}
+
+	m.throttledLogger().Warnf("too_many_rules/"+serviceID,
+		"truncating config for service %s with %d mapping rules to the limit of %d", serviceID, len(rules), limit)
+	sorted := make([]client.ProxyRule, len(rules))
+	copy(sorted, rules)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Position != sorted[j].Position {
+			return sorted[i].Position < sorted[j].Position
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	config.Content.Proxy.ProxyRules = sorted[:limit]
+	return nil
+}
+
+// validateRules logs each mapping rule of the config which cannot be compiled
+// Returns an error wrapping ErrInvalidRules if strict rule validation is enabled and any rule is invalid
+func (m Manager) validateRules(serviceID string, config client.ProxyConfig) error {
+	errs := ValidateConfig(config)
+	for _, err := range errs {
+		m.throttledLogger().Errorf(fmt.Sprintf("invalid_rule/%s/%d", serviceID, err.RuleID),
+			"invalid mapping rule for service %s - %s", serviceID, err)
+	}
+
+	if m.strictRules && len(errs) > 0 {
+		return fmt.Errorf("%w %s - %s", ErrInvalidRules, serviceID, errs[0])
+	}
+	return nil
+}
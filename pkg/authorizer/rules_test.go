@@ -0,0 +1,427 @@
+package authorizer
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+func newRulesConfig(rules ...client.ProxyRule) client.ProxyConfig {
+	config := client.ProxyConfig{}
+	config.Content.Proxy.ProxyRules = rules
+	return config
+}
+
+func TestValidateConfig(t *testing.T) {
+	inputs := []struct {
+		name          string
+		rules         []client.ProxyRule
+		expectInvalid []int64
+	}{
+		{
+			name: "Test valid rules",
+			rules: []client.ProxyRule{
+				{ID: 1, Pattern: "/"},
+				{ID: 2, Pattern: "/orders/{id}/items$"},
+				{ID: 3, Pattern: "/search?q={query}"},
+				{ID: 4, Pattern: "/v(1|2)/users"},
+			},
+		},
+		{
+			name:  "Test no rules",
+			rules: nil,
+		},
+		{
+			name: "Test invalid rules are each reported",
+			rules: []client.ProxyRule{
+				{ID: 1, Pattern: "/"},
+				{ID: 2, Pattern: "/orders/{id"},
+				{ID: 3, Pattern: "/v(1|2/users"},
+				{ID: 4, Pattern: "orders"},
+				{ID: 5, Pattern: "/items[$"},
+				{ID: 6, Pattern: "/search?q=%zz"},
+			},
+			expectInvalid: []int64{2, 4, 6},
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			errs := ValidateConfig(newRulesConfig(input.rules...))
+			if len(errs) != len(input.expectInvalid) {
+				t.Fatalf("expected %d invalid rules, got %v", len(input.expectInvalid), errs)
+			}
+			for i, err := range errs {
+				if err.RuleID != input.expectInvalid[i] || err.Err == nil {
+					t.Errorf("unexpected rule error %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileRulePattern(t *testing.T) {
+	inputs := []struct {
+		pattern string
+		path    string
+		expect  bool
+	}{
+		{pattern: "/", path: "/anything", expect: true},
+		{pattern: "/orders/{id}$", path: "/orders/12", expect: true},
+		{pattern: "/orders/{id}$", path: "/orders/12/items", expect: false},
+		{pattern: "/orders/{id}/items", path: "/orders/a-b.c/items", expect: true},
+		{pattern: "/orders/{id}/items", path: "/orders//items", expect: false},
+		{pattern: "/search?q={query}", path: "/search", expect: true},
+		{pattern: "/users", path: "/api/users", expect: false},
+		{pattern: "/v1/foo.json", path: "/v1/foo.json", expect: true},
+		{pattern: "/v1/foo.json", path: "/v1/fooXjson", expect: false},
+		{pattern: "/v(1|2)/users", path: "/v(1|2)/users", expect: true},
+		{pattern: "/v(1|2)/users", path: "/v1/users", expect: false},
+		{pattern: "/a+b/{id}.json$", path: "/a+b/12.json", expect: true},
+		{pattern: "/a+b/{id}.json$", path: "/aab/12.json", expect: false},
+		{pattern: "/items[$", path: "/items[", expect: true},
+	}
+
+	for _, input := range inputs {
+		expr, err := compileRulePattern(input.pattern)
+		if err != nil {
+			t.Fatalf("unexpected error compiling %s - %v", input.pattern, err)
+		}
+		if got := expr.MatchString(input.path); got != input.expect {
+			t.Errorf("expected %s matching %s to be %t", input.pattern, input.path, input.expect)
+		}
+	}
+}
+
+func TestManager_StrictRuleValidation(t *testing.T) {
+	invalid := client.ProxyConfigElement{
+		ProxyConfig: newRulesConfig(client.ProxyRule{ID: 1, Pattern: "/"}, client.ProxyRule{ID: 2, Pattern: "/orders/{id"}),
+	}
+	request := SystemRequest{AccessToken: "any", ServiceID: "1", Environment: "production"}
+
+	for _, strict := range []bool{false, true} {
+		logger := &recordingLogger{}
+		m := Manager{
+			clientBuilder: mockBuilder{withSystemClient: mockSystemClient{withConfig: invalid}},
+			backendConf:   BackendConfig{Logger: logger},
+			strictRules:   strict,
+		}
+
+		_, err := m.GetSystemConfiguration("https://any.3scale.net", request)
+		if strict && !errors.Is(err, ErrInvalidRules) {
+			t.Errorf("expected strict validation to fail the fetch, got %v", err)
+		}
+		if !strict && err != nil {
+			t.Errorf("expected the config to be returned, got %v", err)
+		}
+		if len(logger.errors) != 1 {
+			t.Errorf("expected the invalid rule to be logged, got %v", logger.errors)
+		}
+	}
+}
+
+func TestManager_RuleLimit(t *testing.T) {
+	config := client.ProxyConfigElement{
+		ProxyConfig: newRulesConfig(
+			client.ProxyRule{ID: 3, Pattern: "/c", Position: 2},
+			client.ProxyRule{ID: 1, Pattern: "/a", Position: 1},
+			client.ProxyRule{ID: 2, Pattern: "/b", Position: 1},
+		),
+	}
+	request := SystemRequest{AccessToken: "any", ServiceID: "1", Environment: "production"}
+
+	inputs := []struct {
+		name        string
+		limit       RuleLimitConfig
+		expectRules []int64
+		expectErr   error
+		expectWarn  bool
+	}{
+		{
+			name:        "Test no limit",
+			expectRules: []int64{3, 1, 2},
+		},
+		{
+			name:        "Test config within the limit is unchanged",
+			limit:       RuleLimitConfig{MaxRules: 3, Reject: true},
+			expectRules: []int64{3, 1, 2},
+		},
+		{
+			name:        "Test config beyond the limit is truncated by position",
+			limit:       RuleLimitConfig{MaxRules: 2},
+			expectRules: []int64{1, 2},
+			expectWarn:  true,
+		},
+		{
+			name:       "Test config beyond the limit is rejected",
+			limit:      RuleLimitConfig{MaxRules: 2, Reject: true},
+			expectErr:  ErrTooManyRules,
+			expectWarn: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			logger := &recordingLogger{}
+			m := Manager{
+				clientBuilder: mockBuilder{withSystemClient: mockSystemClient{withConfig: config}},
+				backendConf:   BackendConfig{Logger: logger},
+				ruleLimit:     input.limit,
+			}
+
+			got, err := m.GetSystemConfiguration("https://any.3scale.net", request)
+			if !errors.Is(err, input.expectErr) {
+				t.Fatalf("expected error %v, got %v", input.expectErr, err)
+			}
+			var ids []int64
+			for _, rule := range got.Content.Proxy.ProxyRules {
+				ids = append(ids, rule.ID)
+			}
+			if !reflect.DeepEqual(ids, input.expectRules) {
+				t.Errorf("expected rules %v, got %v", input.expectRules, ids)
+			}
+			if warned := len(logger.warnings) == 1; warned != input.expectWarn {
+				t.Errorf("expected a warning to be logged %t, got %v", input.expectWarn, logger.warnings)
+			}
+		})
+	}
+
+	if len(config.ProxyConfig.Content.Proxy.ProxyRules) != 3 || config.ProxyConfig.Content.Proxy.ProxyRules[0].ID != 3 {
+		t.Error("expected truncation not to modify the rules of the fetched config")
+	}
+}
+
+// ruleFixture is a set of mapping rules and the usage APIcast matches for each request. Fixtures are
+// loaded from testdata/apicast so divergences from APIcast can be added without changing the test
+type ruleFixture struct {
+	Description string             `json:"description"`
+	Rules       []client.ProxyRule `json:"rules"`
+	Cases       []struct {
+		Method string         `json:"method"`
+		Path   string         `json:"path"`
+		Expect map[string]int `json:"expect"`
+	} `json:"cases"`
+}
+
+func TestMatchRules_APIcast(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "apicast", "*.json"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("expected fixtures to be available - %v", err)
+	}
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			var fixture ruleFixture
+			if err := json.Unmarshal(data, &fixture); err != nil {
+				t.Fatalf("invalid fixture - %v", err)
+			}
+			if errs := ValidateConfig(newRulesConfig(fixture.Rules...)); len(errs) > 0 {
+				t.Fatalf("invalid rules in fixture - %v", errs)
+			}
+
+			for _, c := range fixture.Cases {
+				u, err := url.ParseRequestURI(c.Path)
+				if err != nil {
+					t.Fatalf("invalid path %q - %v", c.Path, err)
+				}
+				got := CompileMappingRules(fixture.Rules, RuleOptions{}).Match(c.Method, u)
+				if len(got) == 0 && len(c.Expect) == 0 {
+					continue
+				}
+				if !reflect.DeepEqual(got, c.Expect) {
+					t.Errorf("%s: %s %s expected %v, got %v", fixture.Description, c.Method, c.Path, c.Expect, got)
+				}
+			}
+		})
+	}
+}
+
+func TestMappingRules_PathNormalization(t *testing.T) {
+	rules := []client.ProxyRule{
+		{ID: 1, HTTPMethod: "GET", Pattern: "/v1/foo$", MetricSystemName: "foo", Delta: 1},
+		{ID: 2, HTTPMethod: "GET", Pattern: "/v1/a/b$", MetricSystemName: "ab", Delta: 1},
+		{ID: 3, HTTPMethod: "GET", Pattern: "/$", MetricSystemName: "root", Delta: 1},
+	}
+	all := PathNormalization{CollapseSlashes: true, StripTrailingSlash: true, DecodeUnreserved: true}
+
+	inputs := []struct {
+		name          string
+		normalization PathNormalization
+		path          string
+		expect        map[string]int
+	}{
+		{name: "Test duplicate slashes miss by default", path: "/v1//foo", expect: map[string]int{}},
+		{name: "Test duplicate slashes are collapsed", normalization: PathNormalization{CollapseSlashes: true}, path: "/v1//foo", expect: map[string]int{"foo": 1}},
+		{name: "Test trailing slash misses by default", path: "/v1/foo/", expect: map[string]int{}},
+		{name: "Test trailing slash is stripped", normalization: PathNormalization{StripTrailingSlash: true}, path: "/v1/foo/", expect: map[string]int{"foo": 1}},
+		{name: "Test root is not stripped", normalization: all, path: "//", expect: map[string]int{"root": 1}},
+		{name: "Test encoded unreserved characters are decoded", normalization: all, path: "/v1/%66%6F%6f", expect: map[string]int{"foo": 1}},
+		{name: "Test encoded unreserved characters are not decoded unless configured", normalization: PathNormalization{CollapseSlashes: true}, path: "/v1/%66oo", expect: map[string]int{}},
+		{name: "Test encoded slash is a separator by default", path: "/v1/a%2Fb", expect: map[string]int{"ab": 1}},
+		{name: "Test encoded slash is not decoded", normalization: all, path: "/v1/a%2Fb", expect: map[string]int{}},
+		{name: "Test all normalizations", normalization: all, path: "/v1//%66oo/", expect: map[string]int{"foo": 1}},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			u, err := url.ParseRequestURI(input.path)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			got := CompileMappingRules(rules, RuleOptions{Normalization: input.normalization}).Match("GET", u)
+			if !reflect.DeepEqual(got, input.expect) {
+				t.Errorf("expected %v, got %v", input.expect, got)
+			}
+		})
+	}
+}
+
+func TestMappingRules_MatchRequestURI(t *testing.T) {
+	rules := []client.ProxyRule{
+		{ID: 1, HTTPMethod: "GET", Pattern: "/items$", MetricSystemName: "items", Delta: 1},
+		{ID: 2, HTTPMethod: "GET", Pattern: "/search/{term}", MetricSystemName: "search", Delta: 1},
+		{ID: 3, HTTPMethod: "GET", Pattern: "/export?format={format}", MetricSystemName: "export", Delta: 1},
+	}
+
+	inputs := []struct {
+		name       string
+		requestURI bool
+		path       string
+		expect     map[string]int
+	}{
+		{name: "Test a query parameter does not match the path of a rule", path: "/search?term=foo", expect: map[string]int{}},
+		{name: "Test a query parameter does not match the path of a rule with the request uri", requestURI: true, path: "/search?term=foo", expect: map[string]int{}},
+		{name: "Test an anchored rule ignores the query string by default", path: "/items?page=2", expect: map[string]int{"items": 1}},
+		{name: "Test an anchored rule misses a query string with the request uri", requestURI: true, path: "/items?page=2", expect: map[string]int{}},
+		{name: "Test an anchored rule matches without a query string with the request uri", requestURI: true, path: "/items", expect: map[string]int{"items": 1}},
+		{name: "Test query arguments of a rule are matched by default", path: "/export?format=csv", expect: map[string]int{"export": 1}},
+		{name: "Test query arguments of a rule are matched with the request uri", requestURI: true, path: "/export?format=csv", expect: map[string]int{"export": 1}},
+		{name: "Test missing query arguments of a rule miss", path: "/export", expect: map[string]int{}},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			u, err := url.ParseRequestURI(input.path)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			got := CompileMappingRules(rules, RuleOptions{MatchRequestURI: input.requestURI}).Match("GET", u)
+			if !reflect.DeepEqual(got, input.expect) {
+				t.Errorf("expected %v, got %v", input.expect, got)
+			}
+		})
+	}
+}
+
+func TestMappingRules_CapDeltas(t *testing.T) {
+	rules := []client.ProxyRule{
+		{ID: 1, HTTPMethod: "GET", Pattern: "/", MetricSystemName: "hits", Delta: 1},
+		{ID: 2, HTTPMethod: "GET", Pattern: "/widgets", MetricSystemName: "hits", Delta: 1},
+		{ID: 3, HTTPMethod: "GET", Pattern: "/widgets/{id}", MetricSystemName: "hits", Delta: 3},
+		{ID: 4, HTTPMethod: "GET", Pattern: "/widgets", MetricSystemName: "widgets", Delta: 2},
+		{ID: 5, HTTPMethod: "GET", Pattern: "/widgets/{id}", MetricSystemName: "widgets", Delta: 1},
+		{ID: 6, HTTPMethod: "GET", Pattern: "/free", MetricSystemName: "free", Delta: 0},
+	}
+
+	inputs := []struct {
+		name         string
+		path         string
+		expectSummed map[string]int
+		expectCapped map[string]int
+	}{
+		{
+			name:         "Test single matching rule",
+			path:         "/",
+			expectSummed: map[string]int{"hits": 1},
+			expectCapped: map[string]int{"hits": 1},
+		},
+		{
+			name:         "Test overlapping rules of the same delta",
+			path:         "/widgets",
+			expectSummed: map[string]int{"hits": 2, "widgets": 2},
+			expectCapped: map[string]int{"hits": 1, "widgets": 2},
+		},
+		{
+			name:         "Test overlapping rules are capped at the largest delta",
+			path:         "/widgets/1",
+			expectSummed: map[string]int{"hits": 5, "widgets": 3},
+			expectCapped: map[string]int{"hits": 3, "widgets": 2},
+		},
+		{
+			name:         "Test zero delta is kept",
+			path:         "/free",
+			expectSummed: map[string]int{"hits": 1, "free": 0},
+			expectCapped: map[string]int{"hits": 1, "free": 0},
+		},
+	}
+
+	summed := CompileMappingRules(rules, RuleOptions{})
+	capped := CompileMappingRules(rules, RuleOptions{CapDeltas: true})
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			u, err := url.ParseRequestURI(input.path)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if got := summed.Match("GET", u); !reflect.DeepEqual(got, input.expectSummed) {
+				t.Errorf("expected summed usage %v, got %v", input.expectSummed, got)
+			}
+			if got := capped.Match("GET", u); !reflect.DeepEqual(got, input.expectCapped) {
+				t.Errorf("expected capped usage %v, got %v", input.expectCapped, got)
+			}
+		})
+	}
+}
+
+func TestMappingRules_Explain(t *testing.T) {
+	rules := []client.ProxyRule{
+		{ID: 1, HTTPMethod: "GET", Pattern: "/", MetricSystemName: "hits", Delta: 1},
+		{ID: 2, HTTPMethod: "GET", Pattern: "/widgets", MetricSystemName: "widgets", Delta: 1},
+		{ID: 3, HTTPMethod: "GET", Pattern: "/widgets/{id}", MetricSystemName: "hits", Delta: 2},
+		{ID: 4, HTTPMethod: "POST", Pattern: "/widgets", MetricSystemName: "create", Delta: 1},
+		{ID: 5, HTTPMethod: "GET", Pattern: "/orders", MetricSystemName: "orders", Delta: 1, Last: true},
+		{ID: 6, HTTPMethod: "GET", Pattern: "/orders/{id}", MetricSystemName: "order", Delta: 1},
+	}
+
+	inputs := []struct {
+		name          string
+		method        string
+		path          string
+		expectRules   []int64
+		expectMetrics map[string]int
+	}{
+		{name: "Test non overlapping rules", method: "POST", path: "/widgets", expectRules: []int64{4}, expectMetrics: map[string]int{"create": 1}},
+		{name: "Test overlapping rules", method: "GET", path: "/widgets/1", expectRules: []int64{1, 2, 3}, expectMetrics: map[string]int{"hits": 3, "widgets": 1}},
+		{name: "Test rules after a last rule are not matched", method: "GET", path: "/orders/1", expectRules: []int64{1, 5}, expectMetrics: map[string]int{"hits": 1, "orders": 1}},
+		{name: "Test no rules match", method: "DELETE", path: "/widgets", expectMetrics: map[string]int{}},
+	}
+
+	compiled := CompileMappingRules(rules, RuleOptions{})
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			u, _ := url.ParseRequestURI(input.path)
+			metrics, matched := compiled.Explain(input.method, u)
+
+			var ids []int64
+			for _, rule := range matched {
+				ids = append(ids, rule.ID)
+			}
+			if !reflect.DeepEqual(ids, input.expectRules) {
+				t.Errorf("expected rules %v to match, got %v", input.expectRules, ids)
+			}
+			if !reflect.DeepEqual(metrics, input.expectMetrics) || !reflect.DeepEqual(compiled.Match(input.method, u), metrics) {
+				t.Errorf("expected usage %v, got %v", input.expectMetrics, metrics)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package authorizer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+// errSpillClosed is returned when reports are spilled once the AsyncReporter has been closed
+var errSpillClosed = errors.New("spill file has been closed")
+
+// replaySuffix is appended to the path of the spill file while its records are being replayed
+const replaySuffix = ".replay"
+
+// expiredSuffix is appended to the path of the spill file to name the file spilled reports are moved to once they
+// are too old to be accepted by 3scale backend. See MaxTransactionAge
+const expiredSuffix = ".expired"
+
+// SpillConfig configures the spilling of pending reports to disk by the AsyncReporter
+// Spilled reports hold the credentials of the request and so the file is created readable only by its owner
+// Reports spilled for longer than MaxTransactionAge are no longer accepted by 3scale backend. On replay they are
+// counted as dropped and appended to the file at Path with the ".expired" suffix, which is left for reconciliation
+type SpillConfig struct {
+	// Path of the spill file. An empty path disables spilling
+	Path string
+	// Threshold is the number of pending reports above which reports are spilled rather than buffered
+	// Defaults to, and is capped at, AsyncReportConfig.BufferSize
+	Threshold int
+}
+
+// spillRecord is a pending report as written to the spill file
+type spillRecord struct {
+	BackendURL   string             `json:"backend_url"`
+	Service      string             `json:"service"`
+	Auth         BackendAuth        `json:"auth"`
+	Transactions []spillTransaction `json:"transactions"`
+}
+
+type spillTransaction struct {
+	Metrics   map[string]int `json:"metrics"`
+	Params    BackendParams  `json:"params"`
+	Timestamp int64          `json:"timestamp"`
+}
+
+// spillFile appends pending reports to a file as JSON lines
+// Records are synced to disk before the file is rotated for replay and when the file is closed
+type spillFile struct {
+	path string
+	file *os.File
+	// pending is true while there are records on disk waiting to be replayed
+	pending bool
+	// closed is set once the reporter has been closed, after which no records are appended
+	closed bool
+}
+
+func newSpillFile(path string) *spillFile {
+	s := &spillFile{path: path}
+	// records left over from a previous run are replayed on start up
+	for _, p := range []string{path, path + replaySuffix} {
+		if info, err := os.Stat(p); err == nil && info.Size() > 0 {
+			s.pending = true
+		}
+	}
+	return s
+}
+
+// append the reports to the spill file, setting the time they were queued on transactions without a timestamp
+// so they are reported in the correct period when they are replayed
+func (s *spillFile) append(reports ...pendingReport) error {
+	if s.closed {
+		return errSpillClosed
+	}
+	if s.file == nil {
+		file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		s.file = file
+	}
+
+	w := bufio.NewWriter(s.file)
+	encoder := json.NewEncoder(w)
+	for _, report := range reports {
+		if err := encoder.Encode(newSpillRecord(report)); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	s.pending = true
+	return nil
+}
+
+// rotate moves the spilled records aside so they can be replayed while new records are spilled
+// Returns the path of the file to replay. Records left over from an interrupted replay are replayed first
+func (s *spillFile) rotate() (string, error) {
+	replay := s.path + replaySuffix
+	if _, err := os.Stat(replay); err == nil {
+		return replay, nil
+	}
+
+	if err := s.closeFile(); err != nil {
+		return "", err
+	}
+	s.pending = false
+
+	if err := os.Rename(s.path, replay); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+	return replay, nil
+}
+
+// close syncs any spilled records to disk and closes the file, refusing any further records
+func (s *spillFile) close() error {
+	s.closed = true
+	return s.closeFile()
+}
+
+// closeFile syncs any spilled records to disk and closes the file, which is reopened by the next append
+func (s *spillFile) closeFile() error {
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Sync()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.file = nil
+	return err
+}
+
+// readSpill returns the reports held by the spill file at the provided path
+// Records which cannot be decoded, such as one partially written before a crash, are skipped and counted
+func readSpill(path string) ([]pendingReport, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	var reports []pendingReport
+	var skipped int
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record spillRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil || len(record.Transactions) == 0 {
+			skipped++
+			continue
+		}
+		reports = append(reports, record.toPendingReport())
+	}
+	if err := scanner.Err(); err != nil {
+		// the remainder of the file is unreadable so is treated as a corrupt tail
+		skipped++
+	}
+	return reports, skipped, nil
+}
+
+// splitExpired separates the reports holding a transaction too old to be accepted by 3scale backend
+func splitExpired(reports []pendingReport, now time.Time) ([]pendingReport, []pendingReport) {
+	var fresh, expired []pendingReport
+	for _, report := range reports {
+		if report.expired(now) {
+			expired = append(expired, report)
+			continue
+		}
+		fresh = append(fresh, report)
+	}
+	return fresh, expired
+}
+
+func (report pendingReport) expired(now time.Time) bool {
+	for _, transaction := range report.request.Transactions {
+		if transaction.Timestamp != 0 && time.Unix(transaction.Timestamp, 0).Before(now.Add(-MaxTransactionAge)) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendExpired moves the reports to the file of expired reports alongside the spill file at the provided path
+// so they can be reconciled, as 3scale backend no longer accepts them
+func appendExpired(path string, reports []pendingReport) error {
+	expired := &spillFile{path: path + expiredSuffix}
+	err := expired.append(reports...)
+	if closeErr := expired.close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func newSpillRecord(report pendingReport) spillRecord {
+	record := spillRecord{
+		BackendURL:   report.backendURL,
+		Service:      report.request.Service,
+		Auth:         report.request.Auth,
+		Transactions: make([]spillTransaction, 0, len(report.request.Transactions)),
+	}
+
+	queuedAt := report.queuedAt
+	if queuedAt.IsZero() {
+		queuedAt = time.Now()
+	}
+	for _, transaction := range report.request.Transactions {
+		timestamp := transaction.Timestamp
+		if timestamp == 0 {
+			timestamp = queuedAt.Unix()
+		}
+		record.Transactions = append(record.Transactions, spillTransaction{
+			Metrics:   transaction.Metrics,
+			Params:    transaction.Params,
+			Timestamp: timestamp,
+		})
+	}
+	return record
+}
+
+func (record spillRecord) toPendingReport() pendingReport {
+	transactions := make([]BackendTransaction, 0, len(record.Transactions))
+	for _, transaction := range record.Transactions {
+		transactions = append(transactions, BackendTransaction{
+			Metrics:   transaction.Metrics,
+			Params:    transaction.Params,
+			Timestamp: transaction.Timestamp,
+		})
+	}
+
+	return pendingReport{
+		backendURL: record.BackendURL,
+		request: BackendRequest{
+			Auth:         record.Auth,
+			Service:      record.Service,
+			Transactions: transactions,
+		},
+	}
+}
@@ -0,0 +1,264 @@
+package authorizer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/3scale/3scale-authorizer/pkg/core"
+)
+
+// scriptedSender records the reports it is asked to send, failing those for which fail returns an error
+type scriptedSender struct {
+	mu       sync.Mutex
+	fail     func(request BackendRequest) error
+	attempts int
+	requests []BackendRequest
+}
+
+func (s *scriptedSender) Report(backendURL string, request BackendRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	if s.fail != nil {
+		if err := s.fail(request); err != nil {
+			return err
+		}
+	}
+	s.requests = append(s.requests, request)
+	return nil
+}
+
+func (s *scriptedSender) sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var services []string
+	for _, request := range s.requests {
+		services = append(services, request.Service)
+	}
+	return services
+}
+
+func (s *scriptedSender) waitForSent(t *testing.T, expect []string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for !reflect.DeepEqual(s.sent(), expect) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected reports %v to be sent, got %v", expect, s.sent())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newSpillRequest(service string) BackendRequest {
+	return BackendRequest{
+		Auth:    BackendAuth{Type: "service_token", Value: "token"},
+		Service: service,
+		Transactions: []BackendTransaction{
+			{Metrics: map[string]int{"hits": 1}, Params: BackendParams{AppID: "app"}},
+		},
+	}
+}
+
+func TestAsyncReporter_SpillReplayedAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reports.spill")
+	logger := core.NewLogThrottle(&core.NoOpLogger{}, 1, time.Minute)
+
+	sender := newGatedSender()
+	defer close(sender.gate)
+	crashed := newAsyncReporter(sender, logger, AsyncReportConfig{BufferSize: 10, Spill: SpillConfig{Path: path, Threshold: 1}})
+
+	// the first report is taken by the background sender and the second buffered, the remainder are spilled
+	crashed.Report("url", newSpillRequest("0"))
+	waitForPending(t, crashed, 0)
+	for _, service := range []string{"1", "2", "3"} {
+		crashed.Report("url", newSpillRequest(service))
+	}
+
+	// the process crashes part way through spilling a record
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("expected reports to have been spilled - %v", err)
+	}
+	file.WriteString(`{"backend_url":"url","serv`)
+	file.Close()
+
+	recovered := &scriptedSender{}
+	r := newAsyncReporter(recovered, logger, AsyncReportConfig{Spill: SpillConfig{Path: path}})
+	recovered.waitForSent(t, []string{"2", "3"})
+	if err := r.Close(time.Second * 5); err != nil {
+		t.Fatalf("unexpected error closing %v", err)
+	}
+
+	for _, request := range recovered.requests {
+		expect := newSpillRequest(request.Service)
+		if request.Transactions[0].Timestamp == 0 {
+			t.Error("expected spilled reports to carry the time they were queued")
+		}
+		request.Transactions[0].Timestamp = 0
+		if !reflect.DeepEqual(request, expect) {
+			t.Errorf("expected replayed report %+v, got %+v", expect, request)
+		}
+	}
+	for _, p := range []string{path, path + replaySuffix} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed once replayed", p)
+		}
+	}
+}
+
+func TestAsyncReporter_SpillWhileBackendUnavailable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reports.spill")
+
+	down := true
+	sender := &scriptedSender{fail: func(request BackendRequest) error {
+		if down {
+			return fmt.Errorf("%w - error calling Report", ErrBackendUnavailable)
+		}
+		if request.Service == "invalid" {
+			return fmt.Errorf("report not accepted by 3scale - metric_invalid")
+		}
+		return nil
+	}}
+	r := newAsyncReporter(sender, core.NewLogThrottle(&core.NoOpLogger{}, 1, time.Minute),
+		AsyncReportConfig{Spill: SpillConfig{Path: path}})
+
+	for _, service := range []string{"0", "invalid", "1"} {
+		r.Report("url", newSpillRequest(service))
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		sender.mu.Lock()
+		attempts := sender.attempts
+		sender.mu.Unlock()
+		if attempts == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected each report to be attempted, got %d attempts", attempts)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the spilled reports are replayed once 3scale accepts a report
+	sender.mu.Lock()
+	down = false
+	sender.mu.Unlock()
+	r.Report("url", newSpillRequest("2"))
+
+	sender.waitForSent(t, []string{"2", "0", "1"})
+	if err := r.Close(time.Second * 5); err != nil {
+		t.Fatalf("unexpected error closing %v", err)
+	}
+	if r.Dropped() != 0 {
+		t.Errorf("expected no reports to be dropped, got %d", r.Dropped())
+	}
+}
+
+func TestAsyncReporter_SpillOnClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reports.spill")
+
+	sender := newGatedSender()
+	defer close(sender.gate)
+	r := newAsyncReporter(sender, core.NewLogThrottle(&core.NoOpLogger{}, 1, time.Minute),
+		AsyncReportConfig{Spill: SpillConfig{Path: path}})
+
+	r.Report("url", newSpillRequest("0"))
+	waitForPending(t, r, 0)
+	r.Report("url", newSpillRequest("1"))
+	r.Report("url", newSpillRequest("2"))
+
+	// reports which remain unsent at the deadline are spilled rather than lost
+	if err := r.Close(time.Millisecond * 50); err != nil {
+		t.Fatalf("expected pending reports to be spilled, got %v", err)
+	}
+
+	reports, skipped, err := readSpill(path)
+	if err != nil || skipped != 0 {
+		t.Fatalf("unexpected error reading spill file %v, %d skipped", err, skipped)
+	}
+	var services []string
+	for _, report := range reports {
+		services = append(services, report.request.Service)
+	}
+	if !reflect.DeepEqual(services, []string{"1", "2"}) {
+		t.Errorf("expected the pending reports to be spilled, got %v", services)
+	}
+}
+
+func TestAsyncReporter_SpillClosedWhileSending(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reports.spill")
+
+	gate := make(chan struct{})
+	sender := &scriptedSender{fail: func(request BackendRequest) error {
+		if request.Service == "0" {
+			<-gate
+			return fmt.Errorf("%w - error calling Report", ErrBackendUnavailable)
+		}
+		return nil
+	}}
+	r := newAsyncReporter(sender, core.NewLogThrottle(&core.NoOpLogger{}, 1, time.Minute),
+		AsyncReportConfig{Spill: SpillConfig{Path: path}})
+
+	r.Report("url", newSpillRequest("0"))
+	waitForPending(t, r, 0)
+	r.Report("url", newSpillRequest("1"))
+	if err := r.Close(time.Millisecond * 50); err != nil {
+		t.Fatalf("expected pending reports to be spilled, got %v", err)
+	}
+
+	// the report being sent at the deadline fails once the spill file has been closed
+	close(gate)
+	select {
+	case <-r.done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected the background sender to stop")
+	}
+
+	if r.spill.file != nil {
+		t.Error("expected the spill file not to be reopened once closed")
+	}
+	if r.Dropped() != 1 {
+		t.Errorf("expected the report failing after close to be dropped, got %d", r.Dropped())
+	}
+	reports, _, err := readSpill(path)
+	if err != nil || len(reports) != 1 || reports[0].request.Service != "1" {
+		t.Errorf("expected only the pending report to be spilled, got %+v - %v", reports, err)
+	}
+}
+
+func TestAsyncReporter_SpillExpired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reports.spill")
+
+	expired := newSpillRequest("expired")
+	expired.Transactions[0].Timestamp = time.Now().Add(-MaxTransactionAge - time.Minute).Unix()
+	spill := newSpillFile(path)
+	if err := spill.append(pendingReport{backendURL: "url", request: newSpillRequest("0")},
+		pendingReport{backendURL: "url", request: expired}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	spill.close()
+
+	sender := &scriptedSender{}
+	r := newAsyncReporter(sender, core.NewLogThrottle(&core.NoOpLogger{}, 1, time.Minute),
+		AsyncReportConfig{Spill: SpillConfig{Path: path}})
+	sender.waitForSent(t, []string{"0"})
+	if err := r.Close(time.Second * 5); err != nil {
+		t.Fatalf("unexpected error closing %v", err)
+	}
+
+	if sender.attempts != 1 {
+		t.Errorf("expected the expired report not to be sent, got %d attempts", sender.attempts)
+	}
+	if r.Dropped() != 1 {
+		t.Errorf("expected the expired report to be counted as dropped, got %d", r.Dropped())
+	}
+	reports, _, err := readSpill(path + expiredSuffix)
+	if err != nil || len(reports) != 1 || !reflect.DeepEqual(reports[0].request, expired) {
+		t.Errorf("expected the expired report to be moved aside, got %+v - %v", reports, err)
+	}
+}
@@ -0,0 +1,227 @@
+package authorizer
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetricsSink records metrics emitted by a MetricsReporter built with NewMetricsReporter
+// Implementations must be safe for concurrent use and must not block
+type MetricsSink interface {
+	Counter(name string, value int64, tags map[string]string)
+	Gauge(name string, value float64, tags map[string]string)
+	// Histogram records an observation. Durations are observed in milliseconds
+	Histogram(name string, value float64, tags map[string]string)
+}
+
+// Names of the metrics recorded to a MetricsSink
+const (
+	MetricUpstreamRequests = "upstream.requests"
+	MetricUpstreamDuration = "upstream.duration_ms"
+	MetricCacheHits        = "cache.hits"
+	MetricCacheMisses      = "cache.misses"
+	MetricCacheEntries     = "cache.entries"
+	MetricCacheHitRatio    = "cache.hit_ratio"
+	MetricFlushDuration    = "cache.flush_duration_ms"
+	MetricFlushLag         = "cache.flush_lag_ms"
+	MetricDecisions        = "authz.decisions"
+	MetricDecisionDuration = "authz.duration_ms"
+	MetricInFlight         = "authz.in_flight"
+	// MetricBreakerState is 0 while closed, 1 while open and 2 while half-open
+	MetricBreakerState     = "breaker.state"
+	MetricUpstreamInFlight = "upstream.in_flight"
+	MetricUpstreamShed     = "upstream.shed"
+	MetricConfigStaleness  = "system.config_staleness_ms"
+	MetricConfigAge        = "system.config_age_ms"
+	MetricSystemFailures   = "system.failures"
+	MetricBackendFailures  = "backend.failures"
+)
+
+// upstreamTags returns the tags of the metrics of a call to 3scale, other than its status code
+func upstreamTags(report TelemetryReport) map[string]string {
+	tags := map[string]string{
+		"host":   report.Host,
+		"method": report.Method,
+	}
+	if report.Target != "" {
+		tags["target"] = string(report.Target)
+	}
+	if report.ErrorClass != ErrorClassNone {
+		tags["error_class"] = string(report.ErrorClass)
+	}
+	return tags
+}
+
+// NewMetricsReporter returns a MetricsReporter which records HTTP calls to 3scale, cache hits and misses, the state
+// of backend caches after each flush, decisions,
+// decisions in progress, circuit breaker state, calls in flight to 3scale backend, the staleness and age of served
+// configs and failed calls to 3scale system and 3scale backend to the provided sink
+func NewMetricsReporter(sink MetricsSink) *MetricsReporter {
+	return &MetricsReporter{
+		ReportMetrics: true,
+		ResponseCB: func(report TelemetryReport) {
+			tags := upstreamTags(report)
+			tags["code"] = strconv.Itoa(report.Code)
+			sink.Counter(MetricUpstreamRequests, 1, tags)
+			sink.Histogram(MetricUpstreamDuration, durationMillis(report.TimeTaken), tags)
+		},
+		// calls which failed without a response are tagged with their error class but no code
+		ErrorCB: func(report TelemetryReport) {
+			tags := upstreamTags(report)
+			sink.Counter(MetricUpstreamRequests, 1, tags)
+			sink.Histogram(MetricUpstreamDuration, durationMillis(report.TimeTaken), tags)
+		},
+		CacheHitCB: func(cache Cache) {
+			sink.Counter(MetricCacheHits, 1, map[string]string{"cache": cache.String()})
+		},
+		CacheMissCB: func(cache Cache) {
+			sink.Counter(MetricCacheMisses, 1, map[string]string{"cache": cache.String()})
+		},
+		BackendCacheCB: func(report BackendCacheReport) {
+			tags := map[string]string{"backend": report.Backend}
+			sink.Gauge(MetricCacheEntries, float64(report.Entries), tags)
+			sink.Gauge(MetricCacheHitRatio, report.HitRatio, tags)
+			sink.Histogram(MetricFlushDuration, durationMillis(report.FlushDuration), tags)
+			sink.Gauge(MetricFlushLag, durationMillis(report.FlushLag), tags)
+		},
+		DecisionCB: func(report DecisionReport) {
+			tags := map[string]string{
+				"service": report.Service,
+				"outcome": string(report.Outcome),
+			}
+			if report.Reason != ReasonNone {
+				tags["reason"] = string(report.Reason)
+			}
+			if report.FromCache {
+				tags["source"] = "cache"
+			}
+			sink.Counter(MetricDecisions, 1, tags)
+			sink.Histogram(MetricDecisionDuration, durationMillis(report.TimeTaken), map[string]string{"service": report.Service})
+		},
+		InFlightCB: func(inFlight int64) {
+			sink.Gauge(MetricInFlight, float64(inFlight), nil)
+		},
+		BreakerStateCB: func(host string, state BreakerState) {
+			sink.Gauge(MetricBreakerState, float64(state), map[string]string{"host": host})
+		},
+		BackendInFlightCB: func(inFlight int64) {
+			sink.Gauge(MetricUpstreamInFlight, float64(inFlight), nil)
+		},
+		ShedCB: func() {
+			sink.Counter(MetricUpstreamShed, 1, nil)
+		},
+		ConfigStalenessCB: func(service string, staleness time.Duration) {
+			sink.Gauge(MetricConfigStaleness, durationMillis(staleness), map[string]string{"service": service})
+		},
+		ConfigAgeCB: func(service string, age time.Duration) {
+			sink.Gauge(MetricConfigAge, durationMillis(age), map[string]string{"service": service})
+		},
+		FailureCB: func(report FailureReport) {
+			metric := MetricBackendFailures
+			if report.Target == TargetSystem {
+				metric = MetricSystemFailures
+			}
+			sink.Counter(metric, 1, map[string]string{"service": report.Service, "error_class": string(report.ErrorClass)})
+		},
+	}
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// StatsDTagFormat determines how tags are written by the StatsDSink
+type StatsDTagFormat int
+
+const (
+	// StatsDTagsNone drops tags, as plain StatsD has no support for them
+	StatsDTagsNone StatsDTagFormat = iota
+	// StatsDTagsDogStatsD writes tags in the DogStatsD format
+	StatsDTagsDogStatsD
+)
+
+// StatsDConfig configures a StatsDSink
+type StatsDConfig struct {
+	// Address of the StatsD server in host:port format
+	Address string
+	// Prefix, if set, is prepended to each metric name separated by a '.'
+	Prefix    string
+	TagFormat StatsDTagFormat
+}
+
+// StatsDSink is a MetricsSink which sends metrics to a StatsD server over UDP
+// Each metric is sent as a single packet and failures to send are ignored
+type StatsDSink struct {
+	conn   net.Conn
+	config StatsDConfig
+}
+
+// NewStatsDSink returns a StatsDSink sending metrics to the configured address
+func NewStatsDSink(config StatsDConfig) (*StatsDSink, error) {
+	conn, err := net.Dial("udp", config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create statsd connection - %s", err)
+	}
+	return &StatsDSink{conn: conn, config: config}, nil
+}
+
+func (s *StatsDSink) Counter(name string, value int64, tags map[string]string) {
+	s.send(name, strconv.FormatInt(value, 10), "c", tags)
+}
+
+func (s *StatsDSink) Gauge(name string, value float64, tags map[string]string) {
+	s.send(name, strconv.FormatFloat(value, 'f', -1, 64), "g", tags)
+}
+
+func (s *StatsDSink) Histogram(name string, value float64, tags map[string]string) {
+	metricType := "ms"
+	if s.config.TagFormat == StatsDTagsDogStatsD {
+		metricType = "h"
+	}
+	s.send(name, strconv.FormatFloat(value, 'f', -1, 64), metricType, tags)
+}
+
+// Close the connection to the StatsD server
+func (s *StatsDSink) Close() error {
+	return s.conn.Close()
+}
+
+func (s *StatsDSink) send(name, value, metricType string, tags map[string]string) {
+	s.conn.Write([]byte(s.format(name, value, metricType, tags)))
+}
+
+func (s *StatsDSink) format(name, value, metricType string, tags map[string]string) string {
+	var b strings.Builder
+	if s.config.Prefix != "" {
+		b.WriteString(s.config.Prefix)
+		b.WriteByte('.')
+	}
+	b.WriteString(name)
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(metricType)
+
+	if s.config.TagFormat == StatsDTagsDogStatsD && len(tags) > 0 {
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		b.WriteString("|#")
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(k)
+			b.WriteByte(':')
+			b.WriteString(tags[k])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,166 @@
+package authorizer
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/3scale/3scale-go-client/threescale"
+)
+
+func TestStatsDSink(t *testing.T) {
+	inputs := []struct {
+		name   string
+		config StatsDConfig
+		expect []string
+	}{
+		{
+			name:   "Test plain statsd drops tags",
+			config: StatsDConfig{Prefix: "authorizer"},
+			expect: []string{
+				"authorizer.requests:1|c",
+				"authorizer.in_flight:2.5|g",
+				"authorizer.duration:12|ms",
+			},
+		},
+		{
+			name:   "Test DogStatsD writes sorted tags",
+			config: StatsDConfig{TagFormat: StatsDTagsDogStatsD},
+			expect: []string{
+				"requests:1|c|#code:200,host:backend",
+				"in_flight:2.5|g",
+				"duration:12|h|#code:200,host:backend",
+			},
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			listener := newUDPListener(t)
+			defer listener.Close()
+
+			input.config.Address = listener.LocalAddr().String()
+			sink, err := NewStatsDSink(input.config)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			defer sink.Close()
+
+			tags := map[string]string{"host": "backend", "code": "200"}
+			sink.Counter("requests", 1, tags)
+			sink.Gauge("in_flight", 2.5, nil)
+			sink.Histogram("duration", 12, tags)
+
+			for _, expect := range input.expect {
+				if got := readPacket(t, listener); got != expect {
+					t.Errorf("expected packet %q, got %q", expect, got)
+				}
+			}
+		})
+	}
+}
+
+func TestNewMetricsReporter(t *testing.T) {
+	listener := newUDPListener(t)
+	defer listener.Close()
+
+	sink, err := NewStatsDSink(StatsDConfig{Address: listener.LocalAddr().String(), TagFormat: StatsDTagsDogStatsD})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer sink.Close()
+
+	m := Manager{
+		clientBuilder: mockBuilder{
+			withBackendClient: mockBackendClient{withAuthResponse: &threescale.AuthorizeResult{
+				Authorized: false, ErrorCode: "limits_exceeded",
+			}},
+		},
+		metricsReporter: NewMetricsReporter(sink),
+		inFlight:        new(int64),
+	}
+
+	request := BackendRequest{
+		Service: "svc",
+		Transactions: []BackendTransaction{
+			{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: "any"}},
+		},
+	}
+	m.AuthRep("any", request)
+
+	expect := []string{
+		"authz.in_flight:1|g",
+		"authz.in_flight:0|g",
+		"authz.decisions:1|c|#outcome:denied,reason:limits_exceeded,service:svc",
+		"authz.duration_ms:",
+	}
+	for _, e := range expect {
+		if got := readPacket(t, listener); !strings.HasPrefix(got, e) {
+			t.Errorf("expected packet with prefix %q, got %q", e, got)
+		}
+	}
+
+	m.metricsReporter.CacheHitCB(System)
+	if got := readPacket(t, listener); got != "cache.hits:1|c|#cache:system" {
+		t.Errorf("unexpected cache hit packet %q", got)
+	}
+
+	m.metricsReporter.CacheMissCB(Backend)
+	if got := readPacket(t, listener); got != "cache.misses:1|c|#cache:backend" {
+		t.Errorf("unexpected cache miss packet %q", got)
+	}
+
+	m.metricsReporter.BackendCacheCB(BackendCacheReport{Backend: "backend", Entries: 3, HitRatio: 0.5})
+	for _, e := range []string{
+		"cache.entries:3|g|#backend:backend",
+		"cache.hit_ratio:0.5|g|#backend:backend",
+		"cache.flush_duration_ms:0|h|#backend:backend",
+		"cache.flush_lag_ms:0|g|#backend:backend",
+	} {
+		if got := readPacket(t, listener); got != e {
+			t.Errorf("expected packet %q, got %q", e, got)
+		}
+	}
+
+	m.metricsReporter.ErrorCB(TelemetryReport{Target: TargetBackend, Host: "backend", Method: "GET", ErrorClass: ErrorClassTimeout})
+	if got := readPacket(t, listener); got != "upstream.requests:1|c|#error_class:timeout,host:backend,method:GET,target:backend" {
+		t.Errorf("unexpected upstream packet %q", got)
+	}
+	readPacket(t, listener)
+
+	m.metricsReporter.BreakerStateCB("backend", BreakerOpen)
+	if got := readPacket(t, listener); got != "breaker.state:1|g|#host:backend" {
+		t.Errorf("unexpected breaker state packet %q", got)
+	}
+
+	m.metricsReporter.FailureCB(FailureReport{Target: TargetSystem, Service: "1", ErrorClass: ErrorClassServer})
+	if got := readPacket(t, listener); got != "system.failures:1|c|#error_class:5xx,service:1" {
+		t.Errorf("unexpected system failure packet %q", got)
+	}
+
+	m.metricsReporter.FailureCB(FailureReport{Target: TargetBackend, Service: "1", ErrorClass: ErrorClassTimeout})
+	if got := readPacket(t, listener); got != "backend.failures:1|c|#error_class:timeout,service:1" {
+		t.Errorf("unexpected backend failure packet %q", got)
+	}
+}
+
+func newUDPListener(t *testing.T) net.PacketConn {
+	t.Helper()
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen - %v", err)
+	}
+	return listener
+}
+
+func readPacket(t *testing.T, listener net.PacketConn) string {
+	t.Helper()
+	buf := make([]byte, 1024)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("expected a packet - %v", err)
+	}
+	return string(buf[:n])
+}
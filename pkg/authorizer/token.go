@@ -0,0 +1,148 @@
+package authorizer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+// AccessTokenSource provides an access token for 3scale system
+// Implementations must be safe for concurrent use
+type AccessTokenSource interface {
+	Token() (string, error)
+}
+
+// FileTokenSource provides an access token read from a file, such as a mounted secret
+// The file is read lazily and re-read whenever its modification time changes, allowing the
+// token to be rotated without a restart. Surrounding whitespace is trimmed from the token
+type FileTokenSource struct {
+	path    string
+	mu      sync.RWMutex
+	token   string
+	modTime time.Time
+}
+
+// NewFileTokenSource returns a FileTokenSource for the provided path
+// The file must exist and contain a non-empty token at the time of construction
+func NewFileTokenSource(path string) (*FileTokenSource, error) {
+	source := &FileTokenSource{path: path}
+	if _, err := source.Token(); err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+// Token returns the current contents of the file
+func (f *FileTokenSource) Token() (string, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read access token - %s", err.Error())
+	}
+
+	f.mu.RLock()
+	token, modTime := f.token, f.modTime
+	f.mu.RUnlock()
+
+	if token != "" && info.ModTime().Equal(modTime) {
+		return token, nil
+	}
+
+	contents, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read access token - %s", err.Error())
+	}
+
+	token = strings.TrimSpace(string(contents))
+	if token == "" {
+		return "", fmt.Errorf("access token file %s is empty", f.path)
+	}
+
+	f.mu.Lock()
+	f.token, f.modTime = token, info.ModTime()
+	f.mu.Unlock()
+	return token, nil
+}
+
+const (
+	// SecretAdminURLKey is the name of the file in a secret directory that holds the admin portal URL
+	SecretAdminURLKey = "adminURL"
+	// SecretTokenKey is the name of the file in a secret directory that holds the access token
+	SecretTokenKey = "token"
+)
+
+// SecretSource provides the admin portal URL and access token from a mounted secret directory
+// such as a Kubernetes secret. Each value is re-read when its file changes. See FileTokenSource
+// Configs fetched through the GetSystemConfiguration and Check methods of the source use the current value of
+// both, so either can be rotated without a restart
+type SecretSource struct {
+	adminURL *FileTokenSource
+	token    *FileTokenSource
+}
+
+// NewSecretSource returns a SecretSource for the provided directory
+// The directory must contain non-empty 'adminURL' and 'token' files at the time of construction
+func NewSecretSource(dir string) (*SecretSource, error) {
+	adminURL, err := NewFileTokenSource(filepath.Join(dir, SecretAdminURLKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret - %s", err.Error())
+	}
+
+	token, err := NewFileTokenSource(filepath.Join(dir, SecretTokenKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret - %s", err.Error())
+	}
+
+	return &SecretSource{adminURL: adminURL, token: token}, nil
+}
+
+// AdminURL returns the current admin portal URL
+func (s *SecretSource) AdminURL() (string, error) {
+	return s.adminURL.Token()
+}
+
+// Token returns the current access token
+func (s *SecretSource) Token() (string, error) {
+	return s.token.Token()
+}
+
+// SystemRequest returns a SystemRequest for the provided service and environment which reads the
+// access token from the secret
+func (s *SecretSource) SystemRequest(serviceID, environment string) SystemRequest {
+	return SystemRequest{
+		AccessTokenSource: s,
+		ServiceID:         serviceID,
+		Environment:       environment,
+	}
+}
+
+// SystemConfigChecker fetches configs from 3scale system and checks requests against them
+// Satisfied by the Manager and the ReloadableManager
+type SystemConfigChecker interface {
+	GetSystemConfiguration(systemURL string, request SystemRequest) (client.ProxyConfig, error)
+	Check(systemURL string, request SystemRequest, check CheckRequest) (*BackendResponse, error)
+}
+
+// GetSystemConfiguration returns the config of the service fetched by the checker from the current admin portal URL
+// Configs are cached per admin portal URL, so a rotated URL fetches the config from the new admin portal
+func (s *SecretSource) GetSystemConfiguration(checker SystemConfigChecker, serviceID, environment string) (client.ProxyConfig, error) {
+	adminURL, err := s.AdminURL()
+	if err != nil {
+		return client.ProxyConfig{}, err
+	}
+	return checker.GetSystemConfiguration(adminURL, s.SystemRequest(serviceID, environment))
+}
+
+// Check checks the request with the checker against the config of the service from the current admin portal URL
+func (s *SecretSource) Check(checker SystemConfigChecker, serviceID, environment string, check CheckRequest) (*BackendResponse, error) {
+	adminURL, err := s.AdminURL()
+	if err != nil {
+		return nil, err
+	}
+	return checker.Check(adminURL, s.SystemRequest(serviceID, environment), check)
+}
@@ -0,0 +1,174 @@
+package authorizer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/3scale/3scale-authorizer/pkg/fake"
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+func TestFileTokenSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir - %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "token")
+	if _, err := NewFileTokenSource(path); err == nil {
+		t.Error("expected error when token file does not exist")
+	}
+
+	writeToken(t, path, "  \n", time.Now())
+	if _, err := NewFileTokenSource(path); err == nil {
+		t.Error("expected error when token file is empty")
+	}
+
+	writeToken(t, path, "first\n", time.Now())
+	source, err := NewFileTokenSource(path)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if token, _ := source.Token(); token != "first" {
+		t.Errorf("unexpected token %s", token)
+	}
+
+	writeToken(t, path, "second", time.Now().Add(time.Minute))
+	if token, _ := source.Token(); token != "second" {
+		t.Errorf("expected rotated token to be read, got %s", token)
+	}
+}
+
+func TestManager_RotatedAccessToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir - %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	portal := fake.NewSystem("first")
+	defer portal.Close()
+	portal.SetConfig("1", "production", client.ProxyConfig{ID: 1, Version: 1, Environment: "production"})
+
+	path := filepath.Join(dir, "token")
+	writeToken(t, path, "first", time.Now())
+	source, err := NewFileTokenSource(path)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	systemCache := NewSystemCache(SystemCacheConfig{MaxSize: -1}, make(chan struct{}))
+	m := NewManager(&http.Client{}, systemCache, BackendConfig{}, nil)
+	request := SystemRequest{
+		AccessTokenSource: source,
+		ServiceID:         "1",
+		Environment:       "production",
+	}
+
+	config, err := m.GetSystemConfiguration(portal.URL, request)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if config.Version != 1 {
+		t.Errorf("unexpected config version %d", config.Version)
+	}
+
+	// rotate the token, the portal now only accepts the new token
+	portal.SetAccessToken("second")
+	portal.SetConfig("1", "production", client.ProxyConfig{ID: 1, Version: 2, Environment: "production"})
+	writeToken(t, path, "second", time.Now().Add(time.Minute))
+
+	// configs fetched with the old token remain valid
+	config, err = m.GetSystemConfiguration(portal.URL, request)
+	if err != nil || config.Version != 1 {
+		t.Errorf("expected cached config to be served, got version %d and err %v", config.Version, err)
+	}
+
+	// subsequent fetches use the new token
+	systemCache.Refresh()
+	config, err = m.GetSystemConfiguration(portal.URL, request)
+	if err != nil || config.Version != 2 {
+		t.Errorf("expected refresh to use the rotated token, got version %d and err %v", config.Version, err)
+	}
+}
+
+func TestSecretSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir - %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewSecretSource(dir); err == nil {
+		t.Error("expected error when secret is empty")
+	}
+
+	portal := fake.NewSystem("first")
+	defer portal.Close()
+	portal.SetConfig("1", "production", client.ProxyConfig{ID: 1, Version: 1, Environment: "production"})
+
+	writeToken(t, filepath.Join(dir, SecretAdminURLKey), portal.URL+"\n", time.Now())
+	if _, err := NewSecretSource(dir); err == nil {
+		t.Error("expected error when secret has no token")
+	}
+	writeToken(t, filepath.Join(dir, SecretTokenKey), "first", time.Now())
+
+	source, err := NewSecretSource(dir)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	adminURL, err := source.AdminURL()
+	if err != nil || adminURL != portal.URL {
+		t.Errorf("unexpected admin URL %s", adminURL)
+	}
+
+	m := NewManager(&http.Client{}, nil, BackendConfig{}, nil)
+	if _, err := m.GetSystemConfiguration(adminURL, source.SystemRequest("1", "production")); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	portal.SetAccessToken("second")
+	writeToken(t, filepath.Join(dir, SecretTokenKey), "second", time.Now().Add(time.Minute))
+
+	if _, err := m.GetSystemConfiguration(adminURL, source.SystemRequest("1", "production")); err != nil {
+		t.Errorf("expected rotated token to be used, got %v", err)
+	}
+
+	// the admin portal URL and token are rotated together to another admin portal
+	rotated := fake.NewSystem("third")
+	defer rotated.Close()
+	rotated.SetConfig("1", "production", client.ProxyConfig{ID: 1, Version: 3, Environment: "production"})
+	writeToken(t, filepath.Join(dir, SecretAdminURLKey), rotated.URL, time.Now().Add(time.Minute*2))
+	writeToken(t, filepath.Join(dir, SecretTokenKey), "third", time.Now().Add(time.Minute*2))
+
+	reloadable, err := NewReloadableManager(ManagerConfig{Client: &http.Client{}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer reloadable.Shutdown()
+	for _, checker := range []SystemConfigChecker{m, reloadable} {
+		config, err := source.GetSystemConfiguration(checker, "1", "production")
+		if err != nil || config.Version != 3 {
+			t.Errorf("expected the config to be fetched from the rotated admin portal, got version %d and err %v", config.Version, err)
+		}
+	}
+	if calls := len(rotated.Requests()); calls != 2 {
+		t.Errorf("expected the rotated admin portal to be called with the rotated token, got %d calls", calls)
+	}
+}
+
+func writeToken(t *testing.T, path, token string, modTime time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(token), 0600); err != nil {
+		t.Fatalf("unexpected error writing token - %v", err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("unexpected error setting token modification time - %v", err)
+	}
+}
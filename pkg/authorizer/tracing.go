@@ -0,0 +1,68 @@
+package authorizer
+
+import (
+	"context"
+	"strconv"
+)
+
+// Names of the spans started by the Manager. See WithTracer
+const (
+	// SpanAuthorize covers an authorization decision made by AuthRep, OauthAuthRep or Authorize
+	SpanAuthorize = "3scale.authorize"
+	// SpanSystemConfig covers fetching the config of a service by GetSystemConfiguration
+	SpanSystemConfig = "3scale.system_config"
+	// SpanBackendCall covers a call to 3scale backend, or to a cached backend, within a decision
+	SpanBackendCall = "3scale.backend"
+)
+
+// Span is an operation traced by a Tracer
+type Span interface {
+	SetAttribute(key, value string)
+	// End the span, recording the error the operation failed with, if any
+	End(err error)
+}
+
+// Tracer starts the spans of the operations performed by the Manager, allowing them to be exported to a
+// tracing system such as OpenTelemetry. See the otel package for an OpenTelemetry Tracer
+// Spans are started from the context passed to the *Context methods of the Manager, such as AuthRepContext, and
+// the context returned is used to start the spans of the operations within, such as the call to 3scale backend
+type Tracer interface {
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+type noopTracer struct{}
+
+func (noopTracer) StartSpan(ctx context.Context, _ string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, string) {}
+func (noopSpan) End(error)                   {}
+
+// WithTracer traces each authorization decision, fetch of a system config and call to 3scale backend
+// Spans are named SpanAuthorize, SpanSystemConfig and SpanBackendCall and carry the service id, the "call" made,
+// the "decision" and "reason" of a decision and whether the result was served from a cache as "cache_hit"
+func WithTracer(tracer Tracer) ManagerOption {
+	return func(o *managerOptions) {
+		o.tracer = tracer
+	}
+}
+
+// tracer returns the configured tracer, falling back to a tracer which discards all spans
+func (m Manager) tracer() Tracer {
+	if m.tracing == nil {
+		return noopTracer{}
+	}
+	return m.tracing
+}
+
+// setDecisionAttributes records the outcome of a decision on its span
+func setDecisionAttributes(span Span, report DecisionReport) {
+	span.SetAttribute("decision", string(report.Outcome))
+	if report.Reason != ReasonNone {
+		span.SetAttribute("reason", string(report.Reason))
+	}
+	span.SetAttribute("cache_hit", strconv.FormatBool(report.FromCache))
+}
@@ -0,0 +1,161 @@
+package authorizer
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/3scale/3scale-authorizer/pkg/fake"
+	"github.com/3scale/3scale-authorizer/pkg/system/v1/cache"
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+// recordingTracer holds the spans it has started in memory
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	name       string
+	parent     *recordedSpan
+	attributes map[string]string
+	ended      bool
+	err        error
+}
+
+type recordedSpanKey struct{}
+
+func (t *recordingTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parent, _ := ctx.Value(recordedSpanKey{}).(*recordedSpan)
+	span := &recordedSpan{name: name, parent: parent, attributes: make(map[string]string)}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, recordedSpanKey{}, span), span
+}
+
+func (s *recordedSpan) SetAttribute(key, value string) { s.attributes[key] = value }
+func (s *recordedSpan) End(err error)                  { s.ended, s.err = true, err }
+
+func TestManager_Tracing(t *testing.T) {
+	portal := fake.NewSystem("access-token")
+	defer portal.Close()
+	portal.SetConfig("1", "production", client.ProxyConfig{ID: 1, Version: 1, Environment: "production"})
+
+	backend := fake.NewBackend()
+	defer backend.Close()
+	backend.AddService("1", "token", nil)
+	backend.AddApplication("1", fake.Application{UserKey: "key"})
+
+	tracer := &recordingTracer{}
+	systemCache := NewSystemCache(SystemCacheConfig{MaxSize: cache.DefaultCacheLimit}, make(chan struct{}))
+	m := NewManager(&http.Client{}, systemCache, BackendConfig{}, nil, WithTracer(tracer))
+
+	systemRequest := SystemRequest{AccessToken: "access-token", ServiceID: "1", Environment: "production"}
+	for i := 0; i < 2; i++ {
+		if _, err := m.GetSystemConfiguration(portal.URL, systemRequest); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	request := BackendRequest{
+		Auth:    BackendAuth{Type: "service_token", Value: "token"},
+		Service: "1",
+		Transactions: []BackendTransaction{
+			{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: "invalid"}},
+		},
+	}
+	if _, err := m.AuthRep(backend.URL, request); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	expect := []recordedSpan{
+		{name: SpanSystemConfig, attributes: map[string]string{"service": "1", "environment": "production", "cache_hit": "false"}},
+		{name: SpanSystemConfig, attributes: map[string]string{"service": "1", "environment": "production", "cache_hit": "true"}},
+		{name: SpanAuthorize, attributes: map[string]string{
+			"service": "1", "call": "AuthRep", "decision": "denied", "reason": "credentials", "cache_hit": "false",
+		}},
+		{name: SpanBackendCall, attributes: map[string]string{"service": "1", "call": "AuthRep", "cache_hit": "false"}},
+	}
+	if len(tracer.spans) != len(expect) {
+		t.Fatalf("expected %d spans, got %d", len(expect), len(tracer.spans))
+	}
+	for i, span := range tracer.spans {
+		if span.name != expect[i].name || !reflect.DeepEqual(span.attributes, expect[i].attributes) || !span.ended || span.err != nil {
+			t.Errorf("expected span %+v, got %+v", expect[i], *span)
+		}
+	}
+}
+
+func TestManager_TracingBackendError(t *testing.T) {
+	tracer := &recordingTracer{}
+	m := NewManager(&http.Client{}, nil, BackendConfig{}, nil, WithTracer(tracer))
+
+	request := BackendRequest{
+		Service:      "1",
+		Transactions: []BackendTransaction{{Params: BackendParams{UserKey: "key"}}},
+	}
+	if _, err := m.Authorize("http://127.0.0.1:1", request); err == nil {
+		t.Fatal("expected an error as 3scale backend is unreachable")
+	}
+
+	for _, span := range tracer.spans {
+		if span.err == nil {
+			t.Errorf("expected span %s to record the error", span.name)
+		}
+	}
+	if len(tracer.spans) != 2 || tracer.spans[0].attributes["decision"] != "error" {
+		t.Errorf("unexpected spans %v", tracer.spans)
+	}
+}
+
+func TestManager_TracingContext(t *testing.T) {
+	portal := fake.NewSystem("access-token")
+	defer portal.Close()
+	backend := fake.NewBackend()
+	defer backend.Close()
+	backend.AddService("1", "token", nil)
+	backend.AddApplication("1", fake.Application{UserKey: "key"})
+
+	config := client.ProxyConfig{ID: 1, Version: 1, Environment: "production"}
+	config.Content.ID = 1
+	config.Content.BackendAuthenticationType = "service_token"
+	config.Content.BackendAuthenticationValue = "token"
+	config.Content.Proxy.Backend.Endpoint = backend.URL
+	config.Content.Proxy.ProxyRules = []client.ProxyRule{{HTTPMethod: "GET", Pattern: "/", MetricSystemName: "hits", Delta: 1}}
+	portal.SetConfig("1", "production", config)
+
+	tracer := &recordingTracer{}
+	m := NewManager(&http.Client{}, nil, BackendConfig{}, nil, WithTracer(tracer))
+
+	// the span of the incoming request, as started by the caller
+	ctx, incoming := tracer.StartSpan(context.Background(), "incoming")
+	request := SystemRequest{AccessToken: "access-token", ServiceID: "1", Environment: "production"}
+	if res, err := m.CheckContext(ctx, portal.URL, request, CheckRequest{Method: "GET", Path: "/?user_key=key"}); err != nil || !res.Authorized {
+		t.Fatalf("expected the check to be authorized, got %+v - %v", res, err)
+	}
+
+	if len(tracer.spans) != 4 {
+		t.Fatalf("expected 4 spans, got %d", len(tracer.spans))
+	}
+	expect := []struct {
+		name   string
+		parent Span
+	}{
+		{name: "incoming"},
+		{name: SpanSystemConfig, parent: incoming},
+		{name: SpanAuthorize, parent: incoming},
+		{name: SpanBackendCall, parent: tracer.spans[2]},
+	}
+	for i, span := range tracer.spans {
+		var parent Span
+		if span.parent != nil {
+			parent = span.parent
+		}
+		if span.name != expect[i].name || parent != expect[i].parent {
+			t.Errorf("expected span %s to be started from %v, got %s started from %v", expect[i].name, expect[i].parent, span.name, parent)
+		}
+	}
+}
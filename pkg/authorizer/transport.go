@@ -0,0 +1,354 @@
+package authorizer
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/3scale/3scale-authorizer/pkg/core"
+)
+
+// HTTPClientConfig configures the HTTP client used to communicate with 3scale system and backend
+type HTTPClientConfig struct {
+	// TLS, if set, is used as the TLS configuration of the client and takes precedence over TLSFiles
+	TLS *tls.Config
+	// TLSFiles allows building the TLS configuration of the client from PEM encoded files
+	TLSFiles TLSFiles
+	// InsecureSkipVerify disables verification of the server certificate chain and host name
+	// It must be explicitly enabled and cannot be combined with a CA file, against which verification is always enforced
+	InsecureSkipVerify bool
+	// MinTLSVersion is the minimum TLS version accepted, such as tls.VersionTLS12. The default of crypto/tls applies if unset
+	MinTLSVersion uint16
+	// SystemTLS and BackendTLS, if set, replace the TLS options above for connections to 3scale system or 3scale
+	// backend, such as when an on-premise backend is signed by an internal CA
+	SystemTLS  *TLSOptions
+	BackendTLS *TLSOptions
+	// Logger is warned when verification of server certificates has been disabled, and is required to disable it
+	Logger core.Logger
+	// Transport tunes the connection pool of the client. Zero values are replaced with the defaults below
+	Transport TransportConfig
+	// Proxy routes calls through forward proxies. The proxy configured by the environment is used by default
+	Proxy EgressProxyConfig
+}
+
+const (
+	// DefaultMaxIdleConns is the default maximum number of idle connections across all hosts
+	DefaultMaxIdleConns = 100
+	// DefaultMaxIdleConnsPerHost is the default maximum number of idle connections kept per host
+	// Requests are typically sent to a single backend host at a high rate so this matches DefaultMaxIdleConns
+	DefaultMaxIdleConnsPerHost = 100
+	// DefaultIdleConnTimeout is the default period an idle connection is kept open for
+	DefaultIdleConnTimeout = time.Second * 90
+	// DefaultTLSHandshakeTimeout is the default timeout of a TLS handshake
+	DefaultTLSHandshakeTimeout = time.Second * 10
+)
+
+// TransportConfig tunes the reuse of connections to 3scale
+type TransportConfig struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	TLSHandshakeTimeout time.Duration
+}
+
+// TLSOptions configures the TLS connections to a 3scale target. See HTTPClientConfig for each of the options
+type TLSOptions struct {
+	TLS                *tls.Config
+	TLSFiles           TLSFiles
+	InsecureSkipVerify bool
+	MinVersion         uint16
+}
+
+// TLSFiles provides the paths to the cert material required to establish a (m)TLS connection to 3scale
+type TLSFiles struct {
+	// CAFile is a bundle of certificates used to verify the server. The system roots are used if unset
+	CAFile string
+	// CertFile and KeyFile are the client certificate and key presented to the server for mTLS
+	// Both must be set if either is set
+	CertFile string
+	KeyFile  string
+}
+
+// NewHTTPClient returns a http.Client configured with the provided config
+// Any cert material is loaded and validated at construction time
+func NewHTTPClient(config HTTPClientConfig) (*http.Client, error) {
+	tlsConfig, err := config.defaultTLS().build(config.Logger, "3scale")
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := config.Proxy.proxyFunc()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := newTransport(config.Transport)
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = proxy
+
+	var roundTripper http.RoundTripper = transport
+	if config.SystemTLS != nil || config.BackendTLS != nil {
+		targets := make(map[Target]http.RoundTripper)
+		for target, options := range map[Target]*TLSOptions{TargetSystem: config.SystemTLS, TargetBackend: config.BackendTLS} {
+			if options == nil {
+				continue
+			}
+			targetTLS, err := options.build(config.Logger, "3scale "+string(target))
+			if err != nil {
+				return nil, fmt.Errorf("invalid TLS options for %s - %s", target, err)
+			}
+			targetTransport := transport.Clone()
+			targetTransport.TLSClientConfig = targetTLS
+			targets[target] = targetTransport
+		}
+		roundTripper = &targetTransport{targets: targets, fallback: transport}
+	}
+
+	return &http.Client{Transport: &proxyRoundTripper{proxied: roundTripper, proxy: proxy}}, nil
+}
+
+// defaultTLS returns the TLS options used for targets without options of their own
+func (c HTTPClientConfig) defaultTLS() TLSOptions {
+	return TLSOptions{
+		TLS:                c.TLS,
+		TLSFiles:           c.TLSFiles,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		MinVersion:         c.MinTLSVersion,
+	}
+}
+
+// build returns the tls.Config for the options, warning loudly if verification is disabled for the target
+// Returns nil and no error when the defaults of crypto/tls apply
+func (o TLSOptions) build(logger core.Logger, target string) (*tls.Config, error) {
+	if o.InsecureSkipVerify && o.TLSFiles.CAFile != "" {
+		return nil, errors.New("InsecureSkipVerify cannot be enabled when a CA file is provided")
+	}
+	if o.InsecureSkipVerify && logger == nil {
+		return nil, errors.New("a Logger is required to warn that InsecureSkipVerify is enabled")
+	}
+	if o.MinVersion != 0 && (o.MinVersion < tls.VersionTLS10 || o.MinVersion > tls.VersionTLS13) {
+		return nil, fmt.Errorf("unsupported minimum TLS version %#x", o.MinVersion)
+	}
+
+	tlsConfig := o.TLS
+	if tlsConfig == nil {
+		var err error
+		tlsConfig, err = o.TLSFiles.TLSConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if o.InsecureSkipVerify || o.MinVersion != 0 {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		} else {
+			tlsConfig = tlsConfig.Clone()
+		}
+	}
+	if o.MinVersion != 0 {
+		tlsConfig.MinVersion = o.MinVersion
+	}
+	if o.InsecureSkipVerify {
+		tlsConfig.InsecureSkipVerify = true
+		logger.Warnf("TLS certificate verification is disabled for connections to %s - connections are open to interception and this must not be used outside of lab environments", target)
+	}
+	return tlsConfig, nil
+}
+
+// targetTransport sends requests through the transport of their target, allowing the TLS options to differ
+// between 3scale system and backend. See withTarget
+type targetTransport struct {
+	targets  map[Target]http.RoundTripper
+	fallback http.RoundTripper
+}
+
+func (t *targetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target, _ := req.Context().Value(targetKey{}).(Target)
+	if transport, ok := t.targets[target]; ok {
+		return transport.RoundTrip(req)
+	}
+	return t.fallback.RoundTrip(req)
+}
+
+// newTransport returns a transport with the pool tuned by the provided config
+func newTransport(config TransportConfig) *http.Transport {
+	if config.MaxIdleConns <= 0 {
+		config.MaxIdleConns = DefaultMaxIdleConns
+	}
+	if config.MaxIdleConnsPerHost <= 0 {
+		config.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	}
+	if config.IdleConnTimeout <= 0 {
+		config.IdleConnTimeout = DefaultIdleConnTimeout
+	}
+	if config.TLSHandshakeTimeout <= 0 {
+		config.TLSHandshakeTimeout = DefaultTLSHandshakeTimeout
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = config.MaxIdleConns
+	transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = config.IdleConnTimeout
+	transport.TLSHandshakeTimeout = config.TLSHandshakeTimeout
+	return transport
+}
+
+// TLSConfig builds a tls.Config from the provided files
+// Returns nil and no error if no files have been provided
+func (f TLSFiles) TLSConfig() (*tls.Config, error) {
+	if f.CAFile == "" && f.CertFile == "" && f.KeyFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+	if f.CAFile != "" {
+		pem, err := ioutil.ReadFile(f.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file - %s", err.Error())
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid certificates found in CA file %s", f.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if f.CertFile != "" || f.KeyFile != "" {
+		if f.CertFile == "" || f.KeyFile == "" {
+			return nil, errors.New("both a client certificate and key must be provided")
+		}
+
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate - %s", err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// ErrResponseTooLarge is returned when reading a response body which exceeds the configured limit
+var ErrResponseTooLarge = errors.New("response body exceeds the maximum allowed size")
+
+// limitedBodyRoundTripper fails responses whose body exceeds the limit
+type limitedBodyRoundTripper struct {
+	proxied http.RoundTripper
+	limit   int64
+}
+
+// withMaxResponseSize returns a copy of the client which fails responses whose body exceeds the limit
+func withMaxResponseSize(client *http.Client, limit int64) *http.Client {
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	limited := *client
+	limited.Transport = &limitedBodyRoundTripper{proxied: transport, limit: limit}
+	return &limited
+}
+
+func (l *limitedBodyRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := l.proxied.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.ContentLength > l.limit {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w - content length %d exceeds %d bytes", ErrResponseTooLarge, resp.ContentLength, l.limit)
+	}
+
+	resp.Body = &limitedReadCloser{ReadCloser: resp.Body, remaining: l.limit}
+	return resp, nil
+}
+
+// limitedReadCloser returns ErrResponseTooLarge once more than the remaining bytes have been read
+type limitedReadCloser struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (l *limitedReadCloser) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, ErrResponseTooLarge
+	}
+
+	// read a single byte past the limit so we can detect the overflow
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n - 1, ErrResponseTooLarge
+	}
+	return n, err
+}
+
+// gzipRoundTripper requests compressed responses and decompresses them
+// Compression is requested explicitly, rather than left to the transport, so that responses are compressed
+// whether or not the proxied transport supports it
+type gzipRoundTripper struct {
+	proxied http.RoundTripper
+}
+
+// withCompression returns a copy of the client which requests compressed responses
+func withCompression(client *http.Client) *http.Client {
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	compressed := *client
+	compressed.Transport = &gzipRoundTripper{proxied: transport}
+	return &compressed
+}
+
+func (g *gzipRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// an encoding requested by the caller is left for the caller to handle
+	if req.Header.Get("Accept-Encoding") != "" || req.Header.Get("Range") != "" {
+		return g.proxied.RoundTrip(req)
+	}
+
+	compressed := req.Clone(req.Context())
+	compressed.Header.Set("Accept-Encoding", "gzip")
+	resp, err := g.proxied.RoundTrip(compressed)
+	if err != nil || !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") || req.Method == http.MethodHead {
+		return resp, err
+	}
+
+	body, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("invalid gzip response - %s", err)
+	}
+	resp.Body = &gzipReadCloser{Reader: body, body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return resp, nil
+}
+
+// gzipReadCloser decompresses the body, closing the compressed body when closed
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (g *gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
+}
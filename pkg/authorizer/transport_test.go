@@ -0,0 +1,608 @@
+package authorizer
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+func TestNewHTTPClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir - %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	clientCert, clientCertFile, clientKeyFile := newTestCertificate(t, dir, "client")
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	ts.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", ts.Certificate().Raw)
+
+	inputs := []struct {
+		name          string
+		config        HTTPClientConfig
+		expectErr     bool
+		expectCallErr bool
+	}{
+		{
+			name:          "Test default config cannot verify the server",
+			config:        HTTPClientConfig{},
+			expectCallErr: true,
+		},
+		{
+			name: "Test CA without client certificate is rejected by the server",
+			config: HTTPClientConfig{
+				TLSFiles: TLSFiles{CAFile: caFile},
+			},
+			expectCallErr: true,
+		},
+		{
+			name: "Test CA and client certificate succeeds",
+			config: HTTPClientConfig{
+				TLSFiles: TLSFiles{CAFile: caFile, CertFile: clientCertFile, KeyFile: clientKeyFile},
+			},
+		},
+		{
+			name: "Test provided tls config takes precedence over files",
+			config: HTTPClientConfig{
+				TLS:      ts.Client().Transport.(*http.Transport).TLSClientConfig,
+				TLSFiles: TLSFiles{CAFile: "does-not-exist"},
+			},
+			expectCallErr: true,
+		},
+		{
+			name: "Test missing CA file fails at construction",
+			config: HTTPClientConfig{
+				TLSFiles: TLSFiles{CAFile: filepath.Join(dir, "does-not-exist")},
+			},
+			expectErr: true,
+		},
+		{
+			name: "Test invalid CA file fails at construction",
+			config: HTTPClientConfig{
+				TLSFiles: TLSFiles{CAFile: clientKeyFile},
+			},
+			expectErr: true,
+		},
+		{
+			name: "Test insecure skip verify is rejected alongside a CA file",
+			config: HTTPClientConfig{
+				TLSFiles:           TLSFiles{CAFile: caFile},
+				InsecureSkipVerify: true,
+			},
+			expectErr: true,
+		},
+		{
+			name: "Test client certificate without key fails at construction",
+			config: HTTPClientConfig{
+				TLSFiles: TLSFiles{CertFile: clientCertFile},
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			client, err := NewHTTPClient(input.config)
+			if err != nil {
+				if !input.expectErr {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+			if input.expectErr {
+				t.Error("expected an error building the client")
+				return
+			}
+
+			resp, err := client.Get(ts.URL)
+			if err != nil {
+				if !input.expectCallErr {
+					t.Errorf("unexpected error calling server %v", err)
+				}
+				return
+			}
+			resp.Body.Close()
+
+			if input.expectCallErr {
+				t.Error("expected call to server to fail")
+			}
+		})
+	}
+}
+
+func TestNewHTTPClient_InsecureSkipVerify(t *testing.T) {
+	// the test server presents a certificate signed by an unknown authority
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	inputs := []struct {
+		name          string
+		config        HTTPClientConfig
+		expectCallErr bool
+	}{
+		{
+			name:          "Test untrusted certificate is rejected by default",
+			config:        HTTPClientConfig{},
+			expectCallErr: true,
+		},
+		{
+			name:          "Test untrusted certificate is rejected with a custom tls config",
+			config:        HTTPClientConfig{TLS: &tls.Config{}},
+			expectCallErr: true,
+		},
+		{
+			name:   "Test untrusted certificate is accepted when explicitly insecure",
+			config: HTTPClientConfig{InsecureSkipVerify: true},
+		},
+		{
+			name:   "Test insecure is applied to a copy of a custom tls config",
+			config: HTTPClientConfig{TLS: &tls.Config{}, InsecureSkipVerify: true},
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			logger := &recordingLogger{}
+			input.config.Logger = logger
+			client, err := NewHTTPClient(input.config)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if input.config.TLS != nil && input.config.TLS.InsecureSkipVerify {
+				t.Error("expected the provided tls config to be left unmodified")
+			}
+			if input.config.InsecureSkipVerify && len(logger.warnings) != 1 {
+				t.Errorf("expected disabling verification to be warned about, got %v", logger.warnings)
+			}
+
+			resp, err := client.Get(ts.URL)
+			if err != nil {
+				if !input.expectCallErr {
+					t.Errorf("unexpected error calling server %v", err)
+				}
+				return
+			}
+			resp.Body.Close()
+
+			if input.expectCallErr {
+				t.Error("expected call to server with an untrusted certificate to fail")
+			}
+		})
+	}
+}
+
+func TestNewHTTPClient_InsecureSkipVerifyRequiresLogger(t *testing.T) {
+	for _, config := range []HTTPClientConfig{
+		{InsecureSkipVerify: true},
+		{SystemTLS: &TLSOptions{InsecureSkipVerify: true}},
+	} {
+		if _, err := NewHTTPClient(config); err == nil {
+			t.Errorf("expected disabling verification without a logger to be rejected for %+v", config)
+		}
+	}
+}
+
+func TestNewHTTPClient_TLSOptionsPerTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir - %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// each server presents a certificate signed by its own CA
+	system, systemCA := newTestTLSServer(t, dir, "system")
+	defer system.Close()
+	backend, backendCA := newTestTLSServer(t, dir, "backend")
+	defer backend.Close()
+
+	logger := &recordingLogger{}
+	client, err := NewHTTPClient(HTTPClientConfig{
+		TLSFiles:   TLSFiles{CAFile: systemCA},
+		BackendTLS: &TLSOptions{TLSFiles: TLSFiles{CAFile: backendCA}},
+		Logger:     logger,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	unbundled, err := NewHTTPClient(HTTPClientConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	inputs := []struct {
+		name          string
+		client        *http.Client
+		url           string
+		expectCallErr bool
+	}{
+		{
+			name:          "Test system fails verification without the bundle",
+			client:        withTarget(unbundled, TargetSystem),
+			url:           system.URL,
+			expectCallErr: true,
+		},
+		{
+			name:          "Test backend fails verification without the bundle",
+			client:        withTarget(unbundled, TargetBackend),
+			url:           backend.URL,
+			expectCallErr: true,
+		},
+		{
+			name:   "Test system verified against the default bundle",
+			client: withTarget(client, TargetSystem),
+			url:    system.URL,
+		},
+		{
+			name:   "Test backend verified against its own bundle",
+			client: withTarget(client, TargetBackend),
+			url:    backend.URL,
+		},
+		{
+			name:          "Test backend bundle does not apply to system",
+			client:        withTarget(client, TargetSystem),
+			url:           backend.URL,
+			expectCallErr: true,
+		},
+		{
+			name:          "Test backend bundle does not apply to unmarked requests",
+			client:        client,
+			url:           backend.URL,
+			expectCallErr: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			resp, err := input.client.Get(input.url)
+			if err != nil {
+				if !input.expectCallErr {
+					t.Errorf("unexpected error calling server %v", err)
+				}
+				return
+			}
+			resp.Body.Close()
+
+			if input.expectCallErr {
+				t.Error("expected call to server to fail")
+			}
+		})
+	}
+
+	if len(logger.warnings) != 0 {
+		t.Errorf("expected no warnings while verification is enabled, got %v", logger.warnings)
+	}
+}
+
+func TestNewHTTPClient_MinTLSVersion(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	ts.StartTLS()
+	defer ts.Close()
+	trusted := ts.Client().Transport.(*http.Transport).TLSClientConfig
+
+	inputs := []struct {
+		name          string
+		config        HTTPClientConfig
+		expectErr     bool
+		expectCallErr bool
+	}{
+		{
+			name:   "Test TLS 1.2 accepted by default",
+			config: HTTPClientConfig{TLS: trusted},
+		},
+		{
+			name:   "Test TLS 1.2 accepted at the minimum",
+			config: HTTPClientConfig{TLS: trusted, MinTLSVersion: tls.VersionTLS12},
+		},
+		{
+			name:          "Test TLS 1.2 rejected below the minimum",
+			config:        HTTPClientConfig{TLS: trusted, MinTLSVersion: tls.VersionTLS13},
+			expectCallErr: true,
+		},
+		{
+			name:          "Test minimum applied per target",
+			config:        HTTPClientConfig{BackendTLS: &TLSOptions{TLS: trusted, MinVersion: tls.VersionTLS13}},
+			expectCallErr: true,
+		},
+		{
+			name:      "Test unknown version fails at construction",
+			config:    HTTPClientConfig{MinTLSVersion: 0x0200},
+			expectErr: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			client, err := NewHTTPClient(input.config)
+			if err != nil {
+				if !input.expectErr {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+			if input.expectErr {
+				t.Fatal("expected an error building the client")
+			}
+			if trusted.MinVersion != 0 {
+				t.Fatal("expected the provided tls config to be left unmodified")
+			}
+
+			resp, err := withTarget(client, TargetBackend).Get(ts.URL)
+			if err != nil {
+				if !input.expectCallErr {
+					t.Errorf("unexpected error calling server %v", err)
+				}
+				return
+			}
+			resp.Body.Close()
+
+			if input.expectCallErr {
+				t.Error("expected call to server to fail")
+			}
+		})
+	}
+}
+
+func TestManager_CompressedConfig(t *testing.T) {
+	config := client.ProxyConfig{ID: 1, Version: 7, Environment: "production"}
+	for i := 0; i < 200; i++ {
+		config.Content.Proxy.ProxyRules = append(config.Content.Proxy.ProxyRules, client.ProxyRule{
+			ID: int64(i + 1), HTTPMethod: "GET", Pattern: fmt.Sprintf("/widgets/%d", i), MetricSystemName: "hits", Delta: 1,
+		})
+	}
+	body, err := json.Marshal(client.ProxyConfigElement{ProxyConfig: config})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	inputs := []struct {
+		name               string
+		disableCompression bool
+		compress           bool
+		limit              int64
+		expectErr          bool
+	}{
+		{
+			name:     "Test compressed config is decoded",
+			compress: true,
+		},
+		{
+			name:               "Test compressed config is decoded by a transport without compression",
+			disableCompression: true,
+			compress:           true,
+		},
+		{
+			name: "Test uncompressed config is decoded",
+		},
+		{
+			name:      "Test size limit applies to the decompressed config",
+			compress:  true,
+			limit:     int64(len(body)) - 1,
+			expectErr: true,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var acceptEncoding string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				acceptEncoding = r.Header.Get("Accept-Encoding")
+				w.Header().Set("Content-Type", "application/json")
+				if !input.compress {
+					w.Write(body)
+					return
+				}
+				w.Header().Set("Content-Encoding", "gzip")
+				gz := gzip.NewWriter(w)
+				gz.Write(body)
+				gz.Close()
+			}))
+			defer ts.Close()
+
+			transport := newTransport(TransportConfig{})
+			transport.DisableCompression = input.disableCompression
+			var opts []ManagerOption
+			if input.limit > 0 {
+				opts = append(opts, WithMaxSystemResponseSize(input.limit))
+			}
+			m := NewManager(&http.Client{Transport: transport}, nil, BackendConfig{}, nil, opts...)
+
+			got, err := m.GetSystemConfiguration(ts.URL, SystemRequest{AccessToken: "any", ServiceID: "1", Environment: "production"})
+			if acceptEncoding != "gzip" {
+				t.Errorf("expected a compressed config to be requested, got accept encoding %q", acceptEncoding)
+			}
+			if input.expectErr {
+				// the system client reports the failure to decode the config as a string
+				if err == nil || !strings.Contains(err.Error(), ErrResponseTooLarge.Error()) {
+					t.Errorf("expected the decompressed config to exceed the limit, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if got.Version != 7 || len(got.Content.Proxy.ProxyRules) != 200 {
+				t.Errorf("expected the config to be decoded, got version %d with %d rules", got.Version, len(got.Content.Proxy.ProxyRules))
+			}
+		})
+	}
+}
+
+// newTestCertificate creates a self-signed certificate and writes the cert and key to the provided directory
+func newTestCertificate(t *testing.T, dir, name string) (*x509.Certificate, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error generating key - %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error creating certificate - %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unexpected error parsing certificate - %v", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error marshalling key - %v", err)
+	}
+
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+	return cert, certFile, keyFile
+}
+
+// newTestTLSServer starts a server presenting a new self-signed certificate, written to the returned path
+func newTestTLSServer(t *testing.T, dir, name string) (*httptest.Server, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error generating key - %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error creating certificate - %v", err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	ts.StartTLS()
+
+	certFile := filepath.Join(dir, name+"-ca.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	return ts, certFile
+}
+
+func writePEM(t *testing.T, path, blockType string, bytes []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: bytes})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("unexpected error writing %s - %v", path, err)
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	transport := newTransport(TransportConfig{MaxIdleConnsPerHost: 10})
+	if transport.MaxIdleConns != DefaultMaxIdleConns || transport.MaxIdleConnsPerHost != 10 ||
+		transport.IdleConnTimeout != DefaultIdleConnTimeout || transport.TLSHandshakeTimeout != DefaultTLSHandshakeTimeout {
+		t.Errorf("unexpected transport settings %+v", transport)
+	}
+}
+
+func TestNewTransport_ReusesConnections(t *testing.T) {
+	const concurrency = 20
+	const callsPerWorker = 25
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><status><authorized>true</authorized></status>`))
+	}))
+	defer ts.Close()
+
+	dials := func(transport *http.Transport) int64 {
+		var count int64
+		dialer := &net.Dialer{}
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt64(&count, 1)
+			return dialer.DialContext(ctx, network, addr)
+		}
+		defer transport.CloseIdleConnections()
+
+		m := NewManager(&http.Client{Transport: transport}, nil, BackendConfig{}, nil)
+		request := BackendRequest{
+			Service: "any",
+			Transactions: []BackendTransaction{
+				{Metrics: map[string]int{"hits": 1}, Params: BackendParams{UserKey: "any"}},
+			},
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < callsPerWorker; j++ {
+					if _, err := m.AuthRep(ts.URL, request); err != nil {
+						t.Errorf("unexpected error %v", err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		return atomic.LoadInt64(&count)
+	}
+
+	// one connection is required per concurrent caller when connections are reused, although a dial
+	// can race with a connection being returned to the pool so some headroom is allowed
+	if tuned := dials(newTransport(TransportConfig{})); tuned > concurrency*2 {
+		t.Errorf("expected at most %d connections to be opened, got %d", concurrency*2, tuned)
+	}
+
+	untuned := http.DefaultTransport.(*http.Transport).Clone()
+	t.Logf("default transport opened %d connections", dials(untuned))
+}
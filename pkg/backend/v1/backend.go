@@ -26,9 +26,32 @@ type Backend struct {
 	// queue must not be nil
 	queue *dequeue
 	// policy defaults to deny if not set
-	policy           FailurePolicy
-	logger           core.Logger
-	cacheHitCallback func()
+	policy            FailurePolicy
+	logger            core.Logger
+	cacheHitCallback  func()
+	cacheMissCallback func()
+	flushCallback     func(stats FlushStats)
+	// services, if set, limits the number of distinct services held in the cache. See SetMaxServices
+	services *serviceLRU
+	// lastFlush is the time the previous flush completed, or the backend was created
+	lastFlush time.Time
+	flushMu   sync.Mutex
+}
+
+// FlushStats describes a completed flush of the cache
+type FlushStats struct {
+	// Entries is the number of applications held in the cache
+	Entries int
+	// Duration is the time taken to report and refresh the cached applications
+	Duration time.Duration
+	// Lag is the time since the previous flush completed and is the maximum age of the usage reported by the flush
+	Lag time.Duration
+}
+
+// CachedDecision is set as the RawResponse of results decided from state cached before the request was made
+type CachedDecision struct {
+	// Age is the time since the cached state was last learned from 3scale
+	Age time.Duration
 }
 
 // Application defined under a 3scale service
@@ -43,6 +66,8 @@ type Application struct {
 	auth            api.ClientAuth
 	params          api.Params
 	timestamp       int64
+	// syncedAt is the time the remote state was last learned from 3scale
+	syncedAt time.Time
 	// id as recorded by 3scale
 	id string
 	// ownedBy this service id
@@ -83,7 +108,9 @@ func NewBackend(url string, client *http.Client, logger core.Logger, policy Fail
 		cache:            NewLocalCache(),
 		queue:            newQueue(100),
 		policy:           policy,
+		logger:           logger,
 		cacheHitCallback: func() {},
+		lastFlush:        time.Now(),
 	}, nil
 }
 
@@ -92,6 +119,28 @@ func (b *Backend) SetCacheHitCallback(f func()) {
 	b.cacheHitCallback = f
 }
 
+// SetCacheMissCallback sets a function which is called each time an application is not found in the cache
+func (b *Backend) SetCacheMissCallback(f func()) {
+	b.cacheMissCallback = f
+}
+
+// SetFlushCallback sets a function which is called after each flush of the cache
+func (b *Backend) SetFlushCallback(f func(stats FlushStats)) {
+	b.flushCallback = f
+}
+
+// SetMaxServices limits the number of distinct services held in the cache, independent of the number of
+// applications cached per service. Once the limit is exceeded, every application of the least recently used
+// service is evicted. Usage of evicted applications which has not yet been reported is reported on the next flush
+// A non-positive limit removes any existing limit. Must be called before the backend is used
+func (b *Backend) SetMaxServices(limit int) {
+	if limit <= 0 {
+		b.services = nil
+		return
+	}
+	b.services = newServiceLRU(limit)
+}
+
 // Authorize authorizes a request based on the current cached values
 // If the request misses the cache, a remote call to 3scale is made
 // Request Transactions must not be nil and must not be empty
@@ -114,6 +163,7 @@ func (b *Backend) authorize(request threescale.Request, oidc bool) (*threescale.
 
 	cacheKey := generateCacheKeyFromRequest(request, 0)
 	app := b.getApplicationFromCache(cacheKey)
+	fromCache := app != nil
 
 	if app == nil {
 		var upstreamResponse *threescale.AuthorizeResult
@@ -130,6 +180,9 @@ func (b *Backend) authorize(request threescale.Request, oidc bool) (*threescale.
 	isAuthorized := b.isAuthorized(app, affectedMetrics)
 
 	result := &threescale.AuthorizeResult{Authorized: isAuthorized}
+	if fromCache {
+		result.RawResponse = app.cachedDecision()
+	}
 	if !isAuthorized {
 		result.ErrorCode = "limits_exceeded"
 	}
@@ -160,6 +213,7 @@ func (b *Backend) authRep(request threescale.Request, oidc bool) (*threescale.Au
 
 	cacheKey := generateCacheKeyFromRequest(request, 0)
 	app := b.getApplicationFromCache(cacheKey)
+	fromCache := app != nil
 
 	if app == nil {
 		var upstreamResponse *threescale.AuthorizeResult
@@ -176,6 +230,9 @@ func (b *Backend) authRep(request threescale.Request, oidc bool) (*threescale.Au
 	isAuthorized := b.isAuthorized(app, affectedMetrics)
 
 	result := &threescale.AuthorizeResult{Authorized: isAuthorized}
+	if fromCache {
+		result.RawResponse = app.cachedDecision()
+	}
 	if isAuthorized {
 		b.localReport(cacheKey, affectedMetrics)
 
@@ -190,7 +247,7 @@ func (b *Backend) authRep(request threescale.Request, oidc bool) (*threescale.Au
 func (b *Backend) handleAuthorizationNetworkError(err error) (*threescale.AuthorizeResult, error) {
 	allow := b.applyPolicy(err)
 	if !allow {
-		return nil, fmt.Errorf("unable to process request - %s", err.Error())
+		return nil, fmt.Errorf("unable to process request - %w", core.RedactError(err))
 	}
 	return &threescale.AuthorizeResult{Authorized: true}, nil
 }
@@ -215,9 +272,50 @@ func (b *Backend) handleCacheMiss(request threescale.Request, cacheKey string, o
 	app.annotateWithRequestDetails(request)
 
 	b.cache.Set(cacheKey, &app)
+	b.touchService(cacheKey)
 	return &app, resp, nil
 }
 
+// touchService marks the service of the cache key as recently used, evicting the least recently used
+// service if the limit on distinct services has been exceeded
+func (b *Backend) touchService(cacheKey string) {
+	if b.services == nil {
+		return
+	}
+	service, _, err := parseCacheKey(cacheKey)
+	if err != nil {
+		return
+	}
+	if evicted, ok := b.services.touch(service); ok {
+		b.evictService(evicted)
+	}
+}
+
+// evictService removes every application of the service from the cache, queueing a snapshot of each
+// so that usage which has not yet been reported is reported on the next flush
+func (b *Backend) evictService(service api.Service) {
+	var evicted int
+	for _, key := range b.cache.Keys() {
+		svc, appID, err := parseCacheKey(key)
+		if err != nil || svc != service {
+			continue
+		}
+		if app, ok := b.cache.Get(key); ok {
+			app.RLock()
+			clone := app.deepCopy()
+			app.RUnlock()
+			clone.ownedBy = svc
+			clone.id = appID
+			if !b.queue.append(&clone) {
+				b.logger.Errorf("unable to queue usage of evicted application for service %s and backend %s", string(svc), b.client.GetPeer())
+			}
+		}
+		b.cache.Delete(key)
+		evicted++
+	}
+	b.logger.Debugf("evicted %d applications of least recently used service %s from cache", evicted, string(service))
+}
+
 // isAuthorized takes a read lock on the application and confirms if the request
 // should be authorized based on the affected metrics against current state
 func (b *Backend) isAuthorized(application *Application, affectedMetrics api.Metrics) bool {
@@ -301,7 +399,11 @@ func (b *Backend) getApplicationFromCache(key string) *Application {
 	app, ok := b.cache.Get(key)
 	if !ok {
 		app = nil
+		if b.cacheMissCallback != nil {
+			b.cacheMissCallback()
+		}
 	} else {
+		b.touchService(key)
 		if b.cacheHitCallback != nil {
 			b.cacheHitCallback()
 		}
@@ -328,8 +430,8 @@ func (b *Backend) localReport(cacheKey string, metrics api.Metrics) {
 	// we have failed to fetch and build an application and populate the cache with it
 	// that is, since the Set func on the cache currently does not return an error then this is ok
 	// if we end up supporting external caches and the write can fail then this may need updating.
-	application := b.getApplicationFromCache(cacheKey)
-	if application == nil {
+	application, ok := b.cache.Get(cacheKey)
+	if !ok {
 		return
 	}
 
@@ -352,7 +454,27 @@ func (b *Backend) localReport(cacheKey string, metrics api.Metrics) {
 
 // Flush the cached entries and report existing state to backend
 func (b *Backend) Flush() {
+	// serialise flushes so the reported lag is measured between consecutive flushes
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	start := time.Now()
 	b.flush()
+	end := time.Now()
+
+	if b.lastFlush.IsZero() {
+		b.lastFlush = start
+	}
+	stats := FlushStats{
+		Entries:  len(b.cache.Keys()),
+		Duration: end.Sub(start),
+		Lag:      end.Sub(b.lastFlush),
+	}
+	b.lastFlush = end
+
+	if b.flushCallback != nil {
+		b.flushCallback(stats)
+	}
 }
 
 // handledApp represents an application that is going through the flushing process
@@ -547,6 +669,7 @@ func (b *Backend) handleFlushCacheUpdate(apps []*handledApp) {
 
 		cachedApp.Lock()
 		cachedApp.adjustLocalState(app, updatedApp.RemoteState, updatedApp.timestamp)
+		cachedApp.syncedAt = updatedApp.syncedAt
 		b.cache.Set(cacheKey, cachedApp)
 		cachedApp.Unlock()
 	}
@@ -626,9 +749,17 @@ func (a *Application) deepCopy() Application {
 		params:           a.params,
 		auth:             a.auth,
 		timestamp:        a.timestamp,
+		syncedAt:         a.syncedAt,
 	}
 }
 
+// cachedDecision describes a decision made from the cached state of the Application
+func (a *Application) cachedDecision() CachedDecision {
+	a.RLock()
+	defer a.RUnlock()
+	return CachedDecision{Age: time.Since(a.syncedAt)}
+}
+
 // updateUnlimitedCounter modifies the Applications 'UnlimitedCounter' field
 func (a *Application) updateUnlimitedCounter(metric string, incrementBy int) {
 	// has no limits so just cache the value for reporting purposes
@@ -9,6 +9,7 @@ import (
 	"reflect"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/3scale/3scale-go-client/threescale"
 	"github.com/3scale/3scale-go-client/threescale/api"
@@ -1781,4 +1782,132 @@ func (mc *mockCache) Keys() []string {
 	return mc.internal.Keys()
 }
 
+func (mc *mockCache) Delete(key string) {
+	mc.internal.Delete(key)
+}
+
 // ********************************
+
+func TestNewBackend(t *testing.T) {
+	logger := &core.NoOpLogger{}
+	b, err := NewBackend("https://su1.3scale.net", nil, logger, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if b.logger != logger {
+		t.Error("expected the provided logger to be used by the backend")
+	}
+
+	b, err = NewBackend("https://su1.3scale.net", nil, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if b.logger == nil {
+		t.Error("expected a default logger to be set")
+	}
+
+	if _, err := NewBackend("invalid", nil, nil, nil); err == nil {
+		t.Error("expected an error for an invalid url")
+	}
+}
+
+func TestBackend_CacheCallbacks(t *testing.T) {
+	cache := NewLocalCache()
+	cache.Set("any_app", &Application{})
+
+	var hits, misses int
+	var flushes []FlushStats
+	b := &Backend{
+		client: &mockRemoteClient{authzErr: errors.New("unavailable")},
+		cache:  cache,
+		queue:  newQueue(10),
+		logger: &core.NoOpLogger{},
+	}
+	b.SetCacheHitCallback(func() { hits++ })
+	b.SetCacheMissCallback(func() { misses++ })
+	b.SetFlushCallback(func(stats FlushStats) { flushes = append(flushes, stats) })
+
+	b.getApplicationFromCache("any_app")
+	b.getApplicationFromCache("other_app")
+	if hits != 1 || misses != 1 {
+		t.Errorf("expected one hit and one miss, got %d hits and %d misses", hits, misses)
+	}
+
+	b.Flush()
+	time.Sleep(time.Millisecond * 10)
+	b.Flush()
+
+	if len(flushes) != 2 {
+		t.Fatalf("expected flush callback to be called for each flush, got %d", len(flushes))
+	}
+	if flushes[0].Entries != 1 {
+		t.Errorf("expected cache size to be reported, got %d", flushes[0].Entries)
+	}
+	if flushes[1].Lag < time.Millisecond*10 || flushes[1].Lag < flushes[1].Duration {
+		t.Errorf("expected lag to cover the period since the previous flush, got %v", flushes[1].Lag)
+	}
+}
+
+func TestBackend_SetMaxServices(t *testing.T) {
+	var reported []api.Service
+	remoteClient := &mockRemoteClient{
+		authRes: &threescale.AuthorizeResult{
+			Authorized:          true,
+			AuthorizeExtensions: threescale.AuthorizeExtensions{Hierarchy: make(api.Hierarchy)},
+		},
+		reportCallback: func(request threescale.Request) {
+			reported = append(reported, request.Service)
+		},
+	}
+	b := &Backend{
+		client: remoteClient,
+		cache:  NewLocalCache(),
+		queue:  newQueue(10),
+		logger: &core.NoOpLogger{},
+	}
+	b.SetMaxServices(2)
+
+	authRep := func(service string) {
+		t.Helper()
+		_, err := b.AuthRep(threescale.Request{
+			Auth:    api.ClientAuth{Type: api.ServiceToken, Value: "any"},
+			Service: api.Service(service),
+			Transactions: []api.Transaction{
+				{Metrics: api.Metrics{"hits": 1}, Params: api.Params{AppID: "app"}},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	authRep("1")
+	authRep("2")
+	// using service 1 leaves service 2 as the least recently used
+	authRep("1")
+	authRep("3")
+
+	for key, expect := range map[string]bool{"1_app": true, "2_app": false, "3_app": true} {
+		if _, ok := b.cache.Get(key); ok != expect {
+			t.Errorf("expected %s to be cached to be %t", key, expect)
+		}
+	}
+	if b.services.len() != 2 {
+		t.Errorf("expected the number of services to be capped, got %d", b.services.len())
+	}
+
+	// usage of the evicted service is reported on the next flush
+	b.Flush()
+	var evictedReported bool
+	for _, service := range reported {
+		if service == "2" {
+			evictedReported = true
+		}
+	}
+	if !evictedReported {
+		t.Errorf("expected the usage of the evicted service to be reported, got reports for %v", reported)
+	}
+	if _, ok := b.cache.Get("2_app"); ok {
+		t.Error("expected the evicted service not to be cached again by the flush")
+	}
+}
@@ -11,6 +11,8 @@ type Cacheable interface {
 	Set(key string, application *Application)
 	// Keys returns a list of keys for all cached items
 	Keys() []string
+	// Delete the application for the provided key, if present
+	Delete(key string)
 }
 
 // LocalCache is an implementation of Cacheable providing an in-memory cache
@@ -44,3 +46,8 @@ func (l LocalCache) Set(cacheKey string, app *Application) {
 func (l LocalCache) Keys() []string {
 	return l.ds.Keys()
 }
+
+// Delete entries for LocalCache
+func (l LocalCache) Delete(cacheKey string) {
+	l.ds.Remove(cacheKey)
+}
@@ -36,6 +36,7 @@ func getApplicationFromResponse(resp *threescale.AuthorizeResult) Application {
 		UnlimitedCounter: make(map[string]int),
 		metricHierarchy:  resp.AuthorizeExtensions.Hierarchy,
 		timestamp:        deriveTimestamp(resp.UsageReports),
+		syncedAt:         time.Now(),
 	}
 }
 
@@ -74,7 +75,7 @@ func getAppIDFromTransaction(transaction api.Transaction) string {
 }
 
 func generateCacheKeyFromRequest(request threescale.Request, transactionIndex int) string {
-	return fmt.Sprintf("%s_%s", request.GetServiceID(), getAppIDFromTransaction(request.Transactions[transactionIndex]))
+	return string(request.GetServiceID()) + "_" + getAppIDFromTransaction(request.Transactions[transactionIndex])
 }
 
 // getEmptyAuthRequest is a helper method to return a request suitable for a blanket auth request
@@ -212,19 +213,19 @@ func hasSurpassedDeadline(timestamp int64, granularity api.Period, endTimestamp
 	deadline := time.Unix(endTimestamp, 0)
 	switch granularity {
 	case api.Minute:
-		return time.Unix(timestamp, 0).Add(time.Minute).After(deadline)
+		return !time.Unix(timestamp, 0).Add(time.Minute).After(deadline)
 	case api.Hour:
-		return time.Unix(timestamp, 0).Add(time.Hour).After(deadline)
+		return !time.Unix(timestamp, 0).Add(time.Hour).After(deadline)
 	case api.Day:
-		return time.Unix(timestamp, 0).AddDate(0, 0, 1).After(deadline)
+		return !time.Unix(timestamp, 0).AddDate(0, 0, 1).After(deadline)
 	case api.Week:
 		// todo - needs revisiting as may not be technically correct with the way 3scale handles weeks
 		// time.Unix(timestamp, 0).AddDate(0, 0, 7).After(deadline)
 		return false
 	case api.Month:
-		return time.Unix(timestamp, 0).AddDate(0, 1, 0).After(deadline)
+		return !time.Unix(timestamp, 0).AddDate(0, 1, 0).After(deadline)
 	case api.Year:
-		return time.Unix(timestamp, 0).AddDate(1, 0, 0).After(deadline)
+		return !time.Unix(timestamp, 0).AddDate(1, 0, 0).After(deadline)
 	default:
 		return false
 	}
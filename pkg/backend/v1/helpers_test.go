@@ -2,6 +2,7 @@ package backend
 
 import (
 	"testing"
+	"time"
 
 	"github.com/3scale/3scale-go-client/threescale"
 	"github.com/3scale/3scale-go-client/threescale/api"
@@ -456,3 +457,55 @@ func TestGetDifferenceBetweenSets(t *testing.T) {
 	got = getDifferenceBetweenSets(destinationReports, sourceReports)
 	equals(t, expect, got)
 }
+
+func Test_HasSurpassedDeadline(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC).Unix()
+
+	inputs := []struct {
+		name        string
+		granularity api.Period
+		end         int64
+		expect      bool
+	}{
+		{
+			name:        "Test same period has not elapsed",
+			granularity: api.Hour,
+			end:         start,
+		},
+		{
+			name:        "Test later in the same period has not elapsed",
+			granularity: api.Hour,
+			end:         start + 59*60,
+		},
+		{
+			name:        "Test next period has elapsed",
+			granularity: api.Hour,
+			end:         start + 60*60,
+			expect:      true,
+		},
+		{
+			name:        "Test next minute has elapsed",
+			granularity: api.Minute,
+			end:         start + 60,
+			expect:      true,
+		},
+		{
+			name:        "Test same day has not elapsed",
+			granularity: api.Day,
+			end:         start + 60*60,
+		},
+		{
+			name:        "Test eternity never elapses",
+			granularity: api.Eternity,
+			end:         start + 365*24*60*60,
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			if got := hasSurpassedDeadline(start, input.granularity, input.end); got != input.expect {
+				t.Errorf("expected %v, got %v", input.expect, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package backend
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/3scale/3scale-go-client/threescale/api"
+)
+
+// serviceLRU tracks the order in which cached services were last used so that the least recently used
+// service can be evicted once the number of distinct services exceeds the limit
+type serviceLRU struct {
+	mu       sync.Mutex
+	limit    int
+	order    *list.List
+	services map[api.Service]*list.Element
+}
+
+func newServiceLRU(limit int) *serviceLRU {
+	return &serviceLRU{
+		limit:    limit,
+		order:    list.New(),
+		services: make(map[api.Service]*list.Element),
+	}
+}
+
+// touch marks the service as the most recently used
+// Returns the least recently used service and true if tracking the service exceeded the limit,
+// in which case the returned service is no longer tracked
+func (l *serviceLRU) touch(service api.Service) (api.Service, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.services[service]; ok {
+		l.order.MoveToFront(e)
+		return "", false
+	}
+
+	l.services[service] = l.order.PushFront(service)
+	if l.order.Len() <= l.limit {
+		return "", false
+	}
+
+	oldest := l.order.Back()
+	l.order.Remove(oldest)
+	evicted := oldest.Value.(api.Service)
+	delete(l.services, evicted)
+	return evicted, true
+}
+
+// len returns the number of services being tracked
+func (l *serviceLRU) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len()
+}
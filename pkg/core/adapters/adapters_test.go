@@ -0,0 +1,162 @@
+package adapters
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/3scale/3scale-authorizer/pkg/core"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func logEachLevel(l core.Logger) {
+	l.Debugf("debug %d", 1)
+	l.Infof("info %d", 2)
+	l.Warnf("warn %d", 3)
+	l.Errorf("error %d", 4)
+}
+
+func TestStdLogger(t *testing.T) {
+	inputs := []struct {
+		name   string
+		debug  bool
+		expect []string
+	}{
+		{
+			name:   "Test debug output is discarded by default",
+			expect: []string{"INFO info 2", "WARN warn 3", "ERROR error 4"},
+		},
+		{
+			name:   "Test debug output is written when enabled",
+			debug:  true,
+			expect: []string{"DEBUG debug 1", "INFO info 2", "WARN warn 3", "ERROR error 4"},
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			logEachLevel(NewStdLogger(log.New(buf, "", 0), input.debug))
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			if strings.Join(lines, "|") != strings.Join(input.expect, "|") {
+				t.Errorf("unexpected output, wanted %v, got %v", input.expect, lines)
+			}
+		})
+	}
+}
+
+func TestLogrusLogger(t *testing.T) {
+	logger, hook := logrustest.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+
+	logEachLevel(NewLogrusLogger(logger))
+
+	expect := []struct {
+		level   logrus.Level
+		message string
+	}{
+		{level: logrus.DebugLevel, message: "debug 1"},
+		{level: logrus.InfoLevel, message: "info 2"},
+		{level: logrus.WarnLevel, message: "warn 3"},
+		{level: logrus.ErrorLevel, message: "error 4"},
+	}
+
+	entries := hook.AllEntries()
+	if len(entries) != len(expect) {
+		t.Fatalf("expected %d entries, got %d", len(expect), len(entries))
+	}
+	for i, e := range expect {
+		if entries[i].Level != e.level || entries[i].Message != e.message {
+			t.Errorf("expected %s at level %s, got %s at level %s", e.message, e.level, entries[i].Message, entries[i].Level)
+		}
+	}
+}
+
+func TestZapLogger(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	logEachLevel(NewZapLogger(zap.New(core).Sugar()))
+
+	expect := []struct {
+		level   zapcore.Level
+		message string
+	}{
+		{level: zapcore.DebugLevel, message: "debug 1"},
+		{level: zapcore.InfoLevel, message: "info 2"},
+		{level: zapcore.WarnLevel, message: "warn 3"},
+		{level: zapcore.ErrorLevel, message: "error 4"},
+	}
+
+	entries := logs.All()
+	if len(entries) != len(expect) {
+		t.Fatalf("expected %d entries, got %d", len(expect), len(entries))
+	}
+	for i, e := range expect {
+		if entries[i].Level != e.level || entries[i].Message != e.message {
+			t.Errorf("expected %s at level %s, got %s at level %s", e.message, e.level, entries[i].Message, entries[i].Level)
+		}
+	}
+}
+
+// keyvalsRecorder records the key value pairs of each entry, as a go-kit logger would receive them
+type keyvalsRecorder struct {
+	entries [][]interface{}
+}
+
+func (r *keyvalsRecorder) Log(keyvals ...interface{}) error {
+	r.entries = append(r.entries, keyvals)
+	return nil
+}
+
+func TestGoKitLogger(t *testing.T) {
+	recorder := &keyvalsRecorder{}
+	logEachLevel(NewGoKitLogger(recorder))
+
+	expect := []string{
+		"level=debug msg=debug 1",
+		"level=info msg=info 2",
+		"level=warn msg=warn 3",
+		"level=error msg=error 4",
+	}
+
+	if len(recorder.entries) != len(expect) {
+		t.Fatalf("expected %d entries, got %d", len(expect), len(recorder.entries))
+	}
+	for i, e := range expect {
+		keyvals := recorder.entries[i]
+		if got := fmt.Sprintf("%s=%s %s=%s", keyvals...); got != e {
+			t.Errorf("expected %q, got %q", e, got)
+		}
+	}
+}
+
+func TestDebugEnabled(t *testing.T) {
+	logrusLogger, _ := logrustest.NewNullLogger()
+	debugCore, _ := observer.New(zapcore.DebugLevel)
+	infoCore, _ := observer.New(zapcore.InfoLevel)
+
+	inputs := []struct {
+		name   string
+		logger core.Logger
+		expect bool
+	}{
+		{name: "Test std logger with debug", logger: NewStdLogger(nil, true), expect: true},
+		{name: "Test std logger without debug", logger: NewStdLogger(nil, false)},
+		{name: "Test logrus logger at info", logger: NewLogrusLogger(logrusLogger)},
+		{name: "Test zap logger at debug", logger: NewZapLogger(zap.New(debugCore).Sugar()), expect: true},
+		{name: "Test zap logger at info", logger: NewZapLogger(zap.New(infoCore).Sugar())},
+		{name: "Test no op logger", logger: &core.NoOpLogger{}},
+		{name: "Test loggers without a level write debug output", logger: NewGoKitLogger(&keyvalsRecorder{}), expect: true},
+	}
+	for _, input := range inputs {
+		if got := core.DebugEnabled(input.logger); got != input.expect {
+			t.Errorf("%s: expected debug enabled to be %t", input.name, input.expect)
+		}
+	}
+}
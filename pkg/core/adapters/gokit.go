@@ -0,0 +1,43 @@
+package adapters
+
+import (
+	"fmt"
+
+	"github.com/3scale/3scale-authorizer/pkg/core"
+)
+
+// KeyvalsLogger is the interface implemented by go-kit's log.Logger
+// It is declared here so that go-kit loggers can be adapted without depending on go-kit
+type KeyvalsLogger interface {
+	Log(keyvals ...interface{}) error
+}
+
+// NewGoKitLogger returns a core.Logger which writes to the provided go-kit logger
+// Each entry is logged with "level" and "msg" keys, matching go-kit's level package
+func NewGoKitLogger(l KeyvalsLogger) core.Logger {
+	return goKitLogger{l}
+}
+
+type goKitLogger struct {
+	logger KeyvalsLogger
+}
+
+func (l goKitLogger) Infof(format string, args ...interface{}) {
+	l.log("info", format, args...)
+}
+
+func (l goKitLogger) Warnf(format string, args ...interface{}) {
+	l.log("warn", format, args...)
+}
+
+func (l goKitLogger) Errorf(format string, args ...interface{}) {
+	l.log("error", format, args...)
+}
+
+func (l goKitLogger) Debugf(format string, args ...interface{}) {
+	l.log("debug", format, args...)
+}
+
+func (l goKitLogger) log(level, format string, args ...interface{}) {
+	l.logger.Log("level", level, "msg", fmt.Sprintf(format, args...))
+}
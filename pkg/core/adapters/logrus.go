@@ -0,0 +1,42 @@
+package adapters
+
+import (
+	"github.com/3scale/3scale-authorizer/pkg/core"
+	"github.com/sirupsen/logrus"
+)
+
+// NewLogrusLogger returns a core.Logger which writes to the provided logrus logger or entry
+func NewLogrusLogger(l logrus.FieldLogger) core.Logger {
+	return logrusLogger{l}
+}
+
+type logrusLogger struct {
+	logger logrus.FieldLogger
+}
+
+func (l logrusLogger) Infof(format string, args ...interface{}) {
+	l.logger.Infof(format, args...)
+}
+
+func (l logrusLogger) Warnf(format string, args ...interface{}) {
+	l.logger.Warnf(format, args...)
+}
+
+func (l logrusLogger) Errorf(format string, args ...interface{}) {
+	l.logger.Errorf(format, args...)
+}
+
+func (l logrusLogger) Debugf(format string, args ...interface{}) {
+	l.logger.Debugf(format, args...)
+}
+
+func (l logrusLogger) DebugEnabled() bool {
+	switch logger := l.logger.(type) {
+	case *logrus.Logger:
+		return logger.IsLevelEnabled(logrus.DebugLevel)
+	case *logrus.Entry:
+		return logger.Logger.IsLevelEnabled(logrus.DebugLevel)
+	default:
+		return true
+	}
+}
@@ -0,0 +1,46 @@
+// package adapters provides implementations of core.Logger backed by commonly used logging libraries
+package adapters
+
+import (
+	"log"
+
+	"github.com/3scale/3scale-authorizer/pkg/core"
+)
+
+// StdLogger adapts a standard library log.Logger to core.Logger
+// Each line is prefixed with its level. Debug output is discarded unless Debug is set
+type StdLogger struct {
+	Logger *log.Logger
+	Debug  bool
+}
+
+// NewStdLogger returns a core.Logger which writes to the provided log.Logger
+// The standard logger is used if 'l' is nil
+func NewStdLogger(l *log.Logger, debug bool) core.Logger {
+	if l == nil {
+		l = log.New(log.Writer(), log.Prefix(), log.Flags())
+	}
+	return &StdLogger{Logger: l, Debug: debug}
+}
+
+func (s *StdLogger) Infof(format string, args ...interface{}) {
+	s.Logger.Printf("INFO "+format, args...)
+}
+
+func (s *StdLogger) Warnf(format string, args ...interface{}) {
+	s.Logger.Printf("WARN "+format, args...)
+}
+
+func (s *StdLogger) Errorf(format string, args ...interface{}) {
+	s.Logger.Printf("ERROR "+format, args...)
+}
+
+func (s *StdLogger) Debugf(format string, args ...interface{}) {
+	if s.Debug {
+		s.Logger.Printf("DEBUG "+format, args...)
+	}
+}
+
+func (s *StdLogger) DebugEnabled() bool {
+	return s.Debug
+}
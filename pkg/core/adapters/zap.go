@@ -0,0 +1,36 @@
+package adapters
+
+import (
+	"github.com/3scale/3scale-authorizer/pkg/core"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// NewZapLogger returns a core.Logger which writes to the provided zap SugaredLogger
+func NewZapLogger(l *zap.SugaredLogger) core.Logger {
+	return zapLogger{l}
+}
+
+type zapLogger struct {
+	logger *zap.SugaredLogger
+}
+
+func (l zapLogger) Infof(format string, args ...interface{}) {
+	l.logger.Infof(format, args...)
+}
+
+func (l zapLogger) Warnf(format string, args ...interface{}) {
+	l.logger.Warnf(format, args...)
+}
+
+func (l zapLogger) Errorf(format string, args ...interface{}) {
+	l.logger.Errorf(format, args...)
+}
+
+func (l zapLogger) Debugf(format string, args ...interface{}) {
+	l.logger.Debugf(format, args...)
+}
+
+func (l zapLogger) DebugEnabled() bool {
+	return l.logger.Desugar().Core().Enabled(zapcore.DebugLevel)
+}
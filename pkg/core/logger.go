@@ -1,16 +1,64 @@
 package core
 
+// Logger is the logging interface used throughout the library
+//
+// Breaking change: Warnf has been added to the interface. Implementations which predate it can be
+// adapted using FromLegacyLogger until they implement Warnf
 type Logger interface {
 	Infof(string, ...interface{})
+	Warnf(string, ...interface{})
 	Errorf(string, ...interface{})
 	Debugf(string, ...interface{})
 }
 
+// DebugLevelLogger is implemented by loggers which can report whether debug output is enabled, allowing
+// the cost of building debug output to be avoided when it would be discarded
+type DebugLevelLogger interface {
+	DebugEnabled() bool
+}
+
+// DebugEnabled returns true if the logger writes debug output. Loggers which do not implement
+// DebugLevelLogger are assumed to write debug output
+func DebugEnabled(l Logger) bool {
+	if leveled, ok := l.(DebugLevelLogger); ok {
+		return leveled.DebugEnabled()
+	}
+	return true
+}
+
+// LegacyLogger is the Logger interface prior to the addition of Warnf
+type LegacyLogger interface {
+	Infof(string, ...interface{})
+	Errorf(string, ...interface{})
+	Debugf(string, ...interface{})
+}
+
+// FromLegacyLogger returns a Logger for an implementation of LegacyLogger
+// If the provided logger implements Warnf it is returned as is, otherwise warnings are logged via Infof
+func FromLegacyLogger(l LegacyLogger) Logger {
+	if logger, ok := l.(Logger); ok {
+		return logger
+	}
+	return legacyLogger{l}
+}
+
+type legacyLogger struct {
+	LegacyLogger
+}
+
+func (l legacyLogger) Warnf(s string, i ...interface{}) {
+	l.Infof(s, i...)
+}
+
 // NoOpLogger logs nothing
 type NoOpLogger struct{}
 
 func (l *NoOpLogger) Infof(s string, i ...interface{}) {}
 
+func (l *NoOpLogger) Warnf(s string, i ...interface{}) {}
+
 func (l *NoOpLogger) Errorf(s string, i ...interface{}) {}
 
 func (l *NoOpLogger) Debugf(s string, i ...interface{}) {}
+
+func (l *NoOpLogger) DebugEnabled() bool { return false }
@@ -0,0 +1,24 @@
+package core
+
+import "testing"
+
+type legacy struct {
+	infos int
+}
+
+func (l *legacy) Infof(string, ...interface{})  { l.infos++ }
+func (l *legacy) Errorf(string, ...interface{}) {}
+func (l *legacy) Debugf(string, ...interface{}) {}
+
+func TestFromLegacyLogger(t *testing.T) {
+	l := &legacy{}
+	FromLegacyLogger(l).Warnf("warning")
+	if l.infos != 1 {
+		t.Errorf("expected warnings from a legacy logger to be logged at info level")
+	}
+
+	noop := &NoOpLogger{}
+	if FromLegacyLogger(noop) != Logger(noop) {
+		t.Errorf("expected a logger implementing Warnf to be returned as is")
+	}
+}
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// CredentialParams are the names of the query and form parameters which carry credentials for 3scale
+var CredentialParams = []string{"user_key", "app_key", "access_token", "service_token", "provider_key"}
+
+// credentialHeaders are the names of headers which carry credentials
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "X-3scale-Proxy-Secret-Token"}
+
+var (
+	// matches plain and form encoded parameters, including those nested within a transaction, eg. transactions[0][user_key]
+	credentialParamRegex = regexp.MustCompile(`(?i)(^|[^a-z0-9_]|%5B)(` + strings.Join(CredentialParams, "|") + `)(\]|%5D)?=([^&\s"'<>]+)`)
+	userInfoRegex        = regexp.MustCompile(`(://[^/\s:@]*:)([^/\s@]+)@`)
+)
+
+// MaskSecret masks all but the first and last two characters of a secret
+// Secrets too short to partially reveal are masked in full
+func MaskSecret(secret string) string {
+	const keep = 2
+	if secret == "" {
+		return ""
+	}
+	if len(secret) <= keep*3 {
+		return strings.Repeat("*", len(secret))
+	}
+	return secret[:keep] + strings.Repeat("*", len(secret)-keep*2) + secret[len(secret)-keep:]
+}
+
+// RedactCredentials masks the value of any credential parameters, and any passwords, in URLs found in the input
+func RedactCredentials(s string) string {
+	s = credentialParamRegex.ReplaceAllStringFunc(s, func(match string) string {
+		parts := credentialParamRegex.FindStringSubmatch(match)
+		return parts[1] + parts[2] + parts[3] + "=" + MaskSecret(parts[4])
+	})
+	return userInfoRegex.ReplaceAllStringFunc(s, func(match string) string {
+		parts := userInfoRegex.FindStringSubmatch(match)
+		return parts[1] + MaskSecret(parts[2]) + "@"
+	})
+}
+
+// RedactHeader returns a copy of the header with the values of credential headers masked
+// and credentials in any other values redacted
+func RedactHeader(h http.Header) http.Header {
+	redacted := make(http.Header, len(h))
+	for name, values := range h {
+		mask := RedactCredentials
+		for _, credentialHeader := range credentialHeaders {
+			if strings.EqualFold(name, credentialHeader) {
+				mask = MaskSecret
+				break
+			}
+		}
+
+		redactedValues := make([]string, len(values))
+		for i, v := range values {
+			redactedValues[i] = mask(v)
+		}
+		redacted[name] = redactedValues
+	}
+	return redacted
+}
+
+// RedactError returns an error with credentials redacted from its message. See RedactCredentials
+// The returned error unwraps to the original error so it can still be inspected with errors.Is and errors.As
+func RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return redactedError{err: err, msg: RedactCredentials(err.Error())}
+}
+
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (r redactedError) Error() string {
+	return r.msg
+}
+
+func (r redactedError) Unwrap() error {
+	return r.err
+}
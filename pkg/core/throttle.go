@@ -0,0 +1,131 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultThrottleLimit is the number of messages per key emitted in each interval by default
+	DefaultThrottleLimit = 5
+	// DefaultThrottleInterval is the default window over which messages are counted
+	DefaultThrottleInterval = time.Minute
+)
+
+// LogThrottle limits the number of similar messages written to a Logger
+// Messages are grouped by a caller provided key, for example a service and a class of message. The first 'limit'
+// messages for a key are emitted in each interval. Once the interval has passed, the number of messages that were
+// suppressed is logged at the level of the last suppressed message before logging resumes
+type LogThrottle struct {
+	logger   Logger
+	limit    int
+	interval time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	windows map[string]*throttleWindow
+}
+
+type throttleWindow struct {
+	start      time.Time
+	count      int
+	suppressed int
+	logf       func(string, ...interface{})
+}
+
+// NewLogThrottle returns a LogThrottle writing to the provided logger
+// A non-positive limit or interval defaults to DefaultThrottleLimit and DefaultThrottleInterval respectively
+func NewLogThrottle(logger Logger, limit int, interval time.Duration) *LogThrottle {
+	if limit <= 0 {
+		limit = DefaultThrottleLimit
+	}
+	if interval <= 0 {
+		interval = DefaultThrottleInterval
+	}
+
+	return &LogThrottle{
+		logger:   logger,
+		limit:    limit,
+		interval: interval,
+		now:      time.Now,
+		windows:  make(map[string]*throttleWindow),
+	}
+}
+
+func (t *LogThrottle) Infof(key, format string, args ...interface{}) {
+	t.logf(key, t.logger.Infof, format, args...)
+}
+
+func (t *LogThrottle) Warnf(key, format string, args ...interface{}) {
+	t.logf(key, t.logger.Warnf, format, args...)
+}
+
+func (t *LogThrottle) Errorf(key, format string, args ...interface{}) {
+	t.logf(key, t.logger.Errorf, format, args...)
+}
+
+func (t *LogThrottle) Debugf(key, format string, args ...interface{}) {
+	t.logf(key, t.logger.Debugf, format, args...)
+}
+
+// Flush logs the summary of any windows which have ended and forgets them
+func (t *LogThrottle) Flush() {
+	now := t.now()
+
+	t.mu.Lock()
+	var summaries []func()
+	for key, w := range t.windows {
+		if now.Sub(w.start) >= t.interval {
+			summaries = append(summaries, w.summary(key))
+			delete(t.windows, key)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, summary := range summaries {
+		summary()
+	}
+}
+
+func (t *LogThrottle) logf(key string, logf func(string, ...interface{}), format string, args ...interface{}) {
+	now := t.now()
+	var summary func()
+
+	t.mu.Lock()
+	w, ok := t.windows[key]
+	if ok && now.Sub(w.start) >= t.interval {
+		summary = w.summary(key)
+		ok = false
+	}
+	if !ok {
+		w = &throttleWindow{start: now}
+		t.windows[key] = w
+	}
+
+	w.count++
+	emit := w.count <= t.limit
+	if !emit {
+		w.suppressed++
+		w.logf = logf
+	}
+	t.mu.Unlock()
+
+	// log outside of the lock so that a slow logger does not block other keys
+	if summary != nil {
+		summary()
+	}
+	if emit {
+		logf(format, args...)
+	}
+}
+
+// summary returns a func which logs the number of messages suppressed in the window, a no-op if none were
+func (w *throttleWindow) summary(key string) func() {
+	if w.suppressed == 0 {
+		return func() {}
+	}
+	suppressed, logf := w.suppressed, w.logf
+	return func() {
+		logf("suppressed %d similar messages for %s", suppressed, key)
+	}
+}
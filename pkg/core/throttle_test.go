@@ -0,0 +1,115 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) record(level, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.record("INFO", format, args...)
+}
+func (l *recordingLogger) Warnf(format string, args ...interface{}) {
+	l.record("WARN", format, args...)
+}
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.record("ERROR", format, args...)
+}
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.record("DEBUG", format, args...)
+}
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestLogThrottle(t *testing.T) {
+	logger := &recordingLogger{}
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	throttle := NewLogThrottle(logger, 2, time.Minute)
+	throttle.now = clock.now
+
+	for i := 0; i < 5; i++ {
+		throttle.Warnf("svc-a/credentials", "invalid credentials %d", i)
+	}
+	throttle.Errorf("svc-b/backend", "backend failure")
+
+	expect := []string{
+		"WARN invalid credentials 0",
+		"WARN invalid credentials 1",
+		"ERROR backend failure",
+	}
+	assertLines(t, logger.lines, expect)
+
+	// a new window summarises the previous window before logging resumes
+	clock.advance(time.Minute)
+	throttle.Warnf("svc-a/credentials", "invalid credentials %d", 5)
+	expect = append(expect,
+		"WARN suppressed 3 similar messages for svc-a/credentials",
+		"WARN invalid credentials 5",
+	)
+	assertLines(t, logger.lines, expect)
+
+	// flush summarises windows which have ended without further messages for the key
+	throttle.Warnf("svc-a/credentials", "invalid credentials %d", 6)
+	throttle.Warnf("svc-a/credentials", "invalid credentials %d", 7)
+	throttle.Flush()
+	expect = append(expect, "WARN invalid credentials 6")
+	assertLines(t, logger.lines, expect)
+
+	clock.advance(time.Minute)
+	throttle.Flush()
+	expect = append(expect, "WARN suppressed 1 similar messages for svc-a/credentials")
+	assertLines(t, logger.lines, expect)
+
+	// a key with nothing suppressed produces no summary
+	throttle.Flush()
+	assertLines(t, logger.lines, expect)
+}
+
+func TestLogThrottle_Concurrent(t *testing.T) {
+	logger := &recordingLogger{}
+	throttle := NewLogThrottle(logger, 3, time.Hour)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			throttle.Errorf(fmt.Sprintf("key-%d", i%2), "message %d", i)
+		}(i)
+	}
+	wg.Wait()
+
+	if len(logger.lines) != 6 {
+		t.Errorf("expected 3 messages per key to be emitted, got %d", len(logger.lines))
+	}
+}
+
+func assertLines(t *testing.T, got, expect []string) {
+	t.Helper()
+	if len(got) != len(expect) {
+		t.Fatalf("expected %d lines, got %d - %v", len(expect), len(got), got)
+	}
+	for i := range expect {
+		if got[i] != expect[i] {
+			t.Errorf("line %d - expected %q, got %q", i, expect[i], got[i])
+		}
+	}
+}
@@ -0,0 +1,483 @@
+package fake
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Paths of the 3scale backend endpoints served by Backend
+const (
+	AuthorizePath      = "/transactions/authorize.xml"
+	AuthRepPath        = "/transactions/authrep.xml"
+	OauthAuthorizePath = "/transactions/oauth_authorize.xml"
+	OauthAuthRepPath   = "/transactions/oauth_authrep.xml"
+	ReportPath         = "/transactions.xml"
+)
+
+const timeLayout = "2006-01-02 15:04:05 -0700"
+
+var transactionParam = regexp.MustCompile(`^transactions\[(\d+)\]\[(.+)\]$`)
+
+// Application is an application of a service known to Backend, identified by its user key or by its app id
+type Application struct {
+	UserKey string
+	AppID   string
+	// AppKey, if set, must be provided alongside the AppID
+	AppKey string
+	Limits []Limit
+}
+
+// Limit is a rate limit on a metric of an application
+type Limit struct {
+	Metric string
+	// Period is one of minute, hour, day, week, month, year or eternity
+	Period string
+	Max    int
+}
+
+// Backend is a fake of 3scale backend (apisonator)
+// It authorizes requests against the configured services and applications, tracks the usage reported per metric
+// and denies requests which would exceed a limit. The hierarchy, flat_usage, rejection_reason_header,
+// limit_headers and no_body extensions are supported
+type Backend struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	services map[string]*fakeService
+	faults   *faults
+	rec      recorder
+}
+
+type fakeService struct {
+	token string
+	// hierarchy maps parent metrics to their children
+	hierarchy map[string][]string
+	apps      []*fakeApp
+}
+
+type fakeApp struct {
+	Application
+	usage map[string]int
+	// windows holds the usage of each limit in its current period, keyed by metric and period
+	windows map[string]*window
+}
+
+type window struct {
+	start time.Time
+	end   time.Time
+	usage int
+}
+
+// NewBackend starts a fake of 3scale backend with no services
+// The caller should call Close when finished, to shut it down
+func NewBackend() *Backend {
+	b := &Backend{
+		services: make(map[string]*fakeService),
+		faults:   newFaults(),
+	}
+	b.Server = httptest.NewServer(http.HandlerFunc(b.serveHTTP))
+	return b
+}
+
+// AddService adds a service which accepts the provided service token, or provider key
+// The hierarchy maps parent metrics to their children and may be nil
+func (b *Backend) AddService(serviceID, serviceToken string, hierarchy map[string][]string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.services[serviceID] = &fakeService{token: serviceToken, hierarchy: hierarchy}
+}
+
+// AddApplication adds an application to a service added with AddService
+func (b *Backend) AddApplication(serviceID string, app Application) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	svc, ok := b.services[serviceID]
+	if !ok {
+		panic(fmt.Sprintf("fake: unknown service %s", serviceID))
+	}
+	svc.apps = append(svc.apps, &fakeApp{
+		Application: app,
+		usage:       make(map[string]int),
+		windows:     make(map[string]*window),
+	})
+}
+
+// Usage returns the total usage of the metric reported for the application identified by the user key or app id
+func (b *Backend) Usage(serviceID, credential, metric string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if svc, ok := b.services[serviceID]; ok {
+		for _, app := range svc.apps {
+			if app.UserKey == credential || app.AppID == credential {
+				return app.usage[metric]
+			}
+		}
+	}
+	return 0
+}
+
+// Fail responds to requests for the service with the provided status. An empty service id fails every request
+// A zero status removes the failure
+func (b *Backend) Fail(serviceID string, status int) {
+	b.faults.set(serviceID, status)
+}
+
+// SetLatency delays every response by the provided duration
+func (b *Backend) SetLatency(latency time.Duration) {
+	b.faults.setLatency(latency)
+}
+
+// Requests returns the requests received to the provided path, or all requests for an empty path
+func (b *Backend) Requests(path string) []Request {
+	return b.rec.matching(path)
+}
+
+func (b *Backend) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	b.rec.record(r)
+
+	serviceID := r.Form.Get("service_id")
+	if status := b.faults.apply(serviceID, ""); status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+	extensions, _ := url.ParseQuery(r.Header.Get("3scale-options"))
+
+	switch r.URL.Path {
+	case AuthorizePath, OauthAuthorizePath:
+		b.serveAuth(w, r.Form, extensions, false)
+	case AuthRepPath, OauthAuthRepPath:
+		b.serveAuth(w, r.Form, extensions, true)
+	case ReportPath:
+		b.serveReport(w, r.Form, extensions)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (b *Backend) serveAuth(w http.ResponseWriter, values url.Values, extensions url.Values, report bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	svc, code := b.service(values)
+	if code != "" {
+		writeError(w, code, extensions)
+		return
+	}
+	app, code := svc.application(values.Get("user_key"), values.Get("app_id"), values.Get("app_key"))
+	if code != "" {
+		writeError(w, code, extensions)
+		return
+	}
+
+	usage := usageValues(values)
+	if extensions.Get("flat_usage") != "1" {
+		usage = svc.withParents(usage)
+	}
+
+	now := time.Now()
+	authorized := app.withinLimits(usage, now)
+	if authorized && report {
+		app.add(usage, now)
+	}
+
+	status := statusXML{Authorized: authorized, Plan: "Basic"}
+	if !authorized {
+		status.Reason = "usage limits are exceeded"
+		if extensions.Get("rejection_reason_header") == "1" {
+			w.Header().Set("3scale-rejection-reason", "limits_exceeded")
+		}
+	}
+	for _, limit := range app.Limits {
+		win := app.window(limit, now)
+		status.UsageReports = append(status.UsageReports, usageReportXML{
+			Metric:       limit.Metric,
+			Period:       limit.Period,
+			PeriodStart:  win.start.Format(timeLayout),
+			PeriodEnd:    win.end.Format(timeLayout),
+			MaxValue:     limit.Max,
+			CurrentValue: win.usage,
+		})
+	}
+	if extensions.Get("hierarchy") == "1" {
+		status.Hierarchy = &hierarchyXML{}
+		for _, parent := range sortedKeys(svc.hierarchy) {
+			status.Hierarchy.Metrics = append(status.Hierarchy.Metrics, metricXML{
+				Name:     parent,
+				Children: strings.Join(svc.hierarchy[parent], " "),
+			})
+		}
+	}
+	if extensions.Get("limit_headers") == "1" && len(app.Limits) > 0 {
+		win := app.window(app.Limits[0], now)
+		w.Header().Set("3scale-limit-remaining", strconv.Itoa(app.Limits[0].Max-win.usage))
+		w.Header().Set("3scale-limit-reset", strconv.Itoa(int(win.end.Sub(now).Seconds())))
+	}
+
+	if !authorized {
+		w.WriteHeader(http.StatusConflict)
+	}
+	if extensions.Get("no_body") == "1" {
+		return
+	}
+	writeXML(w, status)
+}
+
+func (b *Backend) serveReport(w http.ResponseWriter, values url.Values, extensions url.Values) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	svc, code := b.service(values)
+	if code != "" {
+		writeError(w, code, extensions)
+		return
+	}
+
+	// transactions for unknown applications are dropped, as 3scale processes reports asynchronously
+	now := time.Now()
+	for _, transaction := range transactionValues(values) {
+		app, code := svc.application(transaction.Get("user_key"), transaction.Get("app_id"), transaction.Get("app_key"))
+		if code != "" {
+			continue
+		}
+		usage := usageValues(transaction)
+		if extensions.Get("flat_usage") != "1" {
+			usage = svc.withParents(usage)
+		}
+		app.add(usage, now)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// service returns the service of the request or the error code for an unknown service or invalid token
+func (b *Backend) service(values url.Values) (*fakeService, string) {
+	svc, ok := b.services[values.Get("service_id")]
+	if !ok {
+		return nil, "service_id_invalid"
+	}
+	if token := values.Get("service_token"); token != "" {
+		if token != svc.token {
+			return nil, "service_token_invalid"
+		}
+		return svc, ""
+	}
+	if values.Get("provider_key") != svc.token {
+		return nil, "provider_key_invalid"
+	}
+	return svc, ""
+}
+
+// application returns the application identified by the credentials or the error code for invalid credentials
+func (svc *fakeService) application(userKey, appID, appKey string) (*fakeApp, string) {
+	for _, app := range svc.apps {
+		switch {
+		case userKey != "" && app.UserKey == userKey:
+			return app, ""
+		case appID != "" && app.AppID == appID:
+			if app.AppKey != "" && app.AppKey != appKey {
+				return nil, "application_key_invalid"
+			}
+			return app, ""
+		}
+	}
+	if userKey != "" {
+		return nil, "user_key_invalid"
+	}
+	return nil, "application_not_found"
+}
+
+// withParents returns the usage with the usage of each child metric added to its parent
+func (svc *fakeService) withParents(usage map[string]int) map[string]int {
+	withParents := make(map[string]int, len(usage))
+	for metric, value := range usage {
+		withParents[metric] += value
+	}
+	for parent, children := range svc.hierarchy {
+		for _, child := range children {
+			if value, ok := usage[child]; ok {
+				withParents[parent] += value
+			}
+		}
+	}
+	return withParents
+}
+
+func (app *fakeApp) withinLimits(usage map[string]int, now time.Time) bool {
+	for _, limit := range app.Limits {
+		if value, ok := usage[limit.Metric]; ok && app.window(limit, now).usage+value > limit.Max {
+			return false
+		}
+	}
+	return true
+}
+
+func (app *fakeApp) add(usage map[string]int, now time.Time) {
+	for metric, value := range usage {
+		app.usage[metric] += value
+	}
+	for _, limit := range app.Limits {
+		app.window(limit, now).usage += usage[limit.Metric]
+	}
+}
+
+// window returns the current period of the limit, starting a new period once the previous has ended
+func (app *fakeApp) window(limit Limit, now time.Time) *window {
+	key := limit.Metric + "/" + limit.Period
+	win, ok := app.windows[key]
+	if !ok || !now.Before(win.end) {
+		start, end := periodWindow(limit.Period, now)
+		win = &window{start: start, end: end}
+		app.windows[key] = win
+	}
+	return win
+}
+
+// periodWindow returns the start and end of the period containing now
+func periodWindow(period string, now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+	year, month, day := now.Date()
+	switch period {
+	case "minute":
+		start := now.Truncate(time.Minute)
+		return start, start.Add(time.Minute)
+	case "hour":
+		start := now.Truncate(time.Hour)
+		return start, start.Add(time.Hour)
+	case "day":
+		start := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1)
+	case "week":
+		offset := (int(now.Weekday()) + 6) % 7
+		start := time.Date(year, month, day-offset, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 7)
+	case "month":
+		start := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	case "year":
+		start := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(1, 0, 0)
+	default:
+		return time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// usageValues returns the usage held by the values under keys of the form usage[<metric>]
+func usageValues(values url.Values) map[string]int {
+	usage := make(map[string]int)
+	for key := range values {
+		if strings.HasPrefix(key, "usage[") && strings.HasSuffix(key, "]") {
+			if value, err := strconv.Atoi(values.Get(key)); err == nil {
+				usage[strings.TrimSuffix(strings.TrimPrefix(key, "usage["), "]")] = value
+			}
+		}
+	}
+	return usage
+}
+
+// transactionValues splits the values of a report into the values of each transaction, in order
+func transactionValues(values url.Values) []url.Values {
+	byIndex := make(map[int]url.Values)
+	for key := range values {
+		match := transactionParam.FindStringSubmatch(key)
+		if match == nil {
+			continue
+		}
+		index, _ := strconv.Atoi(match[1])
+		if byIndex[index] == nil {
+			byIndex[index] = make(url.Values)
+		}
+		// usage is keyed as transactions[i][usage][metric] and is keyed as usage[metric] in the transaction
+		param := match[2]
+		if strings.HasPrefix(param, "usage][") {
+			param = "usage[" + strings.TrimPrefix(param, "usage][") + "]"
+		}
+		byIndex[index].Set(param, values.Get(key))
+	}
+
+	indexes := make([]int, 0, len(byIndex))
+	for index := range byIndex {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	transactions := make([]url.Values, 0, len(indexes))
+	for _, index := range indexes {
+		transactions = append(transactions, byIndex[index])
+	}
+	return transactions
+}
+
+// errorStatus is the status 3scale responds with for each error code
+var errorStatus = map[string]int{
+	"service_id_invalid":      http.StatusNotFound,
+	"service_token_invalid":   http.StatusForbidden,
+	"provider_key_invalid":    http.StatusForbidden,
+	"user_key_invalid":        http.StatusForbidden,
+	"application_not_found":   http.StatusNotFound,
+	"application_key_invalid": http.StatusConflict,
+}
+
+func writeError(w http.ResponseWriter, code string, extensions url.Values) {
+	if extensions.Get("rejection_reason_header") == "1" {
+		w.Header().Set("3scale-rejection-reason", code)
+	}
+	w.WriteHeader(errorStatus[code])
+	if extensions.Get("no_body") == "1" {
+		return
+	}
+	writeXML(w, errorXML{Code: code, Message: strings.Replace(code, "_", " ", -1)})
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type statusXML struct {
+	XMLName      xml.Name         `xml:"status"`
+	Authorized   bool             `xml:"authorized"`
+	Reason       string           `xml:"reason,omitempty"`
+	Plan         string           `xml:"plan"`
+	UsageReports []usageReportXML `xml:"usage_reports>usage_report,omitempty"`
+	Hierarchy    *hierarchyXML    `xml:"hierarchy,omitempty"`
+}
+
+type usageReportXML struct {
+	Metric       string `xml:"metric,attr"`
+	Period       string `xml:"period,attr"`
+	PeriodStart  string `xml:"period_start"`
+	PeriodEnd    string `xml:"period_end"`
+	MaxValue     int    `xml:"max_value"`
+	CurrentValue int    `xml:"current_value"`
+}
+
+type hierarchyXML struct {
+	Metrics []metricXML `xml:"metric"`
+}
+
+type metricXML struct {
+	Name     string `xml:"name,attr"`
+	Children string `xml:"children,attr"`
+}
+
+type errorXML struct {
+	XMLName xml.Name `xml:"error"`
+	Code    string   `xml:"code,attr"`
+	Message string   `xml:",chardata"`
+}
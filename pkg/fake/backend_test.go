@@ -0,0 +1,73 @@
+package fake
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/3scale/3scale-go-client/threescale"
+	"github.com/3scale/3scale-go-client/threescale/api"
+	threescaleHTTP "github.com/3scale/3scale-go-client/threescale/http"
+)
+
+func TestBackend(t *testing.T) {
+	b := NewBackend()
+	defer b.Close()
+	b.AddService("1", "token", map[string][]string{"hits": {"orders"}})
+	b.AddApplication("1", Application{UserKey: "key", Limits: []Limit{{Metric: "hits", Period: "minute", Max: 2}}})
+	b.AddApplication("1", Application{AppID: "id", AppKey: "secret"})
+
+	c, err := threescaleHTTP.NewClient(b.URL, http.DefaultClient)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	request := func(params api.Params, metrics api.Metrics) threescale.Request {
+		return threescale.Request{
+			Auth:         api.ClientAuth{Type: api.ServiceToken, Value: "token"},
+			Service:      "1",
+			Transactions: []api.Transaction{{Params: params, Metrics: metrics}},
+			Extensions:   api.Extensions{api.HierarchyExtension: "1", "rejection_reason_header": "1"},
+		}
+	}
+
+	res, err := c.AuthRep(request(api.Params{UserKey: "key"}, api.Metrics{"orders": 1}))
+	if err != nil || !res.Authorized {
+		t.Fatalf("expected the request to be authorized, got %v - %v", res, err)
+	}
+	if len(res.Hierarchy["hits"]) != 1 || len(res.UsageReports["hits"]) != 1 || res.UsageReports["hits"][0].CurrentValue != 1 {
+		t.Errorf("expected the hierarchy and usage to be returned, got %v", res)
+	}
+
+	if _, err := c.Report(request(api.Params{UserKey: "key"}, api.Metrics{"hits": 1})); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if res, _ := c.AuthRep(request(api.Params{UserKey: "key"}, api.Metrics{"hits": 1})); res.Authorized || res.ErrorCode != "limits_exceeded" {
+		t.Errorf("expected the limit to be exceeded, got %v", res)
+	}
+	if usage := b.Usage("1", "key", "hits"); usage != 2 {
+		t.Errorf("expected the usage of the parent metric to include its children, got %d", usage)
+	}
+
+	inputs := []struct {
+		params     api.Params
+		expectCode string
+	}{
+		{params: api.Params{AppID: "id", AppKey: "secret"}},
+		{params: api.Params{AppID: "id", AppKey: "invalid"}, expectCode: "application_key_invalid"},
+		{params: api.Params{AppID: "unknown"}, expectCode: "application_not_found"},
+		{params: api.Params{UserKey: "unknown"}, expectCode: "user_key_invalid"},
+	}
+	for _, input := range inputs {
+		res, err := c.Authorize(request(input.params, api.Metrics{"hits": 1}))
+		if err != nil || res.Authorized != (input.expectCode == "") || res.ErrorCode != input.expectCode {
+			t.Errorf("expected error code %q for %v, got %v - %v", input.expectCode, input.params, res, err)
+		}
+	}
+
+	b.Fail("", http.StatusServiceUnavailable)
+	if _, err := c.Authorize(request(api.Params{AppID: "id", AppKey: "secret"}, nil)); err == nil {
+		t.Error("expected the injected failure to be returned")
+	}
+	if authReps := b.Requests(AuthRepPath); len(authReps) != 2 {
+		t.Errorf("expected each AuthRep to be recorded, got %d", len(authReps))
+	}
+}
@@ -0,0 +1,97 @@
+// Package fake provides in-process fakes of 3scale system and 3scale backend for integration testing
+// Each fake is an httptest.Server speaking the subset of the 3scale APIs used by the authorizer
+package fake
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Request is a request received by a fake
+type Request struct {
+	Method string
+	Path   string
+	// Values holds the query and form values of the request
+	Values url.Values
+	Header http.Header
+}
+
+// faults holds the failures injected into a fake
+type faults struct {
+	mu      sync.Mutex
+	status  map[string]int
+	latency time.Duration
+}
+
+func newFaults() *faults {
+	return &faults{status: make(map[string]int)}
+}
+
+// set the status returned for the key, a zero status removes the fault
+func (f *faults) set(key string, status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if status == 0 {
+		delete(f.status, key)
+		return
+	}
+	f.status[key] = status
+}
+
+func (f *faults) setLatency(latency time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latency = latency
+}
+
+// apply waits for the injected latency and returns the status injected for any of the keys, zero if none
+func (f *faults) apply(keys ...string) int {
+	f.mu.Lock()
+	latency := f.latency
+	var status int
+	for _, key := range keys {
+		if s, ok := f.status[key]; ok {
+			status = s
+			break
+		}
+	}
+	f.mu.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	return status
+}
+
+// recorder records the requests received by a fake
+type recorder struct {
+	mu       sync.Mutex
+	requests []Request
+}
+
+func (r *recorder) record(req *http.Request) {
+	req.ParseForm()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, Request{
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Values: req.Form,
+		Header: req.Header.Clone(),
+	})
+}
+
+// matching returns the recorded requests to the provided path, or all requests for an empty path
+func (r *recorder) matching(path string) []Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var matched []Request
+	for _, req := range r.requests {
+		if path == "" || req.Path == path {
+			matched = append(matched, req)
+		}
+	}
+	return matched
+}
@@ -0,0 +1,187 @@
+package fake
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+var (
+	proxyConfigPath  = regexp.MustCompile(`^/admin/api/services/([^/]+)/proxy/configs/([^/]+)/latest\.json$`)
+	mappingRulesPath = regexp.MustCompile(`^/admin/api/services/([^/]+)/proxy/mapping_rules\.json$`)
+)
+
+// System is a fake of the 3scale system (porta) admin API
+// It serves the latest proxy config and the mapping rules of each configured service and environment
+// Requests must provide the access token, as a basic auth password or as the access_token parameter
+type System struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	accessToken string
+	// configs are keyed by service id and environment
+	configs map[string]map[string]client.ProxyConfig
+	// rules are the mapping rules of each service in the admin portal, keyed by service id
+	rules  map[string][]client.ProxyRule
+	faults *faults
+	rec    recorder
+}
+
+// NewSystem starts a fake of 3scale system which accepts the provided access token
+// The caller should call Close when finished, to shut it down
+func NewSystem(accessToken string) *System {
+	s := &System{
+		accessToken: accessToken,
+		configs:     make(map[string]map[string]client.ProxyConfig),
+		rules:       make(map[string][]client.ProxyRule),
+		faults:      newFaults(),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// SetConfig sets the latest proxy config of the service in the environment, replacing any existing config
+func (s *System) SetConfig(serviceID, environment string, config client.ProxyConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.configs[serviceID] == nil {
+		s.configs[serviceID] = make(map[string]client.ProxyConfig)
+	}
+	s.configs[serviceID][environment] = config
+}
+
+// SetMappingRules sets the mapping rules of the service in the admin portal, such as to imitate rules which
+// have not been promoted to any environment. By default the rules of the production config are served
+func (s *System) SetMappingRules(serviceID string, rules []client.ProxyRule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules[serviceID] = rules
+}
+
+// SetAccessToken replaces the access token accepted by the fake, such as to imitate the rotation of a token
+func (s *System) SetAccessToken(accessToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accessToken = accessToken
+}
+
+// RemoveConfig removes the proxy config of the service in the environment, which is then served as a 404
+func (s *System) RemoveConfig(serviceID, environment string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.configs[serviceID], environment)
+}
+
+// Fail responds to requests for the service with the provided status. An empty service id fails every request
+// A zero status removes the failure
+func (s *System) Fail(serviceID string, status int) {
+	s.faults.set(serviceID, status)
+}
+
+// SetLatency delays every response by the provided duration
+func (s *System) SetLatency(latency time.Duration) {
+	s.faults.setLatency(latency)
+}
+
+// Requests returns the requests received, in the order they were received
+func (s *System) Requests() []Request {
+	return s.rec.matching("")
+}
+
+func (s *System) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.rec.record(r)
+
+	configMatch := proxyConfigPath.FindStringSubmatch(r.URL.Path)
+	rulesMatch := mappingRulesPath.FindStringSubmatch(r.URL.Path)
+	var serviceID string
+	switch {
+	case configMatch != nil:
+		serviceID = configMatch[1]
+	case rulesMatch != nil:
+		serviceID = rulesMatch[1]
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"status": "Not found"})
+		return
+	}
+
+	if status := s.faults.apply(serviceID, ""); status != 0 {
+		writeJSON(w, status, map[string]string{"error": http.StatusText(status)})
+		return
+	}
+	if !s.authorized(r) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "Access denied"})
+		return
+	}
+
+	if configMatch != nil {
+		s.serveConfig(w, serviceID, configMatch[2])
+		return
+	}
+	s.serveMappingRules(w, serviceID)
+}
+
+func (s *System) authorized(r *http.Request) bool {
+	s.mu.Lock()
+	accessToken := s.accessToken
+	s.mu.Unlock()
+
+	if _, password, ok := r.BasicAuth(); ok && password == accessToken {
+		return true
+	}
+	return r.Form.Get("access_token") == accessToken
+}
+
+func (s *System) serveConfig(w http.ResponseWriter, serviceID, environment string) {
+	s.mu.Lock()
+	config, ok := s.configs[serviceID][environment]
+	s.mu.Unlock()
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"status": "Not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, client.ProxyConfigElement{ProxyConfig: config})
+}
+
+// serveMappingRules serves the mapping rules of the service set by SetMappingRules, otherwise those of its
+// production config if it has one
+func (s *System) serveMappingRules(w http.ResponseWriter, serviceID string) {
+	s.mu.Lock()
+	rules, ok := s.rules[serviceID]
+	if !ok {
+		for environment, c := range s.configs[serviceID] {
+			if !ok || environment == "production" {
+				rules, ok = c.Content.Proxy.ProxyRules, true
+			}
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"status": "Not found"})
+		return
+	}
+
+	list := client.MappingRuleJSONList{MappingRules: []client.MappingRuleJSON{}}
+	for _, rule := range rules {
+		list.MappingRules = append(list.MappingRules, client.MappingRuleJSON{Element: client.MappingRuleItem{
+			ID:         rule.ID,
+			MetricID:   rule.MetricID,
+			Pattern:    rule.Pattern,
+			HTTPMethod: rule.HTTPMethod,
+			Delta:      int(rule.Delta),
+			Position:   rule.Position,
+			Last:       rule.Last,
+		}})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
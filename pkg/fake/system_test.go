@@ -0,0 +1,62 @@
+package fake
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+func newSystemClient(t *testing.T, s *System, accessToken string) *client.ThreeScaleClient {
+	t.Helper()
+	u, _ := url.Parse(s.URL)
+	port, _ := strconv.Atoi(u.Port())
+	ap, err := client.NewAdminPortal(u.Scheme, u.Hostname(), port)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return client.NewThreeScale(ap, accessToken, http.DefaultClient)
+}
+
+func TestSystem(t *testing.T) {
+	s := NewSystem("token")
+	defer s.Close()
+
+	config := client.ProxyConfig{ID: 1, Version: 2, Environment: "production"}
+	config.Content.Proxy.ProxyRules = []client.ProxyRule{{ID: 3, Pattern: "/", MetricID: 4, Delta: 1}}
+	s.SetConfig("1", "production", config)
+
+	c := newSystemClient(t, s, "token")
+	element, err := c.GetLatestProxyConfig("1", "production")
+	if err != nil || element.ProxyConfig.Version != 2 {
+		t.Fatalf("expected the config to be served, got %v - %v", element, err)
+	}
+	rules, err := c.ListProductMappingRules(1)
+	if err != nil || len(rules.MappingRules) != 1 || rules.MappingRules[0].Element.Pattern != "/" {
+		t.Errorf("expected the mapping rules to be served, got %v - %v", rules, err)
+	}
+
+	if _, err := c.GetLatestProxyConfig("1", "staging"); err == nil {
+		t.Error("expected an error for an unknown environment")
+	}
+	if _, err := newSystemClient(t, s, "invalid").GetLatestProxyConfig("1", "production"); err == nil {
+		t.Error("expected an error for an invalid access token")
+	}
+
+	s.Fail("1", http.StatusInternalServerError)
+	if _, err := c.GetLatestProxyConfig("1", "production"); err == nil {
+		t.Error("expected the injected failure to be returned")
+	}
+	s.Fail("1", 0)
+
+	s.RemoveConfig("1", "production")
+	if _, err := c.GetLatestProxyConfig("1", "production"); err == nil {
+		t.Error("expected an error once the config was removed")
+	}
+
+	if requests := s.Requests(); len(requests) != 6 || requests[0].Path != "/admin/api/services/1/proxy/configs/production/latest.json" {
+		t.Errorf("expected each request to be recorded, got %v", requests)
+	}
+}
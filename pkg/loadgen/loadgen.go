@@ -0,0 +1,259 @@
+// Package loadgen drives synthetic load through an in-process authorizer backed by the fakes of 3scale system and
+// 3scale backend, to compare the capacity of a replica across configurations and releases
+package loadgen
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/3scale/3scale-authorizer/pkg/authorizer"
+	"github.com/3scale/3scale-authorizer/pkg/fake"
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+const (
+	// DefaultConcurrency is the number of workers used when none is configured
+	DefaultConcurrency = 8
+	// DefaultDuration is how long load is driven for when no duration is configured
+	DefaultDuration = time.Second * 10
+	// DefaultCacheFlushInterval is used when backend caching is enabled without a flush interval
+	DefaultCacheFlushInterval = time.Second
+
+	accessToken  = "loadgen"
+	serviceToken = "loadgen"
+	environment  = "production"
+	validKey     = "valid"
+	invalidKey   = "invalid"
+)
+
+// Config configures a run. See Run
+type Config struct {
+	// Concurrency is the number of workers each making one request at a time
+	Concurrency int
+	Duration    time.Duration
+	// Services is the number of distinct services requests are spread across. Defaults to one
+	Services int
+	// InvalidRatio is the fraction, between 0 and 1, of requests made with invalid credentials
+	InvalidRatio float64
+	// Backend configures the Manager, including the backend cache
+	Backend authorizer.BackendConfig
+	// SystemCache, if set, caches the configs of the services
+	SystemCache *authorizer.SystemCacheConfig
+	// Seed for the request mix, making the sequence of requests of a worker repeatable
+	Seed int64
+}
+
+func (c Config) withDefaults() Config {
+	if c.Concurrency <= 0 {
+		c.Concurrency = DefaultConcurrency
+	}
+	if c.Duration <= 0 {
+		c.Duration = DefaultDuration
+	}
+	if c.Services <= 0 {
+		c.Services = 1
+	}
+	if c.Backend.EnableCaching && c.Backend.CacheFlushInterval <= 0 {
+		c.Backend.CacheFlushInterval = DefaultCacheFlushInterval
+	}
+	return c
+}
+
+// Result summarises a run
+type Result struct {
+	Requests   int64         `json:"requests"`
+	Authorized int64         `json:"authorized"`
+	Denied     int64         `json:"denied"`
+	Errors     int64         `json:"errors"`
+	Elapsed    time.Duration `json:"elapsed_ns"`
+	// Throughput is the number of requests completed per second
+	Throughput float64 `json:"throughput"`
+	// Latencies of a request, including fetching the config of its service, keyed by percentile
+	Latencies map[string]time.Duration `json:"latencies_ns"`
+	// SystemCalls and BackendCalls are the number of calls made to each of the fakes during the run, excluding
+	// the flush of cached usage once the run is complete
+	SystemCalls  int64 `json:"system_calls"`
+	BackendCalls int64 `json:"backend_calls"`
+}
+
+// String returns a human readable summary of the result
+func (r Result) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "requests:      %d (%d authorized, %d denied, %d errors) in %s\n",
+		r.Requests, r.Authorized, r.Denied, r.Errors, r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(&b, "throughput:    %.1f/s\n", r.Throughput)
+	for _, p := range percentiles {
+		fmt.Fprintf(&b, "latency %-5s  %s\n", p.name, r.Latencies[p.name])
+	}
+	fmt.Fprintf(&b, "system calls:  %d\n", r.SystemCalls)
+	fmt.Fprintf(&b, "backend calls: %d\n", r.BackendCalls)
+	return b.String()
+}
+
+var percentiles = []struct {
+	name     string
+	quantile float64
+}{
+	{name: "p50", quantile: 0.5},
+	{name: "p90", quantile: 0.9},
+	{name: "p99", quantile: 0.99},
+	{name: "max", quantile: 1},
+}
+
+// Run starts the fakes, builds a Manager from the config and drives requests through it from each worker for the
+// configured duration. Each request fetches the config of its service and is authorized and reported with AuthRep
+func Run(config Config) (Result, error) {
+	config = config.withDefaults()
+	if config.InvalidRatio < 0 || config.InvalidRatio > 1 {
+		return Result{}, errors.New("invalid ratio must be between 0 and 1")
+	}
+
+	system := fake.NewSystem(accessToken)
+	defer system.Close()
+	backend := fake.NewBackend()
+	defer backend.Close()
+
+	for i := 0; i < config.Services; i++ {
+		serviceID := strconv.Itoa(i + 1)
+		proxyConfig := client.ProxyConfig{ID: i + 1, Version: 1, Environment: environment}
+		proxyConfig.Content.ID = int64(i + 1)
+		proxyConfig.Content.BackendAuthenticationType = "service_token"
+		proxyConfig.Content.BackendAuthenticationValue = serviceToken
+		proxyConfig.Content.Proxy.Backend.Endpoint = backend.URL
+		proxyConfig.Content.Proxy.ProxyRules = []client.ProxyRule{
+			{ID: 1, HTTPMethod: "GET", Pattern: "/", MetricSystemName: "hits", Delta: 1},
+		}
+		system.SetConfig(serviceID, environment, proxyConfig)
+		backend.AddService(serviceID, serviceToken, nil)
+		backend.AddApplication(serviceID, fake.Application{UserKey: validKey})
+	}
+
+	counter := &countingTransport{proxied: http.DefaultTransport, system: system.URL, backend: backend.URL}
+	managerConfig := authorizer.ManagerConfig{Client: &http.Client{Transport: counter}, Backend: config.Backend}
+	if config.SystemCache != nil {
+		managerConfig.SystemCache = authorizer.NewSystemCache(*config.SystemCache, make(chan struct{}))
+	}
+	manager, err := authorizer.NewReloadableManager(managerConfig)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var result Result
+	latencies := make([][]time.Duration, config.Concurrency)
+	deadline := time.Now().Add(config.Duration)
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < config.Concurrency; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(config.Seed + int64(worker)))
+			for time.Now().Before(deadline) {
+				serviceID := strconv.Itoa(random.Intn(config.Services) + 1)
+				key := validKey
+				if random.Float64() < config.InvalidRatio {
+					key = invalidKey
+				}
+
+				began := time.Now()
+				res, err := check(manager, system.URL, serviceID, key)
+				latencies[worker] = append(latencies[worker], time.Since(began))
+
+				atomic.AddInt64(&result.Requests, 1)
+				switch {
+				case err != nil:
+					atomic.AddInt64(&result.Errors, 1)
+				case res.Authorized:
+					atomic.AddInt64(&result.Authorized, 1)
+				default:
+					atomic.AddInt64(&result.Denied, 1)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	result.Elapsed = time.Since(start)
+
+	manager.Shutdown()
+
+	result.Throughput = float64(result.Requests) / result.Elapsed.Seconds()
+	result.Latencies = quantiles(latencies)
+	result.SystemCalls = atomic.LoadInt64(&counter.systemCalls)
+	result.BackendCalls = atomic.LoadInt64(&counter.backendCalls)
+	return result, nil
+}
+
+// check fetches the config of the service and authorizes a request made with the user key against it
+func check(manager authorizer.Authorizer, portalURL, serviceID, userKey string) (*authorizer.BackendResponse, error) {
+	proxyConfig, err := manager.GetSystemConfiguration(portalURL, authorizer.SystemRequest{
+		AccessToken: accessToken,
+		ServiceID:   serviceID,
+		Environment: environment,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := authorizer.NewBackendRequest(proxyConfig, authorizer.CheckRequest{
+		Method: http.MethodGet,
+		Path:   "/?user_key=" + userKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return manager.AuthRep(proxyConfig.Content.Proxy.Backend.Endpoint, request)
+}
+
+// quantiles merges the latencies recorded by each worker and returns each of the percentiles
+func quantiles(perWorker [][]time.Duration) map[string]time.Duration {
+	var all []time.Duration
+	for _, latencies := range perWorker {
+		all = append(all, latencies...)
+	}
+	result := make(map[string]time.Duration, len(percentiles))
+	if len(all) == 0 {
+		return result
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	for _, p := range percentiles {
+		i := int(p.quantile*float64(len(all))+0.5) - 1
+		if i < 0 {
+			i = 0
+		}
+		if i >= len(all) {
+			i = len(all) - 1
+		}
+		result[p.name] = all[i]
+	}
+	return result
+}
+
+// countingTransport counts the calls made to each of the fakes
+type countingTransport struct {
+	proxied      http.RoundTripper
+	system       string
+	backend      string
+	systemCalls  int64
+	backendCalls int64
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target := req.URL.Scheme + "://" + req.URL.Host
+	switch {
+	case target == t.system:
+		atomic.AddInt64(&t.systemCalls, 1)
+	case target == t.backend:
+		atomic.AddInt64(&t.backendCalls, 1)
+	}
+	return t.proxied.RoundTrip(req)
+}
@@ -0,0 +1,127 @@
+package loadgen
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/3scale/3scale-authorizer/pkg/authorizer"
+	"github.com/3scale/3scale-porta-go-client/client"
+)
+
+func TestRun(t *testing.T) {
+	inputs := []struct {
+		name   string
+		config Config
+		check  func(t *testing.T, result Result)
+	}{
+		{
+			name: "Test each request calls 3scale without caching",
+			config: Config{
+				Concurrency:  2,
+				Duration:     time.Millisecond * 200,
+				Services:     2,
+				InvalidRatio: 0.5,
+			},
+			check: func(t *testing.T, result Result) {
+				if result.SystemCalls != result.Requests || result.BackendCalls != result.Requests {
+					t.Errorf("expected a call to system and backend per request, got %+v", result)
+				}
+				if result.Authorized == 0 || result.Denied == 0 {
+					t.Errorf("expected a mix of authorized and denied requests, got %+v", result)
+				}
+			},
+		},
+		{
+			name: "Test caching avoids calls to 3scale",
+			config: Config{
+				Concurrency: 2,
+				Duration:    time.Millisecond * 200,
+				Backend:     authorizer.BackendConfig{EnableCaching: true, CacheFlushInterval: time.Hour},
+				SystemCache: &authorizer.SystemCacheConfig{MaxSize: -1, TTL: time.Hour, RefreshInterval: time.Hour},
+			},
+			check: func(t *testing.T, result Result) {
+				// each worker may miss the system cache before the config of the service is cached
+				if result.SystemCalls > 2 || result.BackendCalls >= result.Requests {
+					t.Errorf("expected requests to be served from the caches, got %+v", result)
+				}
+				if result.Denied != 0 {
+					t.Errorf("expected only valid credentials to be used, got %+v", result)
+				}
+			},
+		},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			result, err := Run(input.config)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if result.Requests == 0 || result.Errors != 0 || result.Authorized+result.Denied != result.Requests {
+				t.Fatalf("unexpected result %+v", result)
+			}
+			if result.Throughput <= 0 || result.Latencies["p50"] <= 0 || result.Latencies["p99"] > result.Latencies["max"] {
+				t.Errorf("unexpected throughput or latencies %+v", result)
+			}
+			if !strings.Contains(result.String(), "throughput:") {
+				t.Errorf("expected a readable summary, got %s", result)
+			}
+			input.check(t, result)
+		})
+	}
+
+	if _, err := Run(Config{InvalidRatio: 2}); err == nil {
+		t.Error("expected an error for an invalid ratio")
+	}
+}
+
+// stubAuthorizer serves a fixed config and records the requests it is asked to authorize
+type stubAuthorizer struct {
+	configErr  error
+	backendURL string
+	requests   []authorizer.BackendRequest
+}
+
+func (s *stubAuthorizer) GetSystemConfiguration(string, authorizer.SystemRequest) (client.ProxyConfig, error) {
+	config := client.ProxyConfig{ID: 1}
+	config.Content.ID = 1
+	config.Content.Proxy.Backend.Endpoint = "https://backend.example.com"
+	config.Content.Proxy.ProxyRules = []client.ProxyRule{{HTTPMethod: "GET", Pattern: "/", MetricSystemName: "hits", Delta: 1}}
+	return config, s.configErr
+}
+
+func (s *stubAuthorizer) AuthRep(backendURL string, request authorizer.BackendRequest) (*authorizer.BackendResponse, error) {
+	s.backendURL = backendURL
+	s.requests = append(s.requests, request)
+	return &authorizer.BackendResponse{Authorized: true}, nil
+}
+
+func (s *stubAuthorizer) Authorize(string, authorizer.BackendRequest) (*authorizer.BackendResponse, error) {
+	return nil, errors.New("unexpected call to Authorize")
+}
+
+func (s *stubAuthorizer) Report(string, authorizer.BackendRequest) error {
+	return errors.New("unexpected call to Report")
+}
+
+func TestCheck(t *testing.T) {
+	stub := &stubAuthorizer{}
+	res, err := check(stub, "https://portal.example.com", "1", validKey)
+	if err != nil || !res.Authorized {
+		t.Fatalf("expected the check to be authorized, got %v - %v", res, err)
+	}
+	if stub.backendURL != "https://backend.example.com" || len(stub.requests) != 1 {
+		t.Fatalf("expected a single request to the backend of the config, got %v to %s", stub.requests, stub.backendURL)
+	}
+	transaction := stub.requests[0].Transactions[0]
+	if transaction.Params.UserKey != validKey || transaction.Metrics["hits"] != 1 {
+		t.Errorf("unexpected transaction %+v", transaction)
+	}
+
+	stub = &stubAuthorizer{configErr: errors.New("unavailable")}
+	if _, err := check(stub, "https://portal.example.com", "1", validKey); err == nil || len(stub.requests) != 0 {
+		t.Error("expected the check to fail without authorizing when the config is unavailable")
+	}
+}
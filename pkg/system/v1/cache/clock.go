@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the current time and tickers to the cache, allowing the passing of time to be controlled in tests
+// See 'ConfigCache.SetClock()' and 'ManualClock'
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks on its channel at intervals until stopped. See time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// RealClock is the Clock backed by the time package, used by default
+type RealClock struct{}
+
+// Now returns the current local time
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTicker returns a time.Ticker
+func (RealClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// ManualClock is a Clock whose time only changes when advanced, for deterministic tests of expiry and refreshes
+// Tickers fire as time is advanced past each of their intervals, dropping ticks which are not received as
+// done by time.Ticker
+type ManualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*manualTicker
+}
+
+// NewManualClock returns a ManualClock set to the provided time
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+// Now returns the current time of the clock
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTicker returns a ticker which fires each time the clock is advanced past its next tick
+func (c *ManualClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &manualTicker{c: make(chan time.Time, 1), interval: d, next: c.now.Add(d), clock: c}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward, firing any tickers due in the meantime
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		if c.now.Before(t.next) {
+			continue
+		}
+		select {
+		case t.c <- c.now:
+		default:
+		}
+		for !c.now.Before(t.next) {
+			t.next = t.next.Add(t.interval)
+		}
+	}
+}
+
+type manualTicker struct {
+	c        chan time.Time
+	interval time.Duration
+	next     time.Time
+	clock    *ManualClock
+}
+
+func (t *manualTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *manualTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	for i, ticker := range t.clock.tickers {
+		if ticker == t {
+			t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket which can be used to limit the rate of calls to 3scale system
+// It measures and waits out real time regardless of the clock of the cache
+type rateLimiter struct {
+	mu sync.Mutex
+	// interval is the time taken for a single token to be added to the bucket
+	interval time.Duration
+	burst    float64
+	tokens   float64
+	last     time.Time
+}
+
+func newRateLimiter(perSecond float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		interval: time.Duration(float64(time.Second) / perSecond),
+		burst:    float64(burst),
+		tokens:   float64(burst),
+		last:     time.Now(),
+	}
+}
+
+// wait blocks until a token is available and takes it from the bucket
+// It is safe to call on a nil rateLimiter, in which case it returns immediately
+func (r *rateLimiter) wait() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	current := time.Now()
+	r.tokens += float64(current.Sub(r.last)) / float64(r.interval)
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = current
+
+	// take the token, allowing the bucket to go into debt which the caller then waits out
+	r.tokens--
+	var delay time.Duration
+	if r.tokens < 0 {
+		delay = time.Duration(-r.tokens * float64(r.interval))
+	}
+	r.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
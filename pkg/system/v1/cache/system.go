@@ -20,9 +20,14 @@ const (
 	// DefaultCacheLimit - Default max number of items that can be stored in the cache at any time
 	// A negative value implies that there is no limit on the number of cached items
 	DefaultCacheLimit = -1
+
+	// DefaultCapacityThreshold - Default fraction of the limit at which the capacity hook is called
+	DefaultCapacityThreshold = 0.9
 )
 
-var now = time.Now
+// ErrRemoveFromCache can be returned by a refresh callback to signal that the element should be removed from the cache
+// rather than being left to expire, for example when the resource no longer exists upstream
+var ErrRemoveFromCache = errors.New("element should be removed from the cache")
 
 // ConfigurationCache is the interface for managing a cache of `Proxy Config` resource(s)
 type ConfigurationCache interface {
@@ -37,9 +42,15 @@ type ConfigurationCache interface {
 
 // Value defines the value that must be stored in the cache
 type Value struct {
-	Item        client.ProxyConfig
-	expires     time.Time
-	refreshWith RefreshCb
+	Item             client.ProxyConfig
+	expires          time.Time
+	fetched          time.Time
+	refreshWith      RefreshCb
+	refreshRulesWith RefreshRulesCb
+	prepareWith      PrepareCb
+	prepared         interface{}
+	// clock is that of the cache the value was stored in
+	clock Clock
 }
 
 // ConfigCache provides an in-memory solution which implements 'ConfigurationCache'
@@ -49,11 +60,40 @@ type ConfigCache struct {
 	refreshWorkerRunning int32
 	stopRefreshWorker    chan struct{}
 	ttl                  time.Duration
+	capacity             capacityWatcher
+	refreshLimiter       *rateLimiter
+	// staleGrace is the period past expiry an element is still returned by Get when enforceExpiry is set
+	staleGrace    time.Duration
+	enforceExpiry bool
+	// refreshing counts the refreshes in progress
+	refreshing int32
+	clock      Clock
+}
+
+// CapacityHook is called when the number of elements in the cache crosses the configured capacity threshold
+// It is provided with the fraction of the capacity in use at the time of the crossing
+type CapacityHook func(fraction float64)
+
+// capacityWatcher tracks the crossing of a high-water mark for the cache
+type capacityWatcher struct {
+	threshold float64
+	// softLimit is used to compute the fraction in use when the cache has no limit
+	softLimit int
+	hook      CapacityHook
+	crossed   int32
 }
 
 // RefreshCb defines a callback which can be used to refresh elements in the cache as required
 type RefreshCb func() (client.ProxyConfig, error)
 
+// RefreshRulesCb defines a callback which can be used to refresh only the mapping rules of an element in the cache
+// It is provided with the currently cached config and returns the updated set of rules
+type RefreshRulesCb func(current client.ProxyConfig) ([]client.ProxyRule, error)
+
+// PrepareCb defines a callback which derives the state used to serve requests from a config, such as its compiled
+// mapping rules, so that the state is built once each time the element is stored rather than on each request
+type PrepareCb func(config client.ProxyConfig) (interface{}, error)
+
 // NewConfigCache returns a ConfigCache configured with the provided inputs
 // It accepts a 'time to live' which will be the default value used to mark cached items as expired
 // Max entries limits the number of objects that can exist in the cache at a given time
@@ -76,22 +116,55 @@ func NewDefaultConfigCache() *ConfigCache {
 
 // Get an element from the cache if it exists
 // The returned bool identifies if the element was present or not
+// If a stale grace period has been set, elements past their expiry plus the grace period are treated as missing
+// and elements within the grace period are returned flagged as stale. See 'SetStaleGracePeriod()'
 func (scp *ConfigCache) Get(key string) (Value, bool) {
 	value, ok := scp.cache.Get(key)
 	if !ok {
 		return Value{}, ok
 	}
-	return value.(Value), ok
+
+	v := value.(Value)
+	if scp.enforceExpiry && scp.now().After(v.expires.Add(scp.staleGrace)) {
+		return Value{}, false
+	}
+	return v, ok
+}
+
+// SetStaleGracePeriod enforces expiry of elements returned by 'Get()'
+// Elements which have expired, for example because they could not be refreshed, continue to be returned for
+// the provided grace period and are flagged as stale. See 'Value.IsStale()'
+// By default, expired elements are returned until they are flushed from the cache
+func (scp *ConfigCache) SetStaleGracePeriod(grace time.Duration) {
+	scp.staleGrace = grace
+	scp.enforceExpiry = true
+}
+
+// Snapshot returns a shallow copy of all elements in the cache keyed by their cache key
+// The snapshot is a best-effort, point-in-time view. Each shard of the underlying map is read consistently
+// but writes to other shards may occur while the snapshot is being taken
+func (scp *ConfigCache) Snapshot() map[string]Value {
+	items := scp.cache.Items()
+	snapshot := make(map[string]Value, len(items))
+	for key, v := range items {
+		snapshot[key] = v.(Value)
+	}
+	return snapshot
 }
 
 // Set an item in the cache under the provided key
 // Returns an error if the max number of entries in the cache has been reached
 func (scp *ConfigCache) Set(key string, v Value) error {
 	if scp.limit < 0 || scp.cache.Count() < scp.limit {
+		v.clock = scp.clock
 		if v.expires.IsZero() {
 			v.expires = scp.getExpiryTime()
 		}
+		if v.fetched.IsZero() {
+			v.fetched = scp.now()
+		}
 		scp.cache.Set(key, v)
+		scp.checkCapacity()
 		return nil
 	}
 
@@ -101,6 +174,26 @@ func (scp *ConfigCache) Set(key string, v Value) error {
 // Delete an element from the cache
 func (scp *ConfigCache) Delete(key string) {
 	scp.cache.Remove(key)
+	scp.checkCapacity()
+}
+
+// OnCapacityThreshold sets a hook which is called once each time the cache crosses the provided fraction of its limit
+// The hook will not be called again until the cache has dropped back below the threshold
+// For a cache with no limit, the hook is only called if a soft limit has been set. See 'SetSoftLimit()'
+// A threshold of zero or less defaults to DefaultCapacityThreshold
+func (scp *ConfigCache) OnCapacityThreshold(threshold float64, hook CapacityHook) {
+	if threshold <= 0 {
+		threshold = DefaultCapacityThreshold
+	}
+	scp.capacity.threshold = threshold
+	scp.capacity.hook = hook
+}
+
+// SetSoftLimit sets an estimate of the number of elements the cache is expected to hold
+// It is used in place of the limit to compute the capacity in use where the cache has no limit
+// It does not restrict the number of elements that can be stored in the cache
+func (scp *ConfigCache) SetSoftLimit(maxEntries int) {
+	scp.capacity.softLimit = maxEntries
 }
 
 // FlushExpired elements from the cache
@@ -120,29 +213,98 @@ func (scp *ConfigCache) FlushExpired() {
 }
 
 // Refresh elements in the cache using the provided callback
-// Elements whose callback returns an error will not be refreshed but wil be left in the cache to expire
+// Elements which have a rules callback set will have only their mapping rules refreshed, falling back to a full
+// refresh if the rules callback returns an error
+// Elements whose callback returns an error will not be refreshed but wil be left in the cache to expire, as are
+// elements whose refreshed config is rejected by the prepare callback. See 'Value.SetPrepareCallback()'
+// Elements whose callback returns 'ErrRemoveFromCache' will be removed from the cache immediately
 func (scp *ConfigCache) Refresh() {
+	atomic.AddInt32(&scp.refreshing, 1)
+	defer atomic.AddInt32(&scp.refreshing, -1)
+	scp.refresh()
+}
+
+// RefreshNow refreshes all elements in the cache immediately, as done by 'Refresh()', unless a refresh is already
+// in progress. Returns the number of elements refreshed and false if the refresh was skipped
+// It is safe to call concurrently with the refresh worker
+func (scp *ConfigCache) RefreshNow() (int, bool) {
+	if !atomic.CompareAndSwapInt32(&scp.refreshing, 0, 1) {
+		return 0, false
+	}
+	defer atomic.AddInt32(&scp.refreshing, -1)
+	return scp.refresh(), true
+}
+
+// refresh the elements of the cache, returning the number of elements refreshed
+func (scp *ConfigCache) refresh() int {
 	refreshItems := make(map[string]Value)
+	var forDeletion []string
+
+	// work from a snapshot so that writers are not blocked while the callbacks are running
+	for key, item := range scp.Snapshot() {
+		if item.refreshRulesWith != nil {
+			scp.refreshLimiter.wait()
+			rules, err := item.refreshRulesWith(item.Item)
+			if err == nil {
+				updated := item
+				updated.Item.Content.Proxy.ProxyRules = rules
+				err = updated.Prepare()
+				if err == nil {
+					updated.expires = scp.getExpiryTime()
+					updated.fetched = scp.now()
+					refreshItems[key] = updated
+					continue
+				}
+			}
+			if err == ErrRemoveFromCache {
+				forDeletion = append(forDeletion, key)
+				continue
+			}
+		}
 
-	scp.cache.IterCb(func(key string, v interface{}) {
-		item := v.(Value)
 		if item.refreshWith != nil {
+			scp.refreshLimiter.wait()
 			resp, err := item.refreshWith()
+			if err == ErrRemoveFromCache {
+				forDeletion = append(forDeletion, key)
+				continue
+			}
 			if err != nil {
-				return
+				continue
 			}
 
 			value := Value{
-				Item:        resp,
-				expires:     scp.getExpiryTime(),
-				refreshWith: item.refreshWith,
+				Item:             resp,
+				expires:          scp.getExpiryTime(),
+				fetched:          scp.now(),
+				refreshWith:      item.refreshWith,
+				refreshRulesWith: item.refreshRulesWith,
+				prepareWith:      item.prepareWith,
+			}
+			if err := value.Prepare(); err != nil {
+				continue
 			}
 			refreshItems[key] = value
 		}
-	})
+	}
 	for k, v := range refreshItems {
 		scp.Set(k, v)
 	}
+	for _, key := range forDeletion {
+		scp.Delete(key)
+	}
+	return len(refreshItems)
+}
+
+// SetRefreshRateLimit limits the rate at which refresh callbacks are called during 'Refresh()'
+// Callbacks are called at no more than 'perSecond' on average, allowing bursts of up to 'burst' callbacks
+// A non-positive rate removes any existing limit
+func (scp *ConfigCache) SetRefreshRateLimit(perSecond float64, burst int) {
+	if perSecond <= 0 {
+		scp.refreshLimiter = nil
+		return
+	}
+	scp.refreshLimiter = newRateLimiter(perSecond, burst)
 }
 
 // RunRefreshWorker at increments provided by the interval
@@ -153,11 +315,11 @@ func (scp *ConfigCache) RunRefreshWorker(interval time.Duration, stop chan struc
 	}
 
 	scp.stopRefreshWorker = stop
-	ticker := time.NewTicker(interval)
+	ticker := scp.getClock().NewTicker(interval)
 	go func() {
 		for {
 			select {
-			case <-ticker.C:
+			case <-ticker.C():
 				scp.Refresh()
 			case <-stop:
 				ticker.Stop()
@@ -168,8 +330,49 @@ func (scp *ConfigCache) RunRefreshWorker(interval time.Duration, stop chan struc
 	return nil
 }
 
+// checkCapacity calls the capacity hook if the cache has crossed the threshold since the last check
+func (scp *ConfigCache) checkCapacity() {
+	if scp.capacity.hook == nil {
+		return
+	}
+
+	limit := scp.limit
+	if limit < 0 {
+		limit = scp.capacity.softLimit
+	}
+	if limit <= 0 {
+		return
+	}
+
+	fraction := float64(scp.cache.Count()) / float64(limit)
+	if fraction >= scp.capacity.threshold {
+		if atomic.CompareAndSwapInt32(&scp.capacity.crossed, 0, 1) {
+			scp.capacity.hook(fraction)
+		}
+		return
+	}
+	atomic.StoreInt32(&scp.capacity.crossed, 0)
+}
+
 func (scp *ConfigCache) getExpiryTime() time.Time {
-	return now().Add(scp.ttl)
+	return scp.now().Add(scp.ttl)
+}
+
+// SetClock used by the cache to determine expiry, age and staleness, and to drive the refresh worker
+// Must be called before elements are stored or the worker is started. Defaults to 'RealClock'
+func (scp *ConfigCache) SetClock(clock Clock) {
+	scp.clock = clock
+}
+
+func (scp *ConfigCache) getClock() Clock {
+	if scp.clock == nil {
+		return RealClock{}
+	}
+	return scp.clock
+}
+
+func (scp *ConfigCache) now() time.Time {
+	return scp.getClock().Now()
 }
 
 // SetExpiry time on a value to override the default expiry time set by the caching implementation
@@ -185,6 +388,64 @@ func (v *Value) SetRefreshCallback(fn RefreshCb) *Value {
 	return v
 }
 
+// SetRefreshRulesCallback, the callback that will be used to attempt to refresh only the mapping rules of an element
+// If the callback returns an error, the callback set via 'SetRefreshCallback' is used to refresh the element in full
+func (v *Value) SetRefreshRulesCallback(fn RefreshRulesCb) *Value {
+	v.refreshRulesWith = fn
+	return v
+}
+
+// SetPrepareCallback, the callback that will be used to derive state from the config of the element each time it is
+// fetched or refreshed. If the callback returns an error when refreshing, the element is not refreshed
+// The state is returned by 'Prepared()' once 'Prepare()' has been called, which is done by 'Refresh()'
+func (v *Value) SetPrepareCallback(fn PrepareCb) *Value {
+	v.prepareWith = fn
+	return v
+}
+
+// Prepare derives the state of the value with the prepare callback, if any, returning the error of the callback
+func (v *Value) Prepare() error {
+	if v.prepareWith == nil {
+		return nil
+	}
+	prepared, err := v.prepareWith(v.Item)
+	if err != nil {
+		return err
+	}
+	v.prepared = prepared
+	return nil
+}
+
+// Prepared returns the state derived from the config by the prepare callback, nil if it has not been prepared
+func (v Value) Prepared() interface{} {
+	return v.prepared
+}
+
+// IsStale reports whether the value has expired
+func (v Value) IsStale() bool {
+	return v.isExpired()
+}
+
+// Staleness returns the time since the value expired and is zero if it has not expired
+func (v Value) Staleness() time.Duration {
+	if staleness := v.now().Sub(v.expires); staleness > 0 {
+		return staleness
+	}
+	return 0
+}
+
+// Age returns the time since the value was last fetched or refreshed successfully
+func (v Value) Age() time.Duration {
+	return v.now().Sub(v.fetched)
+}
+
 func (v Value) isExpired() bool {
-	return now().After(v.expires)
+	return v.now().After(v.expires)
+}
+
+func (v Value) now() time.Time {
+	if v.clock == nil {
+		return time.Now()
+	}
+	return v.clock.Now()
 }
@@ -1,7 +1,10 @@
 package cache
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"sync"
 	"testing"
 	"time"
 
@@ -25,6 +28,28 @@ func TestConfigCache_Get(t *testing.T) {
 	}
 }
 
+func TestConfigCache_Snapshot(t *testing.T) {
+	cc := NewDefaultConfigCache()
+	if len(cc.Snapshot()) != 0 {
+		t.Error("expected snapshot of empty cache to be empty")
+	}
+
+	cc.Set("a", Value{Item: client.ProxyConfig{ID: 1}})
+	cc.Set("b", Value{Item: client.ProxyConfig{ID: 2}})
+
+	snapshot := cc.Snapshot()
+	if len(snapshot) != 2 || snapshot["a"].Item.ID != 1 || snapshot["b"].Item.ID != 2 {
+		t.Errorf("expected snapshot to reflect cache contents, got %v", snapshot)
+	}
+
+	// modifications to the cache after the snapshot has been taken must not affect the snapshot
+	cc.Set("a", Value{Item: client.ProxyConfig{ID: 3}})
+	cc.Delete("b")
+	if snapshot["a"].Item.ID != 1 || len(snapshot) != 2 {
+		t.Error("expected snapshot to be unaffected by later writes")
+	}
+}
+
 func TestConfigCache_Set(t *testing.T) {
 	cc := NewDefaultConfigCache()
 	if cc.cache.Count() != 0 {
@@ -56,6 +81,76 @@ func TestConfigCache_Set(t *testing.T) {
 	}
 }
 
+func TestConfigCache_OnCapacityThreshold(t *testing.T) {
+	var calls []float64
+	hook := func(fraction float64) {
+		calls = append(calls, fraction)
+	}
+
+	cc := NewConfigCache(time.Hour, 10)
+	cc.OnCapacityThreshold(0.9, hook)
+	for i := 0; i < 8; i++ {
+		cc.Set(fmt.Sprintf("%d", i), Value{})
+	}
+	if len(calls) != 0 {
+		t.Error("expected hook not to be called below the threshold")
+	}
+
+	cc.Set("8", Value{})
+	cc.Set("9", Value{})
+	// overwriting an existing element should not result in another call
+	cc.Set("9", Value{})
+	if len(calls) != 1 || calls[0] != 0.9 {
+		t.Errorf("expected hook to be called exactly once on crossing, got %v", calls)
+	}
+
+	cc.Delete("9")
+	cc.Delete("8")
+	cc.Set("8", Value{})
+	if len(calls) != 2 {
+		t.Errorf("expected hook to be called again after dropping below and re-crossing, got %v", calls)
+	}
+
+	// test unlimited cache using a soft limit
+	calls = nil
+	cc = NewConfigCache(time.Hour, -1)
+	cc.OnCapacityThreshold(0.5, hook)
+	cc.Set("a", Value{})
+	cc.Set("b", Value{})
+	if len(calls) != 0 {
+		t.Error("expected hook not to be called for unlimited cache without a soft limit")
+	}
+
+	cc.SetSoftLimit(4)
+	cc.Set("c", Value{})
+	cc.Set("d", Value{})
+	if len(calls) != 1 {
+		t.Errorf("expected hook to be called exactly once on crossing the soft limit, got %v", calls)
+	}
+}
+
+func TestConfigCache_OnCapacityThresholdDefault(t *testing.T) {
+	for _, threshold := range []float64{0, -0.5} {
+		var calls []float64
+		cc := NewConfigCache(time.Hour, 10)
+		cc.OnCapacityThreshold(threshold, func(fraction float64) {
+			calls = append(calls, fraction)
+		})
+
+		cc.Set("0", Value{})
+		if len(calls) != 0 {
+			t.Errorf("expected hook not to be called on first set for threshold %v, got %v", threshold, calls)
+		}
+
+		for i := 1; i < 9; i++ {
+			cc.Set(fmt.Sprintf("%d", i), Value{})
+		}
+		if len(calls) != 1 || calls[0] != DefaultCapacityThreshold {
+			t.Errorf("expected hook to be called once at the default threshold for threshold %v, got %v", threshold, calls)
+		}
+	}
+}
+
 func TestConfigCache_Delete(t *testing.T) {
 	cc := NewDefaultConfigCache()
 	cc.Set("test", Value{Item: client.ProxyConfig{ID: 5}})
@@ -71,16 +166,20 @@ func TestConfigCache_Delete(t *testing.T) {
 
 func TestConfigCache_FlushExpired(t *testing.T) {
 	cc := NewDefaultConfigCache()
+	clock := NewManualClock(time.Now())
+	cc.SetClock(clock)
 
-	yesterday := time.Hour * -24
-	v := Value{Item: client.ProxyConfig{ID: 5}}
-	v.SetExpiry(time.Now().Add(yesterday))
-
-	cc.Set("test", v)
+	cc.Set("test", Value{Item: client.ProxyConfig{ID: 5}})
 	if cc.cache.Count() != 1 {
 		t.Error("expected cache to have only one element")
 	}
 
+	cc.FlushExpired()
+	if cc.cache.Count() != 1 {
+		t.Error("expected element within its ttl not to be flushed")
+	}
+
+	clock.Advance(DefaultCacheTTL + time.Second)
 	cc.FlushExpired()
 	if cc.cache.Count() != 0 {
 		t.Error("expected cache to be empty after flushing expired items")
@@ -125,6 +224,141 @@ func TestConfigCache_Refresh(t *testing.T) {
 	}
 }
 
+func TestConfigCache_RefreshRemovesElement(t *testing.T) {
+	cc := NewDefaultConfigCache()
+
+	refreshCb := func() (client.ProxyConfig, error) {
+		return client.ProxyConfig{}, ErrRemoveFromCache
+	}
+	v := Value{Item: client.ProxyConfig{ID: 5}}
+	v.SetRefreshCallback(refreshCb)
+
+	cc.Set("test", v)
+	cc.Set("untouched", Value{Item: client.ProxyConfig{ID: 6}})
+	cc.Refresh()
+	if _, ok := cc.Get("test"); ok {
+		t.Error("expected element to have been removed from the cache")
+	}
+	if _, ok := cc.Get("untouched"); !ok {
+		t.Error("expected element without callback to remain in the cache")
+	}
+}
+
+func TestConfigCache_RefreshRulesOnly(t *testing.T) {
+	cc := NewDefaultConfigCache()
+
+	fullRefreshCalled := false
+	refreshCb := func() (client.ProxyConfig, error) {
+		fullRefreshCalled = true
+		return client.ProxyConfig{ID: 6}, nil
+	}
+	refreshRulesCb := func(current client.ProxyConfig) ([]client.ProxyRule, error) {
+		return []client.ProxyRule{{Pattern: "/new", MetricSystemName: "hits", Delta: 1}}, nil
+	}
+
+	item := client.ProxyConfig{ID: 5}
+	item.Content.BackendAuthenticationType = "service_token"
+	item.Content.BackendAuthenticationValue = "token"
+	item.Content.Proxy.AuthUserKey = "user_key"
+	item.Content.Proxy.ProxyRules = []client.ProxyRule{{Pattern: "/old", MetricSystemName: "hits", Delta: 1}}
+
+	v := Value{Item: item}
+	v.SetRefreshCallback(refreshCb)
+	v.SetRefreshRulesCallback(refreshRulesCb)
+
+	cc.Set("test", v)
+	cc.Refresh()
+	updatedV, ok := cc.Get("test")
+	if !ok {
+		t.Error("expected element to be present")
+	}
+	if fullRefreshCalled {
+		t.Error("expected full refresh to be skipped when rules were refreshed")
+	}
+	if len(updatedV.Item.Content.Proxy.ProxyRules) != 1 || updatedV.Item.Content.Proxy.ProxyRules[0].Pattern != "/new" {
+		t.Error("expected rules to have been refreshed")
+	}
+	if updatedV.Item.ID != 5 ||
+		updatedV.Item.Content.BackendAuthenticationType != "service_token" ||
+		updatedV.Item.Content.BackendAuthenticationValue != "token" ||
+		updatedV.Item.Content.Proxy.AuthUserKey != "user_key" {
+		t.Error("expected auth settings to be untouched when refreshing rules")
+	}
+
+	// test fallback to full refresh
+	refreshRulesCb = func(current client.ProxyConfig) ([]client.ProxyRule, error) {
+		return nil, http.ErrNotSupported
+	}
+	v.SetRefreshRulesCallback(refreshRulesCb)
+	cc.Set("test", v)
+	cc.Refresh()
+	updatedV, _ = cc.Get("test")
+	if !fullRefreshCalled || updatedV.Item.ID != 6 {
+		t.Error("expected full refresh when rules could not be refreshed")
+	}
+}
+
+func TestConfigCache_SetRefreshRateLimit(t *testing.T) {
+	const items = 10
+	const perSecond = 50
+	const burst = 2
+
+	cc := NewDefaultConfigCache()
+	cc.SetRefreshRateLimit(perSecond, burst)
+
+	var mu sync.Mutex
+	var calls []time.Time
+	refreshCb := func() (client.ProxyConfig, error) {
+		mu.Lock()
+		calls = append(calls, time.Now())
+		mu.Unlock()
+		return client.ProxyConfig{}, nil
+	}
+
+	for i := 0; i < items; i++ {
+		v := Value{}
+		v.SetRefreshCallback(refreshCb)
+		cc.Set(fmt.Sprintf("%d", i), v)
+	}
+
+	start := time.Now()
+	cc.Refresh()
+	elapsed := time.Since(start)
+
+	if len(calls) != items {
+		t.Fatalf("expected all items to be refreshed, got %d", len(calls))
+	}
+
+	// the burst is available immediately, the remainder must be spread out at the configured rate
+	minimum := time.Duration(float64(items-burst) / perSecond * float64(time.Second))
+	if elapsed < minimum {
+		t.Errorf("expected refresh to take at least %s when rate limited, took %s", minimum, elapsed)
+	}
+
+	// no window of a second (scaled down to 100ms) should see more than the rate allows plus the burst
+	window := time.Millisecond * 100
+	allowed := int(perSecond*window.Seconds()) + burst
+	for i := range calls {
+		inWindow := 0
+		for _, call := range calls[i:] {
+			if call.Sub(calls[i]) < window {
+				inWindow++
+			}
+		}
+		if inWindow > allowed {
+			t.Errorf("expected at most %d calls within %s, got %d", allowed, window, inWindow)
+		}
+	}
+
+	// removing the limit
+	cc.SetRefreshRateLimit(0, 0)
+	start = time.Now()
+	cc.Refresh()
+	if time.Since(start) >= minimum {
+		t.Error("expected refresh not to be rate limited once the limit is removed")
+	}
+}
+
 func TestConfigCache_RunRefreshWorker(t *testing.T) {
 	// test error on startup
 	cc := NewDefaultConfigCache()
@@ -134,6 +368,8 @@ func TestConfigCache_RunRefreshWorker(t *testing.T) {
 	}
 
 	cc = NewDefaultConfigCache()
+	clock := NewManualClock(time.Now())
+	cc.SetClock(clock)
 	done := make(chan bool)
 	refreshCb := func() (client.ProxyConfig, error) {
 		done <- true
@@ -144,16 +380,222 @@ func TestConfigCache_RunRefreshWorker(t *testing.T) {
 	v.SetRefreshCallback(refreshCb)
 	cc.Set("test", v)
 	stop := make(chan struct{})
-	if err := cc.RunRefreshWorker(time.Millisecond, stop); err != nil {
+	if err := cc.RunRefreshWorker(time.Minute, stop); err != nil {
 		t.Errorf("unexpected error when running refresh worker")
 	}
+	defer close(stop)
 
-	<-time.After(time.Second)
-	success := <-done
-	if !success {
+	clock.Advance(time.Minute)
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
 		t.Error("expected refresh worker to have been called an callback to be executed")
 	}
+}
 
-	close(stop)
+func TestConfigCache_SetStaleGracePeriod(t *testing.T) {
+	cc := NewConfigCache(time.Minute, DefaultCacheLimit)
+	clock := NewManualClock(time.Now())
+	cc.SetClock(clock)
+
+	expired := Value{Item: client.ProxyConfig{ID: 1}}
+	expired.SetExpiry(clock.Now().Add(-time.Second))
+	cc.Set("test", expired)
+
+	// expired elements are returned until flushed if no grace period has been set
+	v, ok := cc.Get("test")
+	if !ok {
+		t.Fatal("expected expired element to be returned when expiry is not enforced")
+	}
+	if !v.IsStale() || v.Staleness() != time.Second {
+		t.Errorf("expected expired element to be flagged as stale, got staleness %s", v.Staleness())
+	}
+
+	cc.SetStaleGracePeriod(time.Minute)
+	v, ok = cc.Get("test")
+	if !ok {
+		t.Fatal("expected element within the grace period to be returned")
+	}
+	if !v.IsStale() || v.Item.ID != 1 {
+		t.Errorf("expected stale element to be returned, got %v", v)
+	}
+
+	fresh := Value{Item: client.ProxyConfig{ID: 2}}
+	cc.Set("fresh", fresh)
+	v, ok = cc.Get("fresh")
+	if !ok || v.IsStale() || v.Staleness() != 0 {
+		t.Error("expected element within its ttl to be returned and not flagged as stale")
+	}
+
+	pastGrace := Value{Item: client.ProxyConfig{ID: 3}}
+	pastGrace.SetExpiry(clock.Now().Add(-time.Minute * 2))
+	cc.Set("past-grace", pastGrace)
+	if _, ok := cc.Get("past-grace"); ok {
+		t.Error("expected element past the grace period to be treated as missing")
+	}
+
+	cc.SetStaleGracePeriod(0)
+	if _, ok := cc.Get("test"); ok {
+		t.Error("expected expired element to be treated as missing with no grace period")
+	}
+}
+
+func TestValue_Age(t *testing.T) {
+	cc := NewConfigCache(time.Minute, DefaultCacheLimit)
+	clock := NewManualClock(time.Now())
+	cc.SetClock(clock)
+
+	fail := false
+	v := Value{Item: client.ProxyConfig{ID: 1}}
+	v.SetRefreshCallback(func() (client.ProxyConfig, error) {
+		if fail {
+			return client.ProxyConfig{}, fmt.Errorf("refresh failed")
+		}
+		return client.ProxyConfig{ID: 1}, nil
+	})
+	cc.Set("test", v)
+
+	clock.Advance(time.Second * 20)
+	cached, _ := cc.Get("test")
+	if age := cached.Age(); age != time.Second*20 {
+		t.Errorf("expected the age to increase over time, got %s", age)
+	}
+
+	cc.Refresh()
+	cached, _ = cc.Get("test")
+	if age := cached.Age(); age != 0 {
+		t.Errorf("expected the age to reset on refresh, got %s", age)
+	}
 
+	fail = true
+	clock.Advance(time.Second * 20)
+	cc.Refresh()
+	cached, _ = cc.Get("test")
+	if age := cached.Age(); age != time.Second*20 {
+		t.Errorf("expected the age to be retained when the refresh fails, got %s", age)
+	}
+}
+
+func TestConfigCache_RefreshNow(t *testing.T) {
+	cc := NewConfigCache(time.Minute, DefaultCacheLimit)
+
+	var mu sync.Mutex
+	var refreshed int
+	started, release := make(chan struct{}), make(chan struct{})
+	blocking := false
+	for i := 0; i < 2; i++ {
+		v := Value{Item: client.ProxyConfig{ID: i}}
+		v.SetRefreshCallback(func() (client.ProxyConfig, error) {
+			mu.Lock()
+			refreshed++
+			block := blocking
+			blocking = false
+			mu.Unlock()
+			if block {
+				close(started)
+				<-release
+			}
+			return client.ProxyConfig{}, nil
+		})
+		cc.Set(fmt.Sprintf("test-%d", i), v)
+	}
+	cc.Set("no-callback", Value{})
+
+	if n, ran := cc.RefreshNow(); !ran || n != 2 {
+		t.Errorf("expected both elements with a callback to be refreshed, got %d - %t", n, ran)
+	}
+	if refreshed != 2 {
+		t.Errorf("expected each refresh callback to be called, got %d", refreshed)
+	}
+
+	// a refresh already in progress, such as one started by the refresh worker, is not duplicated
+	blocking = true
+	done := make(chan struct{})
+	go func() {
+		cc.Refresh()
+		close(done)
+	}()
+	<-started
+	if _, ran := cc.RefreshNow(); ran {
+		t.Error("expected the refresh to be skipped while another is in progress")
+	}
+	close(release)
+	<-done
+
+	if _, ran := cc.RefreshNow(); !ran {
+		t.Error("expected the refresh to run once the other has completed")
+	}
+}
+
+func TestManualClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	ticker := clock.NewTicker(time.Minute)
+
+	clock.Advance(time.Second * 30)
+	select {
+	case <-ticker.C():
+		t.Error("expected the ticker not to fire before its interval")
+	default:
+	}
+
+	// ticks which are not received are dropped
+	clock.Advance(time.Minute * 3)
+	if tick := <-ticker.C(); !tick.Equal(start.Add(time.Second * 210)) {
+		t.Errorf("expected a tick at the current time, got %s", tick)
+	}
+	select {
+	case <-ticker.C():
+		t.Error("expected missed ticks to be dropped")
+	default:
+	}
+
+	ticker.Stop()
+	clock.Advance(time.Hour)
+	select {
+	case <-ticker.C():
+		t.Error("expected a stopped ticker not to fire")
+	default:
+	}
+	if !clock.Now().Equal(start.Add(time.Second*210 + time.Hour)) {
+		t.Errorf("unexpected time %s", clock.Now())
+	}
+}
+
+func TestConfigCache_RefreshPrepares(t *testing.T) {
+	cc := NewDefaultConfigCache()
+
+	var reject bool
+	prepareCb := func(config client.ProxyConfig) (interface{}, error) {
+		if reject {
+			return nil, errors.New("rejected")
+		}
+		return config.Version, nil
+	}
+	version := 1
+	refreshCb := func() (client.ProxyConfig, error) {
+		version++
+		return client.ProxyConfig{Version: version}, nil
+	}
+
+	v := Value{Item: client.ProxyConfig{Version: version}}
+	v.SetRefreshCallback(refreshCb)
+	v.SetPrepareCallback(prepareCb)
+	if err := v.Prepare(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	cc.Set("test", v)
+
+	cc.Refresh()
+	updated, _ := cc.Get("test")
+	if updated.Item.Version != 2 || updated.Prepared() != 2 {
+		t.Errorf("expected the refreshed config to have been prepared, got %v", updated.Prepared())
+	}
+
+	reject = true
+	cc.Refresh()
+	updated, _ = cc.Get("test")
+	if updated.Item.Version != 2 || updated.Prepared() != 2 {
+		t.Errorf("expected a config rejected by the prepare callback not to be refreshed, got version %d", updated.Item.Version)
+	}
 }